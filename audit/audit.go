@@ -0,0 +1,234 @@
+package audit
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/imiller31/k8s-auth-webhook/config"
+	"github.com/imiller31/k8s-auth-webhook/metrics"
+	authorizationv1 "k8s.io/api/authorization/v1"
+)
+
+// Defaults applied when the corresponding AuditConfig field is unset
+const (
+	defaultBufferSize    = 1000
+	defaultBatchSize     = 100
+	defaultFlushInterval = time.Second
+)
+
+// Record is the audit entry emitted for a single SubjectAccessReview
+type Record struct {
+	Timestamp             time.Time                              `json:"timestamp"`
+	User                  string                                 `json:"user"`
+	UID                   string                                 `json:"uid,omitempty"`
+	Groups                []string                               `json:"groups,omitempty"`
+	ResourceAttributes    *authorizationv1.ResourceAttributes    `json:"resourceAttributes,omitempty"`
+	NonResourceAttributes *authorizationv1.NonResourceAttributes `json:"nonResourceAttributes,omitempty"`
+	Decision              string                                 `json:"decision"`
+	Reason                string                                 `json:"reason"`
+	// Rule is the CEL rule or built-in check that produced the decision
+	Rule string `json:"rule,omitempty"`
+	// WouldHaveDenied lists the denials that were recorded but not enforced
+	// because their rule or the webhook is in audit mode
+	WouldHaveDenied []AuditedDenial `json:"wouldHaveDenied,omitempty"`
+	// BreakGlass is set when a break-glass grant allowed a request a
+	// protection policy would have denied
+	BreakGlass *BreakGlassUse `json:"breakGlass,omitempty"`
+	// Cached is set when the decision was served from the decision cache
+	Cached bool `json:"cached,omitempty"`
+	// EvaluationMicros is the time spent evaluating the policy in microseconds
+	EvaluationMicros int64  `json:"evaluationMicros"`
+	ConfigGeneration uint64 `json:"configGeneration"`
+}
+
+// AuditedDenial is a denial by a rule in audit mode
+type AuditedDenial struct {
+	// Rule is the CEL rule or built-in check that would have denied the request
+	Rule   string `json:"rule"`
+	Reason string `json:"reason"`
+}
+
+// BreakGlassUse identifies the break-glass grant that allowed a request
+type BreakGlassUse struct {
+	GrantID     string    `json:"grantID"`
+	Reason      string    `json:"reason"`
+	CreatedBy   string    `json:"createdBy,omitempty"`
+	RequestedBy string    `json:"requestedBy,omitempty"`
+	Source      string    `json:"source"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+// Sink is a destination for batches of audit records
+type Sink interface {
+	// Write persists a batch of records
+	Write(records []Record) error
+	// Close flushes and releases the sink
+	Close() error
+}
+
+// Logger fans audit records out to sinks. Each sink is fed by its own
+// goroutine through a bounded queue; when a queue is full the record is
+// dropped for that sink so a slow sink never delays authorization.
+type Logger struct {
+	workers []*worker
+	wg      sync.WaitGroup
+	once    sync.Once
+
+	// mu guards closed, so Log never sends on a queue Close has closed
+	mu     sync.RWMutex
+	closed bool
+}
+
+// worker batches records from its queue into a single sink
+type worker struct {
+	name          string
+	sink          Sink
+	queue         chan Record
+	batchSize     int
+	flushInterval time.Duration
+}
+
+// NewLogger creates the sinks described by cfg and starts their workers
+func NewLogger(cfg config.AuditConfig) (*Logger, error) {
+	sinks := make([]Sink, 0, len(cfg.Sinks))
+	for i, sinkCfg := range cfg.Sinks {
+		sink, err := newSink(sinkCfg)
+		if err != nil {
+			for _, created := range sinks {
+				created.Close()
+			}
+			return nil, fmt.Errorf("audit sink %d: %v", i, err)
+		}
+		sinks = append(sinks, sink)
+	}
+
+	l := &Logger{}
+	for i, sink := range sinks {
+		l.addSink(fmt.Sprintf("%s-%d", cfg.Sinks[i].Type, i), sink, cfg)
+	}
+	return l, nil
+}
+
+// NewLoggerWithSinks starts a logger writing to already constructed sinks,
+// named after their position
+func NewLoggerWithSinks(cfg config.AuditConfig, sinks ...Sink) *Logger {
+	l := &Logger{}
+	for i, sink := range sinks {
+		l.addSink(fmt.Sprintf("sink-%d", i), sink, cfg)
+	}
+	return l
+}
+
+// addSink starts a worker feeding sink
+func (l *Logger) addSink(name string, sink Sink, cfg config.AuditConfig) {
+	w := &worker{
+		name:          name,
+		sink:          sink,
+		queue:         make(chan Record, orDefault(cfg.BufferSize, defaultBufferSize)),
+		batchSize:     orDefault(cfg.BatchSize, defaultBatchSize),
+		flushInterval: cfg.FlushInterval,
+	}
+	if w.flushInterval <= 0 {
+		w.flushInterval = defaultFlushInterval
+	}
+
+	l.workers = append(l.workers, w)
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		w.run()
+	}()
+}
+
+// Log queues a record for every sink without blocking. Records logged
+// after Close, such as by handlers outliving a shutdown timeout, are
+// dropped.
+func (l *Logger) Log(record Record) {
+	if l == nil {
+		return
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, w := range l.workers {
+		if l.closed {
+			metrics.AuditRecordsDropped.WithLabelValues(w.name).Inc()
+			continue
+		}
+		select {
+		case w.queue <- record:
+		default:
+			metrics.AuditRecordsDropped.WithLabelValues(w.name).Inc()
+		}
+	}
+}
+
+// Close stops accepting records, writes everything still queued and closes
+// the sinks
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	var firstErr error
+	l.once.Do(func() {
+		l.mu.Lock()
+		l.closed = true
+		for _, w := range l.workers {
+			close(w.queue)
+		}
+		l.mu.Unlock()
+		l.wg.Wait()
+
+		for _, w := range l.workers {
+			if err := w.sink.Close(); err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("failed to close audit sink %s: %v", w.name, err)
+			}
+		}
+	})
+	return firstErr
+}
+
+// run writes batches until the queue is closed and drained
+func (w *worker) run() {
+	ticker := time.NewTicker(w.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Record, 0, w.batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := w.sink.Write(batch); err != nil {
+			log.Printf("Audit sink %s failed to write %d records: %v", w.name, len(batch), err)
+			metrics.AuditSinkErrors.WithLabelValues(w.name).Inc()
+		}
+		batch = make([]Record, 0, w.batchSize)
+	}
+
+	for {
+		select {
+		case record, ok := <-w.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, record)
+			if len(batch) >= w.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// orDefault returns value, or def when value is not positive
+func orDefault(value, def int) int {
+	if value <= 0 {
+		return def
+	}
+	return value
+}
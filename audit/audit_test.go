@@ -0,0 +1,159 @@
+package audit
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/imiller31/k8s-auth-webhook/config"
+	"github.com/imiller31/k8s-auth-webhook/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// memorySink records every batch it is given
+type memorySink struct {
+	mu      sync.Mutex
+	batches [][]Record
+	closed  bool
+	err     error
+	// block, when set, holds up writes until it is closed
+	block chan struct{}
+}
+
+func (m *memorySink) Write(records []Record) error {
+	if m.block != nil {
+		<-m.block
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.batches = append(m.batches, append([]Record(nil), records...))
+	return m.err
+}
+
+func (m *memorySink) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	return nil
+}
+
+func (m *memorySink) records() []Record {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var all []Record
+	for _, batch := range m.batches {
+		all = append(all, batch...)
+	}
+	return all
+}
+
+func TestLoggerBatching(t *testing.T) {
+	sink := &memorySink{}
+	logger := NewLoggerWithSinks(config.AuditConfig{BatchSize: 2, FlushInterval: time.Hour}, sink)
+
+	for _, user := range []string{"alice", "bob", "carol"} {
+		logger.Log(Record{User: user})
+	}
+	if err := logger.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	if len(sink.batches) != 2 || len(sink.batches[0]) != 2 || len(sink.batches[1]) != 1 {
+		t.Errorf("expected batches of 2 and 1 records, got %v", sink.batches)
+	}
+	records := sink.records()
+	if len(records) != 3 || records[0].User != "alice" || records[2].User != "carol" {
+		t.Errorf("expected records in order, got %v", records)
+	}
+	if !sink.closed {
+		t.Error("expected sink to be closed")
+	}
+}
+
+func TestLoggerFlushInterval(t *testing.T) {
+	sink := &memorySink{}
+	logger := NewLoggerWithSinks(config.AuditConfig{BatchSize: 100, FlushInterval: 10 * time.Millisecond}, sink)
+	defer logger.Close()
+
+	logger.Log(Record{User: "alice"})
+
+	deadline := time.Now().Add(time.Second)
+	for len(sink.records()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected record to be flushed before the batch filled")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestLoggerDropsWhenFull(t *testing.T) {
+	slow := &memorySink{block: make(chan struct{})}
+	fast := &memorySink{}
+	logger := NewLoggerWithSinks(config.AuditConfig{BufferSize: 1, BatchSize: 1, FlushInterval: time.Hour}, slow, fast)
+
+	dropped := testutil.ToFloat64(metrics.AuditRecordsDropped.WithLabelValues("sink-0"))
+
+	// The slow sink's worker takes one record and blocks writing it; its
+	// queue then holds one more and the rest are dropped
+	logger.Log(Record{User: "first"})
+	time.Sleep(20 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		logger.Log(Record{User: "more"})
+	}
+
+	if got := testutil.ToFloat64(metrics.AuditRecordsDropped.WithLabelValues("sink-0")) - dropped; got != 4 {
+		t.Errorf("expected 4 records dropped for the slow sink, got %v", got)
+	}
+
+	close(slow.block)
+	logger.Close()
+
+	if got := len(slow.records()); got != 2 {
+		t.Errorf("expected slow sink to receive 2 records, got %d", got)
+	}
+	if got := len(fast.records()); got < 2 {
+		t.Errorf("expected fast sink to be unaffected by the slow sink, got %d records", got)
+	}
+}
+
+func TestLoggerSinkErrors(t *testing.T) {
+	sink := &memorySink{err: errors.New("unavailable")}
+	logger := NewLoggerWithSinks(config.AuditConfig{BatchSize: 1}, sink)
+
+	before := testutil.ToFloat64(metrics.AuditSinkErrors.WithLabelValues("sink-0"))
+	logger.Log(Record{User: "alice"})
+	logger.Close()
+
+	if got := testutil.ToFloat64(metrics.AuditSinkErrors.WithLabelValues("sink-0")) - before; got != 1 {
+		t.Errorf("expected 1 sink error, got %v", got)
+	}
+}
+
+func TestLoggerLogAfterClose(t *testing.T) {
+	sink := &memorySink{}
+	logger := NewLoggerWithSinks(config.AuditConfig{}, sink)
+	logger.Log(Record{User: "alice"})
+	if err := logger.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// A handler that outlived the shutdown timeout logs after Close
+	dropped := testutil.ToFloat64(metrics.AuditRecordsDropped.WithLabelValues("sink-0"))
+	logger.Log(Record{User: "bob"})
+
+	if got := testutil.ToFloat64(metrics.AuditRecordsDropped.WithLabelValues("sink-0")) - dropped; got != 1 {
+		t.Errorf("expected the record logged after Close to be dropped, got %v dropped", got)
+	}
+	if records := sink.records(); len(records) != 1 || records[0].User != "alice" {
+		t.Errorf("expected only the record logged before Close, got %v", records)
+	}
+}
+
+func TestNilLogger(t *testing.T) {
+	var logger *Logger
+	logger.Log(Record{User: "alice"})
+	if err := logger.Close(); err != nil {
+		t.Errorf("Close() on nil logger error = %v", err)
+	}
+}
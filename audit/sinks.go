@@ -0,0 +1,239 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/imiller31/k8s-auth-webhook/config"
+)
+
+// Defaults applied when the corresponding AuditSink field is unset
+const (
+	defaultMaxSizeMB      = 100
+	defaultMaxBackups     = 5
+	defaultWebhookTimeout = 5 * time.Second
+)
+
+// newSink creates the sink described by cfg
+func newSink(cfg config.AuditSink) (Sink, error) {
+	switch cfg.Type {
+	case config.AuditSinkStdout:
+		return NewWriterSink(os.Stdout), nil
+	case config.AuditSinkFile:
+		return NewFileSink(cfg.Path, int64(orDefault(cfg.MaxSizeMB, defaultMaxSizeMB))*1024*1024, orDefault(cfg.MaxBackups, defaultMaxBackups))
+	case config.AuditSinkWebhook:
+		timeout := cfg.Timeout
+		if timeout <= 0 {
+			timeout = defaultWebhookTimeout
+		}
+		return NewWebhookSink(cfg.URL, timeout, cfg.BearerTokenFile)
+	default:
+		return nil, fmt.Errorf("unknown audit sink type %q", cfg.Type)
+	}
+}
+
+// WriterSink writes records as JSON lines to an io.Writer
+type WriterSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterSink creates a sink writing JSON lines to w
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+// Write encodes each record on its own line
+func (s *WriterSink) Write(records []Record) error {
+	data, err := encodeLines(records)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(data)
+	return err
+}
+
+// Close is a no-op; the writer is owned by the caller
+func (s *WriterSink) Close() error {
+	return nil
+}
+
+// FileSink writes JSON lines to a local file, rotating it once it exceeds
+// maxSize bytes. Rotated files are renamed to path.1, path.2, ... with the
+// oldest beyond maxBackups removed.
+type FileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewFileSink opens path for appending, creating its directory if needed
+func NewFileSink(path string, maxSize int64, maxBackups int) (*FileSink, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create audit log directory: %v", err)
+	}
+
+	s := &FileSink{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// open opens the current log file and records its size
+func (s *FileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log file: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat audit log file: %v", err)
+	}
+
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+// Write appends the records, rotating first if they would exceed the size limit
+func (s *FileSink) Write(records []Record) error {
+	data, err := encodeLines(records)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.size > 0 && s.size+int64(len(data)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(data)
+	s.size += int64(n)
+	return err
+}
+
+// rotate shifts existing backups up by one, moves the current file to
+// path.1 and opens a fresh file
+func (s *FileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return fmt.Errorf("failed to close audit log file: %v", err)
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", s.path, s.maxBackups))
+	for i := s.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+	}
+	if s.maxBackups > 0 {
+		if err := os.Rename(s.path, s.path+".1"); err != nil {
+			return fmt.Errorf("failed to rotate audit log file: %v", err)
+		}
+	} else if err := os.Remove(s.path); err != nil {
+		return fmt.Errorf("failed to truncate audit log file: %v", err)
+	}
+
+	return s.open()
+}
+
+// Close closes the log file
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// WebhookSink POSTs batches of records as a JSON array to an HTTP endpoint
+type WebhookSink struct {
+	url       string
+	client    *http.Client
+	tokenFile string
+}
+
+// NewWebhookSink creates a sink posting to url. When tokenFile is set its
+// contents are sent as a bearer token, re-read on every batch so rotation
+// needs no restart.
+func NewWebhookSink(url string, timeout time.Duration, tokenFile string) (*WebhookSink, error) {
+	if tokenFile != "" {
+		if _, err := os.Stat(tokenFile); err != nil {
+			return nil, fmt.Errorf("audit webhook token file not found: %s", tokenFile)
+		}
+	}
+
+	return &WebhookSink{
+		url:       url,
+		client:    &http.Client{Timeout: timeout},
+		tokenFile: tokenFile,
+	}, nil
+}
+
+// Write posts the batch and fails on any non-2xx response
+func (s *WebhookSink) Write(records []Record) error {
+	body, err := json.Marshal(records)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit records: %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create audit webhook request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if s.tokenFile != "" {
+		token, err := os.ReadFile(s.tokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to read audit webhook token: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send audit records: %v", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("audit webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Close releases idle connections
+func (s *WebhookSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// encodeLines encodes records as newline-delimited JSON
+func encodeLines(records []Record) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return nil, fmt.Errorf("failed to encode audit record: %v", err)
+		}
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,135 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/imiller31/k8s-auth-webhook/config"
+)
+
+func TestWriterSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewWriterSink(&buf)
+
+	if err := sink.Write([]Record{{User: "alice", Decision: "Deny"}, {User: "bob", Decision: "Allow"}}); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	scanner := bufio.NewScanner(&buf)
+	var users []string
+	for scanner.Scan() {
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("line %q is not a JSON record: %v", scanner.Text(), err)
+		}
+		users = append(users, record.User)
+	}
+	if len(users) != 2 || users[0] != "alice" || users[1] != "bob" {
+		t.Errorf("expected one line per record, got users %v", users)
+	}
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit", "audit.log")
+	record := Record{User: "alice", Decision: "Deny", Reason: "denied"}
+	line, _ := encodeLines([]Record{record})
+
+	// Room for two records per file, keeping two backups
+	sink, err := NewFileSink(path, int64(2*len(line)), 2)
+	if err != nil {
+		t.Fatalf("NewFileSink() error = %v", err)
+	}
+	for i := 0; i < 7; i++ {
+		if err := sink.Write([]Record{record}); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	for _, tt := range []struct {
+		path  string
+		lines int
+	}{
+		{path, 1},
+		{path + ".1", 2},
+		{path + ".2", 2},
+	} {
+		data, err := os.ReadFile(tt.path)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", tt.path, err)
+		}
+		if got := bytes.Count(data, []byte("\n")); got != tt.lines {
+			t.Errorf("expected %d records in %s, got %d", tt.lines, tt.path, got)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected no more than 2 backups, found %s.3", path)
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatalf("failed to write token file: %v", err)
+	}
+
+	var received []Record
+	var authorization string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Errorf("failed to decode batch: %v", err)
+		}
+	}))
+	defer srv.Close()
+
+	sink, err := newSink(config.AuditSink{Type: config.AuditSinkWebhook, URL: srv.URL, BearerTokenFile: tokenFile})
+	if err != nil {
+		t.Fatalf("newSink() error = %v", err)
+	}
+	defer sink.Close()
+
+	if err := sink.Write([]Record{{User: "alice"}, {User: "bob"}}); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if len(received) != 2 || received[1].User != "bob" {
+		t.Errorf("expected batch of 2 records, got %v", received)
+	}
+	if authorization != "Bearer secret" {
+		t.Errorf("expected bearer token to be sent, got %q", authorization)
+	}
+}
+
+func TestWebhookSinkErrorStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	sink, err := NewWebhookSink(srv.URL, time.Second, "")
+	if err != nil {
+		t.Fatalf("NewWebhookSink() error = %v", err)
+	}
+	if err := sink.Write([]Record{{User: "alice"}}); err == nil {
+		t.Error("expected error for non-2xx response")
+	}
+}
+
+func TestNewLoggerInvalidSink(t *testing.T) {
+	_, err := NewLogger(config.AuditConfig{Sinks: []config.AuditSink{
+		{Type: config.AuditSinkStdout},
+		{Type: config.AuditSinkWebhook, URL: "http://localhost", BearerTokenFile: "/nonexistent/token"},
+	}})
+	if err == nil {
+		t.Error("expected error for missing webhook token file")
+	}
+}
@@ -1,35 +1,292 @@
 package auth
 
 import (
+	"fmt"
 	"log"
 	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/imiller31/k8s-auth-webhook/breakglass"
 	"github.com/imiller31/k8s-auth-webhook/cel"
+	"github.com/imiller31/k8s-auth-webhook/cluster"
 	"github.com/imiller31/k8s-auth-webhook/config"
+	"github.com/imiller31/k8s-auth-webhook/decision"
+	"github.com/imiller31/k8s-auth-webhook/metrics"
 	authorizationv1 "k8s.io/api/authorization/v1"
 )
 
+// Names under which the built-in checks report decisions, alongside CEL rule names
+const checkDefault = "builtin:default"
+
 type Authorizer struct {
-	config  *config.Config
-	celEval *cel.Evaluator
+	policy atomic.Pointer[policy]
+	// lister looks up objects for protection policies in lookup mode; nil
+	// when the cluster cannot be reached
+	lister cluster.ObjectLister
+	// namespaces looks up namespace labels for namespace policies; nil when
+	// the cluster cannot be reached
+	namespaces cluster.NamespaceGetter
+	// grants let requests through protection policies; nil when break-glass is disabled
+	grants *breakglass.Store
+}
+
+// policy is an immutable snapshot of the configuration and compiled rules a
+// request is evaluated against
+type policy struct {
+	config          *config.Config
+	celEval         *cel.Evaluator
+	defaultDecision decision.Decision
+	// impersonation decides impersonate requests
+	impersonation impersonationPolicy
+	// protections are the compiled protection policies, in evaluation order
+	protections []protection
+	// auditOnly records denials by every rule and check instead of enforcing them
+	auditOnly bool
+	// cache holds recent decisions made by this policy; nil when disabled
+	cache *decisionCache
+	// generation increases by one every time the policy is replaced
+	generation uint64
 }
 
 func NewAuthorizer(config *config.Config, celEval *cel.Evaluator) *Authorizer {
-	return &Authorizer{
-		config:  config,
-		celEval: celEval,
+	a := &Authorizer{}
+	p := newPolicy(config, celEval, 1)
+	a.policy.Store(p)
+	p.publishMetrics()
+	return a
+}
+
+// publishMetrics exports the generation and rule count of a policy that has just taken effect
+func (p *policy) publishMetrics() {
+	metrics.ConfigGeneration.Set(float64(p.generation))
+	metrics.RulesLoaded.Set(float64(p.celEval.RuleCount()))
+	metrics.DecisionCacheEntries.Set(0)
+}
+
+// newPolicy builds a policy snapshot, falling back to NoOpinion for an
+// invalid default decision and to enforcing for an invalid enforcement
+func newPolicy(cfg *config.Config, celEval *cel.Evaluator, generation uint64) *policy {
+	defaultDecision, err := decision.Parse(cfg.DefaultDecision)
+	if err != nil {
+		log.Printf("Invalid default decision %q, falling back to %s", cfg.DefaultDecision, decision.NoOpinion)
+		defaultDecision = decision.NoOpinion
+	}
+
+	auditOnly, err := config.ParseEnforcement(cfg.Enforcement)
+	if err != nil {
+		log.Printf("Invalid enforcement %q, falling back to %s", cfg.Enforcement, config.EnforcementEnforce)
+	}
+
+	return &policy{
+		config:          cfg,
+		celEval:         celEval,
+		defaultDecision: defaultDecision,
+		impersonation:   newImpersonationPolicy(cfg.Impersonation),
+		protections:     newProtections(cfg),
+		auditOnly:       auditOnly,
+		cache:           newDecisionCache(cfg.DecisionCache),
+		generation:      generation,
+	}
+}
+
+// Update atomically replaces the configuration and compiled rules. Requests
+// already being processed finish against the policy they started with.
+// It returns the generation of the new policy.
+func (a *Authorizer) Update(config *config.Config, celEval *cel.Evaluator) uint64 {
+	for {
+		current := a.policy.Load()
+		next := newPolicy(config, celEval, current.generation+1)
+		if a.policy.CompareAndSwap(current, next) {
+			next.publishMetrics()
+			return next.generation
+		}
+	}
+}
+
+// SetObjectLister sets the lister protection policies use to look up
+// objects in the cluster. It must be called before requests are served.
+func (a *Authorizer) SetObjectLister(lister cluster.ObjectLister) {
+	a.lister = lister
+}
+
+// SetNamespaceGetter sets the getter namespace policies use to look up the
+// labels of namespaces. It must be called before requests are served.
+func (a *Authorizer) SetNamespaceGetter(namespaces cluster.NamespaceGetter) {
+	a.namespaces = namespaces
+}
+
+// SetBreakGlass sets the store of break-glass grants that override
+// protection policy denials. It must be called before requests are served.
+func (a *Authorizer) SetBreakGlass(grants *breakglass.Store) {
+	a.grants = grants
+}
+
+// BreakGlass returns the store of break-glass grants, nil when disabled
+func (a *Authorizer) BreakGlass() *breakglass.Store {
+	return a.grants
+}
+
+// Generation returns the generation of the policy currently in effect
+func (a *Authorizer) Generation() uint64 {
+	return a.policy.Load().generation
+}
+
+// Config returns the configuration currently in effect
+func (a *Authorizer) Config() *config.Config {
+	return a.policy.Load().config
+}
+
+// RuleCount returns the number of CEL rules in the policy in effect
+func (a *Authorizer) RuleCount() int {
+	return a.policy.Load().celEval.RuleCount()
+}
+
+// Checks returns the names of the CEL rules and built-in checks of the
+// policy in effect, in the order they are evaluated
+func (a *Authorizer) Checks() []string {
+	p := a.policy.Load()
+	checks := append(p.celEval.RuleNames(), p.impersonation.checks()...)
+	for _, prot := range p.protections {
+		checks = append(checks, prot.check)
 	}
+	return append(checks, checkDefault)
+}
+
+// Result is the outcome of authorizing a single request
+type Result struct {
+	Decision decision.Decision
+	Reason   string
+	// Rule is the CEL rule or built-in check that produced the decision
+	Rule string
+	// Audited lists the denials recorded instead of enforced because their
+	// rule or the webhook is in audit mode
+	Audited []cel.AuditedDenial
+	// Duration is the time spent evaluating the request
+	Duration time.Duration
+	// BreakGlass is the grant that allowed a request a protection policy would have denied
+	BreakGlass *breakglass.Grant
+	// Cached is set when the decision was served from the decision cache
+	Cached bool
+	// Generation is the generation of the policy the request was evaluated against
+	Generation uint64
+}
+
+func (a *Authorizer) ProcessRequest(sar *authorizationv1.SubjectAccessReview) (decision.Decision, string) {
+	result := a.Authorize(sar)
+	return result.Decision, result.Reason
 }
 
-func (a *Authorizer) ProcessRequest(sar *authorizationv1.SubjectAccessReview) (bool, string) {
+// Authorize evaluates a request and reports the decision together with how it was reached
+func (a *Authorizer) Authorize(sar *authorizationv1.SubjectAccessReview) Result {
 	log.Printf("Processing request for user: %s, groups: %v", sar.Spec.User, sar.Spec.Groups)
 
-	// Check CEL rules first
-	if allowed, reason := a.celEval.Evaluate(sar); !allowed {
-		return false, reason
+	// Evaluate the whole request against a single policy snapshot
+	p := a.policy.Load()
+	start := time.Now()
+
+	key, err := newCacheKey(sar.Spec)
+	if err != nil {
+		log.Printf("Failed to compute decision cache key, skipping cache: %v", err)
+	} else if entry, ok := p.cache.get(key); ok {
+		result := Result{
+			Decision:   entry.decision,
+			Reason:     entry.reason,
+			Rule:       entry.rule,
+			Audited:    entry.audited,
+			Duration:   time.Since(start),
+			Cached:     true,
+			Generation: p.generation,
+		}
+		countDecision(result)
+		return result
+	}
+
+	result := a.authorize(p, sar, nil)
+	if err == nil && a.cacheable(result) {
+		p.cache.add(key, result.Decision, result.Reason, result.Rule, result.Audited)
+	}
+
+	result.Duration = time.Since(start)
+	result.Generation = p.generation
+	countDecision(result)
+	return result
+}
+
+// cacheable reports whether a result may be served again from the cache.
+// With break-glass enabled, protection policy denials are not cached so new
+// grants take effect at once, nor are allows by grants, which must stop
+// when the grant expires or is revoked.
+func (a *Authorizer) cacheable(result Result) bool {
+	if a.grants == nil {
+		return true
+	}
+	return result.BreakGlass == nil && !(result.Decision == decision.Deny && strings.HasPrefix(result.Rule, protectionCheck("")))
+}
+
+// countDecision updates the decision metrics for a served result
+func countDecision(result Result) {
+	metrics.Decisions.WithLabelValues(result.Decision.String(), result.Rule).Inc()
+	if result.BreakGlass != nil {
+		metrics.BreakGlassUses.WithLabelValues(result.Rule).Inc()
+	}
+	for _, denial := range result.Audited {
+		metrics.AuditedDenials.WithLabelValues(denial.Rule).Inc()
+	}
+}
+
+// Explain authorizes a request like Authorize and also returns a step for
+// every CEL rule and built-in check considered, in order, with the one that
+// decided marked decisive. It bypasses the decision cache so the steps
+// always reflect the policy in effect, and is not counted in the decision
+// or CEL rule metrics.
+func (a *Authorizer) Explain(sar *authorizationv1.SubjectAccessReview) (Result, []cel.Step) {
+	p := a.policy.Load()
+	start := time.Now()
+
+	var steps []cel.Step
+	result := a.authorize(p, sar, &steps)
+	result.Duration = time.Since(start)
+	result.Generation = p.generation
+	// Evaluation stops at the rule or check that decides, so it is the last step
+	if len(steps) > 0 {
+		steps[len(steps)-1].Decisive = true
+	}
+	return result, steps
+}
+
+// authorize evaluates a request against a policy and returns the decision,
+// the reason, the name of the CEL rule or built-in check that decided and
+// any denials that were audited instead of enforced. Unless steps is nil, a
+// step is appended for every rule and check considered.
+func (a *Authorizer) authorize(p *policy, sar *authorizationv1.SubjectAccessReview, steps *[]cel.Step) Result {
+	record := func(check, outcome, detail string) {
+		if steps != nil {
+			*steps = append(*steps, cel.Step{Rule: check, Outcome: outcome, Detail: detail})
+		}
+	}
+
+	// Check CEL rules first; a matching allow or deny rule is final
+	result := p.celEval.EvaluateWithOptions(sar, cel.Options{AuditOnly: p.auditOnly, Steps: steps})
+	if result.Decision != decision.NoOpinion {
+		log.Printf("Authorization decision for user %s: %s by CEL rule '%s'", sar.Spec.User, result.Decision, result.Rule)
+		return Result{Decision: result.Decision, Reason: result.Reason, Rule: result.Rule, Audited: result.Audited}
+	}
+	audited := result.Audited
+
+	// decides records the decision of a built-in check that matched and
+	// reports whether it is final. In audit mode denials are collected instead.
+	decides := func(check string, d decision.Decision, reason string) bool {
+		if d == decision.Deny && p.auditOnly {
+			log.Printf("Audit mode: would have denied by rule '%s': %s", check, reason)
+			audited = append(audited, cel.AuditedDenial{Rule: check, Reason: reason})
+			record(check, cel.OutcomeAudited, "would have denied")
+			return false
+		}
+		record(check, cel.OutcomeMatched, d.String())
+		return true
 	}
 
-	// Check for system:masters impersonation attempts
 	if sar.Spec.ResourceAttributes != nil {
 		log.Printf("Resource attributes: Group=%s, Version=%s, Resource=%s, Name=%s, Namespace=%s, Verb=%s",
 			sar.Spec.ResourceAttributes.Group,
@@ -38,44 +295,104 @@ func (a *Authorizer) ProcessRequest(sar *authorizationv1.SubjectAccessReview) (b
 			sar.Spec.ResourceAttributes.Name,
 			sar.Spec.ResourceAttributes.Namespace,
 			sar.Spec.ResourceAttributes.Verb)
+	}
 
-		if sar.Spec.ResourceAttributes.Group == "authentication.k8s.io" &&
-			sar.Spec.ResourceAttributes.Resource == "userextras" &&
-			sar.Spec.ResourceAttributes.Subresource == "groups" &&
-			sar.Spec.ResourceAttributes.Name == "system:masters" {
-			return false, "Impersonation of system:masters group is not allowed"
+	// Check impersonation against the impersonation policy
+	if impersonatesMastersExtra(sar.Spec.ResourceAttributes) {
+		log.Printf("Blocking impersonation of system:masters through the groups extra by user: %s", sar.Spec.User)
+		if decides(checkImpersonation, decision.Deny, mastersExtraDenial) {
+			return Result{Decision: decision.Deny, Reason: mastersExtraDenial, Rule: checkImpersonation, Audited: audited}
+		}
+	} else if target, ok := impersonationTargetOf(sar.Spec.ResourceAttributes); ok {
+		check, d, reason := p.impersonation.decide(sar.Spec, target)
+		if d == decision.NoOpinion {
+			record(check, cel.OutcomeNoMatch, "no impersonation rule allows it")
+		} else if decides(check, d, reason) {
+			return Result{Decision: d, Reason: reason, Rule: check, Audited: audited}
 		}
+	} else {
+		record(checkImpersonation, cel.OutcomeNoMatch, "")
 	}
 
-	// Check for direct system:masters group impersonation
-	if sar.Spec.NonResourceAttributes != nil &&
-		strings.Contains(sar.Spec.NonResourceAttributes.Path, "/groups/system:masters") {
-		return false, "Direct impersonation of system:masters group is not allowed"
+	// breakGlass looks for a grant overriding a protection policy's denial
+	breakGlass := func(prot *protection, denial string) (Result, bool) {
+		grant, ok := a.grants.Match(sar.Spec, prot.name)
+		if !ok {
+			return Result{}, false
+		}
+		log.Printf("BREAK-GLASS: allowing %s by user %s through protection policy '%s' with grant %s (%s), which would have denied it: %s",
+			sar.Spec.ResourceAttributes.Verb, sar.Spec.User, prot.name, grant.ID, grant.Reason, denial)
+		record(prot.check, cel.OutcomeMatched, fmt.Sprintf("%s by break-glass grant %s", decision.Allow, grant.ID))
+		reason := fmt.Sprintf("User '%s' is authorized to %s resources protected by policy '%s' by break-glass grant %s, valid until %s: %s",
+			sar.Spec.User, sar.Spec.ResourceAttributes.Verb, prot.name, grant.ID, grant.ExpiresAt.UTC().Format(time.RFC3339), grant.Reason)
+		return Result{Decision: decision.Allow, Reason: reason, Rule: prot.check, Audited: audited, BreakGlass: &grant}, true
 	}
 
-	// Check for protected resource deletion
-	if sar.Spec.ResourceAttributes != nil &&
-		sar.Spec.ResourceAttributes.Verb == "delete" &&
-		strings.HasPrefix(sar.Spec.ResourceAttributes.Name, a.config.ProtectedPrefix) {
-
-		// Allow privileged user
-		if sar.Spec.User == a.config.PrivilegedUser {
-			log.Printf("Allowing delete operation for privileged user on resource: %s", sar.Spec.ResourceAttributes.Name)
-			return true, "User '" + sar.Spec.User + "' is authorized to delete protected resources as a privileged user"
+	// Check the protection policies in order; the first that allows or denies
+	// decides, unless a break-glass grant overrides its denial
+	for i := range p.protections {
+		prot := &p.protections[i]
+		if prot.namespaceSelector != nil {
+			d, reason, ok := prot.decideNamespace(sar, a.namespaces)
+			if !ok {
+				record(prot.check, cel.OutcomeNoMatch, "")
+				continue
+			}
+			if d == decision.Deny {
+				if result, ok := breakGlass(prot, reason); ok {
+					return result
+				}
+			}
+			if decides(prot.check, d, reason) {
+				return Result{Decision: d, Reason: reason, Rule: prot.check, Audited: audited}
+			}
+			continue
 		}
-
-		// Allow system:masters group
-		for _, group := range sar.Spec.Groups {
-			if group == "system:masters" {
-				log.Printf("Allowing delete operation for user %s in privileged group system:masters", sar.Spec.User)
-				return true, "User '" + sar.Spec.User + "' is authorized to delete protected resources as a member of system:masters group"
+		if prot.appliesToCollection(sar.Spec.ResourceAttributes) {
+			d, reason, ok := prot.decideCollection(sar, a.lister)
+			if !ok {
+				record(prot.check, cel.OutcomeNoMatch, "no protected resources in collection")
+				continue
+			}
+			if d == decision.Deny {
+				if result, ok := breakGlass(prot, reason); ok {
+					return result
+				}
 			}
+			if decides(prot.check, d, reason) {
+				return Result{Decision: d, Reason: reason, Rule: prot.check, Audited: audited}
+			}
+			continue
+		}
+		if !prot.applies(sar.Spec.ResourceAttributes) {
+			record(prot.check, cel.OutcomeNoMatch, "")
+			continue
+		}
+		d, reason := prot.decide(sar)
+		if d == decision.Deny {
+			if result, ok := breakGlass(prot, reason); ok {
+				return result
+			}
+		}
+		if decides(prot.check, d, reason) {
+			return Result{Decision: d, Reason: reason, Rule: prot.check, Audited: audited}
 		}
-
-		log.Printf("Blocking delete operation on protected resource for user: %s", sar.Spec.User)
-		return false, "User '" + sar.Spec.User + "' is not authorized to delete resources with prefix '" + a.config.ProtectedPrefix + "'. Only '" + a.config.PrivilegedUser + "' users or members of system:masters/system:nodes groups can perform this operation."
 	}
 
-	log.Printf("Authorization decision for user %s: true, reason: Request allowed by authorization webhook", sar.Spec.User)
-	return true, "Request allowed by authorization webhook"
+	reason := defaultReason(p.defaultDecision)
+	record(checkDefault, cel.OutcomeMatched, p.defaultDecision.String())
+	log.Printf("Authorization decision for user %s: %s, reason: %s", sar.Spec.User, p.defaultDecision, reason)
+	return Result{Decision: p.defaultDecision, Reason: reason, Rule: checkDefault, Audited: audited}
+}
+
+// defaultReason describes the decision returned for requests no check matched
+func defaultReason(d decision.Decision) string {
+	switch d {
+	case decision.Allow:
+		return "Request allowed by authorization webhook"
+	case decision.Deny:
+		return "Request denied by authorization webhook default policy"
+	default:
+		return "No opinion: request not matched by authorization webhook"
+	}
 }
@@ -1,10 +1,15 @@
 package auth
 
 import (
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/imiller31/k8s-auth-webhook/cel"
 	"github.com/imiller31/k8s-auth-webhook/config"
+	"github.com/imiller31/k8s-auth-webhook/decision"
+	"github.com/imiller31/k8s-auth-webhook/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	authorizationv1 "k8s.io/api/authorization/v1"
 )
 
@@ -13,37 +18,83 @@ func TestNewAuthorizer(t *testing.T) {
 		ProtectedPrefix: "test-",
 		PrivilegedUser:  "admin",
 	}
-	celEval, _ := cel.NewEvaluator([]string{})
+	celEval, _ := cel.NewEvaluator(nil)
 
 	authorizer := NewAuthorizer(cfg, celEval)
 	if authorizer == nil {
 		t.Error("NewAuthorizer() returned nil")
 	}
-	if authorizer.config != cfg {
+	if authorizer.Config() != cfg {
 		t.Error("NewAuthorizer() config mismatch")
 	}
-	if authorizer.celEval != celEval {
+	if authorizer.policy.Load().celEval != celEval {
 		t.Error("NewAuthorizer() celEval mismatch")
 	}
+	if authorizer.Generation() != 1 {
+		t.Errorf("NewAuthorizer() generation = %d, want 1", authorizer.Generation())
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	cfg := &config.Config{
+		ProtectedPrefix: "test-",
+		PrivilegedUser:  "admin",
+	}
+	celEval, _ := cel.NewEvaluator(nil)
+	authorizer := NewAuthorizer(cfg, celEval)
+
+	sar := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User: "test-user",
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Verb: "get",
+				Name: "test-resource",
+			},
+		},
+	}
+	if got, _ := authorizer.ProcessRequest(sar); got != decision.NoOpinion {
+		t.Fatalf("ProcessRequest() before update = %v, want %v", got, decision.NoOpinion)
+	}
+
+	newCfg := &config.Config{
+		ProtectedPrefix: "test-",
+		PrivilegedUser:  "admin",
+	}
+	newEval, err := cel.NewEvaluator([]config.CELRule{
+		{Name: "deny-gets", Expression: "resourceAttributes.verb == 'get'", Effect: "deny"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create CEL evaluator: %v", err)
+	}
+
+	if generation := authorizer.Update(newCfg, newEval); generation != 2 {
+		t.Errorf("Update() generation = %d, want 2", generation)
+	}
+	if authorizer.Config() != newCfg {
+		t.Error("Update() did not replace config")
+	}
+	if got, reason := authorizer.ProcessRequest(sar); got != decision.Deny {
+		t.Errorf("ProcessRequest() after update = %v (%s), want %v", got, reason, decision.Deny)
+	}
 }
 
 func TestProcessRequest(t *testing.T) {
 	tests := []struct {
 		name     string
 		cfg      *config.Config
-		celRules []string
+		celRules []config.CELRule
 		sar      *authorizationv1.SubjectAccessReview
-		want     bool
+		want     decision.Decision
 		validate func(*testing.T, string)
 	}{
 		{
-			name: "allow by CEL rule",
+			name: "no opinion when CEL rules pass",
 			cfg: &config.Config{
 				ProtectedPrefix: "test-",
 				PrivilegedUser:  "admin",
 			},
-			celRules: []string{
-				"'system:masters' in groups",
+			celRules: []config.CELRule{
+				config.LegacyRule("'system:masters' in groups"),
 			},
 			sar: &authorizationv1.SubjectAccessReview{
 				Spec: authorizationv1.SubjectAccessReviewSpec{
@@ -51,10 +102,10 @@ func TestProcessRequest(t *testing.T) {
 					Groups: []string{"system:masters"},
 				},
 			},
-			want: true,
+			want: decision.NoOpinion,
 			validate: func(t *testing.T, reason string) {
-				if reason != "Request allowed by authorization webhook" {
-					t.Errorf("expected reason 'Request allowed by authorization webhook', got %s", reason)
+				if reason != "No opinion: request not matched by authorization webhook" {
+					t.Errorf("expected reason 'No opinion: request not matched by authorization webhook', got %s", reason)
 				}
 			},
 		},
@@ -64,8 +115,8 @@ func TestProcessRequest(t *testing.T) {
 				ProtectedPrefix: "test-",
 				PrivilegedUser:  "admin",
 			},
-			celRules: []string{
-				"'system:masters' in groups",
+			celRules: []config.CELRule{
+				config.LegacyRule("'system:masters' in groups"),
 			},
 			sar: &authorizationv1.SubjectAccessReview{
 				Spec: authorizationv1.SubjectAccessReviewSpec{
@@ -73,10 +124,10 @@ func TestProcessRequest(t *testing.T) {
 					Groups: []string{"test-group"},
 				},
 			},
-			want: false,
+			want: decision.Deny,
 			validate: func(t *testing.T, reason string) {
-				if reason != "Request denied by CEL rule 0" {
-					t.Errorf("expected reason 'Request denied by CEL rule 0', got %s", reason)
+				if reason != "Request denied by CEL rule 'rule-0'" {
+					t.Errorf("expected reason \"Request denied by CEL rule 'rule-0'\", got %s", reason)
 				}
 			},
 		},
@@ -86,7 +137,7 @@ func TestProcessRequest(t *testing.T) {
 				ProtectedPrefix: "test-",
 				PrivilegedUser:  "admin",
 			},
-			celRules: []string{},
+			celRules: []config.CELRule{},
 			sar: &authorizationv1.SubjectAccessReview{
 				Spec: authorizationv1.SubjectAccessReviewSpec{
 					ResourceAttributes: &authorizationv1.ResourceAttributes{
@@ -97,7 +148,7 @@ func TestProcessRequest(t *testing.T) {
 					},
 				},
 			},
-			want: false,
+			want: decision.Deny,
 			validate: func(t *testing.T, reason string) {
 				if reason != "Impersonation of system:masters group is not allowed" {
 					t.Errorf("expected reason 'Impersonation of system:masters group is not allowed', got %s", reason)
@@ -105,23 +156,52 @@ func TestProcessRequest(t *testing.T) {
 			},
 		},
 		{
-			name: "block direct system:masters group impersonation",
+			name: "block system:masters group impersonation",
+			cfg: &config.Config{
+				ProtectedPrefix: "test-",
+				PrivilegedUser:  "admin",
+				Impersonation:   config.DefaultConfig().Impersonation,
+			},
+			celRules: []config.CELRule{},
+			sar: &authorizationv1.SubjectAccessReview{
+				Spec: authorizationv1.SubjectAccessReviewSpec{
+					User: "test-user",
+					ResourceAttributes: &authorizationv1.ResourceAttributes{
+						Verb:     "impersonate",
+						Resource: "groups",
+						Name:     "system:masters",
+					},
+				},
+			},
+			want: decision.Deny,
+			validate: func(t *testing.T, reason string) {
+				if reason != "User 'test-user' is not authorized to impersonate group 'system:masters': it is protected from impersonation" {
+					t.Errorf("expected reason 'User 'test-user' is not authorized to impersonate group 'system:masters': it is protected from impersonation', got %s", reason)
+				}
+			},
+		},
+		{
+			name: "block system:admin impersonation",
 			cfg: &config.Config{
 				ProtectedPrefix: "test-",
 				PrivilegedUser:  "admin",
+				Impersonation:   config.DefaultConfig().Impersonation,
 			},
-			celRules: []string{},
+			celRules: []config.CELRule{},
 			sar: &authorizationv1.SubjectAccessReview{
 				Spec: authorizationv1.SubjectAccessReviewSpec{
-					NonResourceAttributes: &authorizationv1.NonResourceAttributes{
-						Path: "/api/v1/users/~/groups/system:masters",
+					User: "test-user",
+					ResourceAttributes: &authorizationv1.ResourceAttributes{
+						Verb:     "impersonate",
+						Resource: "users",
+						Name:     "system:admin",
 					},
 				},
 			},
-			want: false,
+			want: decision.Deny,
 			validate: func(t *testing.T, reason string) {
-				if reason != "Direct impersonation of system:masters group is not allowed" {
-					t.Errorf("expected reason 'Direct impersonation of system:masters group is not allowed', got %s", reason)
+				if reason != "User 'test-user' is not authorized to impersonate user 'system:admin': it is protected from impersonation" {
+					t.Errorf("expected reason 'User 'test-user' is not authorized to impersonate user 'system:admin': it is protected from impersonation', got %s", reason)
 				}
 			},
 		},
@@ -131,7 +211,7 @@ func TestProcessRequest(t *testing.T) {
 				ProtectedPrefix: "test-",
 				PrivilegedUser:  "admin",
 			},
-			celRules: []string{},
+			celRules: []config.CELRule{},
 			sar: &authorizationv1.SubjectAccessReview{
 				Spec: authorizationv1.SubjectAccessReviewSpec{
 					User: "admin",
@@ -141,20 +221,21 @@ func TestProcessRequest(t *testing.T) {
 					},
 				},
 			},
-			want: true,
+			want: decision.Allow,
 			validate: func(t *testing.T, reason string) {
-				if reason != "User 'admin' is authorized to delete protected resources as a privileged user" {
-					t.Errorf("expected reason 'User 'admin' is authorized to delete protected resources as a privileged user', got %s", reason)
+				if reason != "User 'admin' is authorized to delete resources protected by policy 'protected-prefix' as an allowed user" {
+					t.Errorf("expected reason 'User 'admin' is authorized to delete resources protected by policy 'protected-prefix' as an allowed user', got %s", reason)
 				}
 			},
 		},
 		{
 			name: "allow delete by system:masters group",
 			cfg: &config.Config{
-				ProtectedPrefix: "test-",
-				PrivilegedUser:  "admin",
+				ProtectedPrefix:  "test-",
+				PrivilegedUser:   "admin",
+				PrivilegedGroups: []string{"system:masters"},
 			},
-			celRules: []string{},
+			celRules: []config.CELRule{},
 			sar: &authorizationv1.SubjectAccessReview{
 				Spec: authorizationv1.SubjectAccessReviewSpec{
 					User:   "test-user",
@@ -165,10 +246,10 @@ func TestProcessRequest(t *testing.T) {
 					},
 				},
 			},
-			want: true,
+			want: decision.Allow,
 			validate: func(t *testing.T, reason string) {
-				if reason != "User 'test-user' is authorized to delete protected resources as a member of system:masters group" {
-					t.Errorf("expected reason 'User 'test-user' is authorized to delete protected resources as a member of system:masters group', got %s", reason)
+				if reason != "User 'test-user' is authorized to delete resources protected by policy 'protected-prefix' as a member of privileged group 'system:masters'" {
+					t.Errorf("expected reason 'User 'test-user' is authorized to delete resources protected by policy 'protected-prefix' as a member of privileged group 'system:masters'', got %s", reason)
 				}
 			},
 		},
@@ -178,7 +259,7 @@ func TestProcessRequest(t *testing.T) {
 				ProtectedPrefix: "test-",
 				PrivilegedUser:  "admin",
 			},
-			celRules: []string{},
+			celRules: []config.CELRule{},
 			sar: &authorizationv1.SubjectAccessReview{
 				Spec: authorizationv1.SubjectAccessReviewSpec{
 					User: "test-user",
@@ -188,20 +269,20 @@ func TestProcessRequest(t *testing.T) {
 					},
 				},
 			},
-			want: false,
+			want: decision.Deny,
 			validate: func(t *testing.T, reason string) {
-				if reason != "User 'test-user' is not authorized to delete resources with prefix 'test-'. Only 'admin' users or members of system:masters/system:nodes groups can perform this operation." {
-					t.Errorf("expected reason 'User 'test-user' is not authorized to delete resources with prefix 'test-'. Only 'admin' users or members of system:masters/system:nodes groups can perform this operation.', got %s", reason)
+				if reason != "User 'test-user' is not authorized to delete \"test-resource\": it is protected by policy 'protected-prefix'" {
+					t.Errorf("expected reason 'User 'test-user' is not authorized to delete \"test-resource\": it is protected by policy 'protected-prefix'', got %s", reason)
 				}
 			},
 		},
 		{
-			name: "allow non-delete operation",
+			name: "no opinion on non-delete operation",
 			cfg: &config.Config{
 				ProtectedPrefix: "test-",
 				PrivilegedUser:  "admin",
 			},
-			celRules: []string{},
+			celRules: []config.CELRule{},
 			sar: &authorizationv1.SubjectAccessReview{
 				Spec: authorizationv1.SubjectAccessReviewSpec{
 					User: "test-user",
@@ -211,13 +292,82 @@ func TestProcessRequest(t *testing.T) {
 					},
 				},
 			},
-			want: true,
+			want: decision.NoOpinion,
+			validate: func(t *testing.T, reason string) {
+				if reason != "No opinion: request not matched by authorization webhook" {
+					t.Errorf("expected reason 'No opinion: request not matched by authorization webhook', got %s", reason)
+				}
+			},
+		},
+		{
+			name: "allow by CEL rule overrides protection",
+			cfg: &config.Config{
+				ProtectedPrefix: "test-",
+				PrivilegedUser:  "admin",
+			},
+			celRules: []config.CELRule{
+				{Name: "break-glass", Expression: "user == 'oncall'", Effect: "allow", Message: "On-call may delete anything"},
+			},
+			sar: &authorizationv1.SubjectAccessReview{
+				Spec: authorizationv1.SubjectAccessReviewSpec{
+					User: "oncall",
+					ResourceAttributes: &authorizationv1.ResourceAttributes{
+						Verb: "delete",
+						Name: "test-resource",
+					},
+				},
+			},
+			want: decision.Allow,
+			validate: func(t *testing.T, reason string) {
+				if reason != "On-call may delete anything (CEL rule 'break-glass')" {
+					t.Errorf("expected reason \"On-call may delete anything (CEL rule 'break-glass')\", got %s", reason)
+				}
+			},
+		},
+		{
+			name: "configured default allow",
+			cfg: &config.Config{
+				ProtectedPrefix: "test-",
+				PrivilegedUser:  "admin",
+				DefaultDecision: "Allow",
+			},
+			celRules: []config.CELRule{},
+			sar: &authorizationv1.SubjectAccessReview{
+				Spec: authorizationv1.SubjectAccessReviewSpec{
+					User: "test-user",
+					ResourceAttributes: &authorizationv1.ResourceAttributes{
+						Verb: "get",
+						Name: "test-resource",
+					},
+				},
+			},
+			want: decision.Allow,
 			validate: func(t *testing.T, reason string) {
 				if reason != "Request allowed by authorization webhook" {
 					t.Errorf("expected reason 'Request allowed by authorization webhook', got %s", reason)
 				}
 			},
 		},
+		{
+			name: "configured default deny",
+			cfg: &config.Config{
+				ProtectedPrefix: "test-",
+				PrivilegedUser:  "admin",
+				DefaultDecision: "deny",
+			},
+			celRules: []config.CELRule{},
+			sar: &authorizationv1.SubjectAccessReview{
+				Spec: authorizationv1.SubjectAccessReviewSpec{
+					User: "test-user",
+				},
+			},
+			want: decision.Deny,
+			validate: func(t *testing.T, reason string) {
+				if reason != "Request denied by authorization webhook default policy" {
+					t.Errorf("expected reason 'Request denied by authorization webhook default policy', got %s", reason)
+				}
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -239,3 +389,177 @@ func TestProcessRequest(t *testing.T) {
 		})
 	}
 }
+
+func TestProcessRequestMetrics(t *testing.T) {
+	cfg := &config.Config{
+		ProtectedPrefix: "test-",
+		PrivilegedUser:  "admin",
+	}
+	celEval, err := cel.NewEvaluator([]config.CELRule{
+		{Name: "deny-secrets", Expression: "resourceAttributes.resource == 'secrets'", Effect: "deny"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create CEL evaluator: %v", err)
+	}
+	authorizer := NewAuthorizer(cfg, celEval)
+
+	if got := testutil.ToFloat64(metrics.RulesLoaded); got != 1 {
+		t.Errorf("RulesLoaded = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(metrics.ConfigGeneration); got != 1 {
+		t.Errorf("ConfigGeneration = %v, want 1", got)
+	}
+
+	tests := []struct {
+		name     string
+		sar      *authorizationv1.SubjectAccessReview
+		decision string
+		rule     string
+	}{
+		{
+			name: "CEL rule",
+			sar: &authorizationv1.SubjectAccessReview{
+				Spec: authorizationv1.SubjectAccessReviewSpec{
+					User:               "test-user",
+					ResourceAttributes: &authorizationv1.ResourceAttributes{Verb: "get", Resource: "secrets"},
+				},
+			},
+			decision: "Deny",
+			rule:     "deny-secrets",
+		},
+		{
+			name: "built-in check",
+			sar: &authorizationv1.SubjectAccessReview{
+				Spec: authorizationv1.SubjectAccessReviewSpec{
+					User:               "test-user",
+					ResourceAttributes: &authorizationv1.ResourceAttributes{Verb: "delete", Resource: "pods", Name: "test-pod"},
+				},
+			},
+			decision: "Deny",
+			rule:     protectionCheck("protected-prefix"),
+		},
+		{
+			name: "default decision",
+			sar: &authorizationv1.SubjectAccessReview{
+				Spec: authorizationv1.SubjectAccessReviewSpec{
+					User:               "test-user",
+					ResourceAttributes: &authorizationv1.ResourceAttributes{Verb: "get", Resource: "pods"},
+				},
+			},
+			decision: "NoOpinion",
+			rule:     checkDefault,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter := metrics.Decisions.WithLabelValues(tt.decision, tt.rule)
+			before := testutil.ToFloat64(counter)
+
+			authorizer.ProcessRequest(tt.sar)
+
+			if got := testutil.ToFloat64(counter) - before; got != 1 {
+				t.Errorf("decisions_total{decision=%q,rule=%q} increased by %v, want 1", tt.decision, tt.rule, got)
+			}
+		})
+	}
+
+	authorizer.Update(cfg, celEval)
+	if got := testutil.ToFloat64(metrics.ConfigGeneration); got != 2 {
+		t.Errorf("ConfigGeneration after update = %v, want 2", got)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	cfg := &config.Config{
+		ProtectedPrefix: "test-",
+		PrivilegedUser:  "admin",
+		DecisionCache:   config.DecisionCacheConfig{Size: 10, AllowTTL: time.Minute, DenyTTL: time.Minute},
+	}
+	celEval, err := cel.NewEvaluator([]config.CELRule{
+		{Name: "deny-prod", Expression: "resourceAttributes.namespace == 'prod'", Effect: "deny"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create CEL evaluator: %v", err)
+	}
+	authorizer := NewAuthorizer(cfg, celEval)
+
+	sar := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User: "test-user",
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Verb:      "delete",
+				Namespace: "dev",
+				Name:      "test-resource",
+			},
+		},
+	}
+	// Warm the cache; Explain must still evaluate every check
+	authorizer.Authorize(sar)
+
+	result, steps := authorizer.Explain(sar)
+	if result.Decision != decision.Deny || result.Rule != protectionCheck("protected-prefix") || result.Cached {
+		t.Errorf("Explain() = %+v, want uncached Deny by %s", result, protectionCheck("protected-prefix"))
+	}
+
+	want := []cel.Step{
+		{Rule: "deny-prod", Outcome: cel.OutcomeNoMatch, Variables: []cel.Variable{{Name: "resourceAttributes.namespace", Value: "dev"}}},
+		{Rule: checkImpersonation, Outcome: cel.OutcomeNoMatch},
+		{Rule: protectionCheck("protected-prefix"), Outcome: cel.OutcomeMatched, Detail: "Deny", Decisive: true},
+	}
+	if len(steps) != len(want) {
+		t.Fatalf("Explain() steps = %+v, want %+v", steps, want)
+	}
+	for i := range want {
+		if !reflect.DeepEqual(steps[i], want[i]) {
+			t.Errorf("step %d = %+v, want %+v", i, steps[i], want[i])
+		}
+	}
+}
+
+func TestAuditEnforcement(t *testing.T) {
+	cfg := &config.Config{
+		ProtectedPrefix: "test-",
+		PrivilegedUser:  "admin",
+		Enforcement:     config.EnforcementAudit,
+		DecisionCache:   config.DecisionCacheConfig{Size: 10, AllowTTL: time.Minute, DenyTTL: time.Minute},
+	}
+	celEval, err := cel.NewEvaluator([]config.CELRule{
+		{Name: "deny-prod", Expression: "resourceAttributes.namespace == 'prod'", Effect: "deny"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create CEL evaluator: %v", err)
+	}
+	authorizer := NewAuthorizer(cfg, celEval)
+
+	sar := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User: "test-user",
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Verb:      "delete",
+				Namespace: "prod",
+				Name:      "test-resource",
+			},
+		},
+	}
+
+	counter := metrics.AuditedDenials.WithLabelValues(protectionCheck("protected-prefix"))
+	before := testutil.ToFloat64(counter)
+
+	for _, cached := range []bool{false, true} {
+		result := authorizer.Authorize(sar)
+		if result.Cached != cached {
+			t.Fatalf("Authorize() cached = %v, want %v", result.Cached, cached)
+		}
+		if result.Decision != decision.NoOpinion || result.Rule != checkDefault {
+			t.Errorf("Authorize() = %v by %s, want NoOpinion by %s", result.Decision, result.Rule, checkDefault)
+		}
+		if len(result.Audited) != 2 || result.Audited[0].Rule != "deny-prod" || result.Audited[1].Rule != protectionCheck("protected-prefix") {
+			t.Errorf("Authorize() audited = %+v, want deny-prod and %s", result.Audited, protectionCheck("protected-prefix"))
+		}
+	}
+
+	if got := testutil.ToFloat64(counter) - before; got != 2 {
+		t.Errorf("audited_denials_total{rule=%s} increased by %v, want 2", protectionCheck("protected-prefix"), got)
+	}
+}
@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/imiller31/k8s-auth-webhook/cel"
+	"github.com/imiller31/k8s-auth-webhook/config"
+	"github.com/imiller31/k8s-auth-webhook/decision"
+	"github.com/imiller31/k8s-auth-webhook/metrics"
+	authorizationv1 "k8s.io/api/authorization/v1"
+)
+
+// cacheKey identifies a request by the hash of its canonical JSON encoding.
+// Struct fields encode in declaration order and map keys sorted, so equal
+// specs always produce the same key.
+type cacheKey [sha256.Size]byte
+
+// newCacheKey hashes a SubjectAccessReview spec
+func newCacheKey(spec authorizationv1.SubjectAccessReviewSpec) (cacheKey, error) {
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return cacheKey{}, err
+	}
+	return sha256.Sum256(data), nil
+}
+
+// cacheEntry is a cached decision
+type cacheEntry struct {
+	key      cacheKey
+	decision decision.Decision
+	reason   string
+	rule     string
+	// audited lists the denials recorded instead of enforced
+	audited []cel.AuditedDenial
+	expires time.Time
+}
+
+// decisionCache is a size-bounded LRU cache of decisions. Allow decisions
+// expire after allowTTL, Deny and NoOpinion decisions after denyTTL. Every
+// policy has its own cache, so reloading the policy invalidates it.
+type decisionCache struct {
+	size     int
+	allowTTL time.Duration
+	denyTTL  time.Duration
+	now      func() time.Time
+
+	mu      sync.Mutex
+	entries map[cacheKey]*list.Element
+	// lru holds *cacheEntry values, most recently used first
+	lru *list.List
+}
+
+// newDecisionCache creates a cache, or returns nil when caching is disabled
+func newDecisionCache(cfg config.DecisionCacheConfig) *decisionCache {
+	if cfg.Size <= 0 {
+		return nil
+	}
+	return &decisionCache{
+		size:     cfg.Size,
+		allowTTL: cfg.AllowTTL,
+		denyTTL:  cfg.DenyTTL,
+		now:      time.Now,
+		entries:  make(map[cacheKey]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// get returns the unexpired decision cached for key
+func (c *decisionCache) get(key cacheKey) (cacheEntry, bool) {
+	if c == nil {
+		return cacheEntry{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		metrics.DecisionCacheRequests.WithLabelValues("miss").Inc()
+		return cacheEntry{}, false
+	}
+
+	entry := elem.Value.(*cacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.remove(elem)
+		metrics.DecisionCacheRequests.WithLabelValues("miss").Inc()
+		return cacheEntry{}, false
+	}
+
+	c.lru.MoveToFront(elem)
+	metrics.DecisionCacheRequests.WithLabelValues("hit").Inc()
+	return *entry, true
+}
+
+// add caches a decision, evicting the least recently used entry when full.
+// Decisions whose TTL is zero are not cached.
+func (c *decisionCache) add(key cacheKey, d decision.Decision, reason, rule string, audited []cel.AuditedDenial) {
+	if c == nil {
+		return
+	}
+
+	ttl := c.denyTTL
+	if d == decision.Allow {
+		ttl = c.allowTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &cacheEntry{key: key, decision: d, reason: reason, rule: rule, audited: audited, expires: c.now().Add(ttl)}
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(entry)
+	if c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+	metrics.DecisionCacheEntries.Set(float64(c.lru.Len()))
+}
+
+// remove drops an entry; the caller must hold mu
+func (c *decisionCache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).key)
+	metrics.DecisionCacheEntries.Set(float64(c.lru.Len()))
+}
@@ -0,0 +1,150 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/imiller31/k8s-auth-webhook/cel"
+	"github.com/imiller31/k8s-auth-webhook/config"
+	"github.com/imiller31/k8s-auth-webhook/decision"
+	"github.com/imiller31/k8s-auth-webhook/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	authorizationv1 "k8s.io/api/authorization/v1"
+)
+
+func mustCacheKey(t *testing.T, user string) cacheKey {
+	t.Helper()
+	key, err := newCacheKey(authorizationv1.SubjectAccessReviewSpec{User: user})
+	if err != nil {
+		t.Fatalf("newCacheKey() unexpected error: %v", err)
+	}
+	return key
+}
+
+func TestNewCacheKey(t *testing.T) {
+	spec := func(extra map[string]authorizationv1.ExtraValue) authorizationv1.SubjectAccessReviewSpec {
+		return authorizationv1.SubjectAccessReviewSpec{
+			User:   "alice",
+			Groups: []string{"dev", "ops"},
+			Extra:  extra,
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Verb:     "get",
+				Resource: "pods",
+			},
+		}
+	}
+
+	a, _ := newCacheKey(spec(map[string]authorizationv1.ExtraValue{"a": {"1"}, "b": {"2"}}))
+	b, _ := newCacheKey(spec(map[string]authorizationv1.ExtraValue{"b": {"2"}, "a": {"1"}}))
+	if a != b {
+		t.Error("expected equal specs to produce the same key")
+	}
+
+	other := spec(nil)
+	other.ResourceAttributes.Verb = "delete"
+	c, _ := newCacheKey(other)
+	if a == c {
+		t.Error("expected different specs to produce different keys")
+	}
+}
+
+func TestDecisionCache(t *testing.T) {
+	now := time.Unix(0, 0)
+	cache := newDecisionCache(config.DecisionCacheConfig{Size: 2, AllowTTL: time.Minute, DenyTTL: 10 * time.Second})
+	cache.now = func() time.Time { return now }
+
+	alice, bob, carol := mustCacheKey(t, "alice"), mustCacheKey(t, "bob"), mustCacheKey(t, "carol")
+	cache.add(alice, decision.Allow, "allowed", "rule-a", nil)
+	cache.add(bob, decision.Deny, "denied", "rule-b", nil)
+
+	if entry, ok := cache.get(alice); !ok || entry.decision != decision.Allow || entry.rule != "rule-a" {
+		t.Errorf("get(alice) = %+v, %v; want cached Allow", entry, ok)
+	}
+
+	// bob is now the least recently used entry and is evicted
+	cache.add(carol, decision.NoOpinion, "no opinion", "builtin:default", nil)
+	if _, ok := cache.get(bob); ok {
+		t.Error("expected least recently used entry to be evicted")
+	}
+	if _, ok := cache.get(carol); !ok {
+		t.Error("expected carol to be cached")
+	}
+
+	// NoOpinion uses the deny TTL; Allow lives longer
+	now = now.Add(30 * time.Second)
+	if _, ok := cache.get(carol); ok {
+		t.Error("expected NoOpinion entry to expire after the deny TTL")
+	}
+	if _, ok := cache.get(alice); !ok {
+		t.Error("expected Allow entry to outlive the deny TTL")
+	}
+	now = now.Add(time.Minute)
+	if _, ok := cache.get(alice); ok {
+		t.Error("expected Allow entry to expire after the allow TTL")
+	}
+}
+
+func TestDecisionCacheDisabled(t *testing.T) {
+	if cache := newDecisionCache(config.DecisionCacheConfig{AllowTTL: time.Minute}); cache != nil {
+		t.Error("expected zero size to disable the cache")
+	}
+
+	cache := newDecisionCache(config.DecisionCacheConfig{Size: 10, AllowTTL: time.Minute})
+	key := mustCacheKey(t, "alice")
+	cache.add(key, decision.Deny, "denied", "rule", nil)
+	if _, ok := cache.get(key); ok {
+		t.Error("expected decisions with a zero TTL not to be cached")
+	}
+}
+
+func TestAuthorizeCache(t *testing.T) {
+	cfg := &config.Config{
+		ProtectedPrefix: "test-",
+		PrivilegedUser:  "admin",
+		DecisionCache:   config.DecisionCacheConfig{Size: 10, AllowTTL: time.Minute, DenyTTL: time.Minute},
+	}
+	celEval, err := cel.NewEvaluator([]config.CELRule{
+		{Name: "deny-deletes", Expression: "resourceAttributes.verb == 'delete'", Effect: "deny"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create CEL evaluator: %v", err)
+	}
+	authorizer := NewAuthorizer(cfg, celEval)
+
+	sar := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:               "test-user",
+			ResourceAttributes: &authorizationv1.ResourceAttributes{Verb: "delete", Resource: "pods"},
+		},
+	}
+
+	hits := testutil.ToFloat64(metrics.DecisionCacheRequests.WithLabelValues("hit"))
+	misses := testutil.ToFloat64(metrics.DecisionCacheRequests.WithLabelValues("miss"))
+
+	first := authorizer.Authorize(sar)
+	second := authorizer.Authorize(sar)
+	if first.Cached || !second.Cached {
+		t.Errorf("expected only the second request to be served from cache, got cached=%v,%v", first.Cached, second.Cached)
+	}
+	if second.Decision != decision.Deny || second.Rule != "deny-deletes" || second.Reason != first.Reason {
+		t.Errorf("cached result %+v does not match evaluated result %+v", second, first)
+	}
+	if got := testutil.ToFloat64(metrics.DecisionCacheRequests.WithLabelValues("hit")) - hits; got != 1 {
+		t.Errorf("expected 1 cache hit, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.DecisionCacheRequests.WithLabelValues("miss")) - misses; got != 1 {
+		t.Errorf("expected 1 cache miss, got %v", got)
+	}
+
+	// Reloading the policy invalidates the cache
+	allowEval, err := cel.NewEvaluator([]config.CELRule{
+		{Name: "allow-all", Expression: "true", Effect: "allow"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create CEL evaluator: %v", err)
+	}
+	authorizer.Update(cfg, allowEval)
+	if result := authorizer.Authorize(sar); result.Cached || result.Decision != decision.Allow {
+		t.Errorf("expected fresh Allow after reload, got %+v", result)
+	}
+}
@@ -0,0 +1,224 @@
+package auth
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/imiller31/k8s-auth-webhook/config"
+	"github.com/imiller31/k8s-auth-webhook/decision"
+	authorizationv1 "k8s.io/api/authorization/v1"
+)
+
+// checkImpersonation names the impersonation decisions no impersonation
+// rule made: denials of protected identities and of unmatched requests
+const checkImpersonation = "builtin:impersonation"
+
+// impersonationCheck returns the check name an impersonation rule decides under
+func impersonationCheck(name string) string {
+	return checkImpersonation + ":" + name
+}
+
+// Kinds of identity an impersonate request can assume
+const (
+	targetUser           = "user"
+	targetGroup          = "group"
+	targetServiceAccount = "service account"
+	targetUID            = "uid"
+	targetExtra          = "extra"
+)
+
+// impersonationTarget is the identity an impersonate request asks to assume.
+// The apiserver checks every part of an impersonated identity separately.
+type impersonationTarget struct {
+	kind string
+	// name is the user, group, service account or UID, or the extra's value
+	name string
+	// namespace is the service account's namespace
+	namespace string
+	// key is the extra's key
+	key string
+}
+
+func (t impersonationTarget) String() string {
+	switch t.kind {
+	case targetServiceAccount:
+		return fmt.Sprintf("%s '%s/%s'", t.kind, t.namespace, t.name)
+	case targetExtra:
+		return fmt.Sprintf("%s '%s=%s'", t.kind, t.key, t.name)
+	default:
+		return fmt.Sprintf("%s '%s'", t.kind, t.name)
+	}
+}
+
+// mastersExtraDenial is the reason asserting system:masters through the
+// groups user extra is denied
+const mastersExtraDenial = "Impersonation of system:masters group is not allowed"
+
+// impersonatesMastersExtra reports whether a request asks to assert the
+// system:masters group through the groups user extra. Such requests are
+// denied whatever their verb and the impersonation configuration, as they
+// were before impersonation was configurable.
+func impersonatesMastersExtra(attrs *authorizationv1.ResourceAttributes) bool {
+	return attrs != nil &&
+		attrs.Group == "authentication.k8s.io" &&
+		attrs.Resource == "userextras" &&
+		attrs.Subresource == "groups" &&
+		attrs.Name == "system:masters"
+}
+
+// impersonationTargetOf returns the identity an impersonate request asks to
+// assume and reports whether the request is one
+func impersonationTargetOf(attrs *authorizationv1.ResourceAttributes) (impersonationTarget, bool) {
+	if attrs == nil || attrs.Verb != "impersonate" {
+		return impersonationTarget{}, false
+	}
+
+	switch attrs.Group + "/" + attrs.Resource {
+	case "/users":
+		return impersonationTarget{kind: targetUser, name: attrs.Name}, true
+	case "/groups":
+		return impersonationTarget{kind: targetGroup, name: attrs.Name}, true
+	case "/serviceaccounts":
+		return impersonationTarget{kind: targetServiceAccount, namespace: attrs.Namespace, name: attrs.Name}, true
+	case "authentication.k8s.io/uids":
+		return impersonationTarget{kind: targetUID, name: attrs.Name}, true
+	case "authentication.k8s.io/userextras":
+		return impersonationTarget{kind: targetExtra, key: attrs.Subresource, name: attrs.Name}, true
+	}
+	return impersonationTarget{}, false
+}
+
+// impersonationPolicy is the impersonation configuration ready for evaluation
+type impersonationPolicy struct {
+	protectedUsers           []string
+	protectedGroups          []string
+	protectedServiceAccounts []serviceAccountPattern
+	rules                    []impersonationRule
+	denyUnmatched            bool
+}
+
+// impersonationRule is an impersonation rule ready for evaluation
+type impersonationRule struct {
+	name string
+	// check names the rule in decisions, alongside CEL rule names
+	check           string
+	subjects        principals
+	users           []string
+	groups          []string
+	serviceAccounts []serviceAccountPattern
+	uids            []string
+	extras          map[string][]string
+}
+
+// newImpersonationPolicy compiles the impersonation configuration
+func newImpersonationPolicy(cfg config.ImpersonationConfig) impersonationPolicy {
+	p := impersonationPolicy{
+		protectedUsers:           cfg.ProtectedUsers,
+		protectedGroups:          cfg.ProtectedGroups,
+		protectedServiceAccounts: newServiceAccountPatterns(cfg.ProtectedServiceAccounts),
+		denyUnmatched:            cfg.DeniesUnmatched(),
+	}
+	for _, r := range cfg.Rules {
+		p.rules = append(p.rules, impersonationRule{
+			name:            r.Name,
+			check:           impersonationCheck(r.Name),
+			subjects:        newPrincipals(r.Subjects.Users, r.Subjects.Groups, r.Subjects.ServiceAccounts),
+			users:           r.Users,
+			groups:          r.Groups,
+			serviceAccounts: newServiceAccountPatterns(r.ServiceAccounts),
+			uids:            r.UIDs,
+			extras:          r.Extras,
+		})
+	}
+	return p
+}
+
+// protects reports whether a target can never be impersonated. Protected
+// users are also protected as UIDs, and protected users and groups as the
+// values of user extras, so they cannot be asserted through those either.
+func (p *impersonationPolicy) protects(target impersonationTarget) bool {
+	switch target.kind {
+	case targetUser, targetUID:
+		return matchesGlob(p.protectedUsers, target.name)
+	case targetGroup:
+		return matchesGlob(p.protectedGroups, target.name)
+	case targetExtra:
+		return matchesGlob(p.protectedUsers, target.name) || matchesGlob(p.protectedGroups, target.name)
+	case targetServiceAccount:
+		for _, sa := range p.protectedServiceAccounts {
+			if sa.matches(target.namespace, target.name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// covers reports whether the rule lets its subjects impersonate a target
+func (r *impersonationRule) covers(target impersonationTarget) bool {
+	switch target.kind {
+	case targetUser:
+		return matchesGlob(r.users, target.name)
+	case targetGroup:
+		return matchesGlob(r.groups, target.name)
+	case targetServiceAccount:
+		for _, sa := range r.serviceAccounts {
+			if sa.matches(target.namespace, target.name) {
+				return true
+			}
+		}
+	case targetUID:
+		return matchesGlob(r.uids, target.name)
+	case targetExtra:
+		return matchesGlob(r.extras[target.key], target.name) || matchesGlob(r.extras["*"], target.name)
+	}
+	return false
+}
+
+// decide decides an impersonate request. Protected identities are denied to
+// everyone; otherwise the first rule whose subjects include the requester
+// and which covers the target allows it, and unmatched requests are denied
+// or left without an opinion. It returns the check that decided.
+func (p *impersonationPolicy) decide(spec authorizationv1.SubjectAccessReviewSpec, target impersonationTarget) (string, decision.Decision, string) {
+	user := spec.User
+
+	if p.protects(target) {
+		log.Printf("Blocking impersonation of protected %s by user: %s", target, user)
+		return checkImpersonation, decision.Deny, fmt.Sprintf("User '%s' is not authorized to impersonate %s: it is protected from impersonation", user, target)
+	}
+
+	for i := range p.rules {
+		rule := &p.rules[i]
+		how, ok := rule.subjects.match(spec, "allowed")
+		if !ok || !rule.covers(target) {
+			continue
+		}
+		log.Printf("Allowing impersonation of %s for user %s %s by impersonation rule '%s'", target, user, how, rule.name)
+		return rule.check, decision.Allow, fmt.Sprintf("User '%s' is authorized to impersonate %s by impersonation rule '%s' %s", user, target, rule.name, how)
+	}
+
+	if p.denyUnmatched {
+		log.Printf("Blocking impersonation of %s by user %s: no impersonation rule allows it", target, user)
+		return checkImpersonation, decision.Deny, fmt.Sprintf("User '%s' is not authorized to impersonate %s: no impersonation rule allows it", user, target)
+	}
+	return checkImpersonation, decision.NoOpinion, ""
+}
+
+// checks returns the check names of the impersonation decisions in evaluation order
+func (p *impersonationPolicy) checks() []string {
+	checks := []string{checkImpersonation}
+	for _, r := range p.rules {
+		checks = append(checks, r.check)
+	}
+	return checks
+}
+
+// matchesGlob reports whether value matches any of the path.Match patterns
+func matchesGlob(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if globMatch(pattern, value) {
+			return true
+		}
+	}
+	return false
+}
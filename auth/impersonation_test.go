@@ -0,0 +1,248 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/imiller31/k8s-auth-webhook/cel"
+	"github.com/imiller31/k8s-auth-webhook/config"
+	"github.com/imiller31/k8s-auth-webhook/decision"
+	authorizationv1 "k8s.io/api/authorization/v1"
+)
+
+func TestImpersonation(t *testing.T) {
+	rules := []config.ImpersonationRule{
+		{
+			Name:     "support-debug",
+			Subjects: config.ImpersonationSubjects{Groups: []string{"support"}},
+			Users:    []string{"dev-*"},
+			Groups:   []string{"developers", "system:authenticated"},
+			Extras:   map[string][]string{"scopes": {"view"}},
+		},
+		{
+			Name:            "ci-deployers",
+			Subjects:        config.ImpersonationSubjects{ServiceAccounts: []string{"ci/*"}},
+			ServiceAccounts: []string{"apps-*/deployer"},
+			UIDs:            []string{"*"},
+			Extras:          map[string][]string{"*": {"ci-*"}},
+		},
+		{
+			Name:     "everyone-as-masters",
+			Subjects: config.ImpersonationSubjects{Users: []string{"root"}},
+			Groups:   []string{"*"},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		unmatched  string
+		user       string
+		groups     []string
+		attrs      authorizationv1.ResourceAttributes
+		want       decision.Decision
+		wantRule   string
+		wantReason string
+	}{
+		{
+			name:       "user allowed by rule",
+			user:       "carol",
+			groups:     []string{"support"},
+			attrs:      authorizationv1.ResourceAttributes{Verb: "impersonate", Resource: "users", Name: "dev-alice"},
+			want:       decision.Allow,
+			wantRule:   "builtin:impersonation:support-debug",
+			wantReason: "User 'carol' is authorized to impersonate user 'dev-alice' by impersonation rule 'support-debug' as a member of allowed group 'support'",
+		},
+		{
+			name:     "user not covered by rule",
+			user:     "carol",
+			groups:   []string{"support"},
+			attrs:    authorizationv1.ResourceAttributes{Verb: "impersonate", Resource: "users", Name: "prod-bob"},
+			want:     decision.NoOpinion,
+			wantRule: checkDefault,
+		},
+		{
+			name:     "requester not a subject",
+			user:     "mallory",
+			attrs:    authorizationv1.ResourceAttributes{Verb: "impersonate", Resource: "users", Name: "dev-alice"},
+			want:     decision.NoOpinion,
+			wantRule: checkDefault,
+		},
+		{
+			name:       "unmatched denied",
+			unmatched:  config.ImpersonationUnmatchedDeny,
+			user:       "mallory",
+			attrs:      authorizationv1.ResourceAttributes{Verb: "impersonate", Resource: "users", Name: "dev-alice"},
+			want:       decision.Deny,
+			wantRule:   checkImpersonation,
+			wantReason: "User 'mallory' is not authorized to impersonate user 'dev-alice': no impersonation rule allows it",
+		},
+		{
+			name:       "protected group denied despite rule",
+			user:       "root",
+			attrs:      authorizationv1.ResourceAttributes{Verb: "impersonate", Resource: "groups", Name: "system:masters"},
+			want:       decision.Deny,
+			wantRule:   checkImpersonation,
+			wantReason: "User 'root' is not authorized to impersonate group 'system:masters': it is protected from impersonation",
+		},
+		{
+			name:     "other group allowed by wildcard rule",
+			user:     "root",
+			attrs:    authorizationv1.ResourceAttributes{Verb: "impersonate", Resource: "groups", Name: "developers"},
+			want:     decision.Allow,
+			wantRule: "builtin:impersonation:everyone-as-masters",
+		},
+		{
+			name:       "protected user denied",
+			user:       "carol",
+			groups:     []string{"support"},
+			attrs:      authorizationv1.ResourceAttributes{Verb: "impersonate", Resource: "users", Name: "system:admin"},
+			want:       decision.Deny,
+			wantRule:   checkImpersonation,
+			wantReason: "impersonate user 'system:admin': it is protected from impersonation",
+		},
+		{
+			name:       "protected service account denied",
+			user:       "system:serviceaccount:ci:runner",
+			attrs:      authorizationv1.ResourceAttributes{Verb: "impersonate", Resource: "serviceaccounts", Namespace: "kube-system", Name: "deployer"},
+			want:       decision.Deny,
+			wantRule:   checkImpersonation,
+			wantReason: "impersonate service account 'kube-system/deployer': it is protected from impersonation",
+		},
+		{
+			name:       "service account allowed by rule",
+			user:       "system:serviceaccount:ci:runner",
+			attrs:      authorizationv1.ResourceAttributes{Verb: "impersonate", Resource: "serviceaccounts", Namespace: "apps-web", Name: "deployer"},
+			want:       decision.Allow,
+			wantRule:   "builtin:impersonation:ci-deployers",
+			wantReason: "as an allowed service account",
+		},
+		{
+			name:     "service account in other namespace not covered",
+			user:     "system:serviceaccount:ci:runner",
+			attrs:    authorizationv1.ResourceAttributes{Verb: "impersonate", Resource: "serviceaccounts", Namespace: "default", Name: "deployer"},
+			want:     decision.NoOpinion,
+			wantRule: checkDefault,
+		},
+		{
+			name:     "uid allowed by rule",
+			user:     "system:serviceaccount:ci:runner",
+			attrs:    authorizationv1.ResourceAttributes{Verb: "impersonate", Group: "authentication.k8s.io", Resource: "uids", Name: "1234"},
+			want:     decision.Allow,
+			wantRule: "builtin:impersonation:ci-deployers",
+		},
+		{
+			name:     "uid not listed allows none",
+			user:     "carol",
+			groups:   []string{"support"},
+			attrs:    authorizationv1.ResourceAttributes{Verb: "impersonate", Group: "authentication.k8s.io", Resource: "uids", Name: "1234"},
+			want:     decision.NoOpinion,
+			wantRule: checkDefault,
+		},
+		{
+			name:       "extra allowed for its key",
+			user:       "carol",
+			groups:     []string{"support"},
+			attrs:      authorizationv1.ResourceAttributes{Verb: "impersonate", Group: "authentication.k8s.io", Resource: "userextras", Subresource: "scopes", Name: "view"},
+			want:       decision.Allow,
+			wantRule:   "builtin:impersonation:support-debug",
+			wantReason: "impersonate extra 'scopes=view'",
+		},
+		{
+			name:       "system:masters through the groups extra denied",
+			user:       "root",
+			attrs:      authorizationv1.ResourceAttributes{Verb: "impersonate", Group: "authentication.k8s.io", Resource: "userextras", Subresource: "groups", Name: "system:masters"},
+			want:       decision.Deny,
+			wantRule:   checkImpersonation,
+			wantReason: "Impersonation of system:masters group is not allowed",
+		},
+		{
+			name:       "protected group as extra value denied despite rule",
+			user:       "system:serviceaccount:ci:runner",
+			attrs:      authorizationv1.ResourceAttributes{Verb: "impersonate", Group: "authentication.k8s.io", Resource: "userextras", Subresource: "reason", Name: "system:masters"},
+			want:       decision.Deny,
+			wantRule:   checkImpersonation,
+			wantReason: "impersonate extra 'reason=system:masters': it is protected from impersonation",
+		},
+		{
+			name:       "protected user as uid denied despite rule",
+			user:       "system:serviceaccount:ci:runner",
+			attrs:      authorizationv1.ResourceAttributes{Verb: "impersonate", Group: "authentication.k8s.io", Resource: "uids", Name: "system:admin"},
+			want:       decision.Deny,
+			wantRule:   checkImpersonation,
+			wantReason: "impersonate uid 'system:admin': it is protected from impersonation",
+		},
+		{
+			name:     "extra with other key not covered",
+			user:     "carol",
+			groups:   []string{"support"},
+			attrs:    authorizationv1.ResourceAttributes{Verb: "impersonate", Group: "authentication.k8s.io", Resource: "userextras", Subresource: "reason", Name: "view"},
+			want:     decision.NoOpinion,
+			wantRule: checkDefault,
+		},
+		{
+			name:     "extra allowed for any key",
+			user:     "system:serviceaccount:ci:runner",
+			attrs:    authorizationv1.ResourceAttributes{Verb: "impersonate", Group: "authentication.k8s.io", Resource: "userextras", Subresource: "reason", Name: "ci-release"},
+			want:     decision.Allow,
+			wantRule: "builtin:impersonation:ci-deployers",
+		},
+		{
+			name:      "other verbs on impersonation resources not covered",
+			unmatched: config.ImpersonationUnmatchedDeny,
+			user:      "mallory",
+			attrs:     authorizationv1.ResourceAttributes{Verb: "get", Resource: "serviceaccounts", Namespace: "kube-system", Name: "deployer"},
+			want:      decision.NoOpinion,
+			wantRule:  checkDefault,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.DefaultConfig()
+			cfg.Impersonation.ProtectedServiceAccounts = []string{"kube-system/*"}
+			cfg.Impersonation.Rules = rules
+			if tt.unmatched != "" {
+				cfg.Impersonation.Unmatched = tt.unmatched
+			}
+			celEval, err := cel.NewEvaluator(nil)
+			if err != nil {
+				t.Fatalf("Failed to create CEL evaluator: %v", err)
+			}
+			authorizer := NewAuthorizer(cfg, celEval)
+
+			attrs := tt.attrs
+			result := authorizer.Authorize(&authorizationv1.SubjectAccessReview{
+				Spec: authorizationv1.SubjectAccessReviewSpec{User: tt.user, Groups: tt.groups, ResourceAttributes: &attrs},
+			})
+			if result.Decision != tt.want || result.Rule != tt.wantRule {
+				t.Errorf("Authorize() = %v by %s (%s), want %v by %s", result.Decision, result.Rule, result.Reason, tt.want, tt.wantRule)
+			}
+			if !strings.Contains(result.Reason, tt.wantReason) {
+				t.Errorf("Authorize() reason = %q, want it to contain %q", result.Reason, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestImpersonationAuditOnly(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Enforcement = config.EnforcementAudit
+	celEval, err := cel.NewEvaluator(nil)
+	if err != nil {
+		t.Fatalf("Failed to create CEL evaluator: %v", err)
+	}
+	authorizer := NewAuthorizer(cfg, celEval)
+
+	result := authorizer.Authorize(&authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:               "mallory",
+			ResourceAttributes: &authorizationv1.ResourceAttributes{Verb: "impersonate", Resource: "groups", Name: "system:masters"},
+		},
+	})
+	if result.Decision == decision.Deny {
+		t.Errorf("Authorize() = %v by %s, want the denial audited", result.Decision, result.Rule)
+	}
+	if len(result.Audited) != 1 || result.Audited[0].Rule != checkImpersonation {
+		t.Errorf("Authorize() audited = %+v, want one denial by %s", result.Audited, checkImpersonation)
+	}
+}
@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+
+	"github.com/imiller31/k8s-auth-webhook/cluster"
+	"github.com/imiller31/k8s-auth-webhook/config"
+	"github.com/imiller31/k8s-auth-webhook/decision"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// namespaceSelector selects the namespaces a namespace policy protects
+type namespaceSelector struct {
+	names []string
+	globs []string
+	// labels is nil when the policy does not select namespaces by label
+	labels labels.Selector
+}
+
+// newNamespaceSelector compiles a policy's namespace selector. An invalid
+// label selector, which validation rejects, is skipped.
+func newNamespaceSelector(policy string, sel *config.NamespaceSelector) *namespaceSelector {
+	s := &namespaceSelector{names: sel.Names, globs: sel.Globs}
+	if sel.LabelSelector != "" {
+		selector, err := labels.Parse(sel.LabelSelector)
+		if err != nil {
+			log.Printf("Skipping invalid labelSelector %q of protection policy '%s': %v", sel.LabelSelector, policy, err)
+		} else {
+			s.labels = selector
+		}
+	}
+	return s
+}
+
+// matches reports whether a namespace is selected, looking up its labels
+// only when its name is not selected
+func (s *namespaceSelector) matches(name string, getter cluster.NamespaceGetter) (bool, error) {
+	for _, n := range s.names {
+		if n == name {
+			return true, nil
+		}
+	}
+	for _, glob := range s.globs {
+		if ok, _ := path.Match(glob, name); ok {
+			return true, nil
+		}
+	}
+	if s.labels == nil {
+		return false, nil
+	}
+
+	if getter == nil {
+		return false, fmt.Errorf("cluster lookup is unavailable")
+	}
+	ns, err := getter.GetNamespace(context.Background(), name)
+	if err != nil {
+		return false, err
+	}
+	return s.labels.Matches(labels.Set(ns.Labels)), nil
+}
+
+// decideNamespace decides a request under a namespace policy: a protected
+// verb on a selected namespace itself, or on an object in the policy's
+// resource scope inside one. Allowed principals are allowed and everyone
+// else is denied, also when the namespace's labels cannot be looked up. It
+// reports false when the policy does not apply.
+func (p *protection) decideNamespace(sar *authorizationv1.SubjectAccessReview, getter cluster.NamespaceGetter) (decision.Decision, string, bool) {
+	attrs := sar.Spec.ResourceAttributes
+	if attrs == nil || !matchesAny(p.verbs, attrs.Verb) {
+		return decision.NoOpinion, "", false
+	}
+	user := sar.Spec.User
+
+	// namespace is the namespace written to, empty for a deletecollection of
+	// every namespace. target describes what is written in reasons.
+	var namespace, target, protected string
+	if attrs.Group == "" && attrs.Resource == "namespaces" {
+		namespace = attrs.Name
+		if namespace == "" {
+			namespace = attrs.Namespace
+		}
+		if namespace == "" && attrs.Verb != "deletecollection" {
+			return decision.NoOpinion, "", false
+		}
+		target, protected = fmt.Sprintf("namespace %q", namespace), "it is"
+	} else {
+		if attrs.Namespace == "" ||
+			!matchesAny(p.apiGroups, attrs.Group) ||
+			!matchesAny(p.resources, attrs.Resource) {
+			return decision.NoOpinion, "", false
+		}
+		namespace = attrs.Namespace
+		target, protected = describeNamespaced(attrs), "the namespace is"
+	}
+
+	how, allowed := p.allows(sar.Spec)
+	if namespace != "" {
+		selected, err := p.namespaceSelector.matches(namespace, getter)
+		if err != nil {
+			// The policy cannot restrict principals it allows, so they need no lookup
+			if allowed {
+				log.Printf("Skipping protection policy '%s' for user %s %s: cannot look up namespace %s: %v", p.name, user, how, namespace, err)
+				return decision.NoOpinion, "", false
+			}
+			log.Printf("Blocking %s in namespace %s for user %s: protection policy '%s' lookup failed: %v", attrs.Verb, namespace, user, p.name, err)
+			return decision.Deny, fmt.Sprintf("User '%s' is not authorized to %s %s: cannot check whether namespace %q is protected by policy '%s': %v", user, attrs.Verb, target, namespace, p.name, err), true
+		}
+		if !selected {
+			return decision.NoOpinion, "", false
+		}
+	}
+
+	if allowed {
+		log.Printf("Allowing %s in namespace %s for user %s %s by protection policy '%s'", attrs.Verb, namespace, user, how, p.name)
+		return decision.Allow, fmt.Sprintf("User '%s' is authorized to %s resources protected by policy '%s' %s", user, attrs.Verb, p.name, how), true
+	}
+
+	if namespace == "" {
+		log.Printf("Blocking deletecollection of namespaces in the scope of protection policy '%s' for user: %s", p.name, user)
+		return decision.Deny, fmt.Sprintf("User '%s' is not authorized to deletecollection namespaces: it may contain namespaces protected by policy '%s'", user, p.name), true
+	}
+	log.Printf("Blocking %s in namespace %s protected by policy '%s' for user: %s", attrs.Verb, namespace, p.name, user)
+	return decision.Deny, fmt.Sprintf("User '%s' is not authorized to %s %s: %s protected by policy '%s'", user, attrs.Verb, target, protected, p.name), true
+}
+
+// describeNamespaced names the object or collection a request targets in
+// its namespace, e.g. pods "web-0" in namespace "default"
+func describeNamespaced(attrs *authorizationv1.ResourceAttributes) string {
+	if attrs.Name == "" {
+		return describeCollection(attrs)
+	}
+	return fmt.Sprintf("%s in namespace %q", describeResource(attrs), attrs.Namespace)
+}
@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/imiller31/k8s-auth-webhook/config"
+	authorizationv1 "k8s.io/api/authorization/v1"
+)
+
+// principals is a set of users, groups and service account patterns
+type principals struct {
+	users           []string
+	groups          []string
+	serviceAccounts []serviceAccountPattern
+}
+
+// serviceAccountPattern matches service accounts by namespace and name globs
+type serviceAccountPattern struct {
+	namespace string
+	name      string
+}
+
+// newPrincipals builds a principal set. Invalid service account patterns,
+// which validation rejects, are skipped.
+func newPrincipals(users, groups, serviceAccounts []string) principals {
+	return principals{users: users, groups: groups, serviceAccounts: newServiceAccountPatterns(serviceAccounts)}
+}
+
+// newServiceAccountPatterns parses service account patterns, skipping
+// invalid ones, which validation rejects
+func newServiceAccountPatterns(serviceAccounts []string) []serviceAccountPattern {
+	var patterns []serviceAccountPattern
+	for _, sa := range serviceAccounts {
+		namespace, name, err := config.ParseServiceAccount(sa)
+		if err != nil {
+			log.Printf("Skipping invalid service account pattern: %v", err)
+			continue
+		}
+		patterns = append(patterns, serviceAccountPattern{namespace: namespace, name: name})
+	}
+	return patterns
+}
+
+// matches reports whether the pattern matches a service account
+func (sa serviceAccountPattern) matches(namespace, name string) bool {
+	return globMatch(sa.namespace, namespace) && globMatch(sa.name, name)
+}
+
+// match describes how the requester belongs to the set, as its qualifier
+// (e.g. allowed or privileged) user, service account or group member, and
+// reports whether it does
+func (ps *principals) match(spec authorizationv1.SubjectAccessReviewSpec, qualifier string) (string, bool) {
+	for _, user := range ps.users {
+		if spec.User == user {
+			return fmt.Sprintf("as %s user", withArticle(qualifier)), true
+		}
+	}
+
+	if namespace, name, ok := serviceAccountName(spec.User); ok {
+		for _, sa := range ps.serviceAccounts {
+			if sa.matches(namespace, name) {
+				return fmt.Sprintf("as %s service account", withArticle(qualifier)), true
+			}
+		}
+	}
+
+	for _, group := range spec.Groups {
+		for _, allowed := range ps.groups {
+			if group == allowed {
+				return fmt.Sprintf("as a member of %s group '%s'", qualifier, group), true
+			}
+		}
+	}
+	return "", false
+}
+
+// serviceAccountName splits a service account username into its namespace and name
+func serviceAccountName(user string) (string, string, bool) {
+	rest, ok := strings.CutPrefix(user, serviceAccountPrefix)
+	if !ok {
+		return "", "", false
+	}
+	return strings.Cut(rest, ":")
+}
+
+// globMatch reports whether value matches a path.Match pattern
+func globMatch(pattern, value string) bool {
+	ok, _ := path.Match(pattern, value)
+	return ok
+}
+
+// withArticle prefixes a word with a or an
+func withArticle(word string) string {
+	if word != "" && strings.ContainsRune("aeiou", rune(word[0])) {
+		return "an " + word
+	}
+	return "a " + word
+}
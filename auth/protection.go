@@ -0,0 +1,236 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/imiller31/k8s-auth-webhook/cluster"
+	"github.com/imiller31/k8s-auth-webhook/config"
+	"github.com/imiller31/k8s-auth-webhook/decision"
+	authorizationv1 "k8s.io/api/authorization/v1"
+)
+
+// serviceAccountPrefix starts the username of every service account
+const serviceAccountPrefix = "system:serviceaccount:"
+
+// protection is a protection policy ready for evaluation
+type protection struct {
+	name string
+	// check names the policy in decisions, alongside CEL rule names
+	check      string
+	prefixes   []string
+	globs      []string
+	regexes    []*regexp.Regexp
+	apiGroups  []string
+	resources  []string
+	namespaces []string
+	verbs      []string
+	// allowed are the principals the policy allows
+	allowed principals
+	// privileged are the principals every policy allows
+	privileged *principals
+	// protectsDelete is set when deletecollection in the policy's scope is decided by deleteCollection
+	protectsDelete bool
+	// deleteCollection is the policy's deleteCollection mode
+	deleteCollection string
+	// namespaceSelector is set for namespace policies, which protect the
+	// namespaces it selects instead of named resources
+	namespaceSelector *namespaceSelector
+}
+
+// protectionCheck returns the check name a protection policy decides under
+func protectionCheck(name string) string {
+	return "builtin:protection:" + name
+}
+
+// newProtections compiles the effective protection policies of a
+// configuration. Invalid patterns, which validation rejects, are skipped.
+func newProtections(cfg *config.Config) []protection {
+	privileged := newPrincipals(cfg.PrivilegedUsers, cfg.PrivilegedGroups, cfg.PrivilegedServiceAccounts)
+
+	var protections []protection
+	for _, policy := range cfg.EffectiveProtectionPolicies() {
+		p := protection{
+			name:       policy.Name,
+			check:      protectionCheck(policy.Name),
+			prefixes:   policy.Names.Prefixes,
+			globs:      policy.Names.Globs,
+			apiGroups:  policy.APIGroups,
+			resources:  policy.Resources,
+			namespaces: policy.Namespaces,
+			verbs:      policy.ProtectedVerbs(),
+			allowed:    newPrincipals(policy.AllowedUsers, policy.AllowedGroups, policy.AllowedServiceAccounts),
+			privileged: &privileged,
+
+			protectsDelete:   policy.ProtectsDelete(),
+			deleteCollection: policy.DeleteCollection,
+		}
+		if p.deleteCollection == "" {
+			p.deleteCollection = config.DeleteCollectionDeny
+		}
+		if policy.ProtectedNamespaces != nil {
+			// Namespace policies decide deletecollection like any other verb
+			p.namespaceSelector = newNamespaceSelector(policy.Name, policy.ProtectedNamespaces)
+			p.protectsDelete = false
+		}
+		for _, expr := range policy.Names.Regexes {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				log.Printf("Skipping invalid regex %q of protection policy '%s': %v", expr, policy.Name, err)
+				continue
+			}
+			p.regexes = append(p.regexes, re)
+		}
+		protections = append(protections, p)
+	}
+	return protections
+}
+
+// applies reports whether a request uses a protected verb on a resource the
+// policy protects. deletecollection requests, which name no resource, are
+// matched by appliesToCollection instead.
+func (p *protection) applies(attrs *authorizationv1.ResourceAttributes) bool {
+	return attrs != nil &&
+		!(p.protectsDelete && attrs.Verb == "deletecollection") &&
+		matchesAny(p.verbs, attrs.Verb) &&
+		matchesAny(p.apiGroups, attrs.Group) &&
+		matchesAny(p.resources, attrs.Resource) &&
+		matchesAny(p.namespaces, attrs.Namespace) &&
+		p.matchesName(attrs.Name)
+}
+
+// appliesToCollection reports whether a request is a deletecollection of a
+// resource in the scope of a policy that protects delete. A deletecollection
+// across all namespaces is in the scope of every namespaced policy.
+func (p *protection) appliesToCollection(attrs *authorizationv1.ResourceAttributes) bool {
+	return attrs != nil &&
+		p.protectsDelete &&
+		attrs.Verb == "deletecollection" &&
+		matchesAny(p.apiGroups, attrs.Group) &&
+		matchesAny(p.resources, attrs.Resource) &&
+		(attrs.Namespace == "" || matchesAny(p.namespaces, attrs.Namespace))
+}
+
+// matchesName reports whether a resource name matches any of the policy's patterns
+func (p *protection) matchesName(name string) bool {
+	for _, prefix := range p.prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	for _, glob := range p.globs {
+		if ok, _ := path.Match(glob, name); ok {
+			return true
+		}
+	}
+	for _, re := range p.regexes {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// allows describes how the requesting principal is allowed by the policy,
+// e.g. "as a privileged user" or "as an allowed service account", and
+// reports whether it is. Privileged principals are allowed by every policy.
+func (p *protection) allows(spec authorizationv1.SubjectAccessReviewSpec) (string, bool) {
+	if how, ok := p.privileged.match(spec, "privileged"); ok {
+		return how, true
+	}
+	return p.allowed.match(spec, "allowed")
+}
+
+// decide allows a request the policy applies to when it comes from an
+// allowed principal and denies it otherwise
+func (p *protection) decide(sar *authorizationv1.SubjectAccessReview) (decision.Decision, string) {
+	attrs := sar.Spec.ResourceAttributes
+	user := sar.Spec.User
+
+	if how, ok := p.allows(sar.Spec); ok {
+		log.Printf("Allowing %s of resource %s for user %s %s by protection policy '%s'", attrs.Verb, attrs.Name, user, how, p.name)
+		return decision.Allow, fmt.Sprintf("User '%s' is authorized to %s resources protected by policy '%s' %s", user, attrs.Verb, p.name, how)
+	}
+
+	log.Printf("Blocking %s of resource %s protected by policy '%s' for user: %s", attrs.Verb, attrs.Name, p.name, user)
+	return decision.Deny, fmt.Sprintf("User '%s' is not authorized to %s %s: it is protected by policy '%s'", user, attrs.Verb, describeResource(attrs), p.name)
+}
+
+// decideCollection decides a deletecollection the policy applies to. Allowed
+// principals are allowed. Otherwise, in deny mode the request is denied and
+// in lookup mode it is denied when the collection contains an object the
+// policy protects or when that cannot be determined. It reports false when
+// the collection contains no protected objects.
+func (p *protection) decideCollection(sar *authorizationv1.SubjectAccessReview, lister cluster.ObjectLister) (decision.Decision, string, bool) {
+	attrs := sar.Spec.ResourceAttributes
+	user := sar.Spec.User
+	collection := describeCollection(attrs)
+
+	if how, ok := p.allows(sar.Spec); ok {
+		log.Printf("Allowing deletecollection of %s for user %s %s by protection policy '%s'", collection, user, how, p.name)
+		return decision.Allow, fmt.Sprintf("User '%s' is authorized to deletecollection resources protected by policy '%s' %s", user, p.name, how), true
+	}
+
+	if p.deleteCollection != config.DeleteCollectionLookup {
+		log.Printf("Blocking deletecollection of %s in the scope of protection policy '%s' for user: %s", collection, p.name, user)
+		return decision.Deny, fmt.Sprintf("User '%s' is not authorized to deletecollection %s: it may contain resources protected by policy '%s'", user, collection, p.name), true
+	}
+
+	// Fail closed: a collection that cannot be listed may contain protected objects
+	if lister == nil {
+		log.Printf("Blocking deletecollection of %s for user %s: protection policy '%s' needs a cluster lookup, which is unavailable", collection, user, p.name)
+		return decision.Deny, fmt.Sprintf("User '%s' is not authorized to deletecollection %s: cannot check for resources protected by policy '%s': cluster lookup is unavailable", user, collection, p.name), true
+	}
+	objects, err := lister.List(context.Background(), cluster.Resource{
+		Group:     attrs.Group,
+		Version:   attrs.Version,
+		Resource:  attrs.Resource,
+		Namespace: attrs.Namespace,
+	})
+	if err != nil {
+		log.Printf("Blocking deletecollection of %s for user %s: protection policy '%s' lookup failed: %v", collection, user, p.name, err)
+		return decision.Deny, fmt.Sprintf("User '%s' is not authorized to deletecollection %s: cannot check for resources protected by policy '%s': %v", user, collection, p.name, err), true
+	}
+
+	for _, obj := range objects {
+		if matchesAny(p.namespaces, obj.Namespace) && p.matchesName(obj.Name) {
+			log.Printf("Blocking deletecollection of %s containing %s/%s protected by policy '%s' for user: %s", collection, obj.Namespace, obj.Name, p.name, user)
+			return decision.Deny, fmt.Sprintf("User '%s' is not authorized to deletecollection %s: it contains %q, which is protected by policy '%s'", user, collection, obj.Name, p.name), true
+		}
+	}
+	return decision.NoOpinion, "", false
+}
+
+// describeResource names the resource a request targets, e.g. pods "web-0"
+func describeResource(attrs *authorizationv1.ResourceAttributes) string {
+	if attrs.Resource == "" {
+		return fmt.Sprintf("%q", attrs.Name)
+	}
+	return fmt.Sprintf("%s %q", attrs.Resource, attrs.Name)
+}
+
+// describeCollection names the collection a request targets, e.g. pods in namespace "default"
+func describeCollection(attrs *authorizationv1.ResourceAttributes) string {
+	if attrs.Namespace == "" {
+		return attrs.Resource + " in all namespaces"
+	}
+	return fmt.Sprintf("%s in namespace %q", attrs.Resource, attrs.Namespace)
+}
+
+// matchesAny reports whether value is in values, treating an empty list or
+// "*" as a wildcard
+func matchesAny(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == "*" || v == value {
+			return true
+		}
+	}
+	return false
+}
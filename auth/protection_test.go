@@ -0,0 +1,652 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/imiller31/k8s-auth-webhook/breakglass"
+	"github.com/imiller31/k8s-auth-webhook/cel"
+	"github.com/imiller31/k8s-auth-webhook/cluster"
+	"github.com/imiller31/k8s-auth-webhook/config"
+	"github.com/imiller31/k8s-auth-webhook/decision"
+	authorizationv1 "k8s.io/api/authorization/v1"
+)
+
+func TestProtectionPolicies(t *testing.T) {
+	cfg := &config.Config{
+		ProtectionPolicies: []config.ProtectionPolicy{
+			{
+				Name:         "node-pools",
+				Names:        config.NamePatterns{Globs: []string{"managed-*-pool"}},
+				APIGroups:    []string{"agentpool.example.com"},
+				Resources:    []string{"pools"},
+				Verbs:        []string{"delete", "update"},
+				AllowedUsers: []string{"pool-operator"},
+			},
+			{
+				Name:                   "networking",
+				Names:                  config.NamePatterns{Prefixes: []string{"aks-net-"}, Regexes: []string{`^coredns(-custom)?$`}},
+				Namespaces:             []string{"kube-system"},
+				AllowedGroups:          []string{"network-team"},
+				AllowedServiceAccounts: []string{"kube-system/net-controller"},
+			},
+		},
+	}
+	celEval, err := cel.NewEvaluator(nil)
+	if err != nil {
+		t.Fatalf("Failed to create CEL evaluator: %v", err)
+	}
+	authorizer := NewAuthorizer(cfg, celEval)
+
+	tests := []struct {
+		name       string
+		user       string
+		groups     []string
+		attrs      authorizationv1.ResourceAttributes
+		want       decision.Decision
+		wantRule   string
+		wantReason string
+	}{
+		{
+			name:       "glob match denied",
+			user:       "alice",
+			attrs:      authorizationv1.ResourceAttributes{Verb: "update", Group: "agentpool.example.com", Resource: "pools", Name: "managed-gpu-pool"},
+			want:       decision.Deny,
+			wantRule:   "builtin:protection:node-pools",
+			wantReason: `User 'alice' is not authorized to update pools "managed-gpu-pool": it is protected by policy 'node-pools'`,
+		},
+		{
+			name:       "allowed user",
+			user:       "pool-operator",
+			attrs:      authorizationv1.ResourceAttributes{Verb: "delete", Group: "agentpool.example.com", Resource: "pools", Name: "managed-gpu-pool"},
+			want:       decision.Allow,
+			wantRule:   "builtin:protection:node-pools",
+			wantReason: "as an allowed user",
+		},
+		{
+			name:     "unprotected verb",
+			user:     "alice",
+			attrs:    authorizationv1.ResourceAttributes{Verb: "patch", Group: "agentpool.example.com", Resource: "pools", Name: "managed-gpu-pool"},
+			want:     decision.NoOpinion,
+			wantRule: checkDefault,
+		},
+		{
+			name:     "outside resource scope",
+			user:     "alice",
+			attrs:    authorizationv1.ResourceAttributes{Verb: "delete", Resource: "pods", Name: "managed-gpu-pool"},
+			want:     decision.NoOpinion,
+			wantRule: checkDefault,
+		},
+		{
+			name:       "prefix match denied with default verbs",
+			user:       "alice",
+			attrs:      authorizationv1.ResourceAttributes{Verb: "delete", Namespace: "kube-system", Resource: "configmaps", Name: "aks-net-config"},
+			want:       decision.Deny,
+			wantRule:   "builtin:protection:networking",
+			wantReason: "protected by policy 'networking'",
+		},
+		{
+			name:     "regex is anchored",
+			user:     "alice",
+			attrs:    authorizationv1.ResourceAttributes{Verb: "delete", Namespace: "kube-system", Resource: "deployments", Name: "coredns-autoscaler"},
+			want:     decision.NoOpinion,
+			wantRule: checkDefault,
+		},
+		{
+			name:       "regex match denied",
+			user:       "alice",
+			attrs:      authorizationv1.ResourceAttributes{Verb: "delete", Namespace: "kube-system", Resource: "deployments", Name: "coredns-custom"},
+			want:       decision.Deny,
+			wantRule:   "builtin:protection:networking",
+			wantReason: "protected by policy 'networking'",
+		},
+		{
+			name:       "allowed group",
+			user:       "bob",
+			groups:     []string{"dev", "network-team"},
+			attrs:      authorizationv1.ResourceAttributes{Verb: "delete", Namespace: "kube-system", Resource: "configmaps", Name: "aks-net-config"},
+			want:       decision.Allow,
+			wantRule:   "builtin:protection:networking",
+			wantReason: "as a member of allowed group 'network-team'",
+		},
+		{
+			name:       "allowed service account",
+			user:       "system:serviceaccount:kube-system:net-controller",
+			attrs:      authorizationv1.ResourceAttributes{Verb: "delete", Namespace: "kube-system", Resource: "configmaps", Name: "aks-net-config"},
+			want:       decision.Allow,
+			wantRule:   "builtin:protection:networking",
+			wantReason: "as an allowed service account",
+		},
+		{
+			name:     "other service account in the namespace",
+			user:     "system:serviceaccount:kube-system:default",
+			attrs:    authorizationv1.ResourceAttributes{Verb: "delete", Namespace: "kube-system", Resource: "configmaps", Name: "aks-net-config"},
+			want:     decision.Deny,
+			wantRule: "builtin:protection:networking",
+		},
+		{
+			name:     "outside namespace scope",
+			user:     "alice",
+			attrs:    authorizationv1.ResourceAttributes{Verb: "delete", Namespace: "default", Resource: "configmaps", Name: "aks-net-config"},
+			want:     decision.NoOpinion,
+			wantRule: checkDefault,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attrs := tt.attrs
+			result := authorizer.Authorize(&authorizationv1.SubjectAccessReview{
+				Spec: authorizationv1.SubjectAccessReviewSpec{
+					User:               tt.user,
+					Groups:             tt.groups,
+					ResourceAttributes: &attrs,
+				},
+			})
+			if result.Decision != tt.want || result.Rule != tt.wantRule {
+				t.Errorf("Authorize() = %v by %s, want %v by %s", result.Decision, result.Rule, tt.want, tt.wantRule)
+			}
+			if !strings.Contains(result.Reason, tt.wantReason) {
+				t.Errorf("Authorize() reason = %q, want it to contain %q", result.Reason, tt.wantReason)
+			}
+		})
+	}
+
+	want := []string{checkImpersonation, "builtin:protection:node-pools", "builtin:protection:networking", checkDefault}
+	if got := authorizer.Checks(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Checks() = %v, want %v", got, want)
+	}
+}
+
+// fakeLister serves objects from memory and records the resources listed
+type fakeLister struct {
+	objects map[cluster.Resource][]cluster.Object
+	err     error
+	listed  []cluster.Resource
+}
+
+func (f *fakeLister) List(ctx context.Context, resource cluster.Resource) ([]cluster.Object, error) {
+	f.listed = append(f.listed, resource)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.objects[resource], nil
+}
+
+func TestDeleteCollection(t *testing.T) {
+	cfg := &config.Config{
+		ProtectionPolicies: []config.ProtectionPolicy{
+			{
+				Name:                   "aks-automatic",
+				Names:                  config.NamePatterns{Prefixes: []string{"aks-automatic-"}},
+				Resources:              []string{"pods"},
+				AllowedServiceAccounts: []string{"kube-system/namespace-controller"},
+			},
+			{
+				Name:             "networking",
+				Names:            config.NamePatterns{Prefixes: []string{"aks-net-"}},
+				Resources:        []string{"configmaps"},
+				Namespaces:       []string{"kube-system"},
+				DeleteCollection: config.DeleteCollectionLookup,
+			},
+			{
+				Name:      "updates-only",
+				Names:     config.NamePatterns{Prefixes: []string{"aks-"}},
+				Resources: []string{"secrets"},
+				Verbs:     []string{"update"},
+			},
+		},
+	}
+	celEval, err := cel.NewEvaluator(nil)
+	if err != nil {
+		t.Fatalf("Failed to create CEL evaluator: %v", err)
+	}
+
+	configmaps := func(namespace string) cluster.Resource {
+		return cluster.Resource{Version: "v1", Resource: "configmaps", Namespace: namespace}
+	}
+	lister := &fakeLister{objects: map[cluster.Resource][]cluster.Object{
+		configmaps("kube-system"): {{Namespace: "kube-system", Name: "coredns"}, {Namespace: "kube-system", Name: "aks-net-config"}},
+		configmaps("default"):     {{Namespace: "default", Name: "app-config"}},
+		configmaps(""): {
+			{Namespace: "default", Name: "aks-net-lookalike"},
+			{Namespace: "kube-system", Name: "aks-net-config"},
+		},
+	}}
+
+	tests := []struct {
+		name       string
+		user       string
+		attrs      authorizationv1.ResourceAttributes
+		lister     cluster.ObjectLister
+		want       decision.Decision
+		wantRule   string
+		wantReason string
+	}{
+		{
+			name:       "deny mode denies kubectl delete pods --all",
+			user:       "alice",
+			attrs:      authorizationv1.ResourceAttributes{Verb: "deletecollection", Version: "v1", Resource: "pods", Namespace: "default"},
+			want:       decision.Deny,
+			wantRule:   "builtin:protection:aks-automatic",
+			wantReason: `User 'alice' is not authorized to deletecollection pods in namespace "default": it may contain resources protected by policy 'aks-automatic'`,
+		},
+		{
+			name:       "deny mode allows allowed principals",
+			user:       "system:serviceaccount:kube-system:namespace-controller",
+			attrs:      authorizationv1.ResourceAttributes{Verb: "deletecollection", Version: "v1", Resource: "pods", Namespace: "default"},
+			want:       decision.Allow,
+			wantRule:   "builtin:protection:aks-automatic",
+			wantReason: "as an allowed service account",
+		},
+		{
+			name:     "deny mode outside resource scope",
+			user:     "alice",
+			attrs:    authorizationv1.ResourceAttributes{Verb: "deletecollection", Version: "v1", Resource: "services", Namespace: "default"},
+			want:     decision.NoOpinion,
+			wantRule: checkDefault,
+		},
+		{
+			name:       "lookup finds protected object",
+			user:       "alice",
+			attrs:      authorizationv1.ResourceAttributes{Verb: "deletecollection", Version: "v1", Resource: "configmaps", Namespace: "kube-system"},
+			lister:     lister,
+			want:       decision.Deny,
+			wantRule:   "builtin:protection:networking",
+			wantReason: `deletecollection configmaps in namespace "kube-system": it contains "aks-net-config", which is protected by policy 'networking'`,
+		},
+		{
+			name:     "lookup outside namespace scope",
+			user:     "alice",
+			attrs:    authorizationv1.ResourceAttributes{Verb: "deletecollection", Version: "v1", Resource: "configmaps", Namespace: "default"},
+			lister:   lister,
+			want:     decision.NoOpinion,
+			wantRule: checkDefault,
+		},
+		{
+			name:       "lookup across all namespaces only matches scoped namespaces",
+			user:       "alice",
+			attrs:      authorizationv1.ResourceAttributes{Verb: "deletecollection", Version: "v1", Resource: "configmaps"},
+			lister:     lister,
+			want:       decision.Deny,
+			wantRule:   "builtin:protection:networking",
+			wantReason: `deletecollection configmaps in all namespaces: it contains "aks-net-config"`,
+		},
+		{
+			name:       "lookup failure fails closed",
+			user:       "alice",
+			attrs:      authorizationv1.ResourceAttributes{Verb: "deletecollection", Version: "v1", Resource: "configmaps", Namespace: "kube-system"},
+			lister:     &fakeLister{err: errors.New("connection refused")},
+			want:       decision.Deny,
+			wantRule:   "builtin:protection:networking",
+			wantReason: "cannot check for resources protected by policy 'networking': connection refused",
+		},
+		{
+			name:       "lookup without lister fails closed",
+			user:       "alice",
+			attrs:      authorizationv1.ResourceAttributes{Verb: "deletecollection", Version: "v1", Resource: "configmaps", Namespace: "kube-system"},
+			want:       decision.Deny,
+			wantRule:   "builtin:protection:networking",
+			wantReason: "cluster lookup is unavailable",
+		},
+		{
+			name:     "policy not protecting delete",
+			user:     "alice",
+			attrs:    authorizationv1.ResourceAttributes{Verb: "deletecollection", Version: "v1", Resource: "secrets", Namespace: "default"},
+			want:     decision.NoOpinion,
+			wantRule: checkDefault,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authorizer := NewAuthorizer(cfg, celEval)
+			if tt.lister != nil {
+				authorizer.SetObjectLister(tt.lister)
+			}
+			attrs := tt.attrs
+			result := authorizer.Authorize(&authorizationv1.SubjectAccessReview{
+				Spec: authorizationv1.SubjectAccessReviewSpec{User: tt.user, ResourceAttributes: &attrs},
+			})
+			if result.Decision != tt.want || result.Rule != tt.wantRule {
+				t.Errorf("Authorize() = %v by %s (%s), want %v by %s", result.Decision, result.Rule, result.Reason, tt.want, tt.wantRule)
+			}
+			if !strings.Contains(result.Reason, tt.wantReason) {
+				t.Errorf("Authorize() reason = %q, want it to contain %q", result.Reason, tt.wantReason)
+			}
+		})
+	}
+
+	t.Run("legacy policy", func(t *testing.T) {
+		cfg := config.DefaultConfig()
+		authorizer := NewAuthorizer(cfg, celEval)
+		for user, want := range map[string]decision.Decision{
+			"alice":   decision.Deny,
+			"support": decision.Allow,
+			"system:serviceaccount:kube-system:namespace-controller": decision.Allow,
+		} {
+			d, reason := authorizer.ProcessRequest(&authorizationv1.SubjectAccessReview{
+				Spec: authorizationv1.SubjectAccessReviewSpec{
+					User:               user,
+					ResourceAttributes: &authorizationv1.ResourceAttributes{Verb: "deletecollection", Version: "v1", Resource: "pods", Namespace: "default"},
+				},
+			})
+			if d != want {
+				t.Errorf("deletecollection by %s = %v (%s), want %v", user, d, reason, want)
+			}
+		}
+	})
+}
+
+func TestPrivilegedPrincipals(t *testing.T) {
+	cfg := &config.Config{
+		PrivilegedUsers:           []string{"break-glass"},
+		PrivilegedGroups:          []string{"system:masters", "system:nodes"},
+		PrivilegedServiceAccounts: []string{"system:serviceaccount:kube-system:*", "flux-system/kustomize-*"},
+		ProtectionPolicies: []config.ProtectionPolicy{
+			{
+				Name:                   "aks-automatic",
+				Names:                  config.NamePatterns{Prefixes: []string{"aks-automatic-"}},
+				Verbs:                  []string{"delete", "update"},
+				AllowedServiceAccounts: []string{"ops/*"},
+			},
+			{
+				Name:      "node-pools",
+				Names:     config.NamePatterns{Globs: []string{"managed-*-pool"}},
+				Resources: []string{"pools"},
+			},
+		},
+	}
+	celEval, err := cel.NewEvaluator(nil)
+	if err != nil {
+		t.Fatalf("Failed to create CEL evaluator: %v", err)
+	}
+	authorizer := NewAuthorizer(cfg, celEval)
+
+	pod := authorizationv1.ResourceAttributes{Verb: "delete", Namespace: "default", Resource: "pods", Name: "aks-automatic-web"}
+	pool := authorizationv1.ResourceAttributes{Verb: "delete", Resource: "pools", Name: "managed-gpu-pool"}
+	podCollection := authorizationv1.ResourceAttributes{Verb: "deletecollection", Namespace: "default", Resource: "pods"}
+
+	tests := []struct {
+		name       string
+		user       string
+		groups     []string
+		attrs      authorizationv1.ResourceAttributes
+		want       decision.Decision
+		wantReason string
+	}{
+		{name: "privileged user", user: "break-glass", attrs: pod, want: decision.Allow, wantReason: "as a privileged user"},
+		{name: "privileged user on every policy", user: "break-glass", attrs: pool, want: decision.Allow, wantReason: "policy 'node-pools' as a privileged user"},
+		{name: "system:masters", user: "admin", groups: []string{"system:masters"}, attrs: pod, want: decision.Allow, wantReason: "as a member of privileged group 'system:masters'"},
+		{name: "system:nodes", user: "system:node:node-1", groups: []string{"system:nodes", "system:authenticated"}, attrs: pod, want: decision.Allow, wantReason: "as a member of privileged group 'system:nodes'"},
+		{name: "kube-system service account by username glob", user: "system:serviceaccount:kube-system:namespace-controller", attrs: podCollection, want: decision.Allow, wantReason: "as a privileged service account"},
+		{name: "service account by name glob", user: "system:serviceaccount:flux-system:kustomize-controller", attrs: pool, want: decision.Allow, wantReason: "as a privileged service account"},
+		{name: "service account outside privileged patterns", user: "system:serviceaccount:flux-system:helm-controller", attrs: pool, want: decision.Deny},
+		{name: "service account allowed by policy glob", user: "system:serviceaccount:ops:cleaner", attrs: pod, want: decision.Allow, wantReason: "as an allowed service account"},
+		{name: "policy glob does not extend to other policies", user: "system:serviceaccount:ops:cleaner", attrs: pool, want: decision.Deny},
+		{name: "user named like a service account namespace", user: "kube-system", attrs: pod, want: decision.Deny},
+		{name: "unprivileged group", user: "alice", groups: []string{"system:authenticated"}, attrs: podCollection, want: decision.Deny},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attrs := tt.attrs
+			result := authorizer.Authorize(&authorizationv1.SubjectAccessReview{
+				Spec: authorizationv1.SubjectAccessReviewSpec{User: tt.user, Groups: tt.groups, ResourceAttributes: &attrs},
+			})
+			if result.Decision != tt.want {
+				t.Errorf("Authorize() = %v (%s), want %v", result.Decision, result.Reason, tt.want)
+			}
+			if !strings.Contains(result.Reason, tt.wantReason) {
+				t.Errorf("Authorize() reason = %q, want it to contain %q", result.Reason, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestBreakGlass(t *testing.T) {
+	cfg := &config.Config{
+		ProtectionPolicies: []config.ProtectionPolicy{
+			{Name: "aks-automatic", Names: config.NamePatterns{Prefixes: []string{"aks-automatic-"}}},
+		},
+		CELRules:      []config.CELRule{{Name: "no-secrets", Expression: "resourceAttributes.resource == 'secrets'", Effect: "deny"}},
+		DecisionCache: config.DecisionCacheConfig{Size: 10, AllowTTL: time.Hour, DenyTTL: time.Hour},
+	}
+	celEval, err := cel.NewEvaluator(cfg.CELRules)
+	if err != nil {
+		t.Fatalf("Failed to create CEL evaluator: %v", err)
+	}
+	authorizer := NewAuthorizer(cfg, celEval)
+	grants := breakglass.NewStore(config.BreakGlassConfig{MaxDuration: time.Hour})
+	authorizer.SetBreakGlass(grants)
+
+	request := func(user, resource, verb string) *authorizationv1.SubjectAccessReview {
+		return &authorizationv1.SubjectAccessReview{
+			Spec: authorizationv1.SubjectAccessReviewSpec{
+				User:               user,
+				ResourceAttributes: &authorizationv1.ResourceAttributes{Verb: verb, Namespace: "default", Resource: resource, Name: "aks-automatic-web"},
+			},
+		}
+	}
+
+	if result := authorizer.Authorize(request("alice", "pods", "delete")); result.Decision != decision.Deny {
+		t.Fatalf("Authorize() before the grant = %v, want Deny", result.Decision)
+	}
+
+	grant, err := grants.Create(breakglass.Grant{User: "alice", Resources: []string{"pods"}, Reason: "INC-42", CreatedBy: "lead", ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("Create() unexpected error: %v", err)
+	}
+
+	result := authorizer.Authorize(request("alice", "pods", "delete"))
+	if result.Decision != decision.Allow || result.Rule != "builtin:protection:aks-automatic" || result.Cached {
+		t.Fatalf("Authorize() with the grant = %v by %s (cached=%v), want an uncached Allow by the protection check", result.Decision, result.Rule, result.Cached)
+	}
+	if result.BreakGlass == nil || result.BreakGlass.ID != grant.ID {
+		t.Errorf("Authorize() BreakGlass = %+v, want grant %s", result.BreakGlass, grant.ID)
+	}
+	if !strings.Contains(result.Reason, "by break-glass grant "+grant.ID) || !strings.Contains(result.Reason, "INC-42") {
+		t.Errorf("Authorize() reason = %q, want the grant and its reason", result.Reason)
+	}
+
+	if result := authorizer.Authorize(request("alice", "deployments", "delete")); result.Decision != decision.Deny {
+		t.Errorf("Authorize() outside the grant's scope = %v, want Deny", result.Decision)
+	}
+	if result := authorizer.Authorize(request("bob", "pods", "delete")); result.Decision != decision.Deny {
+		t.Errorf("Authorize() for another user = %v, want Deny", result.Decision)
+	}
+	if result := authorizer.Authorize(request("alice", "secrets", "delete")); result.Decision != decision.Deny || result.Rule != "no-secrets" {
+		t.Errorf("Authorize() denied by a CEL rule = %v by %s, want the CEL denial to stand", result.Decision, result.Rule)
+	}
+
+	_, steps := authorizer.Explain(request("alice", "pods", "delete"))
+	if last := steps[len(steps)-1]; last.Rule != "builtin:protection:aks-automatic" || !strings.Contains(last.Detail, grant.ID) {
+		t.Errorf("Explain() last step = %+v, want the protection check allowed by the grant", last)
+	}
+
+	grants.Revoke(grant.ID)
+	if result := authorizer.Authorize(request("alice", "pods", "delete")); result.Decision != decision.Deny || result.Cached {
+		t.Errorf("Authorize() after revoking the grant = %v (cached=%v), want an uncached Deny", result.Decision, result.Cached)
+	}
+}
+
+// fakeNamespaces serves namespace labels from a map and fails while err is set
+type fakeNamespaces struct {
+	labels map[string]map[string]string
+	err    error
+}
+
+func (f *fakeNamespaces) GetNamespace(ctx context.Context, name string) (cluster.Namespace, error) {
+	if f.err != nil {
+		return cluster.Namespace{}, f.err
+	}
+	return cluster.Namespace{Name: name, Labels: f.labels[name]}, nil
+}
+
+func TestNamespaceProtection(t *testing.T) {
+	cfg := &config.Config{
+		ProtectionPolicies: []config.ProtectionPolicy{
+			{
+				Name:                   "infra-namespaces",
+				ProtectedNamespaces:    &config.NamespaceSelector{Names: []string{"kube-system"}, Globs: []string{"infra-*"}},
+				AllowedServiceAccounts: []string{"kube-system/*"},
+			},
+			{
+				Name:                "labelled-namespaces",
+				ProtectedNamespaces: &config.NamespaceSelector{LabelSelector: "protected=true"},
+				Resources:           []string{"configmaps", "namespaces"},
+				Verbs:               []string{"delete", "deletecollection", "patch"},
+				AllowedGroups:       []string{"platform"},
+			},
+		},
+	}
+	celEval, err := cel.NewEvaluator(nil)
+	if err != nil {
+		t.Fatalf("Failed to create CEL evaluator: %v", err)
+	}
+	namespaces := &fakeNamespaces{labels: map[string]map[string]string{
+		"payments": {"protected": "true"},
+		"scratch":  {"protected": "false"},
+	}}
+
+	tests := []struct {
+		name       string
+		user       string
+		groups     []string
+		attrs      authorizationv1.ResourceAttributes
+		namespaces cluster.NamespaceGetter
+		want       decision.Decision
+		wantRule   string
+		wantReason string
+	}{
+		{
+			name:       "namespace deletion denied",
+			user:       "alice",
+			attrs:      authorizationv1.ResourceAttributes{Verb: "delete", Version: "v1", Resource: "namespaces", Name: "kube-system", Namespace: "kube-system"},
+			want:       decision.Deny,
+			wantRule:   "builtin:protection:infra-namespaces",
+			wantReason: `User 'alice' is not authorized to delete namespace "kube-system": it is protected by policy 'infra-namespaces'`,
+		},
+		{
+			name:       "write inside glob-matched namespace denied",
+			user:       "alice",
+			attrs:      authorizationv1.ResourceAttributes{Verb: "create", Group: "apps", Version: "v1", Resource: "deployments", Namespace: "infra-logging"},
+			want:       decision.Deny,
+			wantRule:   "builtin:protection:infra-namespaces",
+			wantReason: `User 'alice' is not authorized to create deployments in namespace "infra-logging": the namespace is protected by policy 'infra-namespaces'`,
+		},
+		{
+			name:     "read inside protected namespace not covered",
+			user:     "alice",
+			attrs:    authorizationv1.ResourceAttributes{Verb: "get", Version: "v1", Resource: "pods", Name: "coredns", Namespace: "kube-system"},
+			want:     decision.NoOpinion,
+			wantRule: checkDefault,
+		},
+		{
+			name:       "allowed service account may write",
+			user:       "system:serviceaccount:kube-system:replicaset-controller",
+			attrs:      authorizationv1.ResourceAttributes{Verb: "create", Version: "v1", Resource: "pods", Namespace: "kube-system"},
+			want:       decision.Allow,
+			wantRule:   "builtin:protection:infra-namespaces",
+			wantReason: "as an allowed service account",
+		},
+		{
+			name:     "creating a namespace not covered",
+			user:     "alice",
+			attrs:    authorizationv1.ResourceAttributes{Verb: "create", Version: "v1", Resource: "namespaces"},
+			want:     decision.NoOpinion,
+			wantRule: checkDefault,
+		},
+		{
+			name:       "deleting every namespace denied",
+			user:       "alice",
+			attrs:      authorizationv1.ResourceAttributes{Verb: "deletecollection", Version: "v1", Resource: "namespaces"},
+			want:       decision.Deny,
+			wantRule:   "builtin:protection:infra-namespaces",
+			wantReason: "it may contain namespaces protected by policy 'infra-namespaces'",
+		},
+		{
+			name:       "labelled namespace protected",
+			user:       "alice",
+			attrs:      authorizationv1.ResourceAttributes{Verb: "patch", Version: "v1", Resource: "configmaps", Name: "settings", Namespace: "payments"},
+			namespaces: namespaces,
+			want:       decision.Deny,
+			wantRule:   "builtin:protection:labelled-namespaces",
+			wantReason: `patch configmaps "settings" in namespace "payments": the namespace is protected by policy 'labelled-namespaces'`,
+		},
+		{
+			name:       "labelled namespace outside resource scope",
+			user:       "alice",
+			attrs:      authorizationv1.ResourceAttributes{Verb: "delete", Version: "v1", Resource: "pods", Name: "web", Namespace: "payments"},
+			namespaces: namespaces,
+			want:       decision.NoOpinion,
+			wantRule:   checkDefault,
+		},
+		{
+			name:       "namespace with other labels not protected",
+			user:       "alice",
+			attrs:      authorizationv1.ResourceAttributes{Verb: "delete", Version: "v1", Resource: "namespaces", Name: "scratch"},
+			namespaces: namespaces,
+			want:       decision.NoOpinion,
+			wantRule:   checkDefault,
+		},
+		{
+			name:       "allowed group may delete labelled namespace",
+			user:       "bob",
+			groups:     []string{"platform"},
+			attrs:      authorizationv1.ResourceAttributes{Verb: "delete", Version: "v1", Resource: "namespaces", Name: "payments"},
+			namespaces: namespaces,
+			want:       decision.Allow,
+			wantRule:   "builtin:protection:labelled-namespaces",
+			wantReason: "as a member of allowed group 'platform'",
+		},
+		{
+			name:       "lookup failure fails closed",
+			user:       "alice",
+			attrs:      authorizationv1.ResourceAttributes{Verb: "delete", Version: "v1", Resource: "configmaps", Name: "settings", Namespace: "payments"},
+			namespaces: &fakeNamespaces{err: errors.New("connection refused")},
+			want:       decision.Deny,
+			wantRule:   "builtin:protection:labelled-namespaces",
+			wantReason: `cannot check whether namespace "payments" is protected by policy 'labelled-namespaces': connection refused`,
+		},
+		{
+			name:       "lookup failure skips allowed principals",
+			user:       "bob",
+			groups:     []string{"platform"},
+			attrs:      authorizationv1.ResourceAttributes{Verb: "delete", Version: "v1", Resource: "configmaps", Name: "settings", Namespace: "payments"},
+			namespaces: &fakeNamespaces{err: errors.New("connection refused")},
+			want:       decision.NoOpinion,
+			wantRule:   checkDefault,
+		},
+		{
+			name:       "lookup without getter fails closed",
+			user:       "alice",
+			attrs:      authorizationv1.ResourceAttributes{Verb: "delete", Version: "v1", Resource: "configmaps", Name: "settings", Namespace: "payments"},
+			want:       decision.Deny,
+			wantRule:   "builtin:protection:labelled-namespaces",
+			wantReason: "cluster lookup is unavailable",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authorizer := NewAuthorizer(cfg, celEval)
+			if tt.namespaces != nil {
+				authorizer.SetNamespaceGetter(tt.namespaces)
+			}
+			attrs := tt.attrs
+			result := authorizer.Authorize(&authorizationv1.SubjectAccessReview{
+				Spec: authorizationv1.SubjectAccessReviewSpec{User: tt.user, Groups: tt.groups, ResourceAttributes: &attrs},
+			})
+			if result.Decision != tt.want || result.Rule != tt.wantRule {
+				t.Errorf("Authorize() = %v by %s (%s), want %v by %s", result.Decision, result.Rule, result.Reason, tt.want, tt.wantRule)
+			}
+			if !strings.Contains(result.Reason, tt.wantReason) {
+				t.Errorf("Authorize() reason = %q, want it to contain %q", result.Reason, tt.wantReason)
+			}
+		})
+	}
+}
@@ -0,0 +1,360 @@
+// Package breakglass keeps time-bound grants that let named users or groups
+// through protection policies during incidents. Grants are created through
+// the admin API or listed in a watched file, and are revoked automatically
+// when they expire.
+package breakglass
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/imiller31/k8s-auth-webhook/config"
+	"github.com/imiller31/k8s-auth-webhook/metrics"
+	"gopkg.in/yaml.v3"
+	authorizationv1 "k8s.io/api/authorization/v1"
+)
+
+// Grant sources
+const (
+	SourceAPI  = "api"
+	SourceFile = "file"
+)
+
+// Grant lets a user, or the members of a group, use the verbs of protection
+// policies on the resources it selects until it expires. Empty scope lists
+// match everything and "*" matches any value.
+type Grant struct {
+	ID string `json:"id" yaml:"id"`
+	// User or Group is who the grant is for; exactly one is set
+	User  string `json:"user,omitempty" yaml:"user"`
+	Group string `json:"group,omitempty" yaml:"group"`
+	// Policies limits the grant to protection policies by name
+	Policies   []string `json:"policies,omitempty" yaml:"policies"`
+	APIGroups  []string `json:"apiGroups,omitempty" yaml:"apiGroups"`
+	Resources  []string `json:"resources,omitempty" yaml:"resources"`
+	Namespaces []string `json:"namespaces,omitempty" yaml:"namespaces"`
+	// Names selects resources by exact name or path.Match glob
+	Names []string `json:"names,omitempty" yaml:"names"`
+	Verbs []string `json:"verbs,omitempty" yaml:"verbs"`
+	// Reason explains why the grant was needed, e.g. an incident reference
+	Reason string `json:"reason" yaml:"reason"`
+	// CreatedBy is the admin token that created the grant through the API,
+	// or the creator named in the grants file
+	CreatedBy string `json:"createdBy,omitempty" yaml:"createdBy"`
+	// RequestedBy is the creator the client named when creating the grant
+	// through the API. It is not verified.
+	RequestedBy string    `json:"requestedBy,omitempty" yaml:"-"`
+	CreatedAt   time.Time `json:"createdAt" yaml:"createdAt"`
+	ExpiresAt   time.Time `json:"expiresAt" yaml:"expiresAt"`
+	// Source is api or file
+	Source string `json:"source" yaml:"-"`
+}
+
+// validate rejects grants without a principal or reason, with invalid name
+// globs, or that are expired or last longer than maxDuration
+func (g *Grant) validate(now time.Time, maxDuration time.Duration) error {
+	if (g.User == "") == (g.Group == "") {
+		return fmt.Errorf("exactly one of user and group is required")
+	}
+	if g.Reason == "" {
+		return fmt.Errorf("a reason is required")
+	}
+	for _, name := range g.Names {
+		if _, err := path.Match(name, ""); err != nil {
+			return fmt.Errorf("invalid name glob %q: %v", name, err)
+		}
+	}
+	if !g.ExpiresAt.After(now) {
+		return fmt.Errorf("expiry %s is not in the future", g.ExpiresAt.Format(time.RFC3339))
+	}
+	if g.ExpiresAt.Sub(now) > maxDuration {
+		return fmt.Errorf("expiry %s is more than %s away", g.ExpiresAt.Format(time.RFC3339), maxDuration)
+	}
+	return nil
+}
+
+// principal describes who the grant is for
+func (g *Grant) principal() string {
+	if g.User != "" {
+		return "user " + g.User
+	}
+	return "group " + g.Group
+}
+
+// matches reports whether the grant covers a request checked by a protection policy
+func (g *Grant) matches(spec authorizationv1.SubjectAccessReviewSpec, policy string) bool {
+	attrs := spec.ResourceAttributes
+	if attrs == nil {
+		return false
+	}
+	if g.User != "" && spec.User != g.User {
+		return false
+	}
+	if g.Group != "" && !contains(spec.Groups, g.Group) {
+		return false
+	}
+	return matchesAny(g.Policies, policy) &&
+		matchesAny(g.Names, attrs.Name) &&
+		matchesAny(g.APIGroups, attrs.Group) &&
+		matchesAny(g.Resources, attrs.Resource) &&
+		matchesAny(g.Namespaces, attrs.Namespace) &&
+		matchesAny(g.Verbs, attrs.Verb)
+}
+
+// Store holds the grants in effect. It is safe for concurrent use.
+type Store struct {
+	grantsFile  string
+	maxDuration time.Duration
+	now         func() time.Time
+
+	mu sync.RWMutex
+	// api holds the grants created through the admin API by ID
+	api map[string]Grant
+	// file holds the grants loaded from the grants file
+	file     []Grant
+	fileHash [sha256.Size]byte
+}
+
+// NewStore creates an empty store for the grants described by cfg. Call
+// LoadFile to read the grants file.
+func NewStore(cfg config.BreakGlassConfig) *Store {
+	return &Store{
+		grantsFile:  cfg.GrantsFile,
+		maxDuration: cfg.MaxDuration,
+		now:         time.Now,
+		api:         make(map[string]Grant),
+	}
+}
+
+// Create validates a grant requested through the admin API and adds it
+// with a new ID
+func (s *Store) Create(g Grant) (Grant, error) {
+	now := s.now()
+	if err := g.validate(now, s.maxDuration); err != nil {
+		return Grant{}, err
+	}
+	id, err := newID()
+	if err != nil {
+		return Grant{}, err
+	}
+	g.ID, g.CreatedAt, g.Source = id, now, SourceAPI
+
+	s.mu.Lock()
+	s.api[g.ID] = g
+	s.mu.Unlock()
+
+	log.Printf("BREAK-GLASS: grant %s created for %s by %q (requested by %q) until %s: %s", g.ID, g.principal(), g.CreatedBy, g.RequestedBy, g.ExpiresAt.Format(time.RFC3339), g.Reason)
+	s.publishMetrics()
+	return g, nil
+}
+
+// Revoke removes a grant created through the admin API and reports whether it existed
+func (s *Store) Revoke(id string) (Grant, bool) {
+	s.mu.Lock()
+	g, ok := s.api[id]
+	delete(s.api, id)
+	s.mu.Unlock()
+
+	if ok {
+		log.Printf("BREAK-GLASS: grant %s for %s revoked", g.ID, g.principal())
+		s.publishMetrics()
+	}
+	return g, ok
+}
+
+// Grants returns the unexpired grants, soonest to expire first
+func (s *Store) Grants() []Grant {
+	now := s.now()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var grants []Grant
+	for _, g := range s.api {
+		if g.ExpiresAt.After(now) {
+			grants = append(grants, g)
+		}
+	}
+	for _, g := range s.file {
+		if g.ExpiresAt.After(now) {
+			grants = append(grants, g)
+		}
+	}
+	sort.Slice(grants, func(i, j int) bool {
+		if !grants[i].ExpiresAt.Equal(grants[j].ExpiresAt) {
+			return grants[i].ExpiresAt.Before(grants[j].ExpiresAt)
+		}
+		return grants[i].ID < grants[j].ID
+	})
+	return grants
+}
+
+// Match returns an unexpired grant covering a request that the named
+// protection policy would deny, preferring the grant that expires last
+func (s *Store) Match(spec authorizationv1.SubjectAccessReviewSpec, policy string) (Grant, bool) {
+	if s == nil {
+		return Grant{}, false
+	}
+
+	grants := s.Grants()
+	for i := len(grants) - 1; i >= 0; i-- {
+		if grants[i].matches(spec, policy) {
+			return grants[i], true
+		}
+	}
+	return Grant{}, false
+}
+
+// Expire revokes the grants that have expired
+func (s *Store) Expire() {
+	now := s.now()
+	s.mu.Lock()
+	var expired []Grant
+	for id, g := range s.api {
+		if !g.ExpiresAt.After(now) {
+			expired = append(expired, g)
+			delete(s.api, id)
+		}
+	}
+	kept := s.file[:0]
+	for _, g := range s.file {
+		if g.ExpiresAt.After(now) {
+			kept = append(kept, g)
+		} else {
+			expired = append(expired, g)
+		}
+	}
+	s.file = kept
+	s.mu.Unlock()
+
+	for _, g := range expired {
+		log.Printf("BREAK-GLASS: grant %s for %s expired at %s and was revoked", g.ID, g.principal(), g.ExpiresAt.Format(time.RFC3339))
+	}
+	if len(expired) > 0 {
+		s.publishMetrics()
+	}
+}
+
+// grantsFile is the format of the grants file
+type grantsFile struct {
+	Grants []Grant `yaml:"grants"`
+}
+
+// LoadFile replaces the file grants with the contents of the grants file if
+// it changed since it was last loaded. Grants without an ID are numbered.
+// Invalid or expired grants are skipped and logged. A missing file holds no
+// grants; a file that cannot be read or parsed keeps the previous grants.
+func (s *Store) LoadFile() error {
+	if s.grantsFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.grantsFile)
+	if os.IsNotExist(err) {
+		data, err = nil, nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read break-glass grants file: %v", err)
+	}
+	hash := sha256.Sum256(data)
+	s.mu.RLock()
+	unchanged := hash == s.fileHash
+	s.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	var file grantsFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("invalid break-glass grants file %s: %v", s.grantsFile, err)
+	}
+
+	now := s.now()
+	var grants []Grant
+	for i, g := range file.Grants {
+		if g.ID == "" {
+			g.ID = fmt.Sprintf("file-%d", i)
+		}
+		g.Source = SourceFile
+		if err := g.validate(now, s.maxDuration); err != nil {
+			log.Printf("BREAK-GLASS: skipping grant %s in %s: %v", g.ID, s.grantsFile, err)
+			continue
+		}
+		grants = append(grants, g)
+	}
+
+	s.mu.Lock()
+	s.file = grants
+	s.fileHash = hash
+	s.mu.Unlock()
+
+	for _, g := range grants {
+		log.Printf("BREAK-GLASS: grant %s for %s loaded from %s, valid until %s: %s", g.ID, g.principal(), s.grantsFile, g.ExpiresAt.Format(time.RFC3339), g.Reason)
+	}
+	s.publishMetrics()
+	return nil
+}
+
+// Watch revokes expired grants and reloads the grants file when it changes,
+// every interval until stop is closed
+func (s *Store) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.Expire()
+			if err := s.LoadFile(); err != nil {
+				log.Printf("ERROR: %v; keeping the previous file grants", err)
+			}
+		}
+	}
+}
+
+// publishMetrics exports the number of unexpired grants
+func (s *Store) publishMetrics() {
+	metrics.BreakGlassGrants.Set(float64(len(s.Grants())))
+}
+
+// newID returns a random grant ID
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate grant ID: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// matchesAny reports whether value matches any of patterns, treating an
+// empty list or "*" as a wildcard. Patterns are path.Match globs.
+func matchesAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, value); ok || p == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// contains reports whether values holds value
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
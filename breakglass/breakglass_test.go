@@ -0,0 +1,191 @@
+package breakglass
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/imiller31/k8s-auth-webhook/config"
+	authorizationv1 "k8s.io/api/authorization/v1"
+)
+
+// newTestStore returns a store whose clock is controlled by the returned pointer
+func newTestStore(grantsFile string) (*Store, *time.Time) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	s := NewStore(config.BreakGlassConfig{GrantsFile: grantsFile, MaxDuration: 4 * time.Hour})
+	s.now = func() time.Time { return now }
+	return s, &now
+}
+
+func deleteRequest(user string, groups []string, attrs authorizationv1.ResourceAttributes) authorizationv1.SubjectAccessReviewSpec {
+	return authorizationv1.SubjectAccessReviewSpec{User: user, Groups: groups, ResourceAttributes: &attrs}
+}
+
+func TestCreate(t *testing.T) {
+	s, now := newTestStore("")
+
+	tests := []struct {
+		name    string
+		grant   Grant
+		wantErr string
+	}{
+		{name: "valid", grant: Grant{User: "alice", Reason: "INC-1", ExpiresAt: now.Add(time.Hour)}},
+		{name: "no principal", grant: Grant{Reason: "INC-1", ExpiresAt: now.Add(time.Hour)}, wantErr: "exactly one of user and group"},
+		{name: "user and group", grant: Grant{User: "alice", Group: "oncall", Reason: "INC-1", ExpiresAt: now.Add(time.Hour)}, wantErr: "exactly one of user and group"},
+		{name: "no reason", grant: Grant{User: "alice", ExpiresAt: now.Add(time.Hour)}, wantErr: "reason is required"},
+		{name: "expired", grant: Grant{User: "alice", Reason: "INC-1", ExpiresAt: now.Add(-time.Minute)}, wantErr: "not in the future"},
+		{name: "too long", grant: Grant{User: "alice", Reason: "INC-1", ExpiresAt: now.Add(5 * time.Hour)}, wantErr: "more than 4h0m0s away"},
+		{name: "invalid name glob", grant: Grant{User: "alice", Names: []string{"["}, Reason: "INC-1", ExpiresAt: now.Add(time.Hour)}, wantErr: "invalid name glob"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			grant, err := s.Create(tt.grant)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Create() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Create() unexpected error: %v", err)
+			}
+			if grant.ID == "" || grant.Source != SourceAPI || !grant.CreatedAt.Equal(*now) {
+				t.Errorf("Create() = %+v, want an ID, source api and the creation time", grant)
+			}
+		})
+	}
+}
+
+func TestMatch(t *testing.T) {
+	s, now := newTestStore("")
+	user, _ := s.Create(Grant{
+		User:       "alice",
+		Policies:   []string{"aks-automatic"},
+		Resources:  []string{"pods"},
+		Namespaces: []string{"default"},
+		Names:      []string{"aks-automatic-*"},
+		Verbs:      []string{"delete"},
+		Reason:     "INC-1",
+		ExpiresAt:  now.Add(time.Hour),
+	})
+	group, _ := s.Create(Grant{Group: "oncall", Reason: "INC-2", ExpiresAt: now.Add(2 * time.Hour)})
+
+	pod := authorizationv1.ResourceAttributes{Verb: "delete", Resource: "pods", Namespace: "default", Name: "aks-automatic-web"}
+	tests := []struct {
+		name   string
+		spec   authorizationv1.SubjectAccessReviewSpec
+		policy string
+		want   string
+	}{
+		{name: "user grant", spec: deleteRequest("alice", nil, pod), policy: "aks-automatic", want: user.ID},
+		{name: "other policy", spec: deleteRequest("alice", nil, pod), policy: "node-pools"},
+		{name: "other verb", spec: deleteRequest("alice", nil, authorizationv1.ResourceAttributes{Verb: "update", Resource: "pods", Namespace: "default", Name: "aks-automatic-web"}), policy: "aks-automatic"},
+		{name: "other name", spec: deleteRequest("alice", nil, authorizationv1.ResourceAttributes{Verb: "delete", Resource: "pods", Namespace: "default", Name: "web"}), policy: "aks-automatic"},
+		{name: "other user", spec: deleteRequest("bob", nil, pod), policy: "aks-automatic"},
+		{name: "group grant with empty scope", spec: deleteRequest("bob", []string{"oncall"}, pod), policy: "node-pools", want: group.ID},
+		{name: "longest-lived grant preferred", spec: deleteRequest("alice", []string{"oncall"}, pod), policy: "aks-automatic", want: group.ID},
+		{name: "non-resource request", spec: authorizationv1.SubjectAccessReviewSpec{User: "alice"}, policy: "aks-automatic"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			grant, ok := s.Match(tt.spec, tt.policy)
+			if ok != (tt.want != "") || grant.ID != tt.want {
+				t.Errorf("Match() = %q, %v, want %q", grant.ID, ok, tt.want)
+			}
+		})
+	}
+
+	*now = now.Add(90 * time.Minute)
+	if grant, ok := s.Match(deleteRequest("alice", nil, pod), "aks-automatic"); ok {
+		t.Errorf("Match() = %q after alice's grant expired, want no grant", grant.ID)
+	}
+}
+
+func TestExpireAndRevoke(t *testing.T) {
+	s, now := newTestStore("")
+	short, _ := s.Create(Grant{User: "alice", Reason: "INC-1", ExpiresAt: now.Add(time.Minute)})
+	long, _ := s.Create(Grant{User: "bob", Reason: "INC-2", ExpiresAt: now.Add(time.Hour)})
+
+	if got := s.Grants(); len(got) != 2 || got[0].ID != short.ID {
+		t.Fatalf("Grants() = %+v, want both grants, soonest to expire first", got)
+	}
+
+	*now = now.Add(2 * time.Minute)
+	s.Expire()
+	if _, ok := s.Revoke(short.ID); ok {
+		t.Errorf("Revoke() found grant %s after it expired", short.ID)
+	}
+
+	if _, ok := s.Revoke(long.ID); !ok {
+		t.Errorf("Revoke() did not find grant %s", long.ID)
+	}
+	if got := s.Grants(); len(got) != 0 {
+		t.Errorf("Grants() = %+v after revoking every grant, want none", got)
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	grantsFile := filepath.Join(t.TempDir(), "grants.yaml")
+	s, now := newTestStore(grantsFile)
+
+	if err := s.LoadFile(); err != nil {
+		t.Fatalf("LoadFile() with a missing file: %v", err)
+	}
+
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(grantsFile, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`grants:
+  - id: inc-1234
+    user: alice
+    resources: ["pods"]
+    reason: "INC-1234: stuck pod"
+    createdBy: oncall-lead
+    expiresAt: 2024-06-01T13:00:00Z
+  - group: oncall
+    reason: "expired"
+    expiresAt: 2024-06-01T11:00:00Z
+  - user: bob
+    reason: "too long"
+    expiresAt: 2024-06-02T12:00:00Z
+  - group: sre
+    reason: "numbered"
+    expiresAt: 2024-06-01T12:30:00Z
+`)
+	if err := s.LoadFile(); err != nil {
+		t.Fatalf("LoadFile() unexpected error: %v", err)
+	}
+	grants := s.Grants()
+	if len(grants) != 2 || grants[0].ID != "file-3" || grants[1].ID != "inc-1234" || grants[1].Source != SourceFile {
+		t.Fatalf("Grants() = %+v, want file-3 and inc-1234 from the file", grants)
+	}
+	if _, ok := s.Revoke("inc-1234"); ok {
+		t.Errorf("Revoke() removed a file grant")
+	}
+
+	write("grants: [")
+	if err := s.LoadFile(); err == nil {
+		t.Errorf("LoadFile() with invalid YAML succeeded, want error")
+	}
+	if len(s.Grants()) != 2 {
+		t.Errorf("expected an invalid file to keep the previous grants, got %+v", s.Grants())
+	}
+
+	*now = now.Add(45 * time.Minute)
+	s.Expire()
+	if grants := s.Grants(); len(grants) != 1 || grants[0].ID != "inc-1234" {
+		t.Errorf("Grants() = %+v after file-3 expired, want inc-1234", grants)
+	}
+
+	os.Remove(grantsFile)
+	if err := s.LoadFile(); err != nil || len(s.Grants()) != 0 {
+		t.Errorf("LoadFile() after the file was removed = %v with grants %+v, want no grants", err, s.Grants())
+	}
+}
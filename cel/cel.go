@@ -3,36 +3,85 @@ package cel
 import (
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/google/cel-go/cel"
 	"github.com/google/cel-go/checker/decls"
+	"github.com/imiller31/k8s-auth-webhook/config"
+	"github.com/imiller31/k8s-auth-webhook/decision"
+	"github.com/imiller31/k8s-auth-webhook/metrics"
 	authorizationv1 "k8s.io/api/authorization/v1"
 )
 
 // Evaluator handles CEL rule compilation and evaluation
 type Evaluator struct {
-	env      *cel.Env
-	programs []cel.Program
+	env   *cel.Env
+	rules []compiledRule
+	// clock supplies the `now` variable
+	clock func() time.Time
+}
+
+// compiledRule is a CEL rule ready for evaluation
+type compiledRule struct {
+	name    string
+	effect  decision.Decision
+	match   config.RuleMatch
+	message string
+	// audit records denials by the rule instead of enforcing them
+	audit   bool
+	program cel.Program
+	// messageProgram is nil when the rule has no message expression
+	messageProgram cel.Program
+	// reads are the variables and fields the expression reads, looked up
+	// when the rule is explained
+	reads []variableRead
+}
+
+// Result is the outcome of evaluating a request against the CEL rules
+type Result struct {
+	Decision decision.Decision
+	// Rule is the name of the rule that matched, empty if none did
+	Rule   string
+	Reason string
+	// Audited lists the denials of rules in audit mode that matched but were
+	// not enforced
+	Audited []AuditedDenial
+}
+
+// AuditedDenial is a denial recorded instead of enforced because its rule
+// or the webhook as a whole is in audit mode
+type AuditedDenial struct {
+	// Rule is the CEL rule or built-in check that would have denied the request
+	Rule   string
+	Reason string
 }
 
 // NewEvaluator creates a new CEL evaluator with the provided rules
-func NewEvaluator(rules []string) (*Evaluator, error) {
+func NewEvaluator(rules []config.CELRule) (*Evaluator, error) {
 	env, err := createEnvironment()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create CEL environment: %v", err)
 	}
 
-	programs, err := compileRules(env, rules)
+	compiled, err := compileRules(env, rules)
 	if err != nil {
 		return nil, fmt.Errorf("failed to compile CEL rules: %v", err)
 	}
 
 	return &Evaluator{
-		env:      env,
-		programs: programs,
+		env:   env,
+		rules: compiled,
+		clock: time.Now,
 	}, nil
 }
 
+// SetClock replaces the clock that supplies the `now` variable, so rules
+// depending on the time can be evaluated at a fixed instant. It must be
+// called before the evaluator is used.
+func (e *Evaluator) SetClock(clock func() time.Time) {
+	e.clock = clock
+}
+
 // createEnvironment sets up the CEL environment with necessary declarations
 func createEnvironment() (*cel.Env, error) {
 	return cel.NewEnv(
@@ -41,47 +90,300 @@ func createEnvironment() (*cel.Env, error) {
 			decls.NewVar("groups", decls.NewListType(decls.String)),
 			decls.NewVar("resourceAttributes", decls.NewMapType(decls.String, decls.String)),
 			decls.NewVar("nonResourceAttributes", decls.NewMapType(decls.String, decls.String)),
+			decls.NewVar("now", decls.Timestamp),
 		),
+		requestVariable(),
+		timeFunctions(),
 	)
 }
 
-// compileRules compiles CEL rules into programs
-func compileRules(env *cel.Env, rules []string) ([]cel.Program, error) {
-	var programs []cel.Program
+// RuleCount returns the number of compiled rules
+func (e *Evaluator) RuleCount() int {
+	return len(e.rules)
+}
 
-	for _, rule := range rules {
-		if rule == "" {
-			continue
+// RuleNames returns the names of the compiled rules in evaluation order
+func (e *Evaluator) RuleNames() []string {
+	names := make([]string, 0, len(e.rules))
+	for _, rule := range e.rules {
+		names = append(names, rule.name)
+	}
+	return names
+}
+
+// compileRules compiles CEL rules and their message expressions into programs
+func compileRules(env *cel.Env, rules []config.CELRule) ([]compiledRule, error) {
+	var compiled []compiledRule
+
+	for i, rule := range rules {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("rule-%d", i)
+		}
+
+		effect, err := decision.Parse(rule.Effect)
+		if err != nil {
+			return nil, fmt.Errorf("invalid effect for CEL rule '%s': %v", name, err)
+		}
+
+		audit, err := config.ParseEnforcement(rule.Enforcement)
+		if err != nil {
+			return nil, fmt.Errorf("invalid enforcement for CEL rule '%s': %v", name, err)
+		}
+
+		prg, ast, err := compileExpression(env, rule.Expression, cel.BoolType)
+		if err != nil {
+			return nil, fmt.Errorf("CEL rule '%s': %v", name, err)
+		}
+		reads, err := compileReads(env, ast)
+		if err != nil {
+			return nil, fmt.Errorf("CEL rule '%s': %v", name, err)
+		}
+
+		var messagePrg cel.Program
+		if rule.MessageExpression != "" {
+			messagePrg, _, err = compileExpression(env, rule.MessageExpression, cel.StringType)
+			if err != nil {
+				return nil, fmt.Errorf("message expression of CEL rule '%s': %v", name, err)
+			}
+		}
+
+		compiled = append(compiled, compiledRule{
+			name:           name,
+			effect:         effect,
+			match:          rule.Match,
+			message:        rule.Message,
+			audit:          audit,
+			program:        prg,
+			messageProgram: messagePrg,
+			reads:          reads,
+		})
+	}
+
+	return compiled, nil
+}
+
+// compileExpression compiles a single CEL expression that must evaluate to
+// the given type into a program, and also returns its checked AST
+func compileExpression(env *cel.Env, expression string, want *cel.Type) (cel.Program, *cel.Ast, error) {
+	ast, issues := env.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, nil, fmt.Errorf("failed to compile '%s': %v", expression, issues.Err())
+	}
+	if err := checkOutputType(ast, want); err != nil {
+		return nil, nil, fmt.Errorf("'%s' %v", expression, err)
+	}
+	if problems := checkTimeArguments(ast); len(problems) > 0 {
+		p := problems[0]
+		return nil, nil, fmt.Errorf("'%s' at %d:%d: %s", expression, p.Line, p.Column, p.Message)
+	}
+
+	prg, err := env.Program(ast)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create program for '%s': %v", expression, err)
+	}
+
+	return prg, ast, nil
+}
+
+// Outcomes recorded in a Step
+const (
+	// OutcomeSkipped means the request was outside the rule's match scope
+	OutcomeSkipped = "skipped"
+	// OutcomeNoMatch means the rule was evaluated and did not match
+	OutcomeNoMatch = "no match"
+	// OutcomeMatched means the rule or check matched and decided
+	OutcomeMatched = "matched"
+	// OutcomeError means evaluating the rule failed
+	OutcomeError = "error"
+	// OutcomeAudited means the rule would have denied the request but is in
+	// audit mode, so evaluation continued
+	OutcomeAudited = "audited"
+)
+
+// Step records how one rule or built-in check handled a request
+type Step struct {
+	// Rule is the CEL rule or built-in check name
+	Rule    string
+	Outcome string
+	// Detail describes the decision or error, if any
+	Detail string
+	// Variables are the values of the variables a CEL rule read, in the
+	// order the expression reads them; nil for skipped rules and built-in checks
+	Variables []Variable
+	// Decisive is set on the step that produced the final decision
+	Decisive bool
+}
+
+// Options adjust how a request is evaluated
+type Options struct {
+	// AuditOnly puts every rule in audit mode
+	AuditOnly bool
+	// Steps, unless nil, receives a step for every rule considered. Such an
+	// evaluation explains a decision rather than making one, so it is not
+	// counted in the metrics.
+	Steps *[]Step
+}
+
+// Evaluate evaluates a SubjectAccessReview against the compiled rules. Rules
+// are considered in order and the first one whose expression is true decides
+// the result with its effect. When no rule matches the evaluator has no
+// opinion and later checks decide. Denials by rules in audit mode are
+// recorded in the result and evaluation continues with the next rule.
+func (e *Evaluator) Evaluate(sar *authorizationv1.SubjectAccessReview) Result {
+	return e.EvaluateWithOptions(sar, Options{})
+}
+
+// Explain evaluates a request like Evaluate and also returns a step for
+// every rule considered, with the rule that decided marked decisive
+func (e *Evaluator) Explain(sar *authorizationv1.SubjectAccessReview) (Result, []Step) {
+	var steps []Step
+	result := e.EvaluateWithOptions(sar, Options{Steps: &steps})
+	// Evaluation stops at the rule that decides, so it is the last step
+	if result.Rule != "" {
+		steps[len(steps)-1].Decisive = true
+	}
+	return result, steps
+}
+
+// EvaluateWithOptions evaluates a request like Evaluate, adjusted by opts
+func (e *Evaluator) EvaluateWithOptions(sar *authorizationv1.SubjectAccessReview, opts Options) Result {
+	steps := opts.Steps
+	if len(e.rules) == 0 {
+		return Result{Decision: decision.NoOpinion, Reason: "No CEL rules configured"}
+	}
+
+	counted := steps == nil
+	start := time.Now()
+	defer func() {
+		if counted {
+			metrics.CELEvaluationDuration.Observe(time.Since(start).Seconds())
+		}
+	}()
+
+	vars := activation(sar)
+	vars["now"] = e.clock()
+
+	record := func(rule *compiledRule, outcome, detail string) {
+		if steps == nil {
+			return
+		}
+		step := Step{Rule: rule.name, Outcome: outcome, Detail: detail}
+		if outcome != OutcomeSkipped {
+			step.Variables = readVariables(rule.reads, vars)
 		}
+		*steps = append(*steps, step)
+	}
+
+	var audited []AuditedDenial
+	// decides records the outcome of a rule that produced result and reports
+	// whether the result is final. Denials in audit mode are collected instead.
+	decides := func(rule *compiledRule, result Result, outcome, detail string) bool {
+		if result.Decision == decision.Deny && (rule.audit || opts.AuditOnly) {
+			log.Printf("Audit mode: would have denied by rule '%s': %s", rule.name, result.Reason)
+			audited = append(audited, AuditedDenial{Rule: rule.name, Reason: result.Reason})
+			record(rule, OutcomeAudited, "would have denied")
+			return false
+		}
+		record(rule, outcome, detail)
+		return true
+	}
 
-		ast, issues := env.Compile(rule)
-		if issues != nil && issues.Err() != nil {
-			return nil, fmt.Errorf("failed to compile CEL rule '%s': %v", rule, issues.Err())
+	for i := range e.rules {
+		rule := &e.rules[i]
+		if !matchesScope(rule.match, sar) {
+			record(rule, OutcomeSkipped, "request outside match scope")
+			continue
 		}
 
-		prg, err := env.Program(ast)
+		result, _, err := rule.program.Eval(vars)
 		if err != nil {
-			return nil, fmt.Errorf("failed to create program for rule '%s': %v", rule, err)
+			log.Printf("Error evaluating rule '%s': %v", rule.name, err)
+			if counted {
+				metrics.RuleErrors.WithLabelValues(rule.name).Inc()
+			}
+			denied := Result{Decision: decision.Deny, Rule: rule.name, Reason: fmt.Sprintf("Error evaluating CEL rule '%s'", rule.name)}
+			if decides(rule, denied, OutcomeError, err.Error()) {
+				denied.Audited = audited
+				return denied
+			}
+			continue
 		}
 
-		programs = append(programs, prg)
+		matched, ok := result.Value().(bool)
+		if !ok {
+			log.Printf("Rule '%s' did not return a boolean", rule.name)
+			if counted {
+				metrics.RuleErrors.WithLabelValues(rule.name).Inc()
+			}
+			denied := Result{Decision: decision.Deny, Rule: rule.name, Reason: fmt.Sprintf("Invalid result from CEL rule '%s'", rule.name)}
+			if decides(rule, denied, OutcomeError, "did not return a boolean") {
+				denied.Audited = audited
+				return denied
+			}
+			continue
+		}
+
+		if matched {
+			if counted {
+				metrics.RuleMatches.WithLabelValues(rule.name, rule.effect.String()).Inc()
+			}
+			decided := Result{Decision: rule.effect, Rule: rule.name, Reason: rule.reason(vars)}
+			if decides(rule, decided, OutcomeMatched, rule.effect.String()) {
+				decided.Audited = audited
+				return decided
+			}
+			continue
+		}
+		record(rule, OutcomeNoMatch, "")
 	}
 
-	return programs, nil
+	return Result{Decision: decision.NoOpinion, Reason: "No CEL rule matched", Audited: audited}
 }
 
-// Evaluate evaluates a SubjectAccessReview against the compiled rules
-func (e *Evaluator) Evaluate(sar *authorizationv1.SubjectAccessReview) (bool, string) {
-	if len(e.programs) == 0 {
-		return true, "No CEL rules configured"
+// reason builds the human-readable reason for a matched rule, preferring the
+// message expression, then the static message, then a generic description
+func (r *compiledRule) reason(vars map[string]interface{}) string {
+	if r.messageProgram != nil {
+		result, _, err := r.messageProgram.Eval(vars)
+		if err != nil {
+			log.Printf("Error evaluating message expression of rule '%s': %v", r.name, err)
+		} else if msg, ok := result.Value().(string); ok {
+			return fmt.Sprintf("%s (CEL rule '%s')", msg, r.name)
+		} else {
+			log.Printf("Message expression of rule '%s' did not return a string", r.name)
+		}
+	}
+
+	if r.message != "" {
+		return fmt.Sprintf("%s (CEL rule '%s')", r.message, r.name)
+	}
+
+	switch r.effect {
+	case decision.Allow:
+		return fmt.Sprintf("Request allowed by CEL rule '%s'", r.name)
+	case decision.Deny:
+		return fmt.Sprintf("Request denied by CEL rule '%s'", r.name)
+	default:
+		return fmt.Sprintf("CEL rule '%s' has no opinion on the request", r.name)
 	}
+}
 
-	// Prepare variables for evaluation
+// activation prepares the variables a SubjectAccessReview exposes to CEL
+func activation(sar *authorizationv1.SubjectAccessReview) map[string]interface{} {
 	vars := map[string]interface{}{
 		"user":   sar.Spec.User,
 		"groups": sar.Spec.Groups,
 	}
 
+	// Expose the full spec as the typed request object; rules reading it
+	// fail closed if it cannot be built
+	if request, err := requestValue(sar.Spec); err != nil {
+		log.Printf("Error building CEL request variable: %v", err)
+	} else {
+		vars["request"] = request
+	}
+
 	// Add resource attributes if present
 	if sar.Spec.ResourceAttributes != nil {
 		attrs := map[string]string{
@@ -105,24 +407,40 @@ func (e *Evaluator) Evaluate(sar *authorizationv1.SubjectAccessReview) (bool, st
 		vars["nonResourceAttributes"] = attrs
 	}
 
-	// Evaluate each rule
-	for i, program := range e.programs {
-		result, _, err := program.Eval(vars)
-		if err != nil {
-			log.Printf("Error evaluating rule %d: %v", i, err)
-			return false, fmt.Sprintf("Error evaluating CEL rule %d", i)
-		}
+	return vars
+}
 
-		allowed, ok := result.Value().(bool)
-		if !ok {
-			log.Printf("Rule %d did not return a boolean", i)
-			return false, fmt.Sprintf("Invalid result from CEL rule %d", i)
-		}
+// matchesScope reports whether a request falls within a rule's match scope.
+// Resource scopes never match non-resource requests.
+func matchesScope(match config.RuleMatch, sar *authorizationv1.SubjectAccessReview) bool {
+	if attrs := sar.Spec.ResourceAttributes; attrs != nil {
+		return matchesAny(match.Verbs, attrs.Verb) &&
+			matchesAny(match.APIGroups, attrs.Group) &&
+			matchesAny(match.Resources, attrs.Resource) &&
+			matchesAny(match.Namespaces, attrs.Namespace)
+	}
 
-		if !allowed {
-			return false, fmt.Sprintf("Request denied by CEL rule %d", i)
-		}
+	if len(match.APIGroups) > 0 || len(match.Resources) > 0 || len(match.Namespaces) > 0 {
+		return false
 	}
 
-	return true, "Request allowed by CEL rules"
+	verb := ""
+	if sar.Spec.NonResourceAttributes != nil {
+		verb = sar.Spec.NonResourceAttributes.Verb
+	}
+	return matchesAny(match.Verbs, verb)
+}
+
+// matchesAny reports whether value is in values, treating an empty list or
+// "*" as a wildcard
+func matchesAny(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == "*" || v == value {
+			return true
+		}
+	}
+	return false
 }
@@ -1,34 +1,53 @@
 package cel
 
 import (
+	"reflect"
 	"testing"
 
+	"github.com/imiller31/k8s-auth-webhook/config"
+	"github.com/imiller31/k8s-auth-webhook/decision"
+	"github.com/imiller31/k8s-auth-webhook/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	authorizationv1 "k8s.io/api/authorization/v1"
 )
 
 func TestNewEvaluator(t *testing.T) {
 	tests := []struct {
 		name    string
-		rules   []string
+		rules   []config.CELRule
 		wantErr bool
 	}{
 		{
 			name:    "empty rules",
-			rules:   []string{},
+			rules:   []config.CELRule{},
 			wantErr: false,
 		},
 		{
 			name: "valid rules",
-			rules: []string{
-				"'system:masters' in groups",
-				"user == 'admin'",
+			rules: []config.CELRule{
+				config.LegacyRule("'system:masters' in groups"),
+				config.LegacyRule("user == 'admin'"),
 			},
 			wantErr: false,
 		},
+		{
+			name: "invalid effect",
+			rules: []config.CELRule{
+				{Name: "bad", Expression: "true", Effect: "maybe"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid message expression",
+			rules: []config.CELRule{
+				{Name: "bad", Expression: "true", Effect: "deny", MessageExpression: "user +"},
+			},
+			wantErr: true,
+		},
 		{
 			name: "invalid rule",
-			rules: []string{
-				"invalid syntax",
+			rules: []config.CELRule{
+				config.LegacyRule("invalid syntax"),
 			},
 			wantErr: true,
 		},
@@ -51,21 +70,21 @@ func TestNewEvaluator(t *testing.T) {
 func TestEvaluate(t *testing.T) {
 	tests := []struct {
 		name     string
-		rules    []string
+		rules    []config.CELRule
 		sar      *authorizationv1.SubjectAccessReview
-		want     bool
+		want     decision.Decision
 		validate func(*testing.T, string)
 	}{
 		{
 			name:  "no rules",
-			rules: []string{},
+			rules: []config.CELRule{},
 			sar: &authorizationv1.SubjectAccessReview{
 				Spec: authorizationv1.SubjectAccessReviewSpec{
 					User:   "test-user",
 					Groups: []string{"test-group"},
 				},
 			},
-			want: true,
+			want: decision.NoOpinion,
 			validate: func(t *testing.T, reason string) {
 				if reason != "No CEL rules configured" {
 					t.Errorf("expected reason 'No CEL rules configured', got %s", reason)
@@ -74,8 +93,8 @@ func TestEvaluate(t *testing.T) {
 		},
 		{
 			name: "allow system:masters group",
-			rules: []string{
-				"'system:masters' in groups",
+			rules: []config.CELRule{
+				config.LegacyRule("'system:masters' in groups"),
 			},
 			sar: &authorizationv1.SubjectAccessReview{
 				Spec: authorizationv1.SubjectAccessReviewSpec{
@@ -83,17 +102,17 @@ func TestEvaluate(t *testing.T) {
 					Groups: []string{"system:masters"},
 				},
 			},
-			want: true,
+			want: decision.NoOpinion,
 			validate: func(t *testing.T, reason string) {
-				if reason != "Request allowed by CEL rules" {
-					t.Errorf("expected reason 'Request allowed by CEL rules', got %s", reason)
+				if reason != "No CEL rule matched" {
+					t.Errorf("expected reason 'No CEL rule matched', got %s", reason)
 				}
 			},
 		},
 		{
 			name: "deny non-system:masters group",
-			rules: []string{
-				"'system:masters' in groups",
+			rules: []config.CELRule{
+				config.LegacyRule("'system:masters' in groups"),
 			},
 			sar: &authorizationv1.SubjectAccessReview{
 				Spec: authorizationv1.SubjectAccessReviewSpec{
@@ -101,51 +120,51 @@ func TestEvaluate(t *testing.T) {
 					Groups: []string{"test-group"},
 				},
 			},
-			want: false,
+			want: decision.Deny,
 			validate: func(t *testing.T, reason string) {
-				if reason != "Request denied by CEL rule 0" {
-					t.Errorf("expected reason 'Request denied by CEL rule 0', got %s", reason)
+				if reason != "Request denied by CEL rule 'rule-0'" {
+					t.Errorf("expected reason \"Request denied by CEL rule 'rule-0'\", got %s", reason)
 				}
 			},
 		},
 		{
 			name: "allow specific user",
-			rules: []string{
-				"user == 'admin'",
+			rules: []config.CELRule{
+				config.LegacyRule("user == 'admin'"),
 			},
 			sar: &authorizationv1.SubjectAccessReview{
 				Spec: authorizationv1.SubjectAccessReviewSpec{
 					User: "admin",
 				},
 			},
-			want: true,
+			want: decision.NoOpinion,
 			validate: func(t *testing.T, reason string) {
-				if reason != "Request allowed by CEL rules" {
-					t.Errorf("expected reason 'Request allowed by CEL rules', got %s", reason)
+				if reason != "No CEL rule matched" {
+					t.Errorf("expected reason 'No CEL rule matched', got %s", reason)
 				}
 			},
 		},
 		{
 			name: "deny specific user",
-			rules: []string{
-				"user == 'admin'",
+			rules: []config.CELRule{
+				config.LegacyRule("user == 'admin'"),
 			},
 			sar: &authorizationv1.SubjectAccessReview{
 				Spec: authorizationv1.SubjectAccessReviewSpec{
 					User: "other-user",
 				},
 			},
-			want: false,
+			want: decision.Deny,
 			validate: func(t *testing.T, reason string) {
-				if reason != "Request denied by CEL rule 0" {
-					t.Errorf("expected reason 'Request denied by CEL rule 0', got %s", reason)
+				if reason != "Request denied by CEL rule 'rule-0'" {
+					t.Errorf("expected reason \"Request denied by CEL rule 'rule-0'\", got %s", reason)
 				}
 			},
 		},
 		{
 			name: "allow based on resource attributes",
-			rules: []string{
-				"has(resourceAttributes.namespace) && resourceAttributes.namespace == 'prod'",
+			rules: []config.CELRule{
+				config.LegacyRule("has(resourceAttributes.namespace) && resourceAttributes.namespace == 'prod'"),
 			},
 			sar: &authorizationv1.SubjectAccessReview{
 				Spec: authorizationv1.SubjectAccessReviewSpec{
@@ -154,17 +173,17 @@ func TestEvaluate(t *testing.T) {
 					},
 				},
 			},
-			want: true,
+			want: decision.NoOpinion,
 			validate: func(t *testing.T, reason string) {
-				if reason != "Request allowed by CEL rules" {
-					t.Errorf("expected reason 'Request allowed by CEL rules', got %s", reason)
+				if reason != "No CEL rule matched" {
+					t.Errorf("expected reason 'No CEL rule matched', got %s", reason)
 				}
 			},
 		},
 		{
 			name: "deny based on resource attributes",
-			rules: []string{
-				"has(resourceAttributes.namespace) && resourceAttributes.namespace == 'prod'",
+			rules: []config.CELRule{
+				config.LegacyRule("has(resourceAttributes.namespace) && resourceAttributes.namespace == 'prod'"),
 			},
 			sar: &authorizationv1.SubjectAccessReview{
 				Spec: authorizationv1.SubjectAccessReviewSpec{
@@ -173,18 +192,18 @@ func TestEvaluate(t *testing.T) {
 					},
 				},
 			},
-			want: false,
+			want: decision.Deny,
 			validate: func(t *testing.T, reason string) {
-				if reason != "Request denied by CEL rule 0" {
-					t.Errorf("expected reason 'Request denied by CEL rule 0', got %s", reason)
+				if reason != "Request denied by CEL rule 'rule-0'" {
+					t.Errorf("expected reason \"Request denied by CEL rule 'rule-0'\", got %s", reason)
 				}
 			},
 		},
 		{
 			name: "multiple rules - all must pass",
-			rules: []string{
-				"'system:masters' in groups",
-				"has(resourceAttributes.namespace) && resourceAttributes.namespace == 'prod'",
+			rules: []config.CELRule{
+				config.LegacyRule("'system:masters' in groups"),
+				config.LegacyRule("has(resourceAttributes.namespace) && resourceAttributes.namespace == 'prod'"),
 			},
 			sar: &authorizationv1.SubjectAccessReview{
 				Spec: authorizationv1.SubjectAccessReviewSpec{
@@ -195,18 +214,18 @@ func TestEvaluate(t *testing.T) {
 					},
 				},
 			},
-			want: true,
+			want: decision.NoOpinion,
 			validate: func(t *testing.T, reason string) {
-				if reason != "Request allowed by CEL rules" {
-					t.Errorf("expected reason 'Request allowed by CEL rules', got %s", reason)
+				if reason != "No CEL rule matched" {
+					t.Errorf("expected reason 'No CEL rule matched', got %s", reason)
 				}
 			},
 		},
 		{
 			name: "multiple rules - one fails",
-			rules: []string{
-				"'system:masters' in groups",
-				"has(resourceAttributes.namespace) && resourceAttributes.namespace == 'prod'",
+			rules: []config.CELRule{
+				config.LegacyRule("'system:masters' in groups"),
+				config.LegacyRule("has(resourceAttributes.namespace) && resourceAttributes.namespace == 'prod'"),
 			},
 			sar: &authorizationv1.SubjectAccessReview{
 				Spec: authorizationv1.SubjectAccessReviewSpec{
@@ -217,10 +236,10 @@ func TestEvaluate(t *testing.T) {
 					},
 				},
 			},
-			want: false,
+			want: decision.Deny,
 			validate: func(t *testing.T, reason string) {
-				if reason != "Request denied by CEL rule 1" {
-					t.Errorf("expected reason 'Request denied by CEL rule 1', got %s", reason)
+				if reason != "Request denied by CEL rule 'rule-1'" {
+					t.Errorf("expected reason \"Request denied by CEL rule 'rule-1'\", got %s", reason)
 				}
 			},
 		},
@@ -233,7 +252,8 @@ func TestEvaluate(t *testing.T) {
 				t.Fatalf("Failed to create evaluator: %v", err)
 			}
 
-			got, reason := eval.Evaluate(tt.sar)
+			result := eval.Evaluate(tt.sar)
+			got, reason := result.Decision, result.Reason
 			if got != tt.want {
 				t.Errorf("Evaluate() = %v, want %v", got, tt.want)
 			}
@@ -243,3 +263,284 @@ func TestEvaluate(t *testing.T) {
 		})
 	}
 }
+
+func TestEvaluateStructuredRules(t *testing.T) {
+	deleteProtected := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User: "alice",
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Verb:      "delete",
+				Resource:  "pods",
+				Namespace: "prod",
+				Name:      "aks-automatic-pod",
+			},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		rules      []config.CELRule
+		sar        *authorizationv1.SubjectAccessReview
+		want       decision.Decision
+		wantRule   string
+		wantReason string
+	}{
+		{
+			name: "deny rule with static message",
+			rules: []config.CELRule{
+				{
+					Name:       "protect-managed",
+					Expression: "resourceAttributes.name.startsWith('aks-automatic-')",
+					Effect:     "deny",
+					Message:    "Managed resources cannot be deleted",
+				},
+			},
+			sar:        deleteProtected,
+			want:       decision.Deny,
+			wantRule:   "protect-managed",
+			wantReason: "Managed resources cannot be deleted (CEL rule 'protect-managed')",
+		},
+		{
+			name: "message expression interpolates request",
+			rules: []config.CELRule{
+				{
+					Name:              "protect-managed",
+					Expression:        "resourceAttributes.name.startsWith('aks-automatic-')",
+					Effect:            "deny",
+					Message:           "static fallback",
+					MessageExpression: "user + ' may not delete ' + resourceAttributes.resource + '/' + resourceAttributes.name",
+				},
+			},
+			sar:        deleteProtected,
+			want:       decision.Deny,
+			wantRule:   "protect-managed",
+			wantReason: "alice may not delete pods/aks-automatic-pod (CEL rule 'protect-managed')",
+		},
+		{
+			name: "message expression falls back to static message on error",
+			rules: []config.CELRule{
+				{
+					Name:              "protect-managed",
+					Expression:        "true",
+					Effect:            "deny",
+					Message:           "static fallback",
+					MessageExpression: "nonResourceAttributes.path",
+				},
+			},
+			sar:        deleteProtected,
+			want:       decision.Deny,
+			wantRule:   "protect-managed",
+			wantReason: "static fallback (CEL rule 'protect-managed')",
+		},
+		{
+			name: "first matching rule wins",
+			rules: []config.CELRule{
+				{Name: "allow-alice", Expression: "user == 'alice'", Effect: "allow"},
+				{Name: "deny-all", Expression: "true", Effect: "deny"},
+			},
+			sar:        deleteProtected,
+			want:       decision.Allow,
+			wantRule:   "allow-alice",
+			wantReason: "Request allowed by CEL rule 'allow-alice'",
+		},
+		{
+			name: "no-opinion rule stops evaluation",
+			rules: []config.CELRule{
+				{Name: "skip-alice", Expression: "user == 'alice'", Effect: "no-opinion"},
+				{Name: "deny-all", Expression: "true", Effect: "deny"},
+			},
+			sar:        deleteProtected,
+			want:       decision.NoOpinion,
+			wantRule:   "skip-alice",
+			wantReason: "CEL rule 'skip-alice' has no opinion on the request",
+		},
+		{
+			name: "rule outside match scope is skipped",
+			rules: []config.CELRule{
+				{
+					Name:       "deny-dev-deletes",
+					Expression: "true",
+					Effect:     "deny",
+					Match:      config.RuleMatch{Verbs: []string{"delete"}, Namespaces: []string{"dev"}},
+				},
+			},
+			sar:        deleteProtected,
+			want:       decision.NoOpinion,
+			wantReason: "No CEL rule matched",
+		},
+		{
+			name: "rule inside match scope is evaluated",
+			rules: []config.CELRule{
+				{
+					Name:       "deny-pod-deletes",
+					Expression: "true",
+					Effect:     "deny",
+					Match:      config.RuleMatch{Verbs: []string{"delete"}, APIGroups: []string{""}, Resources: []string{"pods"}, Namespaces: []string{"*"}},
+				},
+			},
+			sar:        deleteProtected,
+			want:       decision.Deny,
+			wantRule:   "deny-pod-deletes",
+			wantReason: "Request denied by CEL rule 'deny-pod-deletes'",
+		},
+		{
+			name: "resource scope does not match non-resource requests",
+			rules: []config.CELRule{
+				{
+					Name:       "deny-pods",
+					Expression: "true",
+					Effect:     "deny",
+					Match:      config.RuleMatch{Resources: []string{"pods"}},
+				},
+			},
+			sar: &authorizationv1.SubjectAccessReview{
+				Spec: authorizationv1.SubjectAccessReviewSpec{
+					User:                  "alice",
+					NonResourceAttributes: &authorizationv1.NonResourceAttributes{Path: "/healthz", Verb: "get"},
+				},
+			},
+			want:       decision.NoOpinion,
+			wantReason: "No CEL rule matched",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eval, err := NewEvaluator(tt.rules)
+			if err != nil {
+				t.Fatalf("Failed to create evaluator: %v", err)
+			}
+
+			result := eval.Evaluate(tt.sar)
+			if result.Decision != tt.want {
+				t.Errorf("Evaluate() decision = %v, want %v", result.Decision, tt.want)
+			}
+			if result.Rule != tt.wantRule {
+				t.Errorf("Evaluate() rule = %q, want %q", result.Rule, tt.wantRule)
+			}
+			if result.Reason != tt.wantReason {
+				t.Errorf("Evaluate() reason = %q, want %q", result.Reason, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestEvaluateMetrics(t *testing.T) {
+	eval, err := NewEvaluator([]config.CELRule{
+		{Name: "deny-prod", Expression: "resourceAttributes.namespace == 'prod'", Effect: "deny"},
+		{Name: "broken", Expression: "nonResourceAttributes.path == '/'", Effect: "deny"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create evaluator: %v", err)
+	}
+	if eval.RuleCount() != 2 {
+		t.Errorf("RuleCount() = %d, want 2", eval.RuleCount())
+	}
+
+	matches := metrics.RuleMatches.WithLabelValues("deny-prod", "Deny")
+	errors := metrics.RuleErrors.WithLabelValues("broken")
+	matchesBefore, errorsBefore := testutil.ToFloat64(matches), testutil.ToFloat64(errors)
+
+	eval.Evaluate(&authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{Namespace: "prod"},
+		},
+	})
+	eval.Evaluate(&authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{Namespace: "dev"},
+		},
+	})
+
+	if got := testutil.ToFloat64(matches) - matchesBefore; got != 1 {
+		t.Errorf("cel_rule_matches_total{rule=deny-prod} increased by %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(errors) - errorsBefore; got != 1 {
+		t.Errorf("cel_rule_errors_total{rule=broken} increased by %v, want 1", got)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	eval, err := NewEvaluator([]config.CELRule{
+		{Name: "only-secrets", Expression: "true", Effect: "deny", Match: config.RuleMatch{Resources: []string{"secrets"}}},
+		{Name: "deny-prod", Expression: "resourceAttributes.namespace == 'prod'", Effect: "deny"},
+		{Name: "allow-alice", Expression: "user == 'alice'", Effect: "allow"},
+		{Name: "never-reached", Expression: "true", Effect: "deny"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create evaluator: %v", err)
+	}
+
+	sar := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:               "alice",
+			ResourceAttributes: &authorizationv1.ResourceAttributes{Resource: "pods", Namespace: "dev"},
+		},
+	}
+	result, steps := eval.Explain(sar)
+	if want := eval.Evaluate(sar); result.Decision != want.Decision || result.Rule != want.Rule || result.Reason != want.Reason {
+		t.Errorf("Explain() result = %+v, want the Evaluate() result %+v", result, want)
+	}
+
+	want := []Step{
+		{Rule: "only-secrets", Outcome: OutcomeSkipped, Detail: "request outside match scope"},
+		{Rule: "deny-prod", Outcome: OutcomeNoMatch, Variables: []Variable{{Name: "resourceAttributes.namespace", Value: "dev"}}},
+		{Rule: "allow-alice", Outcome: OutcomeMatched, Detail: "Allow", Variables: []Variable{{Name: "user", Value: "alice"}}, Decisive: true},
+	}
+	if len(steps) != len(want) {
+		t.Fatalf("Explain() steps = %+v, want %+v", steps, want)
+	}
+	for i := range want {
+		if !reflect.DeepEqual(steps[i], want[i]) {
+			t.Errorf("step %d = %+v, want %+v", i, steps[i], want[i])
+		}
+	}
+}
+
+func TestEvaluateAuditRules(t *testing.T) {
+	rules := []config.CELRule{
+		{Name: "trial-deny", Expression: "resourceAttributes.verb == 'delete'", Effect: "deny", Enforcement: "audit"},
+		{Name: "trial-broken", Expression: "nonResourceAttributes.path == '/'", Effect: "deny", Enforcement: "audit"},
+		{Name: "allow-alice", Expression: "user == 'alice'", Effect: "allow"},
+		{Name: "deny-delete", Expression: "resourceAttributes.verb == 'delete'", Effect: "deny"},
+	}
+	eval, err := NewEvaluator(rules)
+	if err != nil {
+		t.Fatalf("Failed to create evaluator: %v", err)
+	}
+
+	sar := func(user string) *authorizationv1.SubjectAccessReview {
+		return &authorizationv1.SubjectAccessReview{
+			Spec: authorizationv1.SubjectAccessReviewSpec{
+				User:               user,
+				ResourceAttributes: &authorizationv1.ResourceAttributes{Verb: "delete"},
+			},
+		}
+	}
+
+	// Audited denials are recorded and evaluation continues past them
+	result := eval.Evaluate(sar("alice"))
+	if result.Decision != decision.Allow || result.Rule != "allow-alice" {
+		t.Errorf("Evaluate() = %v by %s, want Allow by allow-alice", result.Decision, result.Rule)
+	}
+	if len(result.Audited) != 2 || result.Audited[0].Rule != "trial-deny" || result.Audited[1].Rule != "trial-broken" {
+		t.Errorf("Evaluate() audited = %+v, want trial-deny and trial-broken", result.Audited)
+	}
+
+	// AuditOnly audits the enforced deny rule as well
+	var steps []Step
+	result = eval.EvaluateWithOptions(sar("bob"), Options{AuditOnly: true, Steps: &steps})
+	if result.Decision != decision.NoOpinion {
+		t.Errorf("EvaluateWithOptions() = %v by %s, want NoOpinion", result.Decision, result.Rule)
+	}
+	if len(result.Audited) != 3 || result.Audited[2].Rule != "deny-delete" {
+		t.Errorf("EvaluateWithOptions() audited = %+v, want three denials ending with deny-delete", result.Audited)
+	}
+	if last := steps[len(steps)-1]; last.Rule != "deny-delete" || last.Outcome != OutcomeAudited {
+		t.Errorf("last step = %+v, want deny-delete audited", last)
+	}
+
+	if _, err := NewEvaluator([]config.CELRule{{Name: "bad", Expression: "true", Effect: "deny", Enforcement: "maybe"}}); err == nil {
+		t.Error("NewEvaluator() accepted an invalid enforcement")
+	}
+}
@@ -0,0 +1,109 @@
+package cel
+
+import (
+	"fmt"
+
+	"github.com/google/cel-go/cel"
+	"github.com/imiller31/k8s-auth-webhook/config"
+)
+
+// Problem is an error in a single CEL rule found by Check
+type Problem struct {
+	// Index is the rule's position in the configuration
+	Index int
+	Rule  string
+	// Field is the rule field at fault: expression or messageExpression
+	Field string
+	// Line and Column locate the error within the field, starting at 1.
+	// Both are zero when the problem concerns the whole expression.
+	Line    int
+	Column  int
+	Message string
+}
+
+func (p Problem) Error() string {
+	if p.Line == 0 {
+		return fmt.Sprintf("CEL rule %d (%s): %s: %s", p.Index, p.Rule, p.Field, p.Message)
+	}
+	return fmt.Sprintf("CEL rule %d (%s): %s:%d:%d: %s", p.Index, p.Rule, p.Field, p.Line, p.Column, p.Message)
+}
+
+// Check compiles every rule and returns all problems found, where
+// NewEvaluator stops at the first. Rules must evaluate to bool and message
+// expressions to string. Missing expressions are left to config validation.
+func Check(rules []config.CELRule) ([]Problem, error) {
+	env, err := createEnvironment()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CEL environment: %v", err)
+	}
+
+	var problems []Problem
+	for i, rule := range rules {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("rule-%d", i)
+		}
+
+		// Columns in a legacy rule's expression are reported against the
+		// bare expression that was written, not the negation wrapping it
+		offset := 0
+		if rule.Legacy {
+			offset = len(config.LegacyPrefix)
+		}
+
+		for _, field := range []struct {
+			name       string
+			expression string
+			want       *cel.Type
+			offset     int
+		}{
+			{"expression", rule.Expression, cel.BoolType, offset},
+			{"messageExpression", rule.MessageExpression, cel.StringType, 0},
+		} {
+			if field.expression == "" {
+				continue
+			}
+			for _, p := range checkExpression(env, field.expression, field.want) {
+				p.Index, p.Rule, p.Field = i, name, field.name
+				if p.Line == 1 {
+					p.Column = max(p.Column-field.offset, 1)
+				}
+				problems = append(problems, p)
+			}
+		}
+	}
+	return problems, nil
+}
+
+// checkExpression compiles an expression and returns every issue reported
+// by the parser and type checker, or if it compiled a type mismatch and
+// any invalid constant arguments to the time helpers
+func checkExpression(env *cel.Env, expression string, want *cel.Type) []Problem {
+	ast, issues := env.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		var problems []Problem
+		for _, e := range issues.Errors() {
+			problems = append(problems, Problem{
+				Line:    e.Location.Line(),
+				Column:  e.Location.Column() + 1,
+				Message: e.Message,
+			})
+		}
+		return problems
+	}
+
+	if err := checkOutputType(ast, want); err != nil {
+		return []Problem{{Message: err.Error()}}
+	}
+	return checkTimeArguments(ast)
+}
+
+// checkOutputType rejects expressions whose static type is neither want nor
+// dynamic; dynamic results are checked when evaluated
+func checkOutputType(ast *cel.Ast, want *cel.Type) error {
+	out := ast.OutputType()
+	if out.IsExactType(want) || out.IsExactType(cel.DynType) {
+		return nil
+	}
+	return fmt.Errorf("must evaluate to %s, got %s", want, out)
+}
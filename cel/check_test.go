@@ -0,0 +1,56 @@
+package cel
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/imiller31/k8s-auth-webhook/config"
+)
+
+func TestCheck(t *testing.T) {
+	rules := []config.CELRule{
+		{Name: "ok", Expression: "user == 'alice'", Effect: "allow", MessageExpression: "'hello ' + user"},
+		{Name: "undeclared", Expression: "user == 'alice' && usr == 'bob'", Effect: "deny"},
+		{Name: "not-bool", Expression: "user", Effect: "deny"},
+		{Name: "bad-message", Expression: "true", Effect: "deny", MessageExpression: "size(groups)"},
+		{Expression: "user ==", Effect: "deny"},
+		{Name: "dynamic", Expression: "resourceAttributes['verb'] == 'get' && request.resourceAttributes.verb == 'get'", Effect: "deny"},
+		config.LegacyRule("user == 'alice' && usr == 'bob'"),
+	}
+
+	problems, err := Check(rules)
+	if err != nil {
+		t.Fatalf("Check() unexpected error: %v", err)
+	}
+
+	want := []Problem{
+		{Index: 1, Rule: "undeclared", Field: "expression", Line: 1, Column: 20},
+		{Index: 2, Rule: "not-bool", Field: "expression"},
+		{Index: 3, Rule: "bad-message", Field: "messageExpression"},
+		{Index: 4, Rule: "rule-4", Field: "expression", Line: 1, Column: 8},
+		// Columns of a legacy rule count from the start of the bare expression
+		{Index: 6, Rule: "rule-6", Field: "expression", Line: 1, Column: 20},
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("Check() returned %d problems, want %d: %v", len(problems), len(want), problems)
+	}
+	for i, w := range want {
+		got := problems[i]
+		if got.Index != w.Index || got.Rule != w.Rule || got.Field != w.Field || got.Line != w.Line || got.Column != w.Column {
+			t.Errorf("problem %d = %+v, want %+v", i, got, w)
+		}
+	}
+	if !strings.Contains(problems[1].Message, "must evaluate to bool") {
+		t.Errorf("expected type error for non-bool rule, got %q", problems[1].Message)
+	}
+	if got := problems[0].Error(); got != "CEL rule 1 (undeclared): expression:1:20: "+problems[0].Message {
+		t.Errorf("unexpected problem format %q", got)
+	}
+}
+
+func TestNewEvaluatorRejectsNonBool(t *testing.T) {
+	_, err := NewEvaluator([]config.CELRule{{Name: "not-bool", Expression: "groups", Effect: "deny"}})
+	if err == nil || !strings.Contains(err.Error(), "must evaluate to bool") {
+		t.Errorf("expected type error, got %v", err)
+	}
+}
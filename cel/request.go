@@ -0,0 +1,147 @@
+package cel
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	authorizationv1 "k8s.io/api/authorization/v1"
+)
+
+// Type names of the request object, matching the names the kube-apiserver uses
+// for the `request` variable in authorizer matchConditions
+const (
+	subjectAccessReviewSpecType  = "kubernetes.SubjectAccessReviewSpec"
+	resourceAttributesType       = "kubernetes.ResourceAttributes"
+	nonResourceAttributesType    = "kubernetes.NonResourceAttributes"
+	fieldSelectorAttributesType  = "kubernetes.FieldSelectorAttributes"
+	fieldSelectorRequirementType = "kubernetes.FieldSelectorRequirement"
+	labelSelectorAttributesType  = "kubernetes.LabelSelectorAttributes"
+	labelSelectorRequirementType = "kubernetes.LabelSelectorRequirement"
+)
+
+// requestTypes declares the fields of every object type reachable from the
+// `request` variable
+var requestTypes = map[string]map[string]*types.Type{
+	subjectAccessReviewSpecType: {
+		"resourceAttributes":    types.NewObjectType(resourceAttributesType),
+		"nonResourceAttributes": types.NewObjectType(nonResourceAttributesType),
+		"user":                  types.StringType,
+		"groups":                types.NewListType(types.StringType),
+		"extra":                 types.NewMapType(types.StringType, types.NewListType(types.StringType)),
+		"uid":                   types.StringType,
+	},
+	resourceAttributesType: {
+		"namespace":     types.StringType,
+		"verb":          types.StringType,
+		"group":         types.StringType,
+		"version":       types.StringType,
+		"resource":      types.StringType,
+		"subresource":   types.StringType,
+		"name":          types.StringType,
+		"fieldSelector": types.NewObjectType(fieldSelectorAttributesType),
+		"labelSelector": types.NewObjectType(labelSelectorAttributesType),
+	},
+	nonResourceAttributesType: {
+		"path": types.StringType,
+		"verb": types.StringType,
+	},
+	fieldSelectorAttributesType: {
+		"rawSelector":  types.StringType,
+		"requirements": types.NewListType(types.NewObjectType(fieldSelectorRequirementType)),
+	},
+	fieldSelectorRequirementType: {
+		"key":      types.StringType,
+		"operator": types.StringType,
+		"values":   types.NewListType(types.StringType),
+	},
+	labelSelectorAttributesType: {
+		"rawSelector":  types.StringType,
+		"requirements": types.NewListType(types.NewObjectType(labelSelectorRequirementType)),
+	},
+	labelSelectorRequirementType: {
+		"key":      types.StringType,
+		"operator": types.StringType,
+		"values":   types.NewListType(types.StringType),
+	},
+}
+
+// requestTypeProvider makes the request object types known to the type
+// checker and defers every other type to the wrapped provider. Request values
+// are plain maps at runtime, so field selection and has() behave as map
+// lookups and an attribute omitted from the review is absent rather than "".
+type requestTypeProvider struct {
+	types.Provider
+}
+
+// requestVariable declares the typed `request` variable in a CEL environment
+func requestVariable() cel.EnvOption {
+	return func(env *cel.Env) (*cel.Env, error) {
+		return env.Extend(
+			cel.CustomTypeProvider(&requestTypeProvider{Provider: env.CELTypeProvider()}),
+			cel.Variable("request", types.NewObjectType(subjectAccessReviewSpecType)),
+		)
+	}
+}
+
+// FindStructType returns the request object type with the given name
+func (p *requestTypeProvider) FindStructType(structType string) (*types.Type, bool) {
+	if _, ok := requestTypes[structType]; ok {
+		return types.NewTypeTypeWithParam(types.NewObjectType(structType)), true
+	}
+	return p.Provider.FindStructType(structType)
+}
+
+// FindStructFieldNames returns the field names of a request object type
+func (p *requestTypeProvider) FindStructFieldNames(structType string) ([]string, bool) {
+	fields, ok := requestTypes[structType]
+	if !ok {
+		return p.Provider.FindStructFieldNames(structType)
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	return names, true
+}
+
+// FindStructFieldType returns the type of a request object field. IsSet and
+// GetFrom are left unset so the interpreter qualifies the runtime map directly.
+func (p *requestTypeProvider) FindStructFieldType(structType, fieldName string) (*types.FieldType, bool) {
+	fields, ok := requestTypes[structType]
+	if !ok {
+		return p.Provider.FindStructFieldType(structType, fieldName)
+	}
+	fieldType, ok := fields[fieldName]
+	if !ok {
+		return nil, false
+	}
+	return &types.FieldType{Type: fieldType}, true
+}
+
+// NewValue rejects construction of request objects inside expressions
+func (p *requestTypeProvider) NewValue(structType string, fields map[string]ref.Val) ref.Val {
+	if _, ok := requestTypes[structType]; ok {
+		return types.NewErr("cannot construct %s in an expression", structType)
+	}
+	return p.Provider.NewValue(structType, fields)
+}
+
+// requestValue converts a SubjectAccessReview spec into the runtime value of
+// the `request` variable. Fields are named after their JSON serialization and
+// empty optional fields are omitted.
+func requestValue(spec authorizationv1.SubjectAccessReviewSpec) (map[string]interface{}, error) {
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal SubjectAccessReview spec: %v", err)
+	}
+
+	value := map[string]interface{}{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal SubjectAccessReview spec: %v", err)
+	}
+
+	return value, nil
+}
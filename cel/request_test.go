@@ -0,0 +1,95 @@
+package cel
+
+import (
+	"testing"
+
+	"github.com/imiller31/k8s-auth-webhook/config"
+	"github.com/imiller31/k8s-auth-webhook/decision"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRequestVariable(t *testing.T) {
+	sar := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   "alice",
+			UID:    "1234",
+			Groups: []string{"dev", "system:authenticated"},
+			Extra: map[string]authorizationv1.ExtraValue{
+				"scopes.authorization.openshift.io": {"user:info"},
+			},
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Verb:      "list",
+				Resource:  "pods",
+				Namespace: "default",
+				FieldSelector: &authorizationv1.FieldSelectorAttributes{
+					Requirements: []metav1.FieldSelectorRequirement{
+						{Key: "spec.nodeName", Operator: metav1.FieldSelectorOpIn, Values: []string{"node-1"}},
+					},
+				},
+				LabelSelector: &authorizationv1.LabelSelectorAttributes{
+					Requirements: []metav1.LabelSelectorRequirement{
+						{Key: "app", Operator: metav1.LabelSelectorOpExists},
+					},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		expression string
+		want       bool
+	}{
+		{name: "user", expression: "request.user == 'alice'", want: true},
+		{name: "uid", expression: "request.uid == '1234'", want: true},
+		{name: "groups", expression: "'dev' in request.groups", want: true},
+		{name: "extra", expression: "request.extra['scopes.authorization.openshift.io'][0] == 'user:info'", want: true},
+		{name: "resource attributes", expression: "request.resourceAttributes.verb == 'list' && request.resourceAttributes.resource == 'pods'", want: true},
+		{name: "absent attribute", expression: "has(request.resourceAttributes.name)", want: false},
+		{name: "absent non-resource attributes", expression: "has(request.nonResourceAttributes)", want: false},
+		{name: "field selector", expression: "request.resourceAttributes.fieldSelector.requirements.exists(r, r.key == 'spec.nodeName' && r.operator == 'In' && 'node-1' in r.values)", want: true},
+		{name: "label selector", expression: "request.resourceAttributes.labelSelector.requirements.all(r, r.key == 'app' && !has(r.values))", want: true},
+		{name: "apiserver match condition", expression: "has(request.resourceAttributes) && request.resourceAttributes.verb in ['update', 'patch', 'delete', 'deletecollection']", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eval, err := NewEvaluator([]config.CELRule{
+				{Name: "probe", Expression: tt.expression, Effect: "deny"},
+			})
+			if err != nil {
+				t.Fatalf("Failed to create evaluator: %v", err)
+			}
+
+			result := eval.Evaluate(sar)
+			matched := result.Decision == decision.Deny
+			if matched != tt.want {
+				t.Errorf("expression %q matched = %v, want %v (reason: %s)", tt.expression, matched, tt.want, result.Reason)
+			}
+		})
+	}
+}
+
+func TestRequestVariableTypeChecking(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression string
+		wantErr    bool
+	}{
+		{name: "known field", expression: "request.resourceAttributes.namespace == 'prod'", wantErr: false},
+		{name: "unknown field", expression: "request.resourceAttributes.namespaces == 'prod'", wantErr: true},
+		{name: "wrong field type", expression: "request.user == 1", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewEvaluator([]config.CELRule{
+				{Name: "probe", Expression: tt.expression, Effect: "deny"},
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewEvaluator() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,367 @@
+package cel
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	// Embed the time zone database so rules can name zones on images
+	// without one
+	_ "time/tzdata"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/ast"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+// timeFunctions declares the helpers rules use to reason about the `now`
+// timestamp, e.g. for change freezes:
+//
+//	now.inWindow(spec) and now.inWindow(spec, zone) report whether the time
+//	falls in a cron window or an ISO 8601 interval
+//	now.weekday(zone) returns the day of the week, e.g. "Friday"
+//	now.timeOfDay(zone) returns the wall-clock time as "15:04"
+//
+// Zones are IANA names such as Europe/London; an empty zone is UTC.
+func timeFunctions() cel.EnvOption {
+	return cel.Lib(timeLib{})
+}
+
+// timeLib is the CEL library registering the time helpers
+type timeLib struct{}
+
+func (timeLib) CompileOptions() []cel.EnvOption {
+	return []cel.EnvOption{
+		cel.Function("inWindow",
+			cel.MemberOverload("timestamp_in_window_string",
+				[]*cel.Type{cel.TimestampType, cel.StringType}, cel.BoolType,
+				cel.BinaryBinding(func(t, spec ref.Val) ref.Val {
+					return inWindowValue(t, spec, types.String(""))
+				})),
+			cel.MemberOverload("timestamp_in_window_string_string",
+				[]*cel.Type{cel.TimestampType, cel.StringType, cel.StringType}, cel.BoolType,
+				cel.FunctionBinding(func(args ...ref.Val) ref.Val {
+					return inWindowValue(args[0], args[1], args[2])
+				})),
+		),
+		cel.Function("weekday",
+			cel.MemberOverload("timestamp_weekday_string",
+				[]*cel.Type{cel.TimestampType, cel.StringType}, cel.StringType,
+				cel.BinaryBinding(func(t, zone ref.Val) ref.Val {
+					local, err := inZone(t, zone)
+					if err != nil {
+						return types.NewErr("weekday: %v", err)
+					}
+					return types.String(local.Weekday().String())
+				})),
+		),
+		cel.Function("timeOfDay",
+			cel.MemberOverload("timestamp_time_of_day_string",
+				[]*cel.Type{cel.TimestampType, cel.StringType}, cel.StringType,
+				cel.BinaryBinding(func(t, zone ref.Val) ref.Val {
+					local, err := inZone(t, zone)
+					if err != nil {
+						return types.NewErr("timeOfDay: %v", err)
+					}
+					return types.String(local.Format("15:04"))
+				})),
+		),
+	}
+}
+
+func (timeLib) ProgramOptions() []cel.ProgramOption {
+	return nil
+}
+
+// checkTimeArguments parses the window specs and zones passed as string
+// literals to the time helpers in a checked expression, so a typo is
+// reported when the rule is loaded rather than failing every evaluation.
+// Arguments computed at evaluation time are left to the helpers.
+func checkTimeArguments(checked *cel.Ast) []Problem {
+	native := checked.NativeRep()
+	var problems []Problem
+	report := func(arg ast.Expr, err error) {
+		loc := native.SourceInfo().GetStartLocation(arg.ID())
+		problems = append(problems, Problem{Line: loc.Line(), Column: loc.Column() + 1, Message: err.Error()})
+	}
+
+	for _, e := range ast.MatchDescendants(ast.NavigateAST(native), ast.KindMatcher(ast.CallKind)) {
+		call := e.AsCall()
+		if !call.IsMemberFunction() {
+			continue
+		}
+		args := call.Args()
+
+		switch call.FunctionName() {
+		case "inWindow":
+			// The spec's interval times are parsed in the zone, or in UTC
+			// when the zone is computed or invalid
+			loc := time.UTC
+			if len(args) == 2 {
+				if zone, ok := stringLiteral(args[1]); ok {
+					var err error
+					if loc, err = loadZone(zone); err != nil {
+						report(args[1], fmt.Errorf("inWindow: %v", err))
+						loc = time.UTC
+					}
+				}
+			}
+			// inWindow fails only on an invalid spec, so evaluating it at
+			// any time validates the spec
+			if spec, ok := stringLiteral(args[0]); ok {
+				if _, err := inWindow(spec, time.Time{}, loc); err != nil {
+					report(args[0], fmt.Errorf("inWindow: %v", err))
+				}
+			}
+		case "weekday", "timeOfDay":
+			if zone, ok := stringLiteral(args[0]); ok {
+				if _, err := loadZone(zone); err != nil {
+					report(args[0], fmt.Errorf("%s: %v", call.FunctionName(), err))
+				}
+			}
+		}
+	}
+	return problems
+}
+
+// stringLiteral returns the value of a string literal expression
+func stringLiteral(e ast.Expr) (string, bool) {
+	if e.Kind() != ast.LiteralKind {
+		return "", false
+	}
+	s, ok := e.AsLiteral().(types.String)
+	return string(s), ok
+}
+
+// inWindowValue implements inWindow for CEL values
+func inWindowValue(t, spec, zone ref.Val) ref.Val {
+	ts, ok := t.(types.Timestamp)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(t)
+	}
+	s, ok := spec.(types.String)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(spec)
+	}
+	z, ok := zone.(types.String)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(zone)
+	}
+
+	loc, err := loadZone(string(z))
+	if err != nil {
+		return types.NewErr("inWindow: %v", err)
+	}
+	in, err := inWindow(string(s), ts.Time, loc)
+	if err != nil {
+		return types.NewErr("inWindow: %v", err)
+	}
+	return types.Bool(in)
+}
+
+// inZone converts a CEL timestamp to the named zone
+func inZone(t, zone ref.Val) (time.Time, error) {
+	ts, ok := t.(types.Timestamp)
+	if !ok {
+		return time.Time{}, fmt.Errorf("no such overload")
+	}
+	z, ok := zone.(types.String)
+	if !ok {
+		return time.Time{}, fmt.Errorf("no such overload")
+	}
+	loc, err := loadZone(string(z))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return ts.Time.In(loc), nil
+}
+
+// loadZone loads an IANA time zone, treating an empty name as UTC
+func loadZone(name string) (*time.Location, error) {
+	if name == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %q", name)
+	}
+	return loc, nil
+}
+
+// inWindow reports whether t falls in the window described by spec, which
+// is either
+//
+//   - a five-field cron expression (minute hour day-of-month month
+//     day-of-week) matching every minute of the window, e.g. "* 15-23 * * FRI"
+//     for Fridays from 15:00, evaluated in loc
+//   - an ISO 8601 interval of two times or dates separated by "/", e.g.
+//     "2026-12-21/2027-01-04", including the start and excluding the end.
+//     Times without an offset and dates are in loc.
+func inWindow(spec string, t time.Time, loc *time.Location) (bool, error) {
+	if fields := strings.Fields(spec); len(fields) == 5 {
+		c, err := parseCron(fields)
+		if err != nil {
+			return false, fmt.Errorf("invalid cron window %q: %v", spec, err)
+		}
+		return c.matches(t.In(loc)), nil
+	}
+
+	if start, end, ok := strings.Cut(spec, "/"); ok {
+		from, err := parseIntervalTime(start, loc)
+		if err != nil {
+			return false, fmt.Errorf("invalid interval %q: %v", spec, err)
+		}
+		to, err := parseIntervalTime(end, loc)
+		if err != nil {
+			return false, fmt.Errorf("invalid interval %q: %v", spec, err)
+		}
+		if !to.After(from) {
+			return false, fmt.Errorf("invalid interval %q: end is not after start", spec)
+		}
+		return !t.Before(from) && t.Before(to), nil
+	}
+
+	return false, fmt.Errorf("invalid window %q: must be a cron expression or an ISO 8601 interval", spec)
+}
+
+// intervalLayouts are the accepted forms of an interval's start and end
+var intervalLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02"}
+
+// parseIntervalTime parses one end of an ISO 8601 interval
+func parseIntervalTime(s string, loc *time.Location) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range intervalLayouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not an RFC 3339 time or a date", s)
+}
+
+// cronSchedule holds the values each field of a cron expression matches as bit sets
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// domAny and dowAny are set when the day fields are "*"; when both day
+	// fields are restricted a day matching either matches, as in cron
+	domAny, dowAny bool
+}
+
+// cronField describes the range and names of a cron field
+type cronField struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var (
+	cronMinute = cronField{name: "minute", min: 0, max: 59}
+	cronHour   = cronField{name: "hour", min: 0, max: 23}
+	cronDom    = cronField{name: "day of month", min: 1, max: 31}
+	cronMonth  = cronField{name: "month", min: 1, max: 12, names: map[string]int{
+		"JAN": 1, "FEB": 2, "MAR": 3, "APR": 4, "MAY": 5, "JUN": 6,
+		"JUL": 7, "AUG": 8, "SEP": 9, "OCT": 10, "NOV": 11, "DEC": 12,
+	}}
+	// Day of week 7 is Sunday, like 0
+	cronDow = cronField{name: "day of week", min: 0, max: 7, names: map[string]int{
+		"SUN": 0, "MON": 1, "TUE": 2, "WED": 3, "THU": 4, "FRI": 5, "SAT": 6,
+	}}
+)
+
+// parseCron parses the five fields of a cron expression
+func parseCron(fields []string) (*cronSchedule, error) {
+	c := &cronSchedule{
+		domAny: strings.HasPrefix(fields[2], "*"),
+		dowAny: strings.HasPrefix(fields[4], "*"),
+	}
+	for i, f := range []struct {
+		field cronField
+		bits  *uint64
+	}{
+		{cronMinute, &c.minute},
+		{cronHour, &c.hour},
+		{cronDom, &c.dom},
+		{cronMonth, &c.month},
+		{cronDow, &c.dow},
+	} {
+		bits, err := f.field.parse(fields[i])
+		if err != nil {
+			return nil, err
+		}
+		*f.bits = bits
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	return c, nil
+}
+
+// parse parses a comma-separated list of values, ranges and steps such as
+// "1,15", "MON-FRI" or "*/15"
+func (f cronField) parse(s string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(s, ",") {
+		base, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepText)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid %s step %q", f.name, stepText)
+			}
+			step = n
+		}
+
+		from, to := f.min, f.max
+		if base != "*" {
+			lo, hi, isRange := strings.Cut(base, "-")
+			var err error
+			if from, err = f.value(lo); err != nil {
+				return 0, err
+			}
+			to = from
+			if isRange {
+				if to, err = f.value(hi); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				to = f.max
+			}
+			if to < from {
+				return 0, fmt.Errorf("invalid %s range %q", f.name, base)
+			}
+		}
+
+		for v := from; v <= to; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// value parses a single number or name of the field
+func (f cronField) value(s string) (int, error) {
+	if v, ok := f.names[strings.ToUpper(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid %s %q", f.name, s)
+	}
+	return v, nil
+}
+
+// matches reports whether the schedule matches the minute of t
+func (c *cronSchedule) matches(t time.Time) bool {
+	if c.minute&(1<<uint(t.Minute())) == 0 ||
+		c.hour&(1<<uint(t.Hour())) == 0 ||
+		c.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if !c.domAny && !c.dowAny {
+		return dom || dow
+	}
+	return dom && dow
+}
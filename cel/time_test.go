@@ -0,0 +1,196 @@
+package cel
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/imiller31/k8s-auth-webhook/config"
+	"github.com/imiller31/k8s-auth-webhook/decision"
+	authorizationv1 "k8s.io/api/authorization/v1"
+)
+
+func TestInWindow(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Fatalf("Failed to load time zone: %v", err)
+	}
+	// Friday 16 October 2026, 15:30 in London (BST)
+	friday := time.Date(2026, 10, 16, 14, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		spec    string
+		loc     *time.Location
+		want    bool
+		wantErr bool
+	}{
+		{name: "cron friday afternoon in London", spec: "* 15-23 * * FRI", loc: london, want: true},
+		{name: "cron friday afternoon in UTC", spec: "* 15-23 * * FRI", loc: time.UTC, want: false},
+		{name: "cron weekdays", spec: "* * * * MON-FRI", loc: time.UTC, want: true},
+		{name: "cron weekend", spec: "* * * * SAT,SUN", loc: time.UTC, want: false},
+		{name: "cron sunday as 7", spec: "* * * * 7", loc: time.UTC, want: false},
+		{name: "cron step", spec: "*/15 * * * *", loc: time.UTC, want: true},
+		{name: "cron step missed", spec: "*/20 * * * *", loc: time.UTC, want: false},
+		{name: "cron month name", spec: "* * * oct *", loc: time.UTC, want: true},
+		{name: "cron day of month or weekday", spec: "* * 1 * FRI", loc: time.UTC, want: true},
+		{name: "cron day of month and any weekday", spec: "* * 1 * *", loc: time.UTC, want: false},
+		{name: "interval of dates", spec: "2026-10-16/2026-10-19", loc: london, want: true},
+		{name: "interval end excluded", spec: "2026-10-12/2026-10-16", loc: london, want: false},
+		{name: "interval of times with offsets", spec: "2026-10-16T14:00:00Z/2026-10-16T15:30:00+01:00", loc: time.UTC, want: false},
+		{name: "interval of local times", spec: "2026-10-16T15:00/2026-10-16T16:00", loc: london, want: true},
+		{name: "interval of local times in UTC", spec: "2026-10-16T15:00/2026-10-16T16:00", loc: time.UTC, want: false},
+		{name: "cron out of range", spec: "60 * * * *", loc: time.UTC, wantErr: true},
+		{name: "cron backwards range", spec: "* 23-15 * * *", loc: time.UTC, wantErr: true},
+		{name: "cron bad step", spec: "*/0 * * * *", loc: time.UTC, wantErr: true},
+		{name: "interval end before start", spec: "2026-10-19/2026-10-16", loc: time.UTC, wantErr: true},
+		{name: "interval bad time", spec: "2026-10-16/tomorrow", loc: time.UTC, wantErr: true},
+		{name: "neither", spec: "fridays", loc: time.UTC, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := inWindow(tt.spec, friday, tt.loc)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("inWindow() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("inWindow() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimeFunctions(t *testing.T) {
+	eval, err := NewEvaluator([]config.CELRule{
+		{
+			Name:       "friday-freeze",
+			Expression: "now.weekday('Europe/London') == 'Friday' && now.timeOfDay('Europe/London') >= '15:00'",
+			Effect:     "deny",
+			Match:      config.RuleMatch{Verbs: []string{"delete"}, Namespaces: []string{"prod"}},
+		},
+		{
+			Name:       "holiday-freeze",
+			Expression: "now.inWindow('2026-12-21/2027-01-04', 'Europe/London')",
+			Effect:     "deny",
+			Match:      config.RuleMatch{Verbs: []string{"delete"}},
+		},
+		{
+			// A zone computed at evaluation time is only checked then
+			Name:       "bad-zone",
+			Expression: "now.weekday('Mars/' + 'Olympus') == 'Friday'",
+			Effect:     "deny",
+			Match:      config.RuleMatch{Verbs: []string{"escalate"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create evaluator: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		now       time.Time
+		verb      string
+		namespace string
+		want      decision.Decision
+		wantRule  string
+	}{
+		{
+			name:      "friday afternoon in prod",
+			now:       time.Date(2026, 10, 16, 14, 30, 0, 0, time.UTC),
+			verb:      "delete",
+			namespace: "prod",
+			want:      decision.Deny,
+			wantRule:  "friday-freeze",
+		},
+		{
+			name:      "friday morning in prod",
+			now:       time.Date(2026, 10, 16, 13, 59, 0, 0, time.UTC),
+			verb:      "delete",
+			namespace: "prod",
+			want:      decision.NoOpinion,
+		},
+		{
+			name:      "friday afternoon in dev",
+			now:       time.Date(2026, 10, 16, 14, 30, 0, 0, time.UTC),
+			verb:      "delete",
+			namespace: "dev",
+			want:      decision.NoOpinion,
+		},
+		{
+			name:      "holidays",
+			now:       time.Date(2026, 12, 24, 9, 0, 0, 0, time.UTC),
+			verb:      "delete",
+			namespace: "dev",
+			want:      decision.Deny,
+			wantRule:  "holiday-freeze",
+		},
+		{
+			name:      "unknown zone fails closed",
+			now:       time.Date(2026, 10, 16, 14, 30, 0, 0, time.UTC),
+			verb:      "escalate",
+			namespace: "dev",
+			want:      decision.Deny,
+			wantRule:  "bad-zone",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eval.SetClock(func() time.Time { return tt.now })
+			sar := &authorizationv1.SubjectAccessReview{
+				Spec: authorizationv1.SubjectAccessReviewSpec{
+					User: "alice",
+					ResourceAttributes: &authorizationv1.ResourceAttributes{
+						Verb:      tt.verb,
+						Resource:  "pods",
+						Namespace: tt.namespace,
+						Name:      "web",
+					},
+				},
+			}
+			result := eval.Evaluate(sar)
+			if result.Decision != tt.want || result.Rule != tt.wantRule {
+				t.Errorf("Evaluate() = %s by '%s' (%s), want %s by '%s'", result.Decision, result.Rule, result.Reason, tt.want, tt.wantRule)
+			}
+		})
+	}
+}
+
+func TestTimeArgumentsCheckedAtCompile(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression string
+		wantColumn int
+		wantErr    string
+	}{
+		{name: "cron typo", expression: "now.inWindow('* 15-23 * * FRY', 'Europe/London')", wantColumn: 14, wantErr: `invalid day of week "FRY"`},
+		{name: "interval typo", expression: "now.inWindow('2026-12-21/2027-13-04')", wantColumn: 14, wantErr: "invalid interval"},
+		{name: "window zone", expression: "now.inWindow('* * * * *', 'Europe/Londn')", wantColumn: 27, wantErr: `unknown time zone "Europe/Londn"`},
+		{name: "weekday zone", expression: "now.weekday('Mars/Olympus') == 'Friday'", wantColumn: 13, wantErr: `weekday: unknown time zone "Mars/Olympus"`},
+		{name: "time of day zone", expression: "user == 'alice' &&\nnow.timeOfDay('Mars/Olympus') >= '15:00'", wantColumn: 15, wantErr: "timeOfDay: unknown time zone"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := []config.CELRule{{Name: "freeze", Expression: tt.expression, Effect: "deny"}}
+			if _, err := NewEvaluator(rules); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("NewEvaluator() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+
+			problems, err := Check(rules)
+			if err != nil {
+				t.Fatalf("Check() unexpected error: %v", err)
+			}
+			wantLine := 1 + strings.Count(tt.expression, "\n")
+			if len(problems) != 1 || problems[0].Line != wantLine || problems[0].Column != tt.wantColumn || !strings.Contains(problems[0].Message, tt.wantErr) {
+				t.Errorf("Check() = %v, want one problem at %d:%d containing %q", problems, wantLine, tt.wantColumn, tt.wantErr)
+			}
+		})
+	}
+
+	// Arguments computed at evaluation time cannot be checked in advance
+	if _, err := NewEvaluator([]config.CELRule{{Name: "computed", Expression: "now.inWindow(user, 'Europe/' + user)", Effect: "deny"}}); err != nil {
+		t.Errorf("NewEvaluator() unexpected error for computed arguments: %v", err)
+	}
+}
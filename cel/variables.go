@@ -0,0 +1,153 @@
+package cel
+
+import (
+	"fmt"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/ast"
+	"github.com/google/cel-go/common/operators"
+	"github.com/google/cel-go/common/types"
+)
+
+// variableNames are the variables rules read requests through
+var variableNames = map[string]bool{
+	"user":                  true,
+	"groups":                true,
+	"resourceAttributes":    true,
+	"nonResourceAttributes": true,
+	"request":               true,
+	"now":                   true,
+}
+
+// Variable is the value of a variable, or of a field of one, that a rule read
+type Variable struct {
+	// Name is the variable or field as written in CEL, e.g.
+	// resourceAttributes.namespace
+	Name  string
+	Value interface{}
+	// Error is set instead of Value when the value could not be read, e.g.
+	// because the field is absent from the request
+	Error string
+}
+
+// variableRead is a variable or field a rule reads, compiled so its value
+// can be looked up when the rule is explained
+type variableRead struct {
+	name    string
+	program cel.Program
+}
+
+// compileReads finds the variables and fields a checked expression reads.
+// Field selections and constant indexes on a variable are followed as far as
+// they go, so `resourceAttributes.namespace == 'prod'` reads
+// resourceAttributes.namespace rather than the whole map.
+func compileReads(env *cel.Env, checked *cel.Ast) ([]variableRead, error) {
+	var names []string
+	seen := make(map[string]bool)
+	var visit func(e ast.Expr)
+	visit = func(e ast.Expr) {
+		if name, ok := variablePath(e); ok {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+			return
+		}
+		switch e.Kind() {
+		case ast.CallKind:
+			call := e.AsCall()
+			if call.IsMemberFunction() {
+				visit(call.Target())
+			}
+			for _, arg := range call.Args() {
+				visit(arg)
+			}
+		case ast.ComprehensionKind:
+			comp := e.AsComprehension()
+			visit(comp.IterRange())
+			visit(comp.AccuInit())
+			visit(comp.LoopCondition())
+			visit(comp.LoopStep())
+			visit(comp.Result())
+		case ast.ListKind:
+			for _, elem := range e.AsList().Elements() {
+				visit(elem)
+			}
+		case ast.MapKind:
+			for _, entry := range e.AsMap().Entries() {
+				visit(entry.AsMapEntry().Key())
+				visit(entry.AsMapEntry().Value())
+			}
+		case ast.StructKind:
+			for _, field := range e.AsStruct().Fields() {
+				visit(field.AsStructField().Value())
+			}
+		case ast.SelectKind:
+			visit(e.AsSelect().Operand())
+		}
+	}
+	visit(checked.NativeRep().Expr())
+
+	reads := make([]variableRead, 0, len(names))
+	for _, name := range names {
+		read, issues := env.Compile(name)
+		if issues != nil && issues.Err() != nil {
+			return nil, fmt.Errorf("failed to compile read of %s: %v", name, issues.Err())
+		}
+		prg, err := env.Program(read)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create program for read of %s: %v", name, err)
+		}
+		reads = append(reads, variableRead{name: name, program: prg})
+	}
+	return reads, nil
+}
+
+// variablePath returns the CEL text of a variable, or of a chain of field
+// selections and constant indexes on one, and reports whether e is one
+func variablePath(e ast.Expr) (string, bool) {
+	switch e.Kind() {
+	case ast.IdentKind:
+		name := e.AsIdent()
+		return name, variableNames[name]
+	case ast.SelectKind:
+		sel := e.AsSelect()
+		operand, ok := variablePath(sel.Operand())
+		if !ok {
+			return "", false
+		}
+		return operand + "." + sel.FieldName(), true
+	case ast.CallKind:
+		call := e.AsCall()
+		if call.FunctionName() != operators.Index || len(call.Args()) != 2 || call.Args()[1].Kind() != ast.LiteralKind {
+			return "", false
+		}
+		key, ok := call.Args()[1].AsLiteral().(types.String)
+		if !ok {
+			return "", false
+		}
+		operand, ok := variablePath(call.Args()[0])
+		if !ok {
+			return "", false
+		}
+		return fmt.Sprintf("%s[%q]", operand, string(key)), true
+	}
+	return "", false
+}
+
+// readVariables looks up the values of the variables a rule reads
+func readVariables(reads []variableRead, vars map[string]interface{}) []Variable {
+	if len(reads) == 0 {
+		return nil
+	}
+	values := make([]Variable, 0, len(reads))
+	for _, read := range reads {
+		val, _, err := read.program.Eval(vars)
+		if err != nil {
+			values = append(values, Variable{Name: read.name, Error: err.Error()})
+			continue
+		}
+		values = append(values, Variable{Name: read.name, Value: val.Value()})
+	}
+	return values
+}
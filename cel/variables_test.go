@@ -0,0 +1,86 @@
+package cel
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/imiller31/k8s-auth-webhook/config"
+	authorizationv1 "k8s.io/api/authorization/v1"
+)
+
+func TestExplainVariables(t *testing.T) {
+	sar := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:               "alice",
+			Groups:             []string{"dev", "ops"},
+			ResourceAttributes: &authorizationv1.ResourceAttributes{Verb: "delete", Resource: "pods", Namespace: "prod"},
+		},
+	}
+	at := time.Date(2026, 10, 16, 14, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		expression string
+		want       []Variable
+	}{
+		{
+			name:       "fields and variables in reading order",
+			expression: "resourceAttributes.verb == 'delete' && user != resourceAttributes.namespace",
+			want: []Variable{
+				{Name: "resourceAttributes.verb", Value: "delete"},
+				{Name: "user", Value: "alice"},
+				{Name: "resourceAttributes.namespace", Value: "prod"},
+			},
+		},
+		{
+			name:       "constant index",
+			expression: "resourceAttributes['resource'] == 'secrets'",
+			want:       []Variable{{Name: `resourceAttributes["resource"]`, Value: "pods"}},
+		},
+		{
+			name:       "macro over a list",
+			expression: "groups.exists(g, g == 'admins')",
+			want:       []Variable{{Name: "groups", Value: []string{"dev", "ops"}}},
+		},
+		{
+			name:       "typed request",
+			expression: "has(request.resourceAttributes) && request.resourceAttributes.verb == 'delete'",
+			want: []Variable{
+				{Name: "request.resourceAttributes", Value: map[string]interface{}{"verb": "delete", "resource": "pods", "namespace": "prod"}},
+				{Name: "request.resourceAttributes.verb", Value: "delete"},
+			},
+		},
+		{
+			name:       "time",
+			expression: "now.weekday('Europe/London') == 'Saturday'",
+			want:       []Variable{{Name: "now", Value: at}},
+		},
+		{
+			name:       "absent field",
+			expression: "has(request.nonResourceAttributes) || nonResourceAttributes.path == '/healthz'",
+			want: []Variable{
+				{Name: "request.nonResourceAttributes", Error: "no such key: nonResourceAttributes"},
+				{Name: "nonResourceAttributes.path", Error: "no such attribute(s): nonResourceAttributes"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eval, err := NewEvaluator([]config.CELRule{{Name: "rule", Expression: tt.expression, Effect: "deny"}})
+			if err != nil {
+				t.Fatalf("Failed to create evaluator: %v", err)
+			}
+			eval.SetClock(func() time.Time { return at })
+
+			_, steps := eval.Explain(sar)
+			if len(steps) != 1 {
+				t.Fatalf("Explain() steps = %+v, want one", steps)
+			}
+			if !reflect.DeepEqual(steps[0].Variables, tt.want) {
+				t.Errorf("Explain() variables = %#v, want %#v", steps[0].Variables, tt.want)
+			}
+		})
+	}
+}
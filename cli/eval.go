@@ -0,0 +1,229 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/imiller31/k8s-auth-webhook/auth"
+	"github.com/imiller31/k8s-auth-webhook/breakglass"
+	"github.com/imiller31/k8s-auth-webhook/cel"
+	"github.com/imiller31/k8s-auth-webhook/cluster"
+	"github.com/imiller31/k8s-auth-webhook/config"
+	"gopkg.in/yaml.v3"
+	authorizationv1 "k8s.io/api/authorization/v1"
+)
+
+// Eval implements the eval subcommand. It loads the configuration with the
+// same layering as the server, runs a SubjectAccessReview read from a JSON
+// or YAML file or built from flags through the authorizer and prints the
+// decision, the reason and every rule and check evaluated. It returns the
+// process exit code: 0 when the request was evaluated, 1 when the
+// configuration or request is invalid and 2 for usage errors.
+func Eval(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("eval", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: webhook eval [-config file] (-f sar.yaml | -user name [-verb verb] ...) [flags]\n\nEvaluate a SubjectAccessReview against the policy without starting the server.\n\n")
+		fs.PrintDefaults()
+	}
+	loader := config.RegisterFlags(fs)
+	file := fs.String("f", "", "Read the SubjectAccessReview from a JSON or YAML file, - for stdin")
+	user := fs.String("user", "", "User making the request")
+	groups := fs.String("groups", "", "Comma-separated groups of the user")
+	verb := fs.String("verb", "", "Verb of the request")
+	apiGroup := fs.String("api-group", "", "API group of the resource")
+	resource := fs.String("resource", "", "Resource of the request")
+	subresource := fs.String("subresource", "", "Subresource of the request")
+	name := fs.String("name", "", "Name of the resource")
+	namespace := fs.String("namespace", "", "Namespace of the resource")
+	fs.StringVar(namespace, "n", "", "Shorthand for -namespace")
+	path := fs.String("path", "", "Non-resource URL path of the request")
+	now := fs.String("now", "", "Evaluate CEL rules as if at this RFC 3339 time instead of now")
+	lookup := fs.Bool("cluster", false, "Look up objects and namespace labels in the cluster described by the clusterLookup settings")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	// Request flags are only meaningful when the request is not read from a file
+	requestFlagSet := false
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "user", "groups", "verb", "api-group", "resource", "subresource", "name", "namespace", "n", "path":
+			requestFlagSet = true
+		}
+	})
+	if *file != "" && requestFlagSet {
+		fmt.Fprintf(stderr, "-f cannot be combined with request flags\n")
+		return 2
+	}
+	if *file == "" && !requestFlagSet {
+		fmt.Fprintf(stderr, "either -f or request flags such as -user and -verb are required\n")
+		fs.Usage()
+		return 2
+	}
+	if *path != "" && (*resource != "" || *name != "" || *namespace != "" || *apiGroup != "" || *subresource != "") {
+		fmt.Fprintf(stderr, "-path cannot be combined with resource flags\n")
+		return 2
+	}
+
+	var at time.Time
+	if *now != "" {
+		var err error
+		if at, err = time.Parse(time.RFC3339, *now); err != nil {
+			fmt.Fprintf(stderr, "invalid -now %q: must be an RFC 3339 time\n", *now)
+			return 2
+		}
+	}
+
+	var sar *authorizationv1.SubjectAccessReview
+	if *file != "" {
+		var err error
+		if sar, err = readSAR(*file, stdin); err != nil {
+			fmt.Fprintf(stdout, "%s: %v\n", *file, err)
+			return 1
+		}
+	} else {
+		sar = &authorizationv1.SubjectAccessReview{
+			Spec: authorizationv1.SubjectAccessReviewSpec{User: *user},
+		}
+		if *groups != "" {
+			sar.Spec.Groups = strings.Split(*groups, ",")
+		}
+		if *path != "" {
+			sar.Spec.NonResourceAttributes = &authorizationv1.NonResourceAttributes{Path: *path, Verb: *verb}
+		} else {
+			sar.Spec.ResourceAttributes = &authorizationv1.ResourceAttributes{
+				Namespace:   *namespace,
+				Verb:        *verb,
+				Group:       *apiGroup,
+				Resource:    *resource,
+				Subresource: *subresource,
+				Name:        *name,
+			}
+		}
+	}
+
+	cfg, err := loader.Resolve()
+	if err != nil {
+		fmt.Fprintf(stdout, "%s: %v\n", loader.ConfigFile(), err)
+		return 1
+	}
+	if problems := cfg.Problems(); len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Fprintf(stdout, "%s: %v\n", loader.ConfigFile(), p)
+		}
+		return 1
+	}
+
+	celEval, err := cel.NewEvaluator(cfg.CELRules)
+	if err != nil {
+		fmt.Fprintf(stdout, "%s: %v\n", loader.ConfigFile(), err)
+		return 1
+	}
+	if !at.IsZero() {
+		celEval.SetClock(func() time.Time { return at })
+	}
+
+	authorizer := auth.NewAuthorizer(cfg, celEval)
+	switch {
+	case *lookup:
+		lister, err := cluster.NewAPILister(cfg.ClusterLookup)
+		if err != nil {
+			fmt.Fprintf(stdout, "%s: %v\n", loader.ConfigFile(), err)
+			return 1
+		}
+		cached := cluster.NewCachingLister(lister, cfg.ClusterLookup.CacheTTL)
+		authorizer.SetObjectLister(cached)
+		authorizer.SetNamespaceGetter(cached)
+	case cfg.NeedsClusterLookup():
+		fmt.Fprintf(stdout, "Warning: cluster lookup is disabled, so protection policies in lookup mode or selecting namespaces by label deny as if the apiserver were unreachable; pass -cluster to look them up\n\n")
+	}
+
+	// Grants created through the admin API live in the server's memory and
+	// cannot be seen here, only those in the grants file
+	if cfg.BreakGlass.GrantsFile != "" {
+		grants := breakglass.NewStore(cfg.BreakGlass)
+		if err := grants.LoadFile(); err != nil {
+			fmt.Fprintf(stdout, "%s: %v\n", loader.ConfigFile(), err)
+			return 1
+		}
+		authorizer.SetBreakGlass(grants)
+	}
+
+	result, steps := authorizer.Explain(sar)
+
+	fmt.Fprintf(stdout, "Decision:   %s\n", result.Decision)
+	fmt.Fprintf(stdout, "Reason:     %s\n", result.Reason)
+	fmt.Fprintf(stdout, "Decided by: %s\n", result.Rule)
+	fmt.Fprintf(stdout, "\nEvaluated:\n")
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	for _, s := range steps {
+		fmt.Fprintf(tw, "  %s\t%s\t%s\n", s.Rule, s.Outcome, s.Detail)
+		for _, v := range s.Variables {
+			fmt.Fprintf(tw, "  \t\t%s\n", formatVariable(v))
+		}
+	}
+	tw.Flush()
+	return 0
+}
+
+// formatVariable prints a value a CEL rule read as name = JSON value, or
+// the error reading it
+func formatVariable(v cel.Variable) string {
+	if v.Error != "" {
+		return fmt.Sprintf("%s: %s", v.Name, v.Error)
+	}
+	value, err := json.Marshal(v.Value)
+	if err != nil {
+		return fmt.Sprintf("%s = %v", v.Name, v.Value)
+	}
+	return fmt.Sprintf("%s = %s", v.Name, value)
+}
+
+// readSAR reads a SubjectAccessReview from a JSON or YAML file, or from
+// stdin when file is -
+func readSAR(file string, stdin io.Reader) (*authorizationv1.SubjectAccessReview, error) {
+	var data []byte
+	var err error
+	if file == "-" {
+		data, err = io.ReadAll(stdin)
+	} else {
+		data, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// JSON is valid YAML, so both are decoded as YAML
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid SubjectAccessReview: %v", err)
+	}
+
+	var sar authorizationv1.SubjectAccessReview
+	if err := decodeAPIObject(doc, &sar); err != nil {
+		return nil, fmt.Errorf("invalid SubjectAccessReview: %v", err)
+	}
+	return &sar, nil
+}
+
+// decodeAPIObject converts a decoded YAML document into a Kubernetes API
+// type by way of JSON, so the type's json field names are honoured and
+// unknown fields are rejected
+func decodeAPIObject(doc interface{}, out interface{}) error {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(out)
+}
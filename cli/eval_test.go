@@ -0,0 +1,163 @@
+package cli
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEval(t *testing.T) {
+	configPath := writeFile(t, "config.yaml", `protectedPrefix: "aks-automatic-"
+privilegedUser: "support"
+celRules:
+  - name: protect-secrets
+    expression: "true"
+    effect: deny
+    match:
+      resources: ["secrets"]
+  - name: friday-freeze
+    expression: "now.weekday('Europe/London') == 'Friday'"
+    effect: deny
+    match:
+      verbs: ["patch"]`)
+
+	sarPath := writeFile(t, "sar.yaml", `apiVersion: authorization.k8s.io/v1
+kind: SubjectAccessReview
+spec:
+  user: support
+  resourceAttributes:
+    verb: delete
+    resource: pods
+    name: aks-automatic-x`)
+
+	tests := []struct {
+		name     string
+		args     []string
+		stdin    string
+		wantCode int
+		want     []string
+	}{
+		{
+			name:     "request from flags",
+			args:     []string{"--user", "alice", "--groups", "dev", "--verb", "delete", "--resource", "pods", "--name", "aks-automatic-x", "-n", "default"},
+			wantCode: 0,
+			want: []string{
+				"Decision:   Deny",
+				"Decided by: builtin:protection:protected-prefix",
+				"protect-secrets",
+				"skipped",
+				"builtin:impersonation",
+			},
+		},
+		{
+			name:     "request from YAML file",
+			args:     []string{"-f", sarPath},
+			wantCode: 0,
+			want:     []string{"Decision:   Allow", "as an allowed user"},
+		},
+		{
+			name:     "request from JSON on stdin",
+			args:     []string{"-f", "-"},
+			stdin:    `{"spec": {"user": "alice", "resourceAttributes": {"verb": "get", "resource": "secrets"}}}`,
+			wantCode: 0,
+			want:     []string{"Decision:   Deny", "Decided by: protect-secrets"},
+		},
+		{
+			name:     "invalid request",
+			args:     []string{"-f", "-"},
+			stdin:    `{"spec": "alice"}`,
+			wantCode: 1,
+			want:     []string{"invalid SubjectAccessReview"},
+		},
+		{
+			name:     "at a fixed time",
+			args:     []string{"--user", "alice", "--verb", "patch", "--resource", "pods", "--now", "2026-10-16T15:30:00+01:00"},
+			wantCode: 0,
+			want:     []string{"Decision:   Deny", "Decided by: friday-freeze", `now = "2026-10-16T15:30:00+01:00"`},
+		},
+		{
+			name:     "invalid time",
+			args:     []string{"--user", "alice", "--verb", "patch", "--now", "friday"},
+			wantCode: 2,
+		},
+		{
+			name:     "no request",
+			wantCode: 2,
+		},
+		{
+			name:     "file and flags",
+			args:     []string{"-f", sarPath, "--user", "alice"},
+			wantCode: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			args := append([]string{"-config", configPath}, tt.args...)
+			code := Eval(args, strings.NewReader(tt.stdin), &stdout, &stderr)
+			if code != tt.wantCode {
+				t.Errorf("Eval() = %d, want %d; output:\n%s%s", code, tt.wantCode, stdout.String(), stderr.String())
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(stdout.String(), want) {
+					t.Errorf("expected output to contain %q, got:\n%s", want, stdout.String())
+				}
+			}
+		})
+	}
+}
+
+func TestEvalClusterLookup(t *testing.T) {
+	apiserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/namespaces/default/pods" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"kind":"PartialObjectMetadataList","metadata":{},"items":[{"metadata":{"name":"aks-net-proxy","namespace":"default"}}]}`))
+	}))
+	defer apiserver.Close()
+
+	configPath := writeFile(t, "config.yaml", `protectionPolicies:
+  - name: networking
+    names:
+      prefixes: ["aks-net-"]
+    deleteCollection: lookup
+clusterLookup:
+  server: "`+apiserver.URL+`"
+  tokenFile: ""
+  caFile: ""`)
+
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{
+			name: "offline",
+			want: []string{"Warning: cluster lookup is disabled", "Decision:   Deny", "cluster lookup is unavailable"},
+		},
+		{
+			name: "with cluster lookup",
+			args: []string{"-cluster"},
+			want: []string{"Decision:   Deny", `it contains "aks-net-proxy"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			args := append([]string{"-config", configPath, "--user", "alice", "--verb", "deletecollection", "--resource", "pods", "-n", "default"}, tt.args...)
+			if code := Eval(args, strings.NewReader(""), &stdout, &stderr); code != 0 {
+				t.Fatalf("Eval() = %d, want 0; output:\n%s%s", code, stdout.String(), stderr.String())
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(stdout.String(), want) {
+					t.Errorf("expected output to contain %q, got:\n%s", want, stdout.String())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,431 @@
+package cli
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/imiller31/k8s-auth-webhook/auth"
+	"github.com/imiller31/k8s-auth-webhook/cel"
+	"github.com/imiller31/k8s-auth-webhook/cluster"
+	"github.com/imiller31/k8s-auth-webhook/config"
+	"github.com/imiller31/k8s-auth-webhook/decision"
+	"gopkg.in/yaml.v3"
+	authorizationv1 "k8s.io/api/authorization/v1"
+)
+
+// TestSuite is a file of policy test cases
+type TestSuite struct {
+	// Name identifies the suite in the output; it defaults to the file name
+	Name  string     `yaml:"name"`
+	Tests []TestCase `yaml:"tests"`
+}
+
+// TestCase is a request together with the decision the policy is expected to make
+type TestCase struct {
+	Name string `yaml:"name"`
+	// Request is a SubjectAccessReview spec, using the API field names
+	Request interface{} `yaml:"request"`
+	// Now is the time CEL rules see as `now`; the current time when unset
+	Now time.Time `yaml:"now"`
+	// Cluster is what protection policies that look up objects or namespace
+	// labels find; a case that needs a lookup and sets none fails
+	Cluster *ClusterState `yaml:"cluster"`
+	Expect  Expectation   `yaml:"expect"`
+}
+
+// ClusterState is the cluster a test case runs against
+type ClusterState struct {
+	Objects []ClusterObject `yaml:"objects"`
+	// Namespaces maps namespace names to their labels. Namespaces left out
+	// have no labels.
+	Namespaces map[string]map[string]string `yaml:"namespaces"`
+}
+
+// ClusterObject is an object in a test case's cluster. Namespace is empty
+// for cluster-scoped objects.
+type ClusterObject struct {
+	Group     string `yaml:"group"`
+	Resource  string `yaml:"resource"`
+	Namespace string `yaml:"namespace"`
+	Name      string `yaml:"name"`
+}
+
+// Expectation is the outcome a test case expects. Empty fields are not checked.
+type Expectation struct {
+	// Decision is Allow, Deny or NoOpinion
+	Decision string `yaml:"decision"`
+	// Reason must be a substring of the reason returned
+	Reason string `yaml:"reason"`
+	// Rule is the CEL rule or built-in check expected to decide
+	Rule string `yaml:"rule"`
+}
+
+// caseResult is the outcome of running a single test case
+type caseResult struct {
+	name     string
+	duration time.Duration
+	// failure describes why the case failed, empty when it passed
+	failure string
+}
+
+// suiteResult is the outcome of running a test suite
+type suiteResult struct {
+	name  string
+	file  string
+	cases []caseResult
+	// err is set when the suite file could not be loaded
+	err error
+	// matched counts the cases each rule or check decided
+	matched map[string]int
+}
+
+// failures returns the number of failed cases
+func (s *suiteResult) failures() int {
+	n := 0
+	for _, c := range s.cases {
+		if c.failure != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// RunTests implements the test subcommand. It loads the configuration with
+// the same layering as the server, runs every case of the given test suite
+// files through the authorizer and prints the result of each case and how
+// often each rule and built-in check decided. It returns the process exit
+// code: 0 when every case passed, 1 when a case failed or the configuration
+// or a suite is invalid and 2 for usage errors.
+func RunTests(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: webhook test [-config file] [-junit file] suite.yaml...\n\nRun policy test suites against the configuration without starting the server.\n\n")
+		fs.PrintDefaults()
+	}
+	loader := config.RegisterFlags(fs)
+	junitFile := fs.String("junit", "", "Also write the results as JUnit XML to this file")
+	verbose := fs.Bool("v", false, "List passing cases as well as failing ones")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fmt.Fprintf(stderr, "at least one test suite file is required\n")
+		fs.Usage()
+		return 2
+	}
+
+	cfg, err := loader.Resolve()
+	if err != nil {
+		fmt.Fprintf(stdout, "%s: %v\n", loader.ConfigFile(), err)
+		return 1
+	}
+	if problems := cfg.Problems(); len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Fprintf(stdout, "%s: %v\n", loader.ConfigFile(), p)
+		}
+		return 1
+	}
+
+	celEval, err := cel.NewEvaluator(cfg.CELRules)
+	if err != nil {
+		fmt.Fprintf(stdout, "%s: %v\n", loader.ConfigFile(), err)
+		return 1
+	}
+	clock := &caseClock{}
+	celEval.SetClock(clock.now)
+	lookups := &caseCluster{}
+	authorizer := auth.NewAuthorizer(cfg, celEval)
+	authorizer.SetObjectLister(lookups)
+	authorizer.SetNamespaceGetter(lookups)
+
+	var results []*suiteResult
+	for _, file := range fs.Args() {
+		results = append(results, runSuite(authorizer, clock, lookups, file))
+	}
+
+	ok := printResults(stdout, authorizer.Checks(), results, *verbose)
+
+	if *junitFile != "" {
+		if err := writeJUnit(*junitFile, authorizer.Checks(), results); err != nil {
+			fmt.Fprintf(stdout, "%s: %v\n", *junitFile, err)
+			return 1
+		}
+	}
+
+	if !ok {
+		return 1
+	}
+	return 0
+}
+
+// loadSuite reads a test suite file, rejecting unknown fields
+func loadSuite(file string) (*TestSuite, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var suite TestSuite
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(&suite); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("invalid test suite: %v", err)
+	}
+	if suite.Name == "" {
+		suite.Name = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	}
+	return &suite, nil
+}
+
+// caseClock is the clock CEL rules see while cases run: the time set by the
+// current case, or the current time
+type caseClock struct {
+	at time.Time
+}
+
+func (c *caseClock) now() time.Time {
+	if c.at.IsZero() {
+		return time.Now()
+	}
+	return c.at
+}
+
+// caseCluster serves the cluster state set by the current case to the
+// authorizer's lookups. Cases run one at a time, so it needs no locking.
+type caseCluster struct {
+	state *ClusterState
+	// missed records a lookup made while the case set no cluster state
+	missed bool
+}
+
+// errNoClusterState fails lookups for cases that set no cluster state
+var errNoClusterState = errors.New("the test case sets no cluster state")
+
+func (c *caseCluster) List(_ context.Context, resource cluster.Resource) ([]cluster.Object, error) {
+	if c.state == nil {
+		c.missed = true
+		return nil, errNoClusterState
+	}
+
+	var objects []cluster.Object
+	for _, obj := range c.state.Objects {
+		if obj.Group == resource.Group && obj.Resource == resource.Resource &&
+			(resource.Namespace == "" || obj.Namespace == resource.Namespace) {
+			objects = append(objects, cluster.Object{Namespace: obj.Namespace, Name: obj.Name})
+		}
+	}
+	return objects, nil
+}
+
+func (c *caseCluster) GetNamespace(_ context.Context, name string) (cluster.Namespace, error) {
+	if c.state == nil {
+		c.missed = true
+		return cluster.Namespace{}, errNoClusterState
+	}
+	return cluster.Namespace{Name: name, Labels: c.state.Namespaces[name]}, nil
+}
+
+// runSuite runs every case of a suite file through the authorizer, setting
+// clock to each case's time and lookups to its cluster state
+func runSuite(authorizer *auth.Authorizer, clock *caseClock, lookups *caseCluster, file string) *suiteResult {
+	result := &suiteResult{name: file, file: file, matched: make(map[string]int)}
+
+	suite, err := loadSuite(file)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	result.name = suite.Name
+
+	for i, tc := range suite.Tests {
+		name := tc.Name
+		if name == "" {
+			name = fmt.Sprintf("case-%d", i)
+		}
+
+		clock.at = tc.Now
+		lookups.state, lookups.missed = tc.Cluster, false
+		start := time.Now()
+		failure := runCase(authorizer, tc, result.matched)
+		// The server would have looked the cluster up, so neither outcome is meaningful
+		if lookups.missed {
+			failure = "a protection policy looks up the cluster but the case sets no cluster state; add cluster.objects or cluster.namespaces"
+		}
+		result.cases = append(result.cases, caseResult{name: name, duration: time.Since(start), failure: failure})
+	}
+	return result
+}
+
+// runCase evaluates a single case, recording the rule that decided it in
+// matched, and describes why it failed or returns "" when it passed
+func runCase(authorizer *auth.Authorizer, tc TestCase, matched map[string]int) string {
+	var want decision.Decision
+	if tc.Expect.Decision != "" {
+		var err error
+		if want, err = decision.Parse(tc.Expect.Decision); err != nil {
+			return fmt.Sprintf("invalid expected decision: %v", err)
+		}
+	}
+
+	sar := &authorizationv1.SubjectAccessReview{}
+	if err := decodeAPIObject(tc.Request, &sar.Spec); err != nil {
+		return fmt.Sprintf("invalid request: %v", err)
+	}
+
+	result, _ := authorizer.Explain(sar)
+	matched[result.Rule]++
+
+	var problems []string
+	if tc.Expect.Decision != "" && result.Decision != want {
+		problems = append(problems, fmt.Sprintf("decision is %s, want %s", result.Decision, want))
+	}
+	if tc.Expect.Reason != "" && !strings.Contains(result.Reason, tc.Expect.Reason) {
+		problems = append(problems, fmt.Sprintf("reason %q does not contain %q", result.Reason, tc.Expect.Reason))
+	}
+	if tc.Expect.Rule != "" && result.Rule != tc.Expect.Rule {
+		problems = append(problems, fmt.Sprintf("decided by %s, want %s", result.Rule, tc.Expect.Rule))
+	}
+	if len(problems) == 0 {
+		return ""
+	}
+	return strings.Join(problems, "; ") + fmt.Sprintf(" (got %s by %s: %s)", result.Decision, result.Rule, result.Reason)
+}
+
+// printResults writes every failing case, a summary and the rule coverage,
+// and reports whether every suite loaded and every case passed
+func printResults(w io.Writer, checks []string, results []*suiteResult, verbose bool) bool {
+	passed, failed, broken := 0, 0, 0
+	matched := make(map[string]int)
+	for _, s := range results {
+		if s.err != nil {
+			fmt.Fprintf(w, "ERROR %s: %v\n", s.file, s.err)
+			broken++
+			continue
+		}
+		for _, c := range s.cases {
+			if c.failure != "" {
+				fmt.Fprintf(w, "FAIL  %s/%s: %s\n", s.name, c.name, c.failure)
+				failed++
+				continue
+			}
+			if verbose {
+				fmt.Fprintf(w, "PASS  %s/%s\n", s.name, c.name)
+			}
+			passed++
+		}
+		for rule, n := range s.matched {
+			matched[rule] += n
+		}
+	}
+
+	fmt.Fprintf(w, "\nCoverage:\n")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	covered := 0
+	for _, check := range checks {
+		if matched[check] > 0 {
+			covered++
+			fmt.Fprintf(tw, "  %s\t%d case(s)\n", check, matched[check])
+		} else {
+			fmt.Fprintf(tw, "  %s\tnot covered\n", check)
+		}
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "%d of %d rules and checks decided at least one case\n\n", covered, len(checks))
+
+	fmt.Fprintf(w, "%d passed, %d failed", passed, failed)
+	if broken > 0 {
+		fmt.Fprintf(w, ", %d suite(s) could not be loaded", broken)
+	}
+	fmt.Fprintln(w)
+	return failed == 0 && broken == 0
+}
+
+// JUnit XML report, in the subset understood by common CI systems
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name       string          `xml:"name,attr"`
+	Tests      int             `xml:"tests,attr"`
+	Failures   int             `xml:"failures,attr"`
+	Errors     int             `xml:"errors,attr"`
+	Properties []junitProperty `xml:"properties>property,omitempty"`
+	Cases      []junitTestCase `xml:"testcase"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Error     *junitFailure `xml:"error,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+}
+
+// writeJUnit writes the results as JUnit XML, with one testsuite per suite
+// file and the cases each rule or check decided as properties
+func writeJUnit(file string, checks []string, results []*suiteResult) error {
+	var report junitTestSuites
+	for _, s := range results {
+		suite := junitTestSuite{Name: s.name}
+		if s.err != nil {
+			suite.Tests, suite.Errors = 1, 1
+			suite.Cases = []junitTestCase{{
+				Name:      "load",
+				ClassName: s.name,
+				Time:      "0",
+				Error:     &junitFailure{Message: s.err.Error()},
+			}}
+			report.Suites = append(report.Suites, suite)
+			continue
+		}
+
+		suite.Tests = len(s.cases)
+		suite.Failures = s.failures()
+		for _, check := range checks {
+			suite.Properties = append(suite.Properties, junitProperty{
+				Name:  "coverage." + check,
+				Value: fmt.Sprint(s.matched[check]),
+			})
+		}
+		for _, c := range s.cases {
+			tc := junitTestCase{
+				Name:      c.name,
+				ClassName: s.name,
+				Time:      fmt.Sprintf("%.6f", c.duration.Seconds()),
+			}
+			if c.failure != "" {
+				tc.Failure = &junitFailure{Message: c.failure}
+			}
+			suite.Cases = append(suite.Cases, tc)
+		}
+		report.Suites = append(report.Suites, suite)
+	}
+
+	data, err := xml.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, append([]byte(xml.Header), append(data, '\n')...), 0644)
+}
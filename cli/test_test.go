@@ -0,0 +1,256 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunTests(t *testing.T) {
+	configPath := writeFile(t, "config.yaml", `protectedPrefix: "aks-automatic-"
+privilegedUser: "support"
+celRules:
+  - name: protect-secrets
+    expression: "true"
+    effect: deny
+    message: "Secrets are off limits"
+    match:
+      resources: ["secrets"]
+  - name: allow-readers
+    expression: "'readers' in groups"
+    effect: allow`)
+
+	passing := writeFile(t, "passing.yaml", `name: managed
+tests:
+  - name: alice cannot delete managed pods
+    request:
+      user: alice
+      resourceAttributes:
+        verb: delete
+        resource: pods
+        name: aks-automatic-x
+    expect:
+      decision: Deny
+      rule: builtin:protection:protected-prefix
+  - name: secrets are denied
+    request:
+      user: alice
+      resourceAttributes: {verb: get, resource: secrets}
+    expect:
+      decision: deny
+      reason: off limits`)
+
+	failing := writeFile(t, "failing.yaml", `tests:
+  - name: wrong decision
+    request:
+      user: bob
+      resourceAttributes: {verb: get, resource: pods}
+    expect:
+      decision: Allow
+  - request:
+      usr: bob
+    expect:
+      decision: Deny`)
+
+	invalid := writeFile(t, "invalid.yaml", `tests:
+  - name: typo
+    expected:
+      decision: Deny`)
+
+	tests := []struct {
+		name     string
+		suites   []string
+		wantCode int
+		want     []string
+	}{
+		{
+			name:     "all pass",
+			suites:   []string{passing},
+			wantCode: 0,
+			want: []string{
+				"protect-secrets 1 case(s)",
+				"allow-readers not covered",
+				"builtin:protection:protected-prefix 1 case(s)",
+				"2 of 5 rules and checks decided at least one case",
+				"2 passed, 0 failed",
+			},
+		},
+		{
+			name:     "failures reported",
+			suites:   []string{passing, failing},
+			wantCode: 1,
+			want: []string{
+				"FAIL failing/wrong decision: decision is NoOpinion, want Allow (got NoOpinion by builtin:default",
+				`FAIL failing/case-1: invalid request: json: unknown field "usr"`,
+				"2 passed, 2 failed",
+			},
+		},
+		{
+			name:     "invalid suite",
+			suites:   []string{invalid},
+			wantCode: 1,
+			want:     []string{"ERROR " + invalid + ": invalid test suite", "1 suite(s) could not be loaded"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			args := append([]string{"-config", configPath}, tt.suites...)
+			code := RunTests(args, &stdout, &stderr)
+			if code != tt.wantCode {
+				t.Errorf("RunTests() = %d, want %d; output:\n%s%s", code, tt.wantCode, stdout.String(), stderr.String())
+			}
+			// Collapse the coverage table's column padding
+			output := strings.Join(strings.Fields(stdout.String()), " ")
+			for _, want := range tt.want {
+				if !strings.Contains(output, want) {
+					t.Errorf("expected output to contain %q, got:\n%s", want, stdout.String())
+				}
+			}
+		})
+	}
+}
+
+func TestRunTestsJUnit(t *testing.T) {
+	configPath := writeFile(t, "config.yaml", `celRules:
+  - name: deny-prod
+    expression: "resourceAttributes.namespace == 'prod'"
+    effect: deny`)
+	suite := writeFile(t, "suite.yaml", `name: namespaces
+tests:
+  - name: prod denied
+    request:
+      resourceAttributes: {namespace: prod}
+    expect:
+      decision: Deny
+  - name: dev denied
+    request:
+      resourceAttributes: {namespace: dev}
+    expect:
+      decision: Deny`)
+	junitPath := filepath.Join(t.TempDir(), "junit.xml")
+
+	var stdout, stderr bytes.Buffer
+	if code := RunTests([]string{"-config", configPath, "-junit", junitPath, suite}, &stdout, &stderr); code != 1 {
+		t.Fatalf("RunTests() = %d, want 1; output:\n%s", code, stdout.String())
+	}
+
+	data, err := os.ReadFile(junitPath)
+	if err != nil {
+		t.Fatalf("Failed to read JUnit report: %v", err)
+	}
+	var report junitTestSuites
+	if err := xml.Unmarshal(data, &report); err != nil {
+		t.Fatalf("Failed to parse JUnit report: %v\n%s", err, data)
+	}
+
+	if len(report.Suites) != 1 {
+		t.Fatalf("got %d test suites, want 1", len(report.Suites))
+	}
+	got := report.Suites[0]
+	if got.Name != "namespaces" || got.Tests != 2 || got.Failures != 1 {
+		t.Errorf("testsuite = %s with %d tests and %d failures, want namespaces with 2 tests and 1 failure", got.Name, got.Tests, got.Failures)
+	}
+	if len(got.Cases) != 2 || got.Cases[0].Failure != nil || got.Cases[1].Failure == nil {
+		t.Errorf("testcases = %+v, want only the second to fail", got.Cases)
+	}
+	if len(got.Properties) == 0 || got.Properties[0] != (junitProperty{Name: "coverage.deny-prod", Value: "1"}) {
+		t.Errorf("properties = %+v, want coverage.deny-prod = 1 first", got.Properties)
+	}
+}
+
+func TestRunTestsNow(t *testing.T) {
+	configPath := writeFile(t, "config.yaml", `celRules:
+  - name: friday-freeze
+    expression: "now.weekday('Europe/London') == 'Friday' && now.timeOfDay('Europe/London') >= '15:00'"
+    effect: deny
+    match:
+      verbs: ["delete"]
+      namespaces: ["prod"]`)
+	suite := writeFile(t, "suite.yaml", `name: freeze
+tests:
+  - name: friday afternoon denied
+    now: 2026-10-16T15:30:00+01:00
+    request:
+      resourceAttributes: {verb: delete, namespace: prod}
+    expect:
+      decision: Deny
+      rule: friday-freeze
+  - name: friday morning not frozen
+    now: 2026-10-16T09:00:00+01:00
+    request:
+      resourceAttributes: {verb: delete, namespace: prod}
+    expect:
+      rule: builtin:default`)
+
+	var stdout, stderr bytes.Buffer
+	if code := RunTests([]string{"-config", configPath, suite}, &stdout, &stderr); code != 0 {
+		t.Fatalf("RunTests() = %d, want 0; output:\n%s%s", code, stdout.String(), stderr.String())
+	}
+}
+
+func TestRunTestsCluster(t *testing.T) {
+	configPath := writeFile(t, "config.yaml", `protectionPolicies:
+  - name: networking
+    names:
+      prefixes: ["aks-net-"]
+    deleteCollection: lookup
+  - name: protected-namespaces
+    protectedNamespaces:
+      labelSelector: "protected=true"`)
+	suite := writeFile(t, "suite.yaml", `name: lookups
+tests:
+  - name: collection with a protected pod
+    request:
+      resourceAttributes: {verb: deletecollection, resource: pods, namespace: default}
+    cluster:
+      objects:
+        - {resource: pods, namespace: default, name: aks-net-proxy}
+        - {resource: pods, namespace: other, name: web-0}
+    expect:
+      decision: Deny
+      reason: contains "aks-net-proxy"
+  - name: collection without protected pods
+    request:
+      resourceAttributes: {verb: deletecollection, resource: pods, namespace: other}
+    cluster:
+      objects:
+        - {resource: pods, namespace: default, name: aks-net-proxy}
+        - {resource: pods, namespace: other, name: web-0}
+    expect:
+      rule: builtin:default
+  - name: write to a labelled namespace
+    request:
+      resourceAttributes: {verb: create, resource: configmaps, namespace: infra}
+    cluster:
+      namespaces:
+        infra: {protected: "true"}
+    expect:
+      decision: Deny
+      rule: builtin:protection:protected-namespaces`)
+
+	var stdout, stderr bytes.Buffer
+	if code := RunTests([]string{"-config", configPath, "-v", suite}, &stdout, &stderr); code != 0 {
+		t.Fatalf("RunTests() = %d, want 0; output:\n%s%s", code, stdout.String(), stderr.String())
+	}
+
+	// Without cluster state the runner cannot reproduce the server's lookup
+	missing := writeFile(t, "missing.yaml", `tests:
+  - name: no cluster state
+    request:
+      resourceAttributes: {verb: deletecollection, resource: pods, namespace: default}
+    expect:
+      decision: Deny`)
+
+	stdout.Reset()
+	if code := RunTests([]string{"-config", configPath, missing}, &stdout, &stderr); code != 1 {
+		t.Errorf("RunTests() = %d, want 1; output:\n%s", code, stdout.String())
+	}
+	if !strings.Contains(stdout.String(), "FAIL  missing/no cluster state: a protection policy looks up the cluster") {
+		t.Errorf("expected the case to fail for its missing cluster state, got:\n%s", stdout.String())
+	}
+}
@@ -0,0 +1,55 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/imiller31/k8s-auth-webhook/cel"
+	"github.com/imiller31/k8s-auth-webhook/config"
+)
+
+// Validate implements the validate subcommand. It loads the configuration
+// with the same layering as the server, without requiring the TLS files to
+// exist, compiles every CEL rule and prints each problem found. It returns
+// the process exit code: 0 when the configuration is valid, 1 when it has
+// problems and 2 for usage errors.
+func Validate(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: webhook validate [-config file] [flags]\n\nCheck a configuration and its CEL rules without starting the server.\n\n")
+		fs.PrintDefaults()
+	}
+	loader := config.RegisterFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, err := loader.Resolve()
+	if err != nil {
+		fmt.Fprintf(stdout, "%s: %v\n", loader.ConfigFile(), err)
+		return 1
+	}
+
+	problems := cfg.Problems()
+	ruleProblems, err := cel.Check(cfg.CELRules)
+	if err != nil {
+		fmt.Fprintf(stdout, "%s: %v\n", loader.ConfigFile(), err)
+		return 1
+	}
+	for _, p := range ruleProblems {
+		problems = append(problems, p)
+	}
+
+	if len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Fprintf(stdout, "%s: %v\n", loader.ConfigFile(), p)
+		}
+		fmt.Fprintf(stdout, "%d problem(s) found\n", len(problems))
+		return 1
+	}
+
+	fmt.Fprintf(stdout, "%s: configuration is valid (%d CEL rules)\n", loader.ConfigFile(), len(cfg.CELRules))
+	return 0
+}
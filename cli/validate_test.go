@@ -0,0 +1,92 @@
+package cli
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFile writes a file into a temporary directory and returns its path
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write %s: %v", name, err)
+	}
+	return path
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		wantCode int
+		want     []string
+	}{
+		{
+			name: "valid without TLS files",
+			config: `tlsCertFile: /nonexistent/cert.pem
+celRules:
+  - name: protect
+    expression: "resourceAttributes.verb == 'delete'"
+    effect: deny`,
+			wantCode: 0,
+			want:     []string{"configuration is valid (1 CEL rules)"},
+		},
+		{
+			name: "every problem reported",
+			config: `defaultDecision: Perhaps
+celRules:
+  - name: typo
+    expression: "usr == 'alice'"
+    effect: deny
+  - name: not-bool
+    expression: "user"
+    effect: allow
+  - name: typo
+    expression: "true"`,
+			wantCode: 1,
+			want: []string{
+				"invalid defaultDecision",
+				`CEL rule 2: duplicate name "typo"`,
+				"CEL rule 2 (typo): no effect",
+				"CEL rule 0 (typo): expression:1:1: undeclared reference to 'usr'",
+				"CEL rule 1 (not-bool): expression: must evaluate to bool, got string",
+				"5 problem(s) found",
+			},
+		},
+		{
+			name:     "invalid YAML",
+			config:   "celRules: [",
+			wantCode: 1,
+			want:     []string{"failed to load config from YAML file"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configPath := writeFile(t, "config.yaml", tt.config)
+
+			var stdout, stderr bytes.Buffer
+			code := Validate([]string{"-config", configPath}, &stdout, &stderr)
+			if code != tt.wantCode {
+				t.Errorf("Validate() = %d, want %d; output:\n%s", code, tt.wantCode, stdout.String())
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(stdout.String(), want) {
+					t.Errorf("expected output to contain %q, got:\n%s", want, stdout.String())
+				}
+			}
+		})
+	}
+}
+
+func TestValidateUsage(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := Validate([]string{"-no-such-flag"}, &stdout, &stderr); code != 2 {
+		t.Errorf("Validate() = %d, want 2 for unknown flag", code)
+	}
+}
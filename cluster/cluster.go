@@ -0,0 +1,380 @@
+// Package cluster looks up objects in the cluster the webhook authorizes
+// requests for, using the apiserver's REST API directly
+package cluster
+
+import (
+	"container/list"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/imiller31/k8s-auth-webhook/config"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Resource identifies a collection of objects, e.g. the pods in a namespace.
+// An empty Namespace selects the objects in every namespace.
+type Resource struct {
+	Group     string
+	Version   string
+	Resource  string
+	Namespace string
+}
+
+func (r Resource) String() string {
+	resource := r.Resource
+	if r.Group != "" {
+		resource += "." + r.Group
+	}
+	if r.Namespace == "" {
+		return resource
+	}
+	return r.Namespace + "/" + resource
+}
+
+// Object identifies a single object; Namespace is empty for cluster-scoped objects
+type Object struct {
+	Namespace string
+	Name      string
+}
+
+// ObjectLister lists the objects of a resource. Implementations must be safe
+// for concurrent use.
+type ObjectLister interface {
+	List(ctx context.Context, resource Resource) ([]Object, error)
+}
+
+// Namespace is a namespace and its labels
+type Namespace struct {
+	Name   string
+	Labels map[string]string
+	// NotFound is set when the namespace does not exist
+	NotFound bool
+}
+
+// NamespaceGetter looks up namespaces. A namespace that does not exist is
+// returned without labels and with NotFound set rather than as an error. Implementations must be
+// safe for concurrent use.
+type NamespaceGetter interface {
+	GetNamespace(ctx context.Context, name string) (Namespace, error)
+}
+
+// listPageSize is the number of objects requested per page
+const listPageSize = 500
+
+// partialMetadataListAccept and partialMetadataAccept ask the apiserver for
+// the metadata of a list or an object only
+const (
+	partialMetadataListAccept = "application/json;as=PartialObjectMetadataList;v=v1;g=meta.k8s.io,application/json"
+	partialMetadataAccept     = "application/json;as=PartialObjectMetadata;v=v1;g=meta.k8s.io,application/json"
+)
+
+// errNotFound is returned by get when the apiserver has no such object
+var errNotFound = errors.New("not found")
+
+// APILister lists objects from the apiserver
+type APILister struct {
+	server    string
+	tokenFile string
+	client    *http.Client
+}
+
+// NewAPILister creates a lister for the apiserver described by cfg. An
+// empty server is taken from the environment of the webhook's pod, an
+// empty caFile uses the system roots and an empty tokenFile sends no token.
+func NewAPILister(cfg config.ClusterLookupConfig) (*APILister, error) {
+	server := cfg.Server
+	if server == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("clusterLookup.server is not set and the webhook is not running in a cluster")
+		}
+		server = "https://" + net.JoinHostPort(host, port)
+	}
+
+	if cfg.TokenFile != "" {
+		if _, err := os.Stat(cfg.TokenFile); err != nil {
+			return nil, fmt.Errorf("cluster lookup token file not found: %s", cfg.TokenFile)
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read cluster lookup CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in cluster lookup CA file %s", cfg.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+
+	return &APILister{
+		server:    strings.TrimSuffix(server, "/"),
+		tokenFile: cfg.TokenFile,
+		client:    &http.Client{Timeout: cfg.Timeout, Transport: transport},
+	}, nil
+}
+
+// List fetches the metadata of every object of the resource, following
+// continue tokens until the list is complete
+func (l *APILister) List(ctx context.Context, resource Resource) ([]Object, error) {
+	path, err := resourcePath(resource)
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []Object
+	continueToken := ""
+	for {
+		query := url.Values{"limit": {fmt.Sprint(listPageSize)}}
+		if continueToken != "" {
+			query.Set("continue", continueToken)
+		}
+
+		var list metav1.PartialObjectMetadataList
+		if err := l.get(ctx, path+"?"+query.Encode(), partialMetadataListAccept, &list); err != nil {
+			return nil, fmt.Errorf("failed to list %s: %v", resource, err)
+		}
+		for _, item := range list.Items {
+			objects = append(objects, Object{Namespace: item.Namespace, Name: item.Name})
+		}
+
+		if continueToken = list.Continue; continueToken == "" {
+			return objects, nil
+		}
+	}
+}
+
+// GetNamespace fetches the metadata of a namespace
+func (l *APILister) GetNamespace(ctx context.Context, name string) (Namespace, error) {
+	if name == "" {
+		return Namespace{}, fmt.Errorf("cannot get unnamed namespace")
+	}
+
+	var obj metav1.PartialObjectMetadata
+	err := l.get(ctx, "/api/v1/namespaces/"+url.PathEscape(name), partialMetadataAccept, &obj)
+	if errors.Is(err, errNotFound) {
+		return Namespace{Name: name, NotFound: true}, nil
+	}
+	if err != nil {
+		return Namespace{}, fmt.Errorf("failed to get namespace %s: %v", name, err)
+	}
+	return Namespace{Name: obj.Name, Labels: obj.Labels}, nil
+}
+
+// get fetches a path from the apiserver and decodes the JSON response into
+// out. It returns errNotFound when the apiserver returns 404.
+func (l *APILister) get(ctx context.Context, path, accept string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, l.server+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", accept)
+
+	if l.tokenFile != "" {
+		token, err := os.ReadFile(l.tokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to read token: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		if resp.StatusCode == http.StatusNotFound {
+			return errNotFound
+		}
+		return fmt.Errorf("apiserver returned status %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// resourcePath returns the REST path of a resource's collection. Core
+// resources default to version v1; other groups need an explicit version.
+func resourcePath(r Resource) (string, error) {
+	if r.Resource == "" || r.Resource == "*" {
+		return "", fmt.Errorf("cannot list unnamed resource %q", r.Resource)
+	}
+
+	version := r.Version
+	if version == "*" {
+		version = ""
+	}
+
+	var path string
+	if r.Group == "" {
+		if version == "" {
+			version = "v1"
+		}
+		path = "/api/" + url.PathEscape(version)
+	} else {
+		if r.Group == "*" || version == "" {
+			return "", fmt.Errorf("cannot list %s without a group and version", r)
+		}
+		path = "/apis/" + url.PathEscape(r.Group) + "/" + url.PathEscape(version)
+	}
+
+	if r.Namespace != "" {
+		path += "/namespaces/" + url.PathEscape(r.Namespace)
+	}
+	return path + "/" + url.PathEscape(r.Resource), nil
+}
+
+// cacheSize bounds the lookups a CachingLister keeps
+const cacheSize = 4096
+
+// CachingLister reuses the objects and namespaces looked up by another
+// lister for a while, keeping at most cacheSize results and evicting the
+// least recently used. Failed lookups and namespaces that do not exist are
+// not cached.
+type CachingLister struct {
+	lister ObjectLister
+	ttl    time.Duration
+	size   int
+	now    func() time.Time
+
+	mu      sync.Mutex
+	entries map[cacheKey]*list.Element
+	// lru holds *cacheEntry values, most recently used first
+	lru *list.List
+}
+
+// cacheKey identifies a lookup: the objects of a resource, or a namespace
+// when resource is unset
+type cacheKey struct {
+	resource  Resource
+	namespace string
+}
+
+// cacheEntry is a lookup result and when it stops being reused
+type cacheEntry struct {
+	key       cacheKey
+	objects   []Object
+	namespace Namespace
+	expires   time.Time
+}
+
+// NewCachingLister caches the results of lister for ttl. A zero ttl disables
+// caching. Namespaces can be looked up when lister is also a NamespaceGetter.
+func NewCachingLister(lister ObjectLister, ttl time.Duration) *CachingLister {
+	return &CachingLister{
+		lister:  lister,
+		ttl:     ttl,
+		size:    cacheSize,
+		now:     time.Now,
+		entries: make(map[cacheKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// List returns the cached objects of the resource or lists them afresh
+func (c *CachingLister) List(ctx context.Context, resource Resource) ([]Object, error) {
+	if c.ttl <= 0 {
+		return c.lister.List(ctx, resource)
+	}
+
+	key := cacheKey{resource: resource}
+	if entry, ok := c.get(key); ok {
+		return entry.objects, nil
+	}
+
+	objects, err := c.lister.List(ctx, resource)
+	if err != nil {
+		return nil, err
+	}
+
+	c.add(&cacheEntry{key: key, objects: objects})
+	return objects, nil
+}
+
+// GetNamespace returns the cached namespace or looks it up afresh
+func (c *CachingLister) GetNamespace(ctx context.Context, name string) (Namespace, error) {
+	getter, ok := c.lister.(NamespaceGetter)
+	if !ok {
+		return Namespace{}, fmt.Errorf("namespace lookup is not supported")
+	}
+	if c.ttl <= 0 {
+		return getter.GetNamespace(ctx, name)
+	}
+
+	key := cacheKey{namespace: name}
+	if entry, ok := c.get(key); ok {
+		return entry.namespace, nil
+	}
+
+	ns, err := getter.GetNamespace(ctx, name)
+	if err != nil {
+		return Namespace{}, err
+	}
+
+	// A namespace created with protecting labels must be seen at once, and
+	// requests for made-up names must not fill the cache
+	if !ns.NotFound {
+		c.add(&cacheEntry{key: key, namespace: ns})
+	}
+	return ns, nil
+}
+
+// get returns the unexpired result cached for key, dropping an expired one
+func (c *CachingLister) get(key cacheKey) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return cacheEntry{}, false
+	}
+
+	entry := elem.Value.(*cacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.remove(elem)
+		return cacheEntry{}, false
+	}
+
+	c.lru.MoveToFront(elem)
+	return *entry, true
+}
+
+// add caches a result for ttl, evicting the least recently used one when full
+func (c *CachingLister) add(entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry.expires = c.now().Add(c.ttl)
+	if elem, ok := c.entries[entry.key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	if c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove drops a result; the caller must hold mu
+func (c *CachingLister) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).key)
+}
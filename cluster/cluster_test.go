@@ -0,0 +1,257 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/imiller31/k8s-auth-webhook/config"
+)
+
+func TestResourcePath(t *testing.T) {
+	tests := []struct {
+		resource Resource
+		want     string
+		wantErr  bool
+	}{
+		{resource: Resource{Resource: "pods", Namespace: "default"}, want: "/api/v1/namespaces/default/pods"},
+		{resource: Resource{Version: "v1", Resource: "nodes"}, want: "/api/v1/nodes"},
+		{resource: Resource{Group: "apps", Version: "v1", Resource: "deployments", Namespace: "kube-system"}, want: "/apis/apps/v1/namespaces/kube-system/deployments"},
+		{resource: Resource{Group: "apps", Resource: "deployments"}, wantErr: true},
+		{resource: Resource{Group: "apps", Version: "*", Resource: "deployments"}, wantErr: true},
+		{resource: Resource{Version: "v1", Resource: "*"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.resource.String(), func(t *testing.T) {
+			got, err := resourcePath(tt.resource)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resourcePath() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("resourcePath() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAPILister(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("secret-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if !strings.Contains(r.Header.Get("Accept"), "as=PartialObjectMetadataList") {
+			t.Errorf("expected a metadata-only request, got Accept %q", r.Header.Get("Accept"))
+		}
+		switch {
+		case r.URL.Path == "/api/v1/namespaces/default/pods" && r.URL.Query().Get("continue") == "":
+			w.Write([]byte(`{"kind":"PartialObjectMetadataList","metadata":{"continue":"page-2"},"items":[{"metadata":{"name":"web-0","namespace":"default"}}]}`))
+		case r.URL.Path == "/api/v1/namespaces/default/pods" && r.URL.Query().Get("continue") == "page-2":
+			w.Write([]byte(`{"kind":"PartialObjectMetadataList","metadata":{},"items":[{"metadata":{"name":"aks-automatic-1","namespace":"default"}}]}`))
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+
+	lister, err := NewAPILister(config.ClusterLookupConfig{Server: server.URL, TokenFile: tokenFile, Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("NewAPILister() error = %v", err)
+	}
+
+	objects, err := lister.List(context.Background(), Resource{Version: "v1", Resource: "pods", Namespace: "default"})
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(objects) != 2 || objects[0].Name != "web-0" || objects[1] != (Object{Namespace: "default", Name: "aks-automatic-1"}) {
+		t.Errorf("List() = %+v, want web-0 and aks-automatic-1 from both pages", objects)
+	}
+
+	if _, err := lister.List(context.Background(), Resource{Version: "v1", Resource: "secrets", Namespace: "default"}); err == nil || !strings.Contains(err.Error(), "status 403") {
+		t.Errorf("List() error = %v, want the apiserver's status", err)
+	}
+
+	if _, err := NewAPILister(config.ClusterLookupConfig{Server: server.URL, TokenFile: "/nonexistent/token"}); err == nil {
+		t.Errorf("NewAPILister() with a missing token file succeeded, want error")
+	}
+}
+
+func TestAPIListerGetNamespace(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept"), "as=PartialObjectMetadata;") {
+			t.Errorf("expected a metadata-only request, got Accept %q", r.Header.Get("Accept"))
+		}
+		switch r.URL.Path {
+		case "/api/v1/namespaces/kube-system":
+			w.Write([]byte(`{"kind":"PartialObjectMetadata","metadata":{"name":"kube-system","labels":{"protected":"true"}}}`))
+		case "/api/v1/namespaces/gone":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+
+	lister, err := NewAPILister(config.ClusterLookupConfig{Server: server.URL, Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("NewAPILister() error = %v", err)
+	}
+
+	ns, err := lister.GetNamespace(context.Background(), "kube-system")
+	if err != nil || ns.Name != "kube-system" || ns.Labels["protected"] != "true" {
+		t.Errorf("GetNamespace() = %+v, %v, want kube-system labelled protected=true", ns, err)
+	}
+	if ns, err := lister.GetNamespace(context.Background(), "gone"); err != nil || ns.Name != "gone" || len(ns.Labels) != 0 || !ns.NotFound {
+		t.Errorf("GetNamespace() of a missing namespace = %+v, %v, want it not found without labels", ns, err)
+	}
+	if _, err := lister.GetNamespace(context.Background(), "secret"); err == nil || !strings.Contains(err.Error(), "status 403") {
+		t.Errorf("GetNamespace() error = %v, want the apiserver's status", err)
+	}
+}
+
+// countingLister counts the lookups it serves and fails while err is set.
+// Namespaces named missing-* do not exist.
+type countingLister struct {
+	calls int
+	err   error
+}
+
+func (c *countingLister) List(ctx context.Context, resource Resource) ([]Object, error) {
+	c.calls++
+	if c.err != nil {
+		return nil, c.err
+	}
+	return []Object{{Namespace: resource.Namespace, Name: "web-0"}}, nil
+}
+
+func (c *countingLister) GetNamespace(ctx context.Context, name string) (Namespace, error) {
+	c.calls++
+	if c.err != nil {
+		return Namespace{}, c.err
+	}
+	if strings.HasPrefix(name, "missing-") {
+		return Namespace{Name: name, NotFound: true}, nil
+	}
+	return Namespace{Name: name, Labels: map[string]string{"protected": "true"}}, nil
+}
+
+func TestCachingLister(t *testing.T) {
+	backend := &countingLister{}
+	cache := NewCachingLister(backend, time.Minute)
+	now := time.Unix(1000, 0)
+	cache.now = func() time.Time { return now }
+	pods := Resource{Version: "v1", Resource: "pods", Namespace: "default"}
+
+	backend.err = errors.New("connection refused")
+	if _, err := cache.List(context.Background(), pods); err == nil {
+		t.Fatalf("List() error = nil, want the backend's error")
+	}
+	backend.err = nil
+
+	for i := 0; i < 3; i++ {
+		if objects, err := cache.List(context.Background(), pods); err != nil || len(objects) != 1 {
+			t.Fatalf("List() = %v, %v", objects, err)
+		}
+	}
+	if backend.calls != 2 {
+		t.Errorf("expected the failed lookup not to be cached and the rest to be served from cache, got %d backend calls", backend.calls)
+	}
+
+	cache.List(context.Background(), Resource{Version: "v1", Resource: "pods", Namespace: "kube-system"})
+	if backend.calls != 3 {
+		t.Errorf("expected a separate entry per namespace, got %d backend calls", backend.calls)
+	}
+
+	now = now.Add(2 * time.Minute)
+	cache.List(context.Background(), pods)
+	if backend.calls != 4 {
+		t.Errorf("expected an expired entry to be listed again, got %d backend calls", backend.calls)
+	}
+}
+
+func TestCachingListerNamespaces(t *testing.T) {
+	backend := &countingLister{}
+	cache := NewCachingLister(backend, time.Minute)
+	now := time.Unix(1000, 0)
+	cache.now = func() time.Time { return now }
+
+	backend.err = errors.New("connection refused")
+	if _, err := cache.GetNamespace(context.Background(), "kube-system"); err == nil {
+		t.Fatalf("GetNamespace() error = nil, want the backend's error")
+	}
+	backend.err = nil
+
+	for i := 0; i < 3; i++ {
+		if ns, err := cache.GetNamespace(context.Background(), "kube-system"); err != nil || ns.Labels["protected"] != "true" {
+			t.Fatalf("GetNamespace() = %+v, %v", ns, err)
+		}
+	}
+	if backend.calls != 2 {
+		t.Errorf("expected the failed lookup not to be cached and the rest to be served from cache, got %d backend calls", backend.calls)
+	}
+
+	now = now.Add(2 * time.Minute)
+	cache.GetNamespace(context.Background(), "kube-system")
+	if backend.calls != 3 {
+		t.Errorf("expected an expired entry to be looked up again, got %d backend calls", backend.calls)
+	}
+
+	for i := 0; i < 2; i++ {
+		if ns, err := cache.GetNamespace(context.Background(), "missing-ns"); err != nil || !ns.NotFound {
+			t.Fatalf("GetNamespace() = %+v, %v, want not found", ns, err)
+		}
+	}
+	if backend.calls != 5 {
+		t.Errorf("expected a missing namespace not to be cached, got %d backend calls", backend.calls)
+	}
+}
+
+func TestCachingListerBounded(t *testing.T) {
+	backend := &countingLister{}
+	cache := NewCachingLister(backend, time.Minute)
+	cache.size = 10
+	now := time.Unix(1000, 0)
+	cache.now = func() time.Time { return now }
+
+	for i := 0; i < 100; i++ {
+		cache.List(context.Background(), Resource{Version: "v1", Resource: "pods", Namespace: fmt.Sprintf("ns-%d", i)})
+		cache.GetNamespace(context.Background(), fmt.Sprintf("ns-%d", i))
+		cache.GetNamespace(context.Background(), fmt.Sprintf("missing-%d", i))
+	}
+	if len(cache.entries) != 10 || cache.lru.Len() != 10 {
+		t.Fatalf("expected the cache to hold 10 lookups, got %d entries and %d in the LRU list", len(cache.entries), cache.lru.Len())
+	}
+
+	// The most recent lookups are kept and the oldest evicted
+	calls := backend.calls
+	cache.GetNamespace(context.Background(), "ns-99")
+	if backend.calls != calls {
+		t.Errorf("expected the most recent namespace to be served from cache")
+	}
+	cache.List(context.Background(), Resource{Version: "v1", Resource: "pods", Namespace: "ns-0"})
+	if backend.calls != calls+1 {
+		t.Errorf("expected the oldest list to have been evicted")
+	}
+
+	// Expired lookups are dropped when they are next looked up, even if
+	// the lookup then fails
+	now = now.Add(2 * time.Minute)
+	backend.err = errors.New("connection refused")
+	cache.GetNamespace(context.Background(), "ns-99")
+	if _, ok := cache.entries[cacheKey{namespace: "ns-99"}]; ok || len(cache.entries) != 9 {
+		t.Errorf("expected the expired namespace to be dropped, got %d entries", len(cache.entries))
+	}
+}
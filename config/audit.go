@@ -0,0 +1,67 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// Audit sink types
+const (
+	AuditSinkStdout  = "stdout"
+	AuditSinkFile    = "file"
+	AuditSinkWebhook = "webhook"
+)
+
+// AuditConfig configures where decision audit records are sent. Every sink
+// has its own buffer, so a slow sink drops records rather than delaying
+// authorization or other sinks.
+type AuditConfig struct {
+	// BufferSize is the number of records queued per sink before new records are dropped
+	BufferSize int `yaml:"bufferSize"`
+	// BatchSize is the maximum number of records written to a sink at once
+	BatchSize int `yaml:"batchSize"`
+	// FlushInterval is the longest a record waits in the queue before being written
+	FlushInterval time.Duration `yaml:"flushInterval"`
+	Sinks         []AuditSink   `yaml:"sinks"`
+}
+
+// AuditSink configures a single audit destination
+type AuditSink struct {
+	// Type is one of stdout, file or webhook
+	Type string `yaml:"type"`
+
+	// Path is the log file written by file sinks
+	Path string `yaml:"path"`
+	// MaxSizeMB is the size at which a file sink rotates its log file
+	MaxSizeMB int `yaml:"maxSizeMB"`
+	// MaxBackups is the number of rotated files a file sink keeps
+	MaxBackups int `yaml:"maxBackups"`
+
+	// URL receives batches of records as a JSON array from webhook sinks
+	URL string `yaml:"url"`
+	// Timeout bounds each webhook sink request
+	Timeout time.Duration `yaml:"timeout"`
+	// BearerTokenFile holds a token sent in the Authorization header by webhook sinks
+	BearerTokenFile string `yaml:"bearerTokenFile"`
+}
+
+// validate checks that every sink has the settings its type requires
+func (a *AuditConfig) validate() error {
+	for i, sink := range a.Sinks {
+		switch sink.Type {
+		case AuditSinkStdout:
+		case AuditSinkFile:
+			if sink.Path == "" {
+				return fmt.Errorf("audit sink %d: file sink requires a path", i)
+			}
+		case AuditSinkWebhook:
+			if sink.URL == "" {
+				return fmt.Errorf("audit sink %d: webhook sink requires a url", i)
+			}
+		default:
+			return fmt.Errorf("audit sink %d: unknown type %q, must be one of %s, %s or %s",
+				i, sink.Type, AuditSinkStdout, AuditSinkFile, AuditSinkWebhook)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// BreakGlassConfig configures time-bound grants that let named users or
+// groups through protection policies during incidents
+type BreakGlassConfig struct {
+	// GrantsFile is a YAML file of grants, re-read whenever it changes.
+	// Empty disables file grants.
+	GrantsFile string `yaml:"grantsFile"`
+	// AdminTokenFile holds the bearer tokens accepted by the admin API, one
+	// per line. Empty disables the admin API.
+	AdminTokenFile string `yaml:"adminTokenFile"`
+	// MaxDuration is the longest a grant may last
+	MaxDuration time.Duration `yaml:"maxDuration"`
+	// CheckInterval is how often expired grants are revoked and the grants
+	// file is checked for changes
+	CheckInterval time.Duration `yaml:"checkInterval"`
+}
+
+// Enabled reports whether grants can be created at all
+func (c *BreakGlassConfig) Enabled() bool {
+	return c.GrantsFile != "" || c.AdminTokenFile != ""
+}
+
+// validate rejects non-positive durations
+func (c *BreakGlassConfig) validate() error {
+	if c.MaxDuration <= 0 {
+		return fmt.Errorf("breakGlass.maxDuration must be positive")
+	}
+	if c.CheckInterval <= 0 {
+		return fmt.Errorf("breakGlass.checkInterval must be positive")
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// DecisionCacheConfig configures the in-process cache of recent decisions,
+// modeled on the apiserver's webhook authorizedTTL and unauthorizedTTL
+type DecisionCacheConfig struct {
+	// Size is the maximum number of cached decisions. Zero disables the cache.
+	Size int `yaml:"size"`
+	// AllowTTL is how long Allow decisions are cached
+	AllowTTL time.Duration `yaml:"allowTTL"`
+	// DenyTTL is how long Deny and NoOpinion decisions are cached
+	DenyTTL time.Duration `yaml:"denyTTL"`
+}
+
+// validate rejects negative sizes and TTLs
+func (c *DecisionCacheConfig) validate() error {
+	if c.Size < 0 {
+		return fmt.Errorf("decisionCache.size must not be negative")
+	}
+	if c.AllowTTL < 0 || c.DenyTTL < 0 {
+		return fmt.Errorf("decisionCache TTLs must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// In-cluster service account credentials mounted into every pod
+const (
+	inClusterTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	inClusterCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+// ClusterLookupConfig configures read access to the cluster, used by
+// protection policies that look up which objects exist
+type ClusterLookupConfig struct {
+	// Server is the apiserver URL. When empty it is derived from the
+	// KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT variables set in pods.
+	Server string `yaml:"server"`
+	// TokenFile holds the bearer token sent to the apiserver; it is re-read
+	// on every request so rotated service account tokens are picked up
+	TokenFile string `yaml:"tokenFile"`
+	// CAFile verifies the apiserver's serving certificate
+	CAFile string `yaml:"caFile"`
+	// Timeout bounds each lookup; keep it well below the apiserver's webhook timeout
+	Timeout time.Duration `yaml:"timeout"`
+	// CacheTTL is how long lookup results are reused
+	CacheTTL time.Duration `yaml:"cacheTTL"`
+}
+
+// validate rejects non-positive timeouts and negative TTLs
+func (c *ClusterLookupConfig) validate() error {
+	if c.Timeout <= 0 {
+		return fmt.Errorf("clusterLookup.timeout must be positive")
+	}
+	if c.CacheTTL < 0 {
+		return fmt.Errorf("clusterLookup.cacheTTL must not be negative")
+	}
+	return nil
+}
@@ -2,21 +2,81 @@ package config
 
 import (
 	"fmt"
-	"log"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/imiller31/k8s-auth-webhook/decision"
 	"gopkg.in/yaml.v3"
 )
 
 // Config holds all configuration for the webhook server
 type Config struct {
-	Port            string   `yaml:"port"`
-	TLSCertFile     string   `yaml:"tlsCertFile"`
-	TLSKeyFile      string   `yaml:"tlsKeyFile"`
-	ProtectedPrefix string   `yaml:"protectedPrefix"`
-	PrivilegedUser  string   `yaml:"privilegedUser"`
-	SupportUser     string   `yaml:"supportUser"`
-	CELRules        []string `yaml:"celRules"`
+	Port        string `yaml:"port"`
+	TLSCertFile string `yaml:"tlsCertFile"`
+	TLSKeyFile  string `yaml:"tlsKeyFile"`
+	// ProtectedPrefix and PrivilegedUser configure a single protection
+	// policy when ProtectionPolicies is empty
+	ProtectedPrefix string `yaml:"protectedPrefix"`
+	PrivilegedUser  string `yaml:"privilegedUser"`
+	// SupportUser is deprecated and ignored
+	SupportUser string `yaml:"supportUser"`
+	// PrivilegedUsers, PrivilegedGroups and PrivilegedServiceAccounts are
+	// allowed by every protection policy. Service accounts are patterns
+	// accepted by ParseServiceAccount.
+	PrivilegedUsers           []string `yaml:"privilegedUsers"`
+	PrivilegedGroups          []string `yaml:"privilegedGroups"`
+	PrivilegedServiceAccounts []string `yaml:"privilegedServiceAccounts"`
+	// ProtectionPolicies protect families of managed resources, each with
+	// its own allowed principals
+	ProtectionPolicies []ProtectionPolicy `yaml:"protectionPolicies"`
+	// Impersonation decides who may impersonate which identities
+	Impersonation ImpersonationConfig `yaml:"impersonation"`
+	CELRules      []CELRule           `yaml:"celRules"`
+	// DefaultDecision is returned for requests no check has an opinion on.
+	// One of Allow, Deny or NoOpinion.
+	DefaultDecision string `yaml:"defaultDecision"`
+	// Enforcement is enforce or audit. In audit mode every denial by a CEL
+	// rule or built-in check is recorded but not applied.
+	Enforcement string `yaml:"enforcement"`
+	// ClientCAFile enables mutual TLS: callers must present a certificate
+	// signed by a CA in this bundle
+	ClientCAFile string `yaml:"clientCAFile"`
+	// AllowedClientCNs and AllowedClientSANs restrict which verified client
+	// certificates are accepted; when both are empty any is accepted
+	AllowedClientCNs  []string `yaml:"allowedClientCNs"`
+	AllowedClientSANs []string `yaml:"allowedClientSANs"`
+	// TokenFile holds the bearer tokens accepted from callers, one per line.
+	// When empty, bearer tokens are not required.
+	TokenFile string `yaml:"tokenFile"`
+	// ExplainTokenFile holds the bearer tokens accepted by the /explain
+	// endpoint, one per line. When empty, the endpoint is not served.
+	ExplainTokenFile string `yaml:"explainTokenFile"`
+	// MetricsPort serves Prometheus metrics over plain HTTP. Empty disables it.
+	MetricsPort string `yaml:"metricsPort"`
+	// Audit configures the structured decision audit log
+	Audit AuditConfig `yaml:"audit"`
+	// DecisionCache caches recent decisions; it is emptied whenever the
+	// policy is reloaded
+	DecisionCache DecisionCacheConfig `yaml:"decisionCache"`
+	// ClusterLookup configures read access to the cluster for protection
+	// policies that look up which objects exist
+	ClusterLookup ClusterLookupConfig `yaml:"clusterLookup"`
+	// BreakGlass configures time-bound grants through protection policies
+	BreakGlass BreakGlassConfig `yaml:"breakGlass"`
+	// ReloadInterval is how often the config file is checked for changes.
+	// A negative value disables polling; SIGHUP still triggers a reload.
+	ReloadInterval time.Duration `yaml:"reloadInterval"`
+	// DrainPeriod is how long the server keeps serving after reporting not
+	// ready on shutdown, so load balancers stop routing to it. A negative
+	// value disables draining.
+	DrainPeriod time.Duration `yaml:"drainPeriod"`
+	// ShutdownTimeout bounds how long in-flight requests may take to finish
+	// once the server stops accepting connections
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+
+	// Sources records the layer each setting's value came from, by YAML key
+	Sources map[string]Source `yaml:"-"`
 }
 
 // DefaultConfig returns a configuration with default values
@@ -26,72 +86,166 @@ func DefaultConfig() *Config {
 		ProtectedPrefix: "aks-automatic-",
 		PrivilegedUser:  "support",
 		SupportUser:     "support",
-		CELRules:        []string{},
+		// Copied so decoding into a loaded configuration never touches the defaults
+		PrivilegedGroups:          append([]string(nil), defaultPrivilegedGroups...),
+		PrivilegedServiceAccounts: append([]string(nil), defaultPrivilegedServiceAccounts...),
+		Impersonation: ImpersonationConfig{
+			ProtectedUsers:  append([]string(nil), defaultProtectedUsers...),
+			ProtectedGroups: append([]string(nil), defaultProtectedGroups...),
+			Unmatched:       ImpersonationUnmatchedNoOpinion,
+		},
+		CELRules:        []CELRule{},
+		DefaultDecision: decision.NoOpinion.String(),
+		Enforcement:     EnforcementEnforce,
+		MetricsPort:     "9090",
+		Audit: AuditConfig{
+			BufferSize:    1000,
+			BatchSize:     100,
+			FlushInterval: time.Second,
+		},
+		DecisionCache: DecisionCacheConfig{
+			AllowTTL: 5 * time.Minute,
+			DenyTTL:  30 * time.Second,
+		},
+		ClusterLookup: ClusterLookupConfig{
+			TokenFile: inClusterTokenFile,
+			CAFile:    inClusterCAFile,
+			Timeout:   time.Second,
+			CacheTTL:  30 * time.Second,
+		},
+		BreakGlass: BreakGlassConfig{
+			MaxDuration:   4 * time.Hour,
+			CheckInterval: 10 * time.Second,
+		},
+		ReloadInterval:  10 * time.Second,
+		DrainPeriod:     5 * time.Second,
+		ShutdownTimeout: 20 * time.Second,
 	}
 }
 
-// Load creates a new Config from a YAML file
+// Load creates a new Config from the defaults and a YAML file, without
+// environment or command-line overrides
 func Load(configFile string) (*Config, error) {
-	// Start with default configuration
-	cfg := DefaultConfig()
-
-	// Load configuration from YAML file
-	if configFile != "" {
-		if err := cfg.loadFromYAML(configFile); err != nil {
-			return nil, fmt.Errorf("failed to load config from YAML file: %v", err)
-		}
-	}
+	return NewLoader(configFile).Load()
+}
 
+// validate checks the merged configuration and that the files it references exist
+func (cfg *Config) validate() error {
 	// Validate required fields
 	if cfg.TLSCertFile == "" || cfg.TLSKeyFile == "" {
-		return nil, fmt.Errorf("tlsCertFile and tlsKeyFile are required in configuration")
+		return fmt.Errorf("tlsCertFile and tlsKeyFile are required in configuration")
+	}
+
+	if problems := cfg.Problems(); len(problems) > 0 {
+		return problems[0]
 	}
 
 	// Check if TLS files exist
 	if _, err := os.Stat(cfg.TLSCertFile); err != nil {
-		return nil, fmt.Errorf("TLS certificate file not found: %s", cfg.TLSCertFile)
+		return fmt.Errorf("TLS certificate file not found: %s", cfg.TLSCertFile)
 	}
 	if _, err := os.Stat(cfg.TLSKeyFile); err != nil {
-		return nil, fmt.Errorf("TLS key file not found: %s", cfg.TLSKeyFile)
+		return fmt.Errorf("TLS key file not found: %s", cfg.TLSKeyFile)
+	}
+	if cfg.ClientCAFile != "" {
+		if _, err := os.Stat(cfg.ClientCAFile); err != nil {
+			return fmt.Errorf("client CA file not found: %s", cfg.ClientCAFile)
+		}
+	}
+	if cfg.TokenFile != "" {
+		if _, err := os.Stat(cfg.TokenFile); err != nil {
+			return fmt.Errorf("token file not found: %s", cfg.TokenFile)
+		}
+	}
+	if cfg.ExplainTokenFile != "" {
+		if _, err := os.Stat(cfg.ExplainTokenFile); err != nil {
+			return fmt.Errorf("explain token file not found: %s", cfg.ExplainTokenFile)
+		}
+	}
+	if cfg.BreakGlass.AdminTokenFile != "" {
+		if _, err := os.Stat(cfg.BreakGlass.AdminTokenFile); err != nil {
+			return fmt.Errorf("break-glass admin token file not found: %s", cfg.BreakGlass.AdminTokenFile)
+		}
+	}
+
+	return nil
+}
+
+// Problems returns every problem with the settings that does not depend on
+// the environment. Unlike Load it does not require the TLS files and other
+// referenced files to exist, so configurations can be checked offline.
+func (cfg *Config) Problems() []error {
+	var problems []error
+
+	if _, err := decision.Parse(cfg.DefaultDecision); err != nil {
+		problems = append(problems, fmt.Errorf("invalid defaultDecision: %v", err))
 	}
 
-	log.Printf("Loaded configuration: Port=%s, ProtectedPrefix=%s, PrivilegedUser=%s, CELRules=%v",
-		cfg.Port, cfg.ProtectedPrefix, cfg.PrivilegedUser, cfg.CELRules)
+	if _, err := ParseEnforcement(cfg.Enforcement); err != nil {
+		problems = append(problems, fmt.Errorf("invalid enforcement: %v", err))
+	}
+
+	problems = append(problems, cfg.ruleProblems()...)
+	problems = append(problems, cfg.protectionProblems()...)
+	problems = append(problems, cfg.privilegedProblems()...)
+	problems = append(problems, cfg.impersonationProblems()...)
+
+	if cfg.ShutdownTimeout < 0 {
+		problems = append(problems, fmt.Errorf("shutdownTimeout must not be negative"))
+	}
+
+	if err := cfg.Audit.validate(); err != nil {
+		problems = append(problems, err)
+	}
 
-	return cfg, nil
+	if err := cfg.DecisionCache.validate(); err != nil {
+		problems = append(problems, err)
+	}
+
+	if err := cfg.ClusterLookup.validate(); err != nil {
+		problems = append(problems, err)
+	}
+
+	if err := cfg.BreakGlass.validate(); err != nil {
+		problems = append(problems, err)
+	}
+
+	return problems
 }
 
-// loadFromYAML loads configuration from a YAML file
+// loadFromYAML overlays the settings present in a YAML file and records
+// them as coming from the file
 func (c *Config) loadFromYAML(filename string) error {
 	data, err := os.ReadFile(filename)
 	if err != nil {
 		return err
 	}
 
-	var yamlConfig Config
-	if err := yaml.Unmarshal(data, &yamlConfig); err != nil {
+	// Decoding onto the current values only replaces fields the file sets
+	if err := yaml.Unmarshal(data, c); err != nil {
 		return err
 	}
 
-	// Update fields that are set in the YAML file
-	if yamlConfig.Port != "" {
-		c.Port = yamlConfig.Port
-	}
-	if yamlConfig.TLSCertFile != "" {
-		c.TLSCertFile = yamlConfig.TLSCertFile
-	}
-	if yamlConfig.TLSKeyFile != "" {
-		c.TLSKeyFile = yamlConfig.TLSKeyFile
-	}
-	if yamlConfig.ProtectedPrefix != "" {
-		c.ProtectedPrefix = yamlConfig.ProtectedPrefix
-	}
-	if yamlConfig.PrivilegedUser != "" {
-		c.PrivilegedUser = yamlConfig.PrivilegedUser
+	var present map[string]interface{}
+	if err := yaml.Unmarshal(data, &present); err != nil {
+		return err
 	}
-	if len(yamlConfig.CELRules) > 0 {
-		c.CELRules = yamlConfig.CELRules
+	for _, s := range settings {
+		if hasKey(present, s.key) {
+			c.Sources[s.key] = SourceFile
+		}
 	}
 
 	return nil
 }
+
+// hasKey reports whether the dotted key path is present in a decoded YAML document
+func hasKey(doc map[string]interface{}, key string) bool {
+	head, rest, nested := strings.Cut(key, ".")
+	value, ok := doc[head]
+	if !ok || !nested {
+		return ok
+	}
+	child, ok := value.(map[string]interface{})
+	return ok && hasKey(child, rest)
+}
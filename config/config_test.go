@@ -5,6 +5,7 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestLoad(t *testing.T) {
@@ -43,6 +44,9 @@ tlsKeyFile: "test-key.pem"`,
 				if len(cfg.CELRules) != 0 {
 					t.Errorf("expected empty CELRules, got %v", cfg.CELRules)
 				}
+				if cfg.DefaultDecision != "NoOpinion" {
+					t.Errorf("expected DefaultDecision=NoOpinion, got %s", cfg.DefaultDecision)
+				}
 			},
 		},
 		{
@@ -75,8 +79,11 @@ celRules:
 				if len(cfg.CELRules) != 2 {
 					t.Errorf("expected 2 CELRules, got %d", len(cfg.CELRules))
 				}
-				if cfg.CELRules[0] != "rule1" || cfg.CELRules[1] != "rule2" {
-					t.Errorf("expected CELRules=[rule1 rule2], got %v", cfg.CELRules)
+				if cfg.CELRules[0].Expression != "!(rule1)" || cfg.CELRules[1].Expression != "!(rule2)" {
+					t.Errorf("expected legacy CELRules to be negated deny rules, got %v", cfg.CELRules)
+				}
+				if cfg.CELRules[0].Effect != "deny" || cfg.CELRules[0].Name != "rule-0" {
+					t.Errorf("expected legacy CELRule to be deny rule named rule-0, got %+v", cfg.CELRules[0])
 				}
 			},
 		},
@@ -92,6 +99,490 @@ tlsKeyFile: "test-key.pem"`,
 tlsCertFile: "test-cert.pem"`,
 			wantErr: true,
 		},
+		{
+			name: "structured CEL rules",
+			yamlFile: `port: "8443"
+tlsCertFile: "test-cert.pem"
+tlsKeyFile: "test-key.pem"
+celRules:
+  - name: protect-managed
+    expression: "resourceAttributes.name.startsWith('aks-automatic-')"
+    effect: deny
+    message: "Managed resources cannot be deleted"
+    messageExpression: "'user ' + user + ' may not delete managed resources'"
+    match:
+      verbs: ["delete"]
+      resources: ["pods"]`,
+			wantErr: false,
+			validate: func(t *testing.T, cfg *Config) {
+				if len(cfg.CELRules) != 1 {
+					t.Fatalf("expected 1 CELRule, got %d", len(cfg.CELRules))
+				}
+				rule := cfg.CELRules[0]
+				if rule.Name != "protect-managed" || rule.Effect != "deny" || rule.Message != "Managed resources cannot be deleted" {
+					t.Errorf("unexpected rule: %+v", rule)
+				}
+				if rule.MessageExpression == "" {
+					t.Error("expected messageExpression to be set")
+				}
+				if len(rule.Match.Verbs) != 1 || rule.Match.Verbs[0] != "delete" {
+					t.Errorf("expected match verbs [delete], got %v", rule.Match.Verbs)
+				}
+				if len(rule.Match.Resources) != 1 || rule.Match.Resources[0] != "pods" {
+					t.Errorf("expected match resources [pods], got %v", rule.Match.Resources)
+				}
+			},
+		},
+		{
+			name: "duplicate CEL rule names",
+			yamlFile: `port: "8443"
+tlsCertFile: "test-cert.pem"
+tlsKeyFile: "test-key.pem"
+celRules:
+  - name: same
+    expression: "true"
+    effect: deny
+  - name: same
+    expression: "false"
+    effect: allow`,
+			wantErr: true,
+		},
+		{
+			name: "CEL rule without effect",
+			yamlFile: `port: "8443"
+tlsCertFile: "test-cert.pem"
+tlsKeyFile: "test-key.pem"
+celRules:
+  - name: missing-effect
+    expression: "true"`,
+			wantErr: true,
+		},
+		{
+			name: "custom default decision",
+			yamlFile: `port: "8443"
+tlsCertFile: "test-cert.pem"
+tlsKeyFile: "test-key.pem"
+defaultDecision: "Allow"
+reloadInterval: "30s"`,
+			wantErr: false,
+			validate: func(t *testing.T, cfg *Config) {
+				if cfg.DefaultDecision != "Allow" {
+					t.Errorf("expected DefaultDecision=Allow, got %s", cfg.DefaultDecision)
+				}
+				if cfg.ReloadInterval != 30*time.Second {
+					t.Errorf("expected ReloadInterval=30s, got %s", cfg.ReloadInterval)
+				}
+			},
+		},
+		{
+			name: "shutdown settings",
+			yamlFile: `port: "8443"
+tlsCertFile: "test-cert.pem"
+tlsKeyFile: "test-key.pem"
+drainPeriod: "-1s"
+shutdownTimeout: "45s"`,
+			wantErr: false,
+			validate: func(t *testing.T, cfg *Config) {
+				if cfg.DrainPeriod != -time.Second {
+					t.Errorf("expected DrainPeriod=-1s, got %s", cfg.DrainPeriod)
+				}
+				if cfg.ShutdownTimeout != 45*time.Second {
+					t.Errorf("expected ShutdownTimeout=45s, got %s", cfg.ShutdownTimeout)
+				}
+			},
+		},
+		{
+			name: "decision cache",
+			yamlFile: `port: "8443"
+tlsCertFile: "test-cert.pem"
+tlsKeyFile: "test-key.pem"
+decisionCache:
+  size: 1000
+  denyTTL: 5s`,
+			wantErr: false,
+			validate: func(t *testing.T, cfg *Config) {
+				if cfg.DecisionCache.Size != 1000 {
+					t.Errorf("expected DecisionCache.Size=1000, got %d", cfg.DecisionCache.Size)
+				}
+				if cfg.DecisionCache.AllowTTL != 5*time.Minute {
+					t.Errorf("expected default DecisionCache.AllowTTL=5m, got %s", cfg.DecisionCache.AllowTTL)
+				}
+				if cfg.DecisionCache.DenyTTL != 5*time.Second {
+					t.Errorf("expected DecisionCache.DenyTTL=5s, got %s", cfg.DecisionCache.DenyTTL)
+				}
+			},
+		},
+		{
+			name: "negative decision cache size",
+			yamlFile: `port: "8443"
+tlsCertFile: "test-cert.pem"
+tlsKeyFile: "test-key.pem"
+decisionCache:
+  size: -1`,
+			wantErr: true,
+		},
+		{
+			name: "audit enforcement",
+			yamlFile: `port: "8443"
+tlsCertFile: "test-cert.pem"
+tlsKeyFile: "test-key.pem"
+enforcement: audit
+celRules:
+  - name: trial
+    expression: "true"
+    effect: deny
+    enforcement: audit`,
+			wantErr: false,
+			validate: func(t *testing.T, cfg *Config) {
+				if cfg.Enforcement != EnforcementAudit {
+					t.Errorf("expected Enforcement=audit, got %s", cfg.Enforcement)
+				}
+				if cfg.CELRules[0].Enforcement != EnforcementAudit {
+					t.Errorf("expected rule Enforcement=audit, got %s", cfg.CELRules[0].Enforcement)
+				}
+			},
+		},
+		{
+			name: "invalid enforcement",
+			yamlFile: `port: "8443"
+tlsCertFile: "test-cert.pem"
+tlsKeyFile: "test-key.pem"
+enforcement: dry-run`,
+			wantErr: true,
+		},
+		{
+			name: "audit enforcement on allow rule",
+			yamlFile: `port: "8443"
+tlsCertFile: "test-cert.pem"
+tlsKeyFile: "test-key.pem"
+celRules:
+  - name: trial
+    expression: "true"
+    effect: allow
+    enforcement: audit`,
+			wantErr: true,
+		},
+		{
+			name: "protection policies",
+			yamlFile: `port: "8443"
+tlsCertFile: "test-cert.pem"
+tlsKeyFile: "test-key.pem"
+protectionPolicies:
+  - name: node-pools
+    names:
+      prefixes: ["aks-pool-"]
+      globs: ["managed-*-pool"]
+      regexes: ["^np[0-9]+$"]
+    resources: ["pools"]
+    verbs: ["delete", "update"]
+    allowedUsers: ["pool-operator"]
+    allowedServiceAccounts: ["kube-system/pool-controller"]`,
+			wantErr: false,
+			validate: func(t *testing.T, cfg *Config) {
+				policies := cfg.EffectiveProtectionPolicies()
+				if len(policies) != 1 || policies[0].Name != "node-pools" {
+					t.Fatalf("expected the node-pools policy, got %+v", policies)
+				}
+				if got := policies[0].ProtectedVerbs(); len(got) != 2 || got[1] != "update" {
+					t.Errorf("expected verbs [delete update], got %v", got)
+				}
+			},
+		},
+		{
+			name: "protection policy problems",
+			yamlFile: `port: "8443"
+tlsCertFile: "test-cert.pem"
+tlsKeyFile: "test-key.pem"
+protectionPolicies:
+  - name: broken
+    names:
+      regexes: ["("]
+    allowedServiceAccounts: ["pool-controller"]`,
+			wantErr: true,
+		},
+		{
+			name: "privileged principals",
+			yamlFile: `port: "8443"
+tlsCertFile: "test-cert.pem"
+tlsKeyFile: "test-key.pem"
+privilegedUsers: ["break-glass"]
+privilegedGroups: ["system:masters"]
+privilegedServiceAccounts: ["system:serviceaccount:kube-system:*"]`,
+			wantErr: false,
+			validate: func(t *testing.T, cfg *Config) {
+				if len(cfg.PrivilegedUsers) != 1 || cfg.PrivilegedUsers[0] != "break-glass" {
+					t.Errorf("expected PrivilegedUsers=[break-glass], got %v", cfg.PrivilegedUsers)
+				}
+				if len(cfg.PrivilegedGroups) != 1 {
+					t.Errorf("expected the file to replace the default PrivilegedGroups, got %v", cfg.PrivilegedGroups)
+				}
+				if len(defaultPrivilegedGroups) != 2 {
+					t.Errorf("expected the defaults to be left untouched, got %v", defaultPrivilegedGroups)
+				}
+			},
+		},
+		{
+			name: "invalid privileged service account",
+			yamlFile: `port: "8443"
+tlsCertFile: "test-cert.pem"
+tlsKeyFile: "test-key.pem"
+privilegedServiceAccounts: ["namespace-controller"]`,
+			wantErr: true,
+		},
+		{
+			name: "impersonation rules",
+			yamlFile: `port: "8443"
+tlsCertFile: "test-cert.pem"
+tlsKeyFile: "test-key.pem"
+impersonation:
+  protectedServiceAccounts: ["kube-system/*"]
+  unmatched: deny
+  rules:
+    - name: support-debug
+      subjects:
+        groups: ["support"]
+      users: ["dev-*"]
+      extras:
+        scopes: ["view"]`,
+			wantErr: false,
+			validate: func(t *testing.T, cfg *Config) {
+				imp := cfg.Impersonation
+				if strings.Join(imp.ProtectedGroups, ",") != "system:masters" || strings.Join(imp.ProtectedUsers, ",") != "system:admin" {
+					t.Errorf("expected the default protected users and groups to be kept, got %v and %v", imp.ProtectedUsers, imp.ProtectedGroups)
+				}
+				if !imp.DeniesUnmatched() {
+					t.Errorf("expected unmatched impersonation to be denied")
+				}
+				if len(imp.Rules) != 1 || imp.Rules[0].Subjects.Groups[0] != "support" || imp.Rules[0].Extras["scopes"][0] != "view" {
+					t.Errorf("expected the support-debug rule, got %+v", imp.Rules)
+				}
+			},
+		},
+		{
+			name: "impersonation rule without subjects",
+			yamlFile: `port: "8443"
+tlsCertFile: "test-cert.pem"
+tlsKeyFile: "test-key.pem"
+impersonation:
+  rules:
+    - name: anyone
+      users: ["*"]`,
+			wantErr: true,
+		},
+		{
+			name: "impersonation rule with invalid glob",
+			yamlFile: `port: "8443"
+tlsCertFile: "test-cert.pem"
+tlsKeyFile: "test-key.pem"
+impersonation:
+  rules:
+    - name: broken
+      subjects:
+        users: ["alice"]
+      groups: ["["]`,
+			wantErr: true,
+		},
+		{
+			name: "unknown impersonation unmatched mode",
+			yamlFile: `port: "8443"
+tlsCertFile: "test-cert.pem"
+tlsKeyFile: "test-key.pem"
+impersonation:
+  unmatched: allow`,
+			wantErr: true,
+		},
+		{
+			name: "deleteCollection lookup",
+			yamlFile: `port: "8443"
+tlsCertFile: "test-cert.pem"
+tlsKeyFile: "test-key.pem"
+protectionPolicies:
+  - name: networking
+    names:
+      prefixes: ["aks-net-"]
+    deleteCollection: lookup
+clusterLookup:
+  server: "https://kubernetes.default.svc"
+  cacheTTL: 1m`,
+			wantErr: false,
+			validate: func(t *testing.T, cfg *Config) {
+				if !cfg.NeedsClusterLookup() {
+					t.Errorf("expected NeedsClusterLookup() for a lookup policy")
+				}
+				if cfg.ClusterLookup.CacheTTL != time.Minute || cfg.ClusterLookup.Timeout != time.Second {
+					t.Errorf("expected ClusterLookup cacheTTL=1m and default timeout=1s, got %+v", cfg.ClusterLookup)
+				}
+			},
+		},
+		{
+			name: "unknown deleteCollection mode",
+			yamlFile: `port: "8443"
+tlsCertFile: "test-cert.pem"
+tlsKeyFile: "test-key.pem"
+protectionPolicies:
+  - name: networking
+    names:
+      prefixes: ["aks-net-"]
+    deleteCollection: allow`,
+			wantErr: true,
+		},
+		{
+			name: "namespace protection policy",
+			yamlFile: `port: "8443"
+tlsCertFile: "test-cert.pem"
+tlsKeyFile: "test-key.pem"
+protectionPolicies:
+  - name: infra-namespaces
+    protectedNamespaces:
+      names: ["kube-system"]
+      globs: ["infra-*"]
+      labelSelector: "protected=true"
+    allowedServiceAccounts: ["kube-system/*"]`,
+			wantErr: false,
+			validate: func(t *testing.T, cfg *Config) {
+				policy := cfg.ProtectionPolicies[0]
+				if got := policy.ProtectedVerbs(); len(got) != 5 || got[0] != "create" {
+					t.Errorf("expected the write verbs by default, got %v", got)
+				}
+				if !cfg.NeedsClusterLookup() {
+					t.Errorf("expected NeedsClusterLookup() for a label selector")
+				}
+			},
+		},
+		{
+			name: "namespace protection policy problems",
+			yamlFile: `port: "8443"
+tlsCertFile: "test-cert.pem"
+tlsKeyFile: "test-key.pem"
+protectionPolicies:
+  - name: broken
+    names:
+      prefixes: ["aks-"]
+    protectedNamespaces:
+      labelSelector: "protected in (true"`,
+			wantErr: true,
+		},
+		{
+			name: "empty namespace selector",
+			yamlFile: `port: "8443"
+tlsCertFile: "test-cert.pem"
+tlsKeyFile: "test-key.pem"
+protectionPolicies:
+  - name: nothing
+    protectedNamespaces: {}`,
+			wantErr: true,
+		},
+		{
+			name: "invalid break-glass max duration",
+			yamlFile: `port: "8443"
+tlsCertFile: "test-cert.pem"
+tlsKeyFile: "test-key.pem"
+breakGlass:
+  grantsFile: "/etc/webhook/grants.yaml"
+  maxDuration: 0s`,
+			wantErr: true,
+		},
+		{
+			name: "missing break-glass admin token file",
+			yamlFile: `port: "8443"
+tlsCertFile: "test-cert.pem"
+tlsKeyFile: "test-key.pem"
+breakGlass:
+  adminTokenFile: "/nonexistent/admin-tokens"`,
+			wantErr: true,
+		},
+		{
+			name: "invalid cluster lookup timeout",
+			yamlFile: `port: "8443"
+tlsCertFile: "test-cert.pem"
+tlsKeyFile: "test-key.pem"
+clusterLookup:
+  timeout: 0s`,
+			wantErr: true,
+		},
+		{
+			name: "protectedPrefix combined with protection policies",
+			yamlFile: `port: "8443"
+tlsCertFile: "test-cert.pem"
+tlsKeyFile: "test-key.pem"
+protectedPrefix: "custom-"
+protectionPolicies:
+  - name: managed
+    names:
+      prefixes: ["aks-"]`,
+			wantErr: true,
+		},
+		{
+			name: "invalid default decision",
+			yamlFile: `port: "8443"
+tlsCertFile: "test-cert.pem"
+tlsKeyFile: "test-key.pem"
+defaultDecision: "Maybe"`,
+			wantErr: true,
+		},
+		{
+			name: "missing client CA file",
+			yamlFile: `port: "8443"
+tlsCertFile: "test-cert.pem"
+tlsKeyFile: "test-key.pem"
+clientCAFile: "/nonexistent/client-ca.pem"`,
+			wantErr: true,
+		},
+		{
+			name: "audit sinks",
+			yamlFile: `port: "8443"
+tlsCertFile: "test-cert.pem"
+tlsKeyFile: "test-key.pem"
+audit:
+  bufferSize: 500
+  flushInterval: 2s
+  sinks:
+    - type: stdout
+    - type: file
+      path: /var/log/webhook/audit.log
+      maxSizeMB: 10
+    - type: webhook
+      url: https://audit.example.com/ingest
+      timeout: 3s`,
+			wantErr: false,
+			validate: func(t *testing.T, cfg *Config) {
+				if cfg.Audit.BufferSize != 500 {
+					t.Errorf("expected Audit.BufferSize=500, got %d", cfg.Audit.BufferSize)
+				}
+				if cfg.Audit.FlushInterval != 2*time.Second {
+					t.Errorf("expected Audit.FlushInterval=2s, got %v", cfg.Audit.FlushInterval)
+				}
+				if len(cfg.Audit.Sinks) != 3 {
+					t.Fatalf("expected 3 audit sinks, got %d", len(cfg.Audit.Sinks))
+				}
+				if cfg.Audit.Sinks[1].Path != "/var/log/webhook/audit.log" || cfg.Audit.Sinks[1].MaxSizeMB != 10 {
+					t.Errorf("unexpected file sink: %+v", cfg.Audit.Sinks[1])
+				}
+				if cfg.Audit.Sinks[2].Timeout != 3*time.Second {
+					t.Errorf("expected webhook sink Timeout=3s, got %v", cfg.Audit.Sinks[2].Timeout)
+				}
+			},
+		},
+		{
+			name: "audit file sink without path",
+			yamlFile: `port: "8443"
+tlsCertFile: "test-cert.pem"
+tlsKeyFile: "test-key.pem"
+audit:
+  sinks:
+    - type: file`,
+			wantErr: true,
+		},
+		{
+			name: "unknown audit sink type",
+			yamlFile: `port: "8443"
+tlsCertFile: "test-cert.pem"
+tlsKeyFile: "test-key.pem"
+audit:
+  sinks:
+    - type: syslog`,
+			wantErr: true,
+		},
 		{
 			name:     "invalid YAML file",
 			yamlFile: "invalid yaml content",
@@ -177,6 +668,35 @@ tlsCertFile: "test-cert.pem"`,
 	}
 }
 
+func TestParseServiceAccount(t *testing.T) {
+	tests := []struct {
+		sa            string
+		wantNamespace string
+		wantName      string
+		wantErr       bool
+	}{
+		{sa: "kube-system/namespace-controller", wantNamespace: "kube-system", wantName: "namespace-controller"},
+		{sa: "system:serviceaccount:kube-system:*", wantNamespace: "kube-system", wantName: "*"},
+		{sa: "*/default", wantNamespace: "*", wantName: "default"},
+		{sa: "namespace-controller", wantErr: true},
+		{sa: "system:serviceaccount:kube-system", wantErr: true},
+		{sa: "kube-system/", wantErr: true},
+		{sa: "kube-system/[", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.sa, func(t *testing.T) {
+			namespace, name, err := ParseServiceAccount(tt.sa)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseServiceAccount() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if namespace != tt.wantNamespace || name != tt.wantName {
+				t.Errorf("ParseServiceAccount() = %q, %q, want %q, %q", namespace, name, tt.wantNamespace, tt.wantName)
+			}
+		})
+	}
+}
+
 func TestDefaultConfig(t *testing.T) {
 	cfg := DefaultConfig()
 
@@ -192,4 +712,42 @@ func TestDefaultConfig(t *testing.T) {
 	if len(cfg.CELRules) != 0 {
 		t.Errorf("expected empty CELRules, got %v", cfg.CELRules)
 	}
+	if cfg.DefaultDecision != "NoOpinion" {
+		t.Errorf("expected DefaultDecision=NoOpinion, got %s", cfg.DefaultDecision)
+	}
+	if cfg.Enforcement != EnforcementEnforce {
+		t.Errorf("expected Enforcement=enforce, got %s", cfg.Enforcement)
+	}
+	if policies := cfg.EffectiveProtectionPolicies(); len(policies) != 1 || policies[0].Name != "protected-prefix" ||
+		policies[0].Names.Prefixes[0] != "aks-automatic-" || policies[0].AllowedUsers[0] != "support" {
+		t.Errorf("expected the legacy protected-prefix policy, got %+v", policies)
+	}
+	if cfg.ReloadInterval != 10*time.Second {
+		t.Errorf("expected ReloadInterval=10s, got %s", cfg.ReloadInterval)
+	}
+	if cfg.MetricsPort != "9090" {
+		t.Errorf("expected MetricsPort=9090, got %s", cfg.MetricsPort)
+	}
+	if cfg.DecisionCache.Size != 0 || cfg.DecisionCache.AllowTTL != 5*time.Minute || cfg.DecisionCache.DenyTTL != 30*time.Second {
+		t.Errorf("expected disabled DecisionCache with 5m/30s TTLs, got %+v", cfg.DecisionCache)
+	}
+	if strings.Join(cfg.PrivilegedGroups, ",") != "system:masters,system:nodes" || strings.Join(cfg.PrivilegedServiceAccounts, ",") != "kube-system/namespace-controller" {
+		t.Errorf("expected system:masters, system:nodes and the namespace controller to be privileged, got %v and %v", cfg.PrivilegedGroups, cfg.PrivilegedServiceAccounts)
+	}
+	if cfg.ClusterLookup.TokenFile != inClusterTokenFile || cfg.ClusterLookup.Timeout != time.Second || cfg.ClusterLookup.CacheTTL != 30*time.Second {
+		t.Errorf("expected in-cluster ClusterLookup defaults, got %+v", cfg.ClusterLookup)
+	}
+	if cfg.BreakGlass.Enabled() || cfg.BreakGlass.MaxDuration != 4*time.Hour || cfg.BreakGlass.CheckInterval != 10*time.Second {
+		t.Errorf("expected disabled BreakGlass with 4h/10s defaults, got %+v", cfg.BreakGlass)
+	}
+	if strings.Join(cfg.Impersonation.ProtectedUsers, ",") != "system:admin" || strings.Join(cfg.Impersonation.ProtectedGroups, ",") != "system:masters" ||
+		cfg.Impersonation.DeniesUnmatched() {
+		t.Errorf("expected system:admin and system:masters to be protected from impersonation and unmatched impersonation to have no opinion, got %+v", cfg.Impersonation)
+	}
+	if cfg.DrainPeriod != 5*time.Second {
+		t.Errorf("expected DrainPeriod=5s, got %s", cfg.DrainPeriod)
+	}
+	if cfg.ShutdownTimeout != 20*time.Second {
+		t.Errorf("expected ShutdownTimeout=20s, got %s", cfg.ShutdownTimeout)
+	}
 }
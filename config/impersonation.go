@@ -0,0 +1,141 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"sort"
+)
+
+// Impersonation unmatched modes
+const (
+	// ImpersonationUnmatchedNoOpinion leaves impersonation no rule allows to the next authorizer
+	ImpersonationUnmatchedNoOpinion = "no-opinion"
+	// ImpersonationUnmatchedDeny denies impersonation no rule allows
+	ImpersonationUnmatchedDeny = "deny"
+)
+
+// defaultProtectedUsers and defaultProtectedGroups can never be impersonated:
+// the cluster admin user and group
+var (
+	defaultProtectedUsers  = []string{"system:admin"}
+	defaultProtectedGroups = []string{"system:masters"}
+)
+
+// ImpersonationConfig decides impersonate requests: which identities can
+// never be impersonated, and which requesters may impersonate which users,
+// groups, service accounts, UIDs and user extras
+type ImpersonationConfig struct {
+	// ProtectedUsers, ProtectedGroups and ProtectedServiceAccounts can never
+	// be impersonated, by anyone. Users and groups are path.Match globs and
+	// service accounts patterns accepted by ParseServiceAccount.
+	ProtectedUsers           []string `yaml:"protectedUsers"`
+	ProtectedGroups          []string `yaml:"protectedGroups"`
+	ProtectedServiceAccounts []string `yaml:"protectedServiceAccounts"`
+	// Rules allow requesters to impersonate identities; the first rule that
+	// covers a request allows it
+	Rules []ImpersonationRule `yaml:"rules"`
+	// Unmatched decides impersonation no rule allows: no-opinion (the
+	// default) hands it to the next authorizer, deny denies it
+	Unmatched string `yaml:"unmatched"`
+}
+
+// ImpersonationRule lets its subjects impersonate the identities it lists.
+// Identities are path.Match globs, so "*" matches any; an empty list allows
+// none of that kind.
+type ImpersonationRule struct {
+	// Name identifies the rule in decisions, logs and metrics
+	Name string `yaml:"name"`
+	// Subjects are the requesters the rule applies to
+	Subjects ImpersonationSubjects `yaml:"subjects"`
+	Users    []string              `yaml:"users"`
+	Groups   []string              `yaml:"groups"`
+	// ServiceAccounts are patterns accepted by ParseServiceAccount
+	ServiceAccounts []string `yaml:"serviceAccounts"`
+	UIDs            []string `yaml:"uids"`
+	// Extras maps user extra keys to the values that may be set for them
+	Extras map[string][]string `yaml:"extras"`
+}
+
+// ImpersonationSubjects are the users, groups and service accounts an
+// impersonation rule applies to. Service accounts are patterns accepted by
+// ParseServiceAccount.
+type ImpersonationSubjects struct {
+	Users           []string `yaml:"users"`
+	Groups          []string `yaml:"groups"`
+	ServiceAccounts []string `yaml:"serviceAccounts"`
+}
+
+// DeniesUnmatched reports whether impersonation no rule allows is denied
+func (c *ImpersonationConfig) DeniesUnmatched() bool {
+	return c.Unmatched == ImpersonationUnmatchedDeny
+}
+
+// impersonationProblems returns every invalid glob, service account pattern
+// or unmatched mode, and every impersonation rule that is unnamed,
+// duplicated, has no subjects or allows nothing
+func (c *Config) impersonationProblems() []error {
+	imp := &c.Impersonation
+	var problems []error
+
+	switch imp.Unmatched {
+	case "", ImpersonationUnmatchedNoOpinion, ImpersonationUnmatchedDeny:
+	default:
+		problems = append(problems, fmt.Errorf("impersonation: unknown unmatched %q: must be %s or %s", imp.Unmatched, ImpersonationUnmatchedNoOpinion, ImpersonationUnmatchedDeny))
+	}
+
+	problems = append(problems, globProblems("impersonation: protectedUsers", imp.ProtectedUsers)...)
+	problems = append(problems, globProblems("impersonation: protectedGroups", imp.ProtectedGroups)...)
+	for _, sa := range imp.ProtectedServiceAccounts {
+		if _, _, err := ParseServiceAccount(sa); err != nil {
+			problems = append(problems, fmt.Errorf("impersonation: protectedServiceAccounts: %v", err))
+		}
+	}
+
+	seen := make(map[string]bool, len(imp.Rules))
+	for i, r := range imp.Rules {
+		if r.Name == "" {
+			problems = append(problems, fmt.Errorf("impersonation rule %d: no name", i))
+		} else if seen[r.Name] {
+			problems = append(problems, fmt.Errorf("impersonation rule %d: duplicate name %q", i, r.Name))
+		}
+		seen[r.Name] = true
+
+		subjects := r.Subjects
+		if len(subjects.Users) == 0 && len(subjects.Groups) == 0 && len(subjects.ServiceAccounts) == 0 {
+			problems = append(problems, fmt.Errorf("impersonation rule %d (%s): no subjects", i, r.Name))
+		}
+		if len(r.Users) == 0 && len(r.Groups) == 0 && len(r.ServiceAccounts) == 0 && len(r.UIDs) == 0 && len(r.Extras) == 0 {
+			problems = append(problems, fmt.Errorf("impersonation rule %d (%s): no users, groups, serviceAccounts, uids or extras to impersonate", i, r.Name))
+		}
+
+		prefix := fmt.Sprintf("impersonation rule %d (%s)", i, r.Name)
+		problems = append(problems, globProblems(prefix, r.Users)...)
+		problems = append(problems, globProblems(prefix, r.Groups)...)
+		problems = append(problems, globProblems(prefix, r.UIDs)...)
+		keys := make([]string, 0, len(r.Extras))
+		for key := range r.Extras {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			problems = append(problems, globProblems(fmt.Sprintf("%s: extra %q", prefix, key), r.Extras[key])...)
+		}
+		for _, sa := range append(append([]string(nil), subjects.ServiceAccounts...), r.ServiceAccounts...) {
+			if _, _, err := ParseServiceAccount(sa); err != nil {
+				problems = append(problems, fmt.Errorf("%s: %v", prefix, err))
+			}
+		}
+	}
+	return problems
+}
+
+// globProblems returns an error for every invalid path.Match pattern
+func globProblems(prefix string, globs []string) []error {
+	var problems []error
+	for _, glob := range globs {
+		if _, err := path.Match(glob, ""); err != nil {
+			problems = append(problems, fmt.Errorf("%s: invalid glob %q: %v", prefix, glob, err))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,172 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+)
+
+// defaultConfigFile is loaded when neither -config nor CONFIG_FILE is set
+const defaultConfigFile = "config.yaml"
+
+// Loader builds the configuration from its layers. Each layer overrides the
+// ones before it:
+//
+//  1. built-in defaults
+//  2. the YAML config file
+//  3. environment variables
+//  4. command-line flags
+type Loader struct {
+	configFile string
+	// configFlag is the -config flag, nil when flags are not used
+	configFlag *string
+	// lookupEnv reads environment variables, nil when they are not used
+	lookupEnv func(string) (string, bool)
+	// flagValues holds the raw value of each setting's flag by YAML key
+	flagValues map[string]*rawValue
+}
+
+// NewLoader returns a loader for a config file that applies no environment
+// or command-line overrides
+func NewLoader(configFile string) *Loader {
+	return &Loader{configFile: configFile}
+}
+
+// RegisterFlags registers -config and a flag for every setting on fs. The
+// returned loader applies the environment and the flags set once fs has
+// been parsed.
+func RegisterFlags(fs *flag.FlagSet) *Loader {
+	l := &Loader{
+		configFlag: fs.String("config", "", "Path to the configuration file (env CONFIG_FILE, default "+defaultConfigFile+")"),
+		lookupEnv:  os.LookupEnv,
+		flagValues: make(map[string]*rawValue),
+	}
+
+	for _, s := range settings {
+		if s.flag == "" {
+			continue
+		}
+		_, isBool := s.value(&Config{}).(interface{ IsBoolFlag() bool })
+		raw := &rawValue{
+			isBool: isBool,
+			// Parse into a scratch config so invalid values fail at flag parsing
+			check: func(value string) error { return s.value(DefaultConfig()).Set(value) },
+		}
+		l.flagValues[s.key] = raw
+		fs.Var(raw, s.flag, fmt.Sprintf("Overrides %s from the config file (env %s)", s.key, s.env))
+	}
+
+	return l
+}
+
+// ConfigFile returns the path of the YAML file to load: the -config flag,
+// then CONFIG_FILE, then config.yaml
+func (l *Loader) ConfigFile() string {
+	if l.configFlag == nil {
+		return l.configFile
+	}
+	if *l.configFlag != "" {
+		return *l.configFlag
+	}
+	if file, ok := l.lookupEnv("CONFIG_FILE"); ok && file != "" {
+		return file
+	}
+	return defaultConfigFile
+}
+
+// Load merges every layer and validates the result
+func (l *Loader) Load() (*Config, error) {
+	cfg, err := l.Resolve()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Loaded configuration: Port=%s, ProtectionPolicies=%v, DefaultDecision=%s, CELRules=%v",
+		cfg.Port, cfg.ProtectionPolicyNames(), cfg.DefaultDecision, cfg.RuleNames())
+
+	return cfg, nil
+}
+
+// Resolve merges every layer without validating the result
+func (l *Loader) Resolve() (*Config, error) {
+	// Start with default configuration
+	cfg := DefaultConfig()
+	cfg.Sources = make(map[string]Source, len(settings))
+	for _, s := range settings {
+		cfg.Sources[s.key] = SourceDefault
+	}
+
+	if configFile := l.ConfigFile(); configFile != "" {
+		if err := cfg.loadFromYAML(configFile); err != nil {
+			return nil, fmt.Errorf("failed to load config from YAML file: %v", err)
+		}
+	}
+
+	if l.lookupEnv != nil {
+		for _, s := range settings {
+			if s.env == "" {
+				continue
+			}
+			if value, ok := l.lookupEnv(s.env); ok {
+				if err := s.value(cfg).Set(value); err != nil {
+					return nil, fmt.Errorf("invalid value for %s: %v", s.env, err)
+				}
+				cfg.Sources[s.key] = SourceEnv
+			}
+		}
+	}
+
+	for _, s := range settings {
+		if raw := l.flagValues[s.key]; raw != nil && raw.set {
+			if err := s.value(cfg).Set(raw.value); err != nil {
+				return nil, fmt.Errorf("invalid value for -%s: %v", s.flag, err)
+			}
+			cfg.Sources[s.key] = SourceFlag
+		}
+	}
+
+	return cfg, nil
+}
+
+// PrintEffective writes every setting with its effective value and the
+// layer that value came from
+func (c *Config) PrintEffective(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SETTING\tVALUE\tSOURCE")
+	for _, s := range settings {
+		source := c.Sources[s.key]
+		if source == "" {
+			source = SourceDefault
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", s.key, s.value(c).String(), source)
+	}
+	return tw.Flush()
+}
+
+// rawValue holds a flag's value until it is applied over the config file
+type rawValue struct {
+	value  string
+	set    bool
+	isBool bool
+	check  func(string) error
+}
+
+func (v *rawValue) Set(value string) error {
+	if err := v.check(value); err != nil {
+		return err
+	}
+	v.value = value
+	v.set = true
+	return nil
+}
+
+func (v *rawValue) String() string { return v.value }
+
+func (v *rawValue) IsBoolFlag() bool { return v.isBool }
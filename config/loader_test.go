@@ -0,0 +1,165 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeLayeredConfig writes a config file and the TLS files it references
+func writeLayeredConfig(t *testing.T, extra string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for _, name := range []string{"cert.pem", "key.pem"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("test"), 0644); err != nil {
+			t.Fatalf("Failed to write TLS file: %v", err)
+		}
+	}
+	content := "tlsCertFile: " + filepath.Join(dir, "cert.pem") + "\ntlsKeyFile: " + filepath.Join(dir, "key.pem") + "\n" + extra
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	return path
+}
+
+func TestLoaderPrecedence(t *testing.T) {
+	configPath := writeLayeredConfig(t, `port: "8443"
+protectedPrefix: "file-"
+privilegedUser: "file-user"
+reloadInterval: 30s
+metricsPort: ""`)
+
+	env := map[string]string{
+		"CONFIG_FILE":         configPath,
+		"PROTECTED_PREFIX":    "env-",
+		"PRIVILEGED_USER":     "env-user",
+		"CEL_RULES":           "user != 'blocked'; has(resourceAttributes.verb)",
+		"DECISION_CACHE_SIZE": "100",
+
+		"PRIVILEGED_SERVICE_ACCOUNTS": "kube-system/*, flux-system/kustomize-controller",
+		"IMPERSONATION_UNMATCHED":     "deny",
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	loader := RegisterFlags(fs)
+	loader.lookupEnv = func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+	if err := fs.Parse([]string{"-privileged-user", "flag-user", "-allowed-client-cns", "apiserver, kube-apiserver", "-audit-flush-interval=2s"}); err != nil {
+		t.Fatalf("Parse() unexpected error: %v", err)
+	}
+
+	cfg, err := loader.Load()
+	if err != nil {
+		t.Fatalf("Load() unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		key    string
+		got    interface{}
+		want   interface{}
+		source Source
+	}{
+		{"port", cfg.Port, "8443", SourceFile},
+		{"metricsPort", cfg.MetricsPort, "", SourceFile},
+		{"reloadInterval", cfg.ReloadInterval, 30 * time.Second, SourceFile},
+		{"protectedPrefix", cfg.ProtectedPrefix, "env-", SourceEnv},
+		{"decisionCache.size", cfg.DecisionCache.Size, 100, SourceEnv},
+		{"privilegedUser", cfg.PrivilegedUser, "flag-user", SourceFlag},
+		{"audit.flushInterval", cfg.Audit.FlushInterval, 2 * time.Second, SourceFlag},
+		{"drainPeriod", cfg.DrainPeriod, 5 * time.Second, SourceDefault},
+		{"impersonation.unmatched", cfg.Impersonation.Unmatched, "deny", SourceEnv},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.key, tt.got, tt.want)
+		}
+		if cfg.Sources[tt.key] != tt.source {
+			t.Errorf("%s source = %s, want %s", tt.key, cfg.Sources[tt.key], tt.source)
+		}
+	}
+
+	if len(cfg.AllowedClientCNs) != 2 || cfg.AllowedClientCNs[1] != "kube-apiserver" {
+		t.Errorf("expected AllowedClientCNs=[apiserver kube-apiserver], got %v", cfg.AllowedClientCNs)
+	}
+	if len(cfg.PrivilegedServiceAccounts) != 2 || cfg.PrivilegedServiceAccounts[0] != "kube-system/*" || cfg.Sources["privilegedServiceAccounts"] != SourceEnv {
+		t.Errorf("expected PrivilegedServiceAccounts from the environment, got %v", cfg.PrivilegedServiceAccounts)
+	}
+	if len(cfg.PrivilegedGroups) != 2 || cfg.Sources["privilegedGroups"] != SourceDefault {
+		t.Errorf("expected default PrivilegedGroups, got %v", cfg.PrivilegedGroups)
+	}
+	if len(cfg.CELRules) != 2 || cfg.CELRules[0].Expression != "!(user != 'blocked')" || cfg.CELRules[1].Name != "rule-1" {
+		t.Errorf("expected two legacy rules from CEL_RULES, got %+v", cfg.CELRules)
+	}
+
+	var out bytes.Buffer
+	if err := cfg.PrintEffective(&out); err != nil {
+		t.Fatalf("PrintEffective() unexpected error: %v", err)
+	}
+	for _, line := range []string{"privilegedUser", "flag-user", "flag"} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("expected effective config to contain %q, got:\n%s", line, out.String())
+		}
+	}
+}
+
+func TestLoaderInvalidValues(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(&bytes.Buffer{})
+	RegisterFlags(fs)
+	if err := fs.Parse([]string{"-drain-period", "soon"}); err == nil {
+		t.Error("expected error for invalid duration flag")
+	}
+
+	configPath := writeLayeredConfig(t, "")
+	loader := RegisterFlags(flag.NewFlagSet("test", flag.ContinueOnError))
+	loader.lookupEnv = func(key string) (string, bool) {
+		switch key {
+		case "CONFIG_FILE":
+			return configPath, true
+		case "AUDIT_BUFFER_SIZE":
+			return "many", true
+		}
+		return "", false
+	}
+	if _, err := loader.Load(); err == nil || !strings.Contains(err.Error(), "AUDIT_BUFFER_SIZE") {
+		t.Errorf("expected error naming AUDIT_BUFFER_SIZE, got %v", err)
+	}
+}
+
+func TestLoaderConfigFile(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		want string
+	}{
+		{name: "default", want: "config.yaml"},
+		{name: "environment", env: map[string]string{"CONFIG_FILE": "/etc/env.yaml"}, want: "/etc/env.yaml"},
+		{name: "flag over environment", args: []string{"-config", "/etc/flag.yaml"}, env: map[string]string{"CONFIG_FILE": "/etc/env.yaml"}, want: "/etc/flag.yaml"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			loader := RegisterFlags(fs)
+			loader.lookupEnv = func(key string) (string, bool) {
+				value, ok := tt.env[key]
+				return value, ok
+			}
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatalf("Parse() unexpected error: %v", err)
+			}
+			if got := loader.ConfigFile(); got != tt.want {
+				t.Errorf("ConfigFile() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
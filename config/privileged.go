@@ -0,0 +1,50 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// serviceAccountUserPrefix starts the username of every service account
+const serviceAccountUserPrefix = "system:serviceaccount:"
+
+// defaultPrivilegedGroups are allowed by every protection policy: cluster
+// admins, and kubelets, which delete the mirror pods and pods they evict
+var defaultPrivilegedGroups = []string{"system:masters", "system:nodes"}
+
+// defaultPrivilegedServiceAccounts are allowed by every protection policy:
+// the namespace controller empties deleted namespaces with deletecollection
+var defaultPrivilegedServiceAccounts = []string{"kube-system/namespace-controller"}
+
+// ParseServiceAccount splits a service account pattern given as
+// namespace/name or as its username, system:serviceaccount:namespace:name.
+// Either part may be a path.Match glob, e.g. kube-system/*.
+func ParseServiceAccount(sa string) (namespace, name string, err error) {
+	var ok bool
+	if rest, isUser := strings.CutPrefix(sa, serviceAccountUserPrefix); isUser {
+		namespace, name, ok = strings.Cut(rest, ":")
+	} else {
+		namespace, name, ok = strings.Cut(sa, "/")
+	}
+	if !ok || namespace == "" || name == "" {
+		return "", "", fmt.Errorf("service account %q must be namespace/name or system:serviceaccount:namespace:name", sa)
+	}
+	for _, part := range []string{namespace, name} {
+		if _, err := path.Match(part, ""); err != nil {
+			return "", "", fmt.Errorf("service account %q: invalid glob %q: %v", sa, part, err)
+		}
+	}
+	return namespace, name, nil
+}
+
+// privilegedProblems returns every invalid privileged service account pattern
+func (c *Config) privilegedProblems() []error {
+	var problems []error
+	for _, sa := range c.PrivilegedServiceAccounts {
+		if _, _, err := ParseServiceAccount(sa); err != nil {
+			problems = append(problems, fmt.Errorf("privilegedServiceAccounts: %v", err))
+		}
+	}
+	return problems
+}
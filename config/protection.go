@@ -0,0 +1,237 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// legacyProtectionPolicy names the policy built from protectedPrefix and
+// privilegedUser when no protection policies are configured
+const legacyProtectionPolicy = "protected-prefix"
+
+// ProtectionPolicy protects a family of managed resources: requests with a
+// protected verb on a resource whose name matches one of the patterns are
+// denied unless they come from an allowed or privileged principal. A policy
+// with protectedNamespaces protects whole namespaces instead.
+type ProtectionPolicy struct {
+	// Name identifies the policy in denial reasons, logs and metrics
+	Name string `yaml:"name"`
+	// Names selects the protected resources by name
+	Names NamePatterns `yaml:"names"`
+	// APIGroups, Resources and Namespaces scope the policy. Empty lists
+	// match everything and "*" matches any value.
+	APIGroups  []string `yaml:"apiGroups"`
+	Resources  []string `yaml:"resources"`
+	Namespaces []string `yaml:"namespaces"`
+	// Verbs are the protected verbs; delete when empty
+	Verbs []string `yaml:"verbs"`
+	// AllowedUsers and AllowedGroups may use the protected verbs
+	AllowedUsers  []string `yaml:"allowedUsers"`
+	AllowedGroups []string `yaml:"allowedGroups"`
+	// AllowedServiceAccounts may use the protected verbs, given as patterns
+	// accepted by ParseServiceAccount
+	AllowedServiceAccounts []string `yaml:"allowedServiceAccounts"`
+	// DeleteCollection decides deletecollection requests in the policy's
+	// scope, which carry no name to match, when the policy protects delete:
+	// deny (the default) or lookup
+	DeleteCollection string `yaml:"deleteCollection"`
+	// ProtectedNamespaces makes the policy protect the namespaces it selects
+	// and the objects in them, scoped by apiGroups and resources, instead of
+	// named resources. It cannot be combined with names, namespaces or
+	// deleteCollection.
+	ProtectedNamespaces *NamespaceSelector `yaml:"protectedNamespaces"`
+}
+
+// NamespaceSelector selects namespaces. A namespace is selected when its
+// name is listed, matches a glob or its labels match the label selector.
+type NamespaceSelector struct {
+	Names []string `yaml:"names"`
+	// Globs match names using path.Match syntax, e.g. infra-*
+	Globs []string `yaml:"globs"`
+	// LabelSelector uses the kubectl label selector syntax, e.g.
+	// "protected=true,tier in (infra)". Labels are looked up in the cluster.
+	LabelSelector string `yaml:"labelSelector"`
+}
+
+// DeleteCollection modes of a protection policy
+const (
+	// DeleteCollectionDeny denies every deletecollection in scope to principals that are not allowed
+	DeleteCollectionDeny = "deny"
+	// DeleteCollectionLookup lists the objects in scope from the cluster and
+	// denies deletecollection only when a protected object exists
+	DeleteCollectionLookup = "lookup"
+)
+
+// NamePatterns matches resource names. A name matches when it matches any
+// of the patterns.
+type NamePatterns struct {
+	// Prefixes match names starting with the prefix
+	Prefixes []string `yaml:"prefixes"`
+	// Globs match names using path.Match syntax, e.g. managed-*-pool
+	Globs []string `yaml:"globs"`
+	// Regexes match names using Go regular expressions; anchor them with ^ and $
+	Regexes []string `yaml:"regexes"`
+}
+
+// defaultProtectedVerbs are protected when a policy lists no verbs
+var defaultProtectedVerbs = []string{"delete"}
+
+// defaultNamespaceProtectedVerbs are protected when a namespace policy lists no verbs
+var defaultNamespaceProtectedVerbs = []string{"create", "update", "patch", "delete", "deletecollection"}
+
+// ProtectedVerbs returns the verbs the policy protects
+func (p *ProtectionPolicy) ProtectedVerbs() []string {
+	if len(p.Verbs) > 0 {
+		return p.Verbs
+	}
+	if p.ProtectedNamespaces != nil {
+		return defaultNamespaceProtectedVerbs
+	}
+	return defaultProtectedVerbs
+}
+
+// ProtectsDelete reports whether the policy protects delete, and so deletecollection
+func (p *ProtectionPolicy) ProtectsDelete() bool {
+	for _, verb := range p.ProtectedVerbs() {
+		if verb == "delete" || verb == "deletecollection" || verb == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// NeedsClusterLookup reports whether any protection policy looks up objects
+// or namespace labels in the cluster
+func (c *Config) NeedsClusterLookup() bool {
+	for _, p := range c.ProtectionPolicies {
+		if p.DeleteCollection == DeleteCollectionLookup {
+			return true
+		}
+		if p.ProtectedNamespaces != nil && p.ProtectedNamespaces.LabelSelector != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// EffectiveProtectionPolicies returns the configured protection policies or,
+// when there are none, a single policy protecting protectedPrefix from
+// deletion by anyone but privilegedUser and the privileged principals
+func (c *Config) EffectiveProtectionPolicies() []ProtectionPolicy {
+	if len(c.ProtectionPolicies) > 0 {
+		return c.ProtectionPolicies
+	}
+
+	policy := ProtectionPolicy{
+		Name:  legacyProtectionPolicy,
+		Names: NamePatterns{Prefixes: []string{c.ProtectedPrefix}},
+	}
+	if c.PrivilegedUser != "" {
+		policy.AllowedUsers = []string{c.PrivilegedUser}
+	}
+	return []ProtectionPolicy{policy}
+}
+
+// ProtectionPolicyNames returns the names of the effective protection policies in evaluation order
+func (c *Config) ProtectionPolicyNames() []string {
+	policies := c.EffectiveProtectionPolicies()
+	names := make([]string, 0, len(policies))
+	for _, p := range policies {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+// protectionProblems returns every protection policy that is unnamed,
+// duplicated, matches no names or namespaces or has an invalid pattern,
+// label selector, service account or deleteCollection mode, and rejects
+// protectedPrefix and privilegedUser set alongside policies
+func (c *Config) protectionProblems() []error {
+	if len(c.ProtectionPolicies) == 0 {
+		return nil
+	}
+
+	var problems []error
+	for _, key := range []string{"protectedPrefix", "privilegedUser"} {
+		if source, ok := c.Sources[key]; ok && source != SourceDefault {
+			problems = append(problems, fmt.Errorf("%s cannot be combined with protectionPolicies", key))
+		}
+	}
+
+	seen := make(map[string]bool, len(c.ProtectionPolicies))
+	for i, p := range c.ProtectionPolicies {
+		if p.Name == "" {
+			problems = append(problems, fmt.Errorf("protection policy %d: no name", i))
+		} else if seen[p.Name] {
+			problems = append(problems, fmt.Errorf("protection policy %d: duplicate name %q", i, p.Name))
+		}
+		seen[p.Name] = true
+
+		if p.ProtectedNamespaces != nil {
+			problems = append(problems, p.namespaceProblems(i)...)
+		} else if len(p.Names.Prefixes) == 0 && len(p.Names.Globs) == 0 && len(p.Names.Regexes) == 0 {
+			problems = append(problems, fmt.Errorf("protection policy %d (%s): no name prefixes, globs or regexes", i, p.Name))
+		}
+		for _, prefix := range p.Names.Prefixes {
+			if prefix == "" {
+				problems = append(problems, fmt.Errorf("protection policy %d (%s): empty name prefix", i, p.Name))
+			}
+		}
+		for _, glob := range p.Names.Globs {
+			if _, err := path.Match(glob, ""); err != nil {
+				problems = append(problems, fmt.Errorf("protection policy %d (%s): invalid glob %q: %v", i, p.Name, glob, err))
+			}
+		}
+		for _, expr := range p.Names.Regexes {
+			if _, err := regexp.Compile(expr); err != nil {
+				problems = append(problems, fmt.Errorf("protection policy %d (%s): invalid regex %q: %v", i, p.Name, expr, err))
+			}
+		}
+		switch p.DeleteCollection {
+		case "", DeleteCollectionDeny, DeleteCollectionLookup:
+		default:
+			problems = append(problems, fmt.Errorf("protection policy %d (%s): unknown deleteCollection %q: must be %s or %s", i, p.Name, p.DeleteCollection, DeleteCollectionDeny, DeleteCollectionLookup))
+		}
+		for _, sa := range p.AllowedServiceAccounts {
+			if _, _, err := ParseServiceAccount(sa); err != nil {
+				problems = append(problems, fmt.Errorf("protection policy %d (%s): %v", i, p.Name, err))
+			}
+		}
+	}
+	return problems
+}
+
+// namespaceProblems returns the problems of a namespace policy: fields that
+// only apply to named resources, and a selector that selects nothing or has
+// an invalid glob or label selector
+func (p *ProtectionPolicy) namespaceProblems(i int) []error {
+	var problems []error
+	if len(p.Names.Prefixes) > 0 || len(p.Names.Globs) > 0 || len(p.Names.Regexes) > 0 {
+		problems = append(problems, fmt.Errorf("protection policy %d (%s): names cannot be combined with protectedNamespaces", i, p.Name))
+	}
+	if len(p.Namespaces) > 0 {
+		problems = append(problems, fmt.Errorf("protection policy %d (%s): namespaces cannot be combined with protectedNamespaces", i, p.Name))
+	}
+	if p.DeleteCollection != "" {
+		problems = append(problems, fmt.Errorf("protection policy %d (%s): deleteCollection cannot be combined with protectedNamespaces", i, p.Name))
+	}
+
+	selector := p.ProtectedNamespaces
+	if len(selector.Names) == 0 && len(selector.Globs) == 0 && selector.LabelSelector == "" {
+		problems = append(problems, fmt.Errorf("protection policy %d (%s): protectedNamespaces has no names, globs or labelSelector", i, p.Name))
+	}
+	for _, glob := range selector.Globs {
+		if _, err := path.Match(glob, ""); err != nil {
+			problems = append(problems, fmt.Errorf("protection policy %d (%s): invalid namespace glob %q: %v", i, p.Name, glob, err))
+		}
+	}
+	if selector.LabelSelector != "" {
+		if _, err := labels.Parse(selector.LabelSelector); err != nil {
+			problems = append(problems, fmt.Errorf("protection policy %d (%s): invalid labelSelector %q: %v", i, p.Name, selector.LabelSelector, err))
+		}
+	}
+	return problems
+}
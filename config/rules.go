@@ -0,0 +1,131 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/imiller31/k8s-auth-webhook/decision"
+	"gopkg.in/yaml.v3"
+)
+
+// CELRule is a named CEL expression together with the effect applied when it matches
+type CELRule struct {
+	// Name identifies the rule in denial reasons and logs
+	Name string `yaml:"name"`
+	// Expression is a CEL expression returning bool; the rule matches when it is true
+	Expression string `yaml:"expression"`
+	// Effect is the decision returned when the rule matches: allow, deny or no-opinion
+	Effect string `yaml:"effect"`
+	// Message is a static human-readable reason returned when the rule matches
+	Message string `yaml:"message"`
+	// MessageExpression is a CEL expression returning a string; it takes
+	// precedence over Message when it evaluates successfully
+	MessageExpression string `yaml:"messageExpression"`
+	// Match limits the requests the rule is evaluated against
+	Match RuleMatch `yaml:"match"`
+	// Enforcement is enforce (the default) or audit. A deny rule in audit
+	// mode records the denial but lets evaluation continue as if the rule
+	// were absent.
+	Enforcement string `yaml:"enforcement"`
+	// Legacy is set on rules converted from a bare expression by
+	// LegacyRule, whose Expression wraps the original in LegacyPrefix
+	Legacy bool `yaml:"-"`
+}
+
+// Enforcement modes of a rule or the webhook as a whole
+const (
+	// EnforcementEnforce applies denials
+	EnforcementEnforce = "enforce"
+	// EnforcementAudit records denials without applying them
+	EnforcementAudit = "audit"
+)
+
+// ParseEnforcement reports whether an enforcement mode is audit. An empty
+// mode enforces.
+func ParseEnforcement(mode string) (bool, error) {
+	switch mode {
+	case "", EnforcementEnforce:
+		return false, nil
+	case EnforcementAudit:
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown enforcement %q: must be %s or %s", mode, EnforcementEnforce, EnforcementAudit)
+	}
+}
+
+// RuleMatch scopes a rule to a subset of requests. Empty lists match
+// everything and "*" matches any value.
+type RuleMatch struct {
+	Verbs      []string `yaml:"verbs"`
+	APIGroups  []string `yaml:"apiGroups"`
+	Resources  []string `yaml:"resources"`
+	Namespaces []string `yaml:"namespaces"`
+}
+
+// UnmarshalYAML accepts either a rule object or, for backwards compatibility,
+// a bare expression string. A bare expression must hold for the request to
+// proceed, so it becomes a deny rule on its negation.
+func (r *CELRule) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*r = LegacyRule(value.Value)
+		return nil
+	}
+
+	type plain CELRule
+	return value.Decode((*plain)(r))
+}
+
+// LegacyPrefix opens the negation LegacyRule wraps a bare expression in
+const LegacyPrefix = "!("
+
+// LegacyRule converts a bare boolean expression that must evaluate to true
+// into a deny rule
+func LegacyRule(expression string) CELRule {
+	return CELRule{
+		Expression: LegacyPrefix + expression + ")",
+		Effect:     "deny",
+		Legacy:     true,
+	}
+}
+
+// RuleNames returns the names of the configured CEL rules in evaluation order
+func (c *Config) RuleNames() []string {
+	names := make([]string, 0, len(c.CELRules))
+	for _, rule := range c.CELRules {
+		names = append(names, rule.Name)
+	}
+	return names
+}
+
+// ruleProblems defaults missing rule names and returns every rule whose
+// name is duplicated, whose expression or effect is missing or invalid, or
+// whose enforcement is invalid
+func (c *Config) ruleProblems() []error {
+	var problems []error
+	seen := make(map[string]bool, len(c.CELRules))
+	for i := range c.CELRules {
+		rule := &c.CELRules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i)
+		}
+		if seen[rule.Name] {
+			problems = append(problems, fmt.Errorf("CEL rule %d: duplicate name %q", i, rule.Name))
+		}
+		seen[rule.Name] = true
+
+		if rule.Expression == "" {
+			problems = append(problems, fmt.Errorf("CEL rule %d (%s): no expression", i, rule.Name))
+		}
+		if rule.Effect == "" {
+			problems = append(problems, fmt.Errorf("CEL rule %d (%s): no effect", i, rule.Name))
+		} else if _, err := decision.Parse(rule.Effect); err != nil {
+			problems = append(problems, fmt.Errorf("CEL rule %d (%s): invalid effect: %v", i, rule.Name, err))
+		}
+
+		if audit, err := ParseEnforcement(rule.Enforcement); err != nil {
+			problems = append(problems, fmt.Errorf("CEL rule %d (%s): invalid enforcement: %v", i, rule.Name, err))
+		} else if effect, err := decision.Parse(rule.Effect); audit && err == nil && effect != decision.Deny {
+			problems = append(problems, fmt.Errorf("CEL rule %d (%s): enforcement %s only applies to deny rules", i, rule.Name, EnforcementAudit))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,255 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Source identifies the configuration layer a setting's value came from.
+// Later layers take precedence: default, then file, then env, then flag.
+type Source string
+
+const (
+	SourceDefault Source = "default"
+	SourceFile    Source = "file"
+	SourceEnv     Source = "env"
+	SourceFlag    Source = "flag"
+)
+
+// setting is a configuration field that can be overridden from the
+// environment and the command line
+type setting struct {
+	// key is the field's path in the YAML file
+	key string
+	// env and flag name the environment variable and command-line flag
+	// that override the field; empty when it can only be set in YAML
+	env  string
+	flag string
+	// value binds the field of a Config for parsing and printing
+	value func(c *Config) flag.Value
+}
+
+// settings lists every configuration field in the order it is printed
+var settings = []setting{
+	{key: "port", env: "PORT", flag: "port",
+		value: func(c *Config) flag.Value { return (*stringValue)(&c.Port) }},
+	{key: "tlsCertFile", env: "TLS_CERT_FILE", flag: "tls-cert-file",
+		value: func(c *Config) flag.Value { return (*stringValue)(&c.TLSCertFile) }},
+	{key: "tlsKeyFile", env: "TLS_KEY_FILE", flag: "tls-key-file",
+		value: func(c *Config) flag.Value { return (*stringValue)(&c.TLSKeyFile) }},
+	{key: "protectedPrefix", env: "PROTECTED_PREFIX", flag: "protected-prefix",
+		value: func(c *Config) flag.Value { return (*stringValue)(&c.ProtectedPrefix) }},
+	{key: "privilegedUser", env: "PRIVILEGED_USER", flag: "privileged-user",
+		value: func(c *Config) flag.Value { return (*stringValue)(&c.PrivilegedUser) }},
+	{key: "supportUser", env: "SUPPORT_USER", flag: "support-user",
+		value: func(c *Config) flag.Value { return (*stringValue)(&c.SupportUser) }},
+	{key: "privilegedUsers", env: "PRIVILEGED_USERS", flag: "privileged-users",
+		value: func(c *Config) flag.Value { return (*listValue)(&c.PrivilegedUsers) }},
+	{key: "privilegedGroups", env: "PRIVILEGED_GROUPS", flag: "privileged-groups",
+		value: func(c *Config) flag.Value { return (*listValue)(&c.PrivilegedGroups) }},
+	{key: "privilegedServiceAccounts", env: "PRIVILEGED_SERVICE_ACCOUNTS", flag: "privileged-service-accounts",
+		value: func(c *Config) flag.Value { return (*listValue)(&c.PrivilegedServiceAccounts) }},
+	{key: "protectionPolicies",
+		value: func(c *Config) flag.Value { return (*protectionPoliciesValue)(&c.ProtectionPolicies) }},
+	{key: "impersonation.protectedUsers", env: "IMPERSONATION_PROTECTED_USERS", flag: "impersonation-protected-users",
+		value: func(c *Config) flag.Value { return (*listValue)(&c.Impersonation.ProtectedUsers) }},
+	{key: "impersonation.protectedGroups", env: "IMPERSONATION_PROTECTED_GROUPS", flag: "impersonation-protected-groups",
+		value: func(c *Config) flag.Value { return (*listValue)(&c.Impersonation.ProtectedGroups) }},
+	{key: "impersonation.protectedServiceAccounts", env: "IMPERSONATION_PROTECTED_SERVICE_ACCOUNTS", flag: "impersonation-protected-service-accounts",
+		value: func(c *Config) flag.Value { return (*listValue)(&c.Impersonation.ProtectedServiceAccounts) }},
+	{key: "impersonation.rules",
+		value: func(c *Config) flag.Value { return (*impersonationRulesValue)(&c.Impersonation.Rules) }},
+	{key: "impersonation.unmatched", env: "IMPERSONATION_UNMATCHED", flag: "impersonation-unmatched",
+		value: func(c *Config) flag.Value { return (*stringValue)(&c.Impersonation.Unmatched) }},
+	{key: "celRules", env: "CEL_RULES", flag: "cel-rules",
+		value: func(c *Config) flag.Value { return (*celRulesValue)(&c.CELRules) }},
+	{key: "defaultDecision", env: "DEFAULT_DECISION", flag: "default-decision",
+		value: func(c *Config) flag.Value { return (*stringValue)(&c.DefaultDecision) }},
+	{key: "enforcement", env: "ENFORCEMENT", flag: "enforcement",
+		value: func(c *Config) flag.Value { return (*stringValue)(&c.Enforcement) }},
+	{key: "clientCAFile", env: "CLIENT_CA_FILE", flag: "client-ca-file",
+		value: func(c *Config) flag.Value { return (*stringValue)(&c.ClientCAFile) }},
+	{key: "allowedClientCNs", env: "ALLOWED_CLIENT_CNS", flag: "allowed-client-cns",
+		value: func(c *Config) flag.Value { return (*listValue)(&c.AllowedClientCNs) }},
+	{key: "allowedClientSANs", env: "ALLOWED_CLIENT_SANS", flag: "allowed-client-sans",
+		value: func(c *Config) flag.Value { return (*listValue)(&c.AllowedClientSANs) }},
+	{key: "tokenFile", env: "TOKEN_FILE", flag: "token-file",
+		value: func(c *Config) flag.Value { return (*stringValue)(&c.TokenFile) }},
+	{key: "explainTokenFile", env: "EXPLAIN_TOKEN_FILE", flag: "explain-token-file",
+		value: func(c *Config) flag.Value { return (*stringValue)(&c.ExplainTokenFile) }},
+	{key: "metricsPort", env: "METRICS_PORT", flag: "metrics-port",
+		value: func(c *Config) flag.Value { return (*stringValue)(&c.MetricsPort) }},
+	{key: "audit.bufferSize", env: "AUDIT_BUFFER_SIZE", flag: "audit-buffer-size",
+		value: func(c *Config) flag.Value { return (*intValue)(&c.Audit.BufferSize) }},
+	{key: "audit.batchSize", env: "AUDIT_BATCH_SIZE", flag: "audit-batch-size",
+		value: func(c *Config) flag.Value { return (*intValue)(&c.Audit.BatchSize) }},
+	{key: "audit.flushInterval", env: "AUDIT_FLUSH_INTERVAL", flag: "audit-flush-interval",
+		value: func(c *Config) flag.Value { return (*durationValue)(&c.Audit.FlushInterval) }},
+	{key: "audit.sinks",
+		value: func(c *Config) flag.Value { return (*auditSinksValue)(&c.Audit.Sinks) }},
+	{key: "decisionCache.size", env: "DECISION_CACHE_SIZE", flag: "decision-cache-size",
+		value: func(c *Config) flag.Value { return (*intValue)(&c.DecisionCache.Size) }},
+	{key: "decisionCache.allowTTL", env: "DECISION_CACHE_ALLOW_TTL", flag: "decision-cache-allow-ttl",
+		value: func(c *Config) flag.Value { return (*durationValue)(&c.DecisionCache.AllowTTL) }},
+	{key: "decisionCache.denyTTL", env: "DECISION_CACHE_DENY_TTL", flag: "decision-cache-deny-ttl",
+		value: func(c *Config) flag.Value { return (*durationValue)(&c.DecisionCache.DenyTTL) }},
+	{key: "clusterLookup.server", env: "CLUSTER_LOOKUP_SERVER", flag: "cluster-lookup-server",
+		value: func(c *Config) flag.Value { return (*stringValue)(&c.ClusterLookup.Server) }},
+	{key: "clusterLookup.tokenFile", env: "CLUSTER_LOOKUP_TOKEN_FILE", flag: "cluster-lookup-token-file",
+		value: func(c *Config) flag.Value { return (*stringValue)(&c.ClusterLookup.TokenFile) }},
+	{key: "clusterLookup.caFile", env: "CLUSTER_LOOKUP_CA_FILE", flag: "cluster-lookup-ca-file",
+		value: func(c *Config) flag.Value { return (*stringValue)(&c.ClusterLookup.CAFile) }},
+	{key: "clusterLookup.timeout", env: "CLUSTER_LOOKUP_TIMEOUT", flag: "cluster-lookup-timeout",
+		value: func(c *Config) flag.Value { return (*durationValue)(&c.ClusterLookup.Timeout) }},
+	{key: "clusterLookup.cacheTTL", env: "CLUSTER_LOOKUP_CACHE_TTL", flag: "cluster-lookup-cache-ttl",
+		value: func(c *Config) flag.Value { return (*durationValue)(&c.ClusterLookup.CacheTTL) }},
+	{key: "breakGlass.grantsFile", env: "BREAK_GLASS_GRANTS_FILE", flag: "break-glass-grants-file",
+		value: func(c *Config) flag.Value { return (*stringValue)(&c.BreakGlass.GrantsFile) }},
+	{key: "breakGlass.adminTokenFile", env: "BREAK_GLASS_ADMIN_TOKEN_FILE", flag: "break-glass-admin-token-file",
+		value: func(c *Config) flag.Value { return (*stringValue)(&c.BreakGlass.AdminTokenFile) }},
+	{key: "breakGlass.maxDuration", env: "BREAK_GLASS_MAX_DURATION", flag: "break-glass-max-duration",
+		value: func(c *Config) flag.Value { return (*durationValue)(&c.BreakGlass.MaxDuration) }},
+	{key: "breakGlass.checkInterval", env: "BREAK_GLASS_CHECK_INTERVAL", flag: "break-glass-check-interval",
+		value: func(c *Config) flag.Value { return (*durationValue)(&c.BreakGlass.CheckInterval) }},
+	{key: "reloadInterval", env: "RELOAD_INTERVAL", flag: "reload-interval",
+		value: func(c *Config) flag.Value { return (*durationValue)(&c.ReloadInterval) }},
+	{key: "drainPeriod", env: "DRAIN_PERIOD", flag: "drain-period",
+		value: func(c *Config) flag.Value { return (*durationValue)(&c.DrainPeriod) }},
+	{key: "shutdownTimeout", env: "SHUTDOWN_TIMEOUT", flag: "shutdown-timeout",
+		value: func(c *Config) flag.Value { return (*durationValue)(&c.ShutdownTimeout) }},
+}
+
+// stringValue parses a plain string
+type stringValue string
+
+func (v *stringValue) Set(s string) error {
+	*v = stringValue(s)
+	return nil
+}
+
+func (v *stringValue) String() string { return string(*v) }
+
+// intValue parses a decimal integer
+type intValue int
+
+func (v *intValue) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("invalid integer %q", s)
+	}
+	*v = intValue(n)
+	return nil
+}
+
+func (v *intValue) String() string { return strconv.Itoa(int(*v)) }
+
+// durationValue parses a Go duration such as 30s or 5m
+type durationValue time.Duration
+
+func (v *durationValue) Set(s string) error {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", s)
+	}
+	*v = durationValue(d)
+	return nil
+}
+
+func (v *durationValue) String() string { return time.Duration(*v).String() }
+
+// listValue parses a comma-separated list, ignoring blank entries
+type listValue []string
+
+func (v *listValue) Set(s string) error {
+	*v = splitList(s, ",")
+	return nil
+}
+
+func (v *listValue) String() string { return strings.Join(*v, ",") }
+
+// celRulesValue parses a semicolon-separated list of bare CEL expressions,
+// each of which must hold for a request to proceed
+type celRulesValue []CELRule
+
+func (v *celRulesValue) Set(s string) error {
+	rules := []CELRule{}
+	for _, expression := range splitList(s, ";") {
+		rules = append(rules, LegacyRule(expression))
+	}
+	*v = rules
+	return nil
+}
+
+func (v *celRulesValue) String() string {
+	names := make([]string, 0, len(*v))
+	for i, rule := range *v {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("rule-%d", i)
+		}
+		names = append(names, name)
+	}
+	return "[" + strings.Join(names, " ") + "]"
+}
+
+// auditSinksValue prints the configured audit sink types; sinks can only be
+// configured in YAML
+type auditSinksValue []AuditSink
+
+func (v *auditSinksValue) Set(string) error {
+	return fmt.Errorf("audit sinks can only be configured in the config file")
+}
+
+func (v *auditSinksValue) String() string {
+	types := make([]string, 0, len(*v))
+	for _, sink := range *v {
+		types = append(types, sink.Type)
+	}
+	return "[" + strings.Join(types, " ") + "]"
+}
+
+// protectionPoliciesValue prints the configured protection policy names;
+// policies can only be configured in YAML
+type protectionPoliciesValue []ProtectionPolicy
+
+func (v *protectionPoliciesValue) Set(string) error {
+	return fmt.Errorf("protection policies can only be configured in the config file")
+}
+
+func (v *protectionPoliciesValue) String() string {
+	names := make([]string, 0, len(*v))
+	for _, p := range *v {
+		names = append(names, p.Name)
+	}
+	return "[" + strings.Join(names, " ") + "]"
+}
+
+// impersonationRulesValue prints the configured impersonation rule names;
+// rules can only be configured in YAML
+type impersonationRulesValue []ImpersonationRule
+
+func (v *impersonationRulesValue) Set(string) error {
+	return fmt.Errorf("impersonation rules can only be configured in the config file")
+}
+
+func (v *impersonationRulesValue) String() string {
+	names := make([]string, 0, len(*v))
+	for _, r := range *v {
+		names = append(names, r.Name)
+	}
+	return "[" + strings.Join(names, " ") + "]"
+}
+
+// splitList splits s on sep, trimming whitespace and dropping empty entries
+func splitList(s, sep string) []string {
+	values := []string{}
+	for _, value := range strings.Split(s, sep) {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
@@ -0,0 +1,59 @@
+package decision
+
+import (
+	"fmt"
+	"strings"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+)
+
+// Decision is the outcome of an authorization check. The zero value is
+// NoOpinion so that an unset decision never grants or refuses access.
+type Decision int
+
+const (
+	// NoOpinion defers the request to the next authorizer in the chain
+	NoOpinion Decision = iota
+	// Allow explicitly grants the request
+	Allow
+	// Deny explicitly refuses the request and short-circuits the chain
+	Deny
+)
+
+// String returns the canonical name of the decision
+func (d Decision) String() string {
+	switch d {
+	case Allow:
+		return "Allow"
+	case Deny:
+		return "Deny"
+	default:
+		return "NoOpinion"
+	}
+}
+
+// Parse converts a decision name into a Decision. Matching is case-insensitive
+// and ignores '-' and '_' so "no-opinion", "no_opinion" and "NoOpinion" are
+// all accepted.
+func Parse(s string) (Decision, error) {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", "_", "").Replace(strings.TrimSpace(s)))
+	switch normalized {
+	case "allow":
+		return Allow, nil
+	case "deny":
+		return Deny, nil
+	case "noopinion":
+		return NoOpinion, nil
+	default:
+		return NoOpinion, fmt.Errorf("unknown decision %q: must be one of Allow, Deny or NoOpinion", s)
+	}
+}
+
+// Status builds the SubjectAccessReviewStatus the apiserver expects for the decision
+func (d Decision) Status(reason string) authorizationv1.SubjectAccessReviewStatus {
+	return authorizationv1.SubjectAccessReviewStatus{
+		Allowed: d == Allow,
+		Denied:  d == Deny,
+		Reason:  reason,
+	}
+}
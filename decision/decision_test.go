@@ -0,0 +1,58 @@
+package decision
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    Decision
+		wantErr bool
+	}{
+		{input: "Allow", want: Allow},
+		{input: "deny", want: Deny},
+		{input: "NoOpinion", want: NoOpinion},
+		{input: "no-opinion", want: NoOpinion},
+		{input: "NO_OPINION", want: NoOpinion},
+		{input: "maybe", wantErr: true},
+		{input: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := Parse(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("Parse(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatus(t *testing.T) {
+	tests := []struct {
+		decision    Decision
+		wantAllowed bool
+		wantDenied  bool
+	}{
+		{decision: Allow, wantAllowed: true, wantDenied: false},
+		{decision: Deny, wantAllowed: false, wantDenied: true},
+		{decision: NoOpinion, wantAllowed: false, wantDenied: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.decision.String(), func(t *testing.T) {
+			status := tt.decision.Status("reason")
+			if status.Allowed != tt.wantAllowed {
+				t.Errorf("Status().Allowed = %v, want %v", status.Allowed, tt.wantAllowed)
+			}
+			if status.Denied != tt.wantDenied {
+				t.Errorf("Status().Denied = %v, want %v", status.Denied, tt.wantDenied)
+			}
+			if status.Reason != "reason" {
+				t.Errorf("Status().Reason = %q, want %q", status.Reason, "reason")
+			}
+		})
+	}
+}
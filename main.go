@@ -1,21 +1,51 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/imiller31/k8s-auth-webhook/audit"
 	"github.com/imiller31/k8s-auth-webhook/auth"
+	"github.com/imiller31/k8s-auth-webhook/breakglass"
 	"github.com/imiller31/k8s-auth-webhook/cel"
+	"github.com/imiller31/k8s-auth-webhook/cli"
+	"github.com/imiller31/k8s-auth-webhook/cluster"
 	"github.com/imiller31/k8s-auth-webhook/config"
+	"github.com/imiller31/k8s-auth-webhook/reload"
 	"github.com/imiller31/k8s-auth-webhook/server"
 )
 
-// main is the entry point for the webhook server
+// main is the entry point for the webhook server and its subcommands
 func main() {
-	configFile := flag.String("config", "config.yaml", "Path to the configuration file")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate":
+			os.Exit(cli.Validate(os.Args[2:], os.Stdout, os.Stderr))
+		case "eval":
+			os.Exit(cli.Eval(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+		case "test":
+			os.Exit(cli.RunTests(os.Args[2:], os.Stdout, os.Stderr))
+		}
+	}
+
+	loader := config.RegisterFlags(flag.CommandLine)
+	printConfig := flag.Bool("print-config", false, "Print the effective configuration and the source of each setting, then exit")
 	flag.Parse()
 
-	cfg, err := config.Load(*configFile)
+	if *printConfig {
+		cfg, err := loader.Resolve()
+		if err != nil {
+			log.Fatalf("Failed to load configuration: %v", err)
+		}
+		cfg.PrintEffective(os.Stdout)
+		return
+	}
+
+	cfg, err := loader.Load()
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
@@ -29,9 +59,65 @@ func main() {
 	// Create authorizer
 	authorizer := auth.NewAuthorizer(cfg, celEval)
 
+	// Look up objects and namespace labels in the cluster for protection
+	// policies; changes to the lookup settings require a restart
+	lister, err := cluster.NewAPILister(cfg.ClusterLookup)
+	switch {
+	case err == nil:
+		cached := cluster.NewCachingLister(lister, cfg.ClusterLookup.CacheTTL)
+		authorizer.SetObjectLister(cached)
+		authorizer.SetNamespaceGetter(cached)
+	case cfg.NeedsClusterLookup():
+		log.Fatalf("Failed to create cluster lookup: %v", err)
+	default:
+		log.Printf("Cluster lookup unavailable, protection policies in lookup mode or selecting namespaces by label will deny: %v", err)
+	}
+
+	// Shut down gracefully on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Honor break-glass grants from the admin API and the grants file;
+	// changes to the break-glass settings require a restart
+	if cfg.BreakGlass.Enabled() {
+		grants := breakglass.NewStore(cfg.BreakGlass)
+		if err := grants.LoadFile(); err != nil {
+			log.Fatalf("Failed to load break-glass grants: %v", err)
+		}
+		authorizer.SetBreakGlass(grants)
+		go grants.Watch(cfg.BreakGlass.CheckInterval, ctx.Done())
+	}
+
+	// Reload configuration and rules when the file changes or on SIGHUP
+	reloader := reload.NewReloader(loader, authorizer)
+	go reloader.Watch(cfg.ReloadInterval, ctx.Done())
+
+	// Start audit sinks; configuration changes to them require a restart
+	auditor, err := audit.NewLogger(cfg.Audit)
+	if err != nil {
+		log.Fatalf("Failed to create audit logger: %v", err)
+	}
+
 	// Create and start webhook server
-	webhookServer := server.NewWebhookServer(cfg, authorizer)
-	if err := webhookServer.Start(); err != nil {
+	webhookServer := server.NewWebhookServer(cfg, authorizer, auditor)
+	webhookServer.SetReloadStatus(reloader)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- webhookServer.Start()
+	}()
+
+	select {
+	case err := <-serveErr:
+		auditor.Close()
 		log.Fatalf("Failed to start server: %v", err)
+	case <-ctx.Done():
+		log.Printf("Received shutdown signal")
+	}
+
+	// Restore default signal handling so a second signal exits immediately
+	stop()
+	if err := webhookServer.Stop(context.Background()); err != nil {
+		log.Fatalf("Failed to shut down cleanly: %v", err)
 	}
+	<-serveErr
 }
@@ -0,0 +1,155 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "k8s_auth_webhook"
+
+// Registry holds every metric exported by the webhook. A dedicated registry
+// keeps tests and multiple servers in one process from colliding with the
+// global default registry.
+var Registry = prometheus.NewRegistry()
+
+var (
+	// Decisions counts authorization decisions by outcome and by the CEL rule
+	// or built-in check that produced them
+	Decisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "decisions_total",
+		Help:      "Authorization decisions by outcome and deciding rule or check.",
+	}, []string{"decision", "rule"})
+
+	// RuleMatches counts how often each CEL rule matched a request
+	RuleMatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cel_rule_matches_total",
+		Help:      "CEL rule matches by rule name and effect.",
+	}, []string{"rule", "effect"})
+
+	// RuleErrors counts CEL rule evaluation failures
+	RuleErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cel_rule_errors_total",
+		Help:      "CEL rule evaluation errors by rule name.",
+	}, []string{"rule"})
+
+	// CELEvaluationDuration observes the time spent evaluating CEL rules for a request
+	CELEvaluationDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "cel_evaluation_duration_seconds",
+		Help:      "Time spent evaluating CEL rules for a single request.",
+		Buckets:   []float64{.00001, .00005, .0001, .0005, .001, .005, .01, .05, .1, .5},
+	})
+
+	// RequestDuration observes end-to-end handling time of webhook requests.
+	// The buckets extend to the apiserver's default 3s webhook timeout.
+	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "request_duration_seconds",
+		Help:      "Webhook request handling latency by HTTP status code.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2, 3},
+	}, []string{"code"})
+
+	// DecodeErrors counts request bodies that could not be decoded
+	DecodeErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "decode_errors_total",
+		Help:      "Requests whose body could not be decoded as a SubjectAccessReview.",
+	})
+
+	// AuditRecordsDropped counts audit records discarded because a sink's buffer was full
+	AuditRecordsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "audit_records_dropped_total",
+		Help:      "Audit records dropped because the sink's buffer was full.",
+	}, []string{"sink"})
+
+	// AuditSinkErrors counts failed writes of audit record batches
+	AuditSinkErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "audit_sink_errors_total",
+		Help:      "Audit record batches a sink failed to write.",
+	}, []string{"sink"})
+
+	// AuditedDenials counts denials recorded instead of enforced because the
+	// rule or the webhook is in audit mode
+	AuditedDenials = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "audited_denials_total",
+		Help:      "Denials recorded but not enforced because the rule or webhook is in audit mode, by rule or check.",
+	}, []string{"rule"})
+
+	// BreakGlassUses counts requests allowed by break-glass grants
+	BreakGlassUses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "break_glass_uses_total",
+		Help:      "Requests allowed by a break-glass grant, by the protection check the grant overrode.",
+	}, []string{"rule"})
+
+	// BreakGlassGrants reports the number of unexpired break-glass grants
+	BreakGlassGrants = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "break_glass_active_grants",
+		Help:      "Number of break-glass grants that have not expired or been revoked.",
+	})
+
+	// DecisionCacheRequests counts decision cache lookups by result
+	DecisionCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "decision_cache_requests_total",
+		Help:      "Decision cache lookups by result (hit or miss).",
+	}, []string{"result"})
+
+	// DecisionCacheEntries reports the number of decisions currently cached
+	DecisionCacheEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "decision_cache_entries",
+		Help:      "Number of decisions in the cache of the policy currently in effect.",
+	})
+
+	// RulesLoaded reports the number of CEL rules in the policy in effect
+	RulesLoaded = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cel_rules_loaded",
+		Help:      "Number of CEL rules in the policy currently in effect.",
+	})
+
+	// ConfigGeneration reports the generation of the policy in effect
+	ConfigGeneration = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "config_generation",
+		Help:      "Generation of the configuration currently in effect; increases on every successful reload.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		Decisions,
+		RuleMatches,
+		RuleErrors,
+		CELEvaluationDuration,
+		RequestDuration,
+		DecodeErrors,
+		AuditRecordsDropped,
+		AuditSinkErrors,
+		AuditedDenials,
+		BreakGlassUses,
+		BreakGlassGrants,
+		DecisionCacheRequests,
+		DecisionCacheEntries,
+		RulesLoaded,
+		ConfigGeneration,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Handler serves the registry in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
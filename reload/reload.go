@@ -0,0 +1,177 @@
+package reload
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/imiller31/k8s-auth-webhook/auth"
+	"github.com/imiller31/k8s-auth-webhook/cel"
+	"github.com/imiller31/k8s-auth-webhook/config"
+)
+
+// Reloader rebuilds the authorization policy from the configuration file and
+// swaps it into the authorizer. A configuration that fails to load or compile
+// is rejected and the policy in effect is kept.
+type Reloader struct {
+	loader     *config.Loader
+	configFile string
+	authorizer *auth.Authorizer
+
+	// mu serializes reloads triggered by polling and SIGHUP
+	mu       sync.Mutex
+	lastHash [sha256.Size]byte
+	// configErr and rulesErr are why the last reload was rejected: the file
+	// failed to load, or its CEL rules failed to compile
+	configErr error
+	rulesErr  error
+}
+
+// NewReloader creates a reloader that watches the loader's configuration
+// file. Environment and command-line overrides are re-applied on every
+// reload. The file's current contents are assumed to be the policy the
+// authorizer was built with.
+func NewReloader(loader *config.Loader, authorizer *auth.Authorizer) *Reloader {
+	configFile := loader.ConfigFile()
+	r := &Reloader{
+		loader:     loader,
+		configFile: configFile,
+		authorizer: authorizer,
+	}
+	if data, err := os.ReadFile(configFile); err == nil {
+		r.lastHash = sha256.Sum256(data)
+	}
+	return r
+}
+
+// Reload loads the configuration file, compiles its CEL rules and, if both
+// succeed, atomically replaces the authorizer's policy
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data, err := os.ReadFile(r.configFile)
+	if err != nil {
+		r.configErr, r.rulesErr = fmt.Errorf("failed to read config file: %v", err), nil
+		return r.reject(r.configErr)
+	}
+
+	cfg, err := r.loader.Load()
+	if err != nil {
+		r.configErr, r.rulesErr = err, nil
+		return r.reject(err)
+	}
+
+	celEval, err := cel.NewEvaluator(cfg.CELRules)
+	if err != nil {
+		r.configErr, r.rulesErr = nil, err
+		return r.reject(err)
+	}
+
+	r.warnRestartRequired(cfg)
+	r.lastHash = sha256.Sum256(data)
+	r.configErr, r.rulesErr = nil, nil
+
+	generation := r.authorizer.Update(cfg, celEval)
+	log.Printf("Reloaded configuration from %s: generation=%d, CELRules=%v", r.configFile, generation, cfg.RuleNames())
+	return nil
+}
+
+// ConfigErr returns why the configuration file failed to load on the last
+// reload, or nil if it loaded or no reload was attempted
+func (r *Reloader) ConfigErr() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.configErr
+}
+
+// RulesErr returns why the CEL rules failed to compile on the last reload,
+// or nil if they compiled or no reload got as far as compiling them
+func (r *Reloader) RulesErr() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rulesErr
+}
+
+// Watch reloads the policy whenever the configuration file's contents change
+// or the process receives SIGHUP, until stop is closed. A non-positive
+// interval disables polling.
+func (r *Reloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-sighup:
+			log.Printf("Received SIGHUP, reloading configuration from %s", r.configFile)
+			r.Reload()
+		case <-tick:
+			if r.changed() {
+				log.Printf("Configuration file %s changed, reloading", r.configFile)
+				r.Reload()
+			}
+		}
+	}
+}
+
+// changed reports whether the configuration file's contents differ from the
+// last successfully loaded or rejected version. Hashing the contents rather
+// than comparing modification times also catches ConfigMap symlink swaps.
+func (r *Reloader) changed() bool {
+	data, err := os.ReadFile(r.configFile)
+	if err != nil {
+		log.Printf("Failed to read config file %s: %v", r.configFile, err)
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return sha256.Sum256(data) != r.lastHash
+}
+
+// reject logs a failed reload and remembers the rejected contents so polling
+// does not retry the same broken file every interval
+func (r *Reloader) reject(err error) error {
+	if data, readErr := os.ReadFile(r.configFile); readErr == nil {
+		r.lastHash = sha256.Sum256(data)
+	}
+	log.Printf("ERROR: rejected configuration reload from %s, keeping policy generation %d: %v",
+		r.configFile, r.authorizer.Generation(), err)
+	return fmt.Errorf("configuration reload rejected: %v", err)
+}
+
+// warnRestartRequired logs settings that only take effect on restart
+func (r *Reloader) warnRestartRequired(cfg *config.Config) {
+	current := r.authorizer.Config()
+	if cfg.Port != current.Port {
+		log.Printf("WARNING: port changed from %s to %s; restart required to take effect", current.Port, cfg.Port)
+	}
+	if cfg.TLSCertFile != current.TLSCertFile || cfg.TLSKeyFile != current.TLSKeyFile {
+		log.Printf("WARNING: TLS file paths changed; restart required to take effect")
+	}
+	if !reflect.DeepEqual(cfg.Audit, current.Audit) {
+		log.Printf("WARNING: audit configuration changed; restart required to take effect")
+	}
+	if cfg.ClusterLookup != current.ClusterLookup {
+		log.Printf("WARNING: cluster lookup configuration changed; restart required to take effect")
+	}
+	if cfg.BreakGlass != current.BreakGlass {
+		log.Printf("WARNING: break-glass configuration changed; restart required to take effect")
+	}
+}
@@ -0,0 +1,170 @@
+package reload
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/imiller31/k8s-auth-webhook/auth"
+	"github.com/imiller31/k8s-auth-webhook/cel"
+	"github.com/imiller31/k8s-auth-webhook/config"
+	"github.com/imiller31/k8s-auth-webhook/decision"
+	authorizationv1 "k8s.io/api/authorization/v1"
+)
+
+// writeConfig writes a config file referencing TLS files in dir
+func writeConfig(t *testing.T, dir, extra string) string {
+	t.Helper()
+
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	for _, path := range []string{certPath, keyPath} {
+		if err := os.WriteFile(path, []byte("test"), 0644); err != nil {
+			t.Fatalf("Failed to write TLS file: %v", err)
+		}
+	}
+
+	content := "port: \"8443\"\ntlsCertFile: \"" + certPath + "\"\ntlsKeyFile: \"" + keyPath + "\"\n" + extra
+	configPath := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	return configPath
+}
+
+// newAuthorizer builds an authorizer from the config file as main does
+func newAuthorizer(t *testing.T, configPath string) *auth.Authorizer {
+	t.Helper()
+
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	celEval, err := cel.NewEvaluator(cfg.CELRules)
+	if err != nil {
+		t.Fatalf("Failed to create CEL evaluator: %v", err)
+	}
+	return auth.NewAuthorizer(cfg, celEval)
+}
+
+var getRequest = &authorizationv1.SubjectAccessReview{
+	Spec: authorizationv1.SubjectAccessReviewSpec{
+		User: "test-user",
+		ResourceAttributes: &authorizationv1.ResourceAttributes{
+			Verb: "get",
+			Name: "test-resource",
+		},
+	},
+}
+
+const denyGetsRule = `celRules:
+  - name: deny-gets
+    expression: "resourceAttributes.verb == 'get'"
+    effect: deny
+`
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	configPath := writeConfig(t, dir, "")
+	authorizer := newAuthorizer(t, configPath)
+	reloader := NewReloader(config.NewLoader(configPath), authorizer)
+
+	writeConfig(t, dir, denyGetsRule)
+	if err := reloader.Reload(); err != nil {
+		t.Fatalf("Reload() unexpected error: %v", err)
+	}
+	if authorizer.Generation() != 2 {
+		t.Errorf("Generation() = %d, want 2", authorizer.Generation())
+	}
+	if got, _ := authorizer.ProcessRequest(getRequest); got != decision.Deny {
+		t.Errorf("ProcessRequest() = %v, want %v", got, decision.Deny)
+	}
+}
+
+func TestReloadKeepsPolicyOnError(t *testing.T) {
+	tests := []struct {
+		name  string
+		extra string
+		// wantRulesErr is set when the rules rather than the file are at fault
+		wantRulesErr bool
+	}{
+		{
+			name: "invalid CEL rule",
+			extra: `celRules:
+  - name: broken
+    expression: "resourceAttributes.verb =="
+    effect: deny
+`,
+			wantRulesErr: true,
+		},
+		{
+			name:  "invalid YAML",
+			extra: "celRules: [",
+		},
+		{
+			name:  "invalid default decision",
+			extra: "defaultDecision: Maybe\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			configPath := writeConfig(t, dir, denyGetsRule)
+			authorizer := newAuthorizer(t, configPath)
+			reloader := NewReloader(config.NewLoader(configPath), authorizer)
+
+			writeConfig(t, dir, tt.extra)
+			if err := reloader.Reload(); err == nil {
+				t.Fatal("Reload() expected error, got none")
+			}
+			if authorizer.Generation() != 1 {
+				t.Errorf("Generation() = %d, want 1", authorizer.Generation())
+			}
+			if got, _ := authorizer.ProcessRequest(getRequest); got != decision.Deny {
+				t.Errorf("ProcessRequest() = %v, want previous policy's %v", got, decision.Deny)
+			}
+			if (reloader.RulesErr() != nil) != tt.wantRulesErr || (reloader.ConfigErr() != nil) == tt.wantRulesErr {
+				t.Errorf("ConfigErr() = %v, RulesErr() = %v, want the rules at fault: %v", reloader.ConfigErr(), reloader.RulesErr(), tt.wantRulesErr)
+			}
+
+			// A good file clears the errors
+			writeConfig(t, dir, denyGetsRule)
+			if err := reloader.Reload(); err != nil || reloader.ConfigErr() != nil || reloader.RulesErr() != nil {
+				t.Errorf("Reload() of a valid file = %v, ConfigErr() = %v, RulesErr() = %v, want no errors", err, reloader.ConfigErr(), reloader.RulesErr())
+			}
+		})
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	configPath := writeConfig(t, dir, "")
+	authorizer := newAuthorizer(t, configPath)
+	reloader := NewReloader(config.NewLoader(configPath), authorizer)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		reloader.Watch(10*time.Millisecond, stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	writeConfig(t, dir, denyGetsRule)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for authorizer.Generation() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("Watch() did not reload the changed config file")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got, _ := authorizer.ProcessRequest(getRequest); got != decision.Deny {
+		t.Errorf("ProcessRequest() = %v, want %v", got, decision.Deny)
+	}
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenAuthenticator validates bearer tokens against a file holding one token
+// per line, optionally followed by a comma and a name identifying its
+// holder, as in the apiserver's static token file. Blank lines and lines
+// starting with '#' are ignored. Several tokens may be listed at once so
+// they can be rotated without downtime, and the file is re-read whenever it
+// changes.
+type tokenAuthenticator struct {
+	tokenFile string
+
+	mu      sync.RWMutex
+	tokens  []namedToken
+	modTime time.Time
+}
+
+// namedToken is the hash of an accepted token and the name of its holder.
+// Unnamed tokens are named after a prefix of their hash, so the token used
+// can be recorded without revealing it.
+type namedToken struct {
+	hash [sha256.Size]byte
+	name string
+}
+
+// tokenNameKey is the request context key of the authenticated token's name
+type tokenNameKey struct{}
+
+// tokenName returns the name of the token a request was authenticated
+// with, or "" if it passed through no token authenticator
+func tokenName(r *http.Request) string {
+	name, _ := r.Context().Value(tokenNameKey{}).(string)
+	return name
+}
+
+// newTokenAuthenticator loads the token file, failing if it holds no tokens
+func newTokenAuthenticator(tokenFile string) (*tokenAuthenticator, error) {
+	a := &tokenAuthenticator{tokenFile: tokenFile}
+	if err := a.maybeReload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// maybeReload re-reads the token file if it changed since the last load
+func (a *tokenAuthenticator) maybeReload() error {
+	info, err := os.Stat(a.tokenFile)
+	if err != nil {
+		return fmt.Errorf("failed to stat token file: %v", err)
+	}
+
+	a.mu.RLock()
+	unchanged := a.tokens != nil && info.ModTime().Equal(a.modTime)
+	a.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	data, err := os.ReadFile(a.tokenFile)
+	if err != nil {
+		return fmt.Errorf("failed to read token file: %v", err)
+	}
+
+	var tokens []namedToken
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		token, name, _ := strings.Cut(line, ",")
+		t := namedToken{hash: sha256.Sum256([]byte(strings.TrimSpace(token))), name: strings.TrimSpace(name)}
+		if t.name == "" {
+			t.name = fmt.Sprintf("token-%x", t.hash[:4])
+		}
+		tokens = append(tokens, t)
+	}
+	if len(tokens) == 0 {
+		return fmt.Errorf("no tokens found in token file %s", a.tokenFile)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.tokens != nil {
+		log.Printf("Reloaded %d bearer tokens from %s", len(tokens), a.tokenFile)
+	}
+	a.tokens = tokens
+	a.modTime = info.ModTime()
+	return nil
+}
+
+// authenticate returns the name of the valid bearer token the request
+// carries, and whether it carries one. Every configured token is compared
+// in constant time.
+func (a *tokenAuthenticator) authenticate(r *http.Request) (string, bool) {
+	if err := a.maybeReload(); err != nil {
+		log.Printf("Failed to reload token file, using previous tokens: %v", err)
+	}
+
+	header := r.Header.Get("Authorization")
+	scheme, token, found := strings.Cut(header, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	presented := sha256.Sum256([]byte(strings.TrimSpace(token)))
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	name, valid := "", 0
+	for _, t := range a.tokens {
+		match := subtle.ConstantTimeCompare(presented[:], t.hash[:])
+		if match == 1 {
+			name = t.name
+		}
+		valid |= match
+	}
+	return name, valid == 1
+}
+
+// middleware rejects requests without a valid bearer token with 401 and
+// passes the token's name on to next in the request context
+func (a *tokenAuthenticator) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, ok := a.authenticate(r)
+		if !ok {
+			log.Printf("Rejected unauthenticated request: Method=%s, URL=%s, RemoteAddr=%s", r.Method, r.URL.String(), r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="k8s-auth-webhook"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenNameKey{}, name)))
+	})
+}
+
+// sensitiveHeaders are never written to logs
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// redactHeaders returns a copy of h with credential-bearing headers redacted
+func redactHeaders(h http.Header) http.Header {
+	redacted := h.Clone()
+	for _, name := range sensitiveHeaders {
+		if _, ok := redacted[name]; ok {
+			redacted[name] = []string{"[REDACTED]"}
+		}
+	}
+	return redacted
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenAuthenticator(t *testing.T) {
+	dir := t.TempDir()
+	tokenPath := filepath.Join(dir, "tokens")
+	start := time.Now().Add(-time.Minute)
+	writeFile(t, tokenPath, []byte("# current and next token\ntoken-a\n\n  token-b  \n"), start)
+
+	tokens, err := newTokenAuthenticator(tokenPath)
+	if err != nil {
+		t.Fatalf("newTokenAuthenticator() unexpected error: %v", err)
+	}
+	handler := tokens.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name          string
+		authorization string
+		wantStatus    int
+	}{
+		{name: "first token", authorization: "Bearer token-a", wantStatus: http.StatusOK},
+		{name: "second token", authorization: "Bearer token-b", wantStatus: http.StatusOK},
+		{name: "case-insensitive scheme", authorization: "bearer token-a", wantStatus: http.StatusOK},
+		{name: "missing header", authorization: "", wantStatus: http.StatusUnauthorized},
+		{name: "unknown token", authorization: "Bearer token-c", wantStatus: http.StatusUnauthorized},
+		{name: "comment is not a token", authorization: "Bearer # current and next token", wantStatus: http.StatusUnauthorized},
+		{name: "wrong scheme", authorization: "Basic token-a", wantStatus: http.StatusUnauthorized},
+		{name: "empty token", authorization: "Bearer ", wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/authorize", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("expected WWW-Authenticate header on 401 response")
+			}
+		})
+	}
+
+	// Rotating the file replaces the accepted tokens
+	writeFile(t, tokenPath, []byte("token-c\n"), start.Add(30*time.Second))
+	for token, wantStatus := range map[string]int{"token-a": http.StatusUnauthorized, "token-c": http.StatusOK} {
+		req := httptest.NewRequest("POST", "/authorize", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != wantStatus {
+			t.Errorf("after rotation %s status = %d, want %d", token, w.Code, wantStatus)
+		}
+	}
+}
+
+func TestTokenAuthenticatorNames(t *testing.T) {
+	tokenPath := filepath.Join(t.TempDir(), "tokens")
+	writeFile(t, tokenPath, []byte("token-a, alice\ntoken-b\n"), time.Now())
+
+	tokens, err := newTokenAuthenticator(tokenPath)
+	if err != nil {
+		t.Fatalf("newTokenAuthenticator() unexpected error: %v", err)
+	}
+	var name string
+	handler := tokens.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name = tokenName(r)
+	}))
+
+	for token, want := range map[string]string{
+		"token-a": "alice",
+		// Unnamed tokens are identified by a prefix of their hash
+		"token-b": fmt.Sprintf("token-%x", sha256.Sum256([]byte("token-b")))[:14],
+	} {
+		req := httptest.NewRequest("POST", "/authorize", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		if name != want {
+			t.Errorf("token %s authenticated as %q, want %q", token, name, want)
+		}
+	}
+}
+
+func TestNewTokenAuthenticatorEmptyFile(t *testing.T) {
+	tokenPath := filepath.Join(t.TempDir(), "tokens")
+	writeFile(t, tokenPath, []byte("# no tokens yet\n\n"), time.Now())
+
+	if _, err := newTokenAuthenticator(tokenPath); err == nil {
+		t.Error("newTokenAuthenticator() expected error for file without tokens, got none")
+	}
+}
+
+func TestRedactHeaders(t *testing.T) {
+	headers := http.Header{}
+	headers.Set("Authorization", "Bearer secret-token")
+	headers.Set("Cookie", "session=secret")
+	headers.Set("Content-Type", "application/json")
+
+	redacted := redactHeaders(headers)
+
+	logged := strings.Join(append(redacted.Values("Authorization"), redacted.Values("Cookie")...), " ")
+	if strings.Contains(logged, "secret") {
+		t.Errorf("redactHeaders() leaked credentials: %v", redacted)
+	}
+	if redacted.Get("Content-Type") != "application/json" {
+		t.Errorf("redactHeaders() dropped non-sensitive header: %v", redacted)
+	}
+	if headers.Get("Authorization") != "Bearer secret-token" {
+		t.Error("redactHeaders() modified the original headers")
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/imiller31/k8s-auth-webhook/breakglass"
+)
+
+// grantRequest is the body of a request creating a break-glass grant. The
+// expiry is given either as expiresAt or as a duration from now. The
+// createdBy it gives is kept as the grant's RequestedBy; the grant's
+// CreatedBy is the admin token the request was authenticated with.
+type grantRequest struct {
+	breakglass.Grant
+	Duration string `json:"duration"`
+}
+
+// breakGlassHandler serves the break-glass admin API:
+//
+//	GET    /breakglass/grants       lists the unexpired grants
+//	POST   /breakglass/grants       creates a grant
+//	DELETE /breakglass/grants/{id}  revokes a grant created through the API
+func breakGlassHandler(grants *breakglass.Store) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /breakglass/grants", func(w http.ResponseWriter, r *http.Request) {
+		list := grants.Grants()
+		if list == nil {
+			list = []breakglass.Grant{}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"grants": list})
+	})
+
+	mux.HandleFunc("POST /breakglass/grants", func(w http.ResponseWriter, r *http.Request) {
+		var req grantRequest
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid grant: %v", err))
+			return
+		}
+		if req.CreatedBy == "" {
+			writeError(w, http.StatusBadRequest, "invalid grant: createdBy is required")
+			return
+		}
+		if req.Duration != "" {
+			if !req.ExpiresAt.IsZero() {
+				writeError(w, http.StatusBadRequest, "invalid grant: set either duration or expiresAt")
+				return
+			}
+			d, err := time.ParseDuration(req.Duration)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid grant: invalid duration %q", req.Duration))
+				return
+			}
+			req.ExpiresAt = time.Now().Add(d)
+		}
+		req.RequestedBy, req.CreatedBy = req.CreatedBy, tokenName(r)
+
+		grant, err := grants.Create(req.Grant)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid grant: %v", err))
+			return
+		}
+		writeJSON(w, http.StatusCreated, grant)
+	})
+
+	mux.HandleFunc("DELETE /breakglass/grants/{id}", func(w http.ResponseWriter, r *http.Request) {
+		grant, ok := grants.Revoke(r.PathValue("id"))
+		if !ok {
+			writeError(w, http.StatusNotFound, "no grant created through the API with that ID; file grants are revoked by removing them from the grants file")
+			return
+		}
+		writeJSON(w, http.StatusOK, grant)
+	})
+
+	return mux
+}
+
+// writeJSON writes v as a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Error marshaling response: %v", err)
+		http.Error(w, "Error encoding response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+// writeError writes a JSON error response
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, map[string]string{"error": message})
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/imiller31/k8s-auth-webhook/audit"
+	"github.com/imiller31/k8s-auth-webhook/auth"
+	"github.com/imiller31/k8s-auth-webhook/breakglass"
+	"github.com/imiller31/k8s-auth-webhook/cel"
+	"github.com/imiller31/k8s-auth-webhook/config"
+	authorizationv1 "k8s.io/api/authorization/v1"
+)
+
+func TestBreakGlassHandler(t *testing.T) {
+	grants := breakglass.NewStore(config.BreakGlassConfig{MaxDuration: time.Hour})
+	tokenPath := filepath.Join(t.TempDir(), "admin-tokens")
+	writeFile(t, tokenPath, []byte("admin-token,oncall-lead\n"), time.Now())
+	admins, err := newTokenAuthenticator(tokenPath)
+	if err != nil {
+		t.Fatalf("newTokenAuthenticator() unexpected error: %v", err)
+	}
+	handler := admins.middleware(breakGlassHandler(grants))
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin-token")
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantError  string
+	}{
+		{name: "duration", body: `{"user":"alice","resources":["pods"],"reason":"INC-42","createdBy":"lead","duration":"30m"}`, wantStatus: http.StatusCreated},
+		{name: "no creator", body: `{"user":"alice","reason":"INC-42","duration":"30m"}`, wantStatus: http.StatusBadRequest, wantError: "createdBy is required"},
+		{name: "longer than the maximum", body: `{"user":"alice","reason":"INC-42","createdBy":"lead","duration":"2h"}`, wantStatus: http.StatusBadRequest, wantError: "more than 1h0m0s away"},
+		{name: "duration and expiry", body: `{"user":"alice","reason":"INC-42","createdBy":"lead","duration":"30m","expiresAt":"2030-01-01T00:00:00Z"}`, wantStatus: http.StatusBadRequest, wantError: "either duration or expiresAt"},
+		// The creator is the authenticated token; the name the client gives is kept apart
+		{name: "claimed creator", body: `{"user":"alice","reason":"INC-42","createdBy":"lead","requestedBy":"someone-else","duration":"30m"}`, wantStatus: http.StatusCreated},
+		{name: "unknown field", body: `{"user":"alice","reason":"INC-42","createdBy":"lead","duration":"30m","ttl":"1h"}`, wantStatus: http.StatusBadRequest, wantError: "unknown field"},
+	}
+
+	var created breakglass.Grant
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := do(http.MethodPost, "/breakglass/grants", tt.body)
+			if rec.Code != tt.wantStatus || !strings.Contains(rec.Body.String(), tt.wantError) {
+				t.Fatalf("POST = %d %s, want %d containing %q", rec.Code, rec.Body.String(), tt.wantStatus, tt.wantError)
+			}
+			if rec.Code == http.StatusCreated {
+				if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil || created.ID == "" || created.CreatedBy != "oncall-lead" || created.RequestedBy != "lead" {
+					t.Fatalf("POST returned %s, want the created grant: %v", rec.Body.String(), err)
+				}
+			}
+		})
+	}
+
+	rec := do(http.MethodGet, "/breakglass/grants", "")
+	var list struct {
+		Grants []breakglass.Grant `json:"grants"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil || len(list.Grants) != 2 || list.Grants[1].ID != created.ID {
+		t.Errorf("GET = %s, want the created grant: %v", rec.Body.String(), err)
+	}
+
+	if rec := do(http.MethodDelete, "/breakglass/grants/"+created.ID, ""); rec.Code != http.StatusOK {
+		t.Errorf("DELETE = %d %s, want 200", rec.Code, rec.Body.String())
+	}
+	if rec := do(http.MethodDelete, "/breakglass/grants/"+created.ID, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("second DELETE = %d, want 404", rec.Code)
+	}
+	if rec := do(http.MethodPut, "/breakglass/grants", "{}"); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT = %d, want 405", rec.Code)
+	}
+}
+
+func TestHandleAuthorizeBreakGlassAudit(t *testing.T) {
+	cfg := &config.Config{ProtectedPrefix: "test-", PrivilegedUser: "admin"}
+	celEval, err := cel.NewEvaluator(nil)
+	if err != nil {
+		t.Fatalf("Failed to create CEL evaluator: %v", err)
+	}
+	authorizer := auth.NewAuthorizer(cfg, celEval)
+	grants := breakglass.NewStore(config.BreakGlassConfig{MaxDuration: time.Hour})
+	authorizer.SetBreakGlass(grants)
+	grant, err := grants.Create(breakglass.Grant{User: "oncall", Reason: "INC-42", CreatedBy: "oncall-lead", RequestedBy: "lead", ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("Create() unexpected error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	auditor := audit.NewLoggerWithSinks(config.AuditConfig{}, audit.NewWriterSink(&buf))
+	server := NewWebhookServer(cfg, authorizer, auditor)
+
+	body, _ := json.Marshal(&authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:               "oncall",
+			ResourceAttributes: &authorizationv1.ResourceAttributes{Verb: "delete", Name: "test-resource"},
+		},
+	})
+	server.handleAuthorize(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/authorize", bytes.NewReader(body)))
+	auditor.Close()
+
+	var record audit.Record
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("expected a single JSON audit record, got %q: %v", buf.String(), err)
+	}
+	if record.Decision != "Allow" || record.BreakGlass == nil || record.BreakGlass.GrantID != grant.ID ||
+		record.BreakGlass.Reason != "INC-42" || record.BreakGlass.CreatedBy != "oncall-lead" || record.BreakGlass.RequestedBy != "lead" || record.BreakGlass.Source != breakglass.SourceAPI {
+		t.Errorf("expected an Allow audit record naming grant %s, got %+v with %+v", grant.ID, record, record.BreakGlass)
+	}
+}
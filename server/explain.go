@@ -0,0 +1,101 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/imiller31/k8s-auth-webhook/auth"
+	"github.com/imiller31/k8s-auth-webhook/cel"
+	authorizationv1 "k8s.io/api/authorization/v1"
+)
+
+// explainResponse is the decision on a SubjectAccessReview together with
+// every rule and check evaluated to reach it
+type explainResponse struct {
+	Decision string `json:"decision"`
+	Reason   string `json:"reason"`
+	// Rule is the CEL rule or built-in check that decided
+	Rule            string          `json:"rule"`
+	WouldHaveDenied []auditedDenial `json:"wouldHaveDenied,omitempty"`
+	// BreakGlassGrant is the ID of the grant that allowed the request, if any
+	BreakGlassGrant  string        `json:"breakGlassGrant,omitempty"`
+	ConfigGeneration uint64        `json:"configGeneration"`
+	EvaluationMicros int64         `json:"evaluationMicros"`
+	Steps            []explainStep `json:"steps"`
+}
+
+// auditedDenial is a denial recorded instead of enforced in audit mode
+type auditedDenial struct {
+	Rule   string `json:"rule"`
+	Reason string `json:"reason"`
+}
+
+// explainStep is how one CEL rule or built-in check handled the request
+type explainStep struct {
+	Rule    string `json:"rule"`
+	Outcome string `json:"outcome"`
+	Detail  string `json:"detail,omitempty"`
+	// Variables are the values a CEL rule read, in the order it read them
+	Variables []explainVariable `json:"variables,omitempty"`
+	Decisive  bool              `json:"decisive,omitempty"`
+}
+
+// explainVariable is a value a CEL rule read, or the error reading it.
+// Name is the variable or field as written in CEL. Value is always present
+// so empty strings are shown; it is null when reading failed.
+type explainVariable struct {
+	Name  string      `json:"name"`
+	Value interface{} `json:"value"`
+	Error string      `json:"error,omitempty"`
+}
+
+// explainHandler serves POST /explain: it evaluates the SubjectAccessReview
+// in the body against the policy in effect and returns the decision and
+// every step taken to reach it. Explained requests bypass the decision
+// cache and are neither audited nor counted in the decision metrics.
+func explainHandler(authorizer *auth.Authorizer) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("POST /explain", func(w http.ResponseWriter, r *http.Request) {
+		var sar authorizationv1.SubjectAccessReview
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&sar); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid SubjectAccessReview: %v", err))
+			return
+		}
+
+		result, steps := authorizer.Explain(&sar)
+		writeJSON(w, http.StatusOK, newExplainResponse(result, steps))
+	})
+
+	return mux
+}
+
+// newExplainResponse converts an explained result to its JSON form
+func newExplainResponse(result auth.Result, steps []cel.Step) explainResponse {
+	resp := explainResponse{
+		Decision:         result.Decision.String(),
+		Reason:           result.Reason,
+		Rule:             result.Rule,
+		ConfigGeneration: result.Generation,
+		EvaluationMicros: result.Duration.Microseconds(),
+		Steps:            make([]explainStep, 0, len(steps)),
+	}
+	for _, denial := range result.Audited {
+		resp.WouldHaveDenied = append(resp.WouldHaveDenied, auditedDenial{Rule: denial.Rule, Reason: denial.Reason})
+	}
+	if result.BreakGlass != nil {
+		resp.BreakGlassGrant = result.BreakGlass.ID
+	}
+
+	for _, s := range steps {
+		step := explainStep{Rule: s.Rule, Outcome: s.Outcome, Detail: s.Detail, Decisive: s.Decisive}
+		for _, v := range s.Variables {
+			step.Variables = append(step.Variables, explainVariable{Name: v.Name, Value: v.Value, Error: v.Error})
+		}
+		resp.Steps = append(resp.Steps, step)
+	}
+	return resp
+}
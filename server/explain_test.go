@@ -0,0 +1,107 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/imiller31/k8s-auth-webhook/auth"
+	"github.com/imiller31/k8s-auth-webhook/cel"
+	"github.com/imiller31/k8s-auth-webhook/config"
+	"github.com/imiller31/k8s-auth-webhook/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	authorizationv1 "k8s.io/api/authorization/v1"
+)
+
+func TestExplainHandler(t *testing.T) {
+	cfg := &config.Config{ProtectedPrefix: "test-", PrivilegedUser: "admin"}
+	celEval, err := cel.NewEvaluator([]config.CELRule{
+		{Name: "deny-prod", Expression: "resourceAttributes.namespace == 'prod'", Effect: "deny"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create CEL evaluator: %v", err)
+	}
+	handler := explainHandler(auth.NewAuthorizer(cfg, celEval))
+
+	do := func(method, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, "/explain", strings.NewReader(body)))
+		return rec
+	}
+
+	decisions := testutil.ToFloat64(metrics.Decisions.WithLabelValues("Deny", "builtin:protection:protected-prefix"))
+	rec := do(http.MethodPost, `{"spec": {"user": "alice", "resourceAttributes": {"verb": "delete", "namespace": "dev", "name": "test-web"}}}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST = %d %s, want 200", rec.Code, rec.Body.String())
+	}
+
+	var resp explainResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("POST returned %s: %v", rec.Body.String(), err)
+	}
+	if resp.Decision != "Deny" || resp.Rule != "builtin:protection:protected-prefix" || resp.ConfigGeneration != 1 {
+		t.Errorf("POST = %s by %s in generation %d, want Deny by builtin:protection:protected-prefix in generation 1", resp.Decision, resp.Rule, resp.ConfigGeneration)
+	}
+	if len(resp.Steps) != 3 {
+		t.Fatalf("POST steps = %+v, want a step for the rule, the impersonation policy and the protection policy", resp.Steps)
+	}
+	if step := resp.Steps[0]; step.Rule != "deny-prod" || step.Outcome != cel.OutcomeNoMatch ||
+		len(step.Variables) != 1 || step.Variables[0].Name != "resourceAttributes.namespace" || step.Variables[0].Value != "dev" {
+		t.Errorf("first step = %+v, want deny-prod not matching on resourceAttributes.namespace = dev", step)
+	}
+	for i, step := range resp.Steps {
+		if want := step.Rule == resp.Rule; step.Decisive != want {
+			t.Errorf("step %d (%s) decisive = %v, want %v", i, step.Rule, step.Decisive, want)
+		}
+	}
+	if got := testutil.ToFloat64(metrics.Decisions.WithLabelValues("Deny", "builtin:protection:protected-prefix")); got != decisions {
+		t.Errorf("decision metric changed from %v to %v, want explained requests not to be counted", decisions, got)
+	}
+
+	if rec := do(http.MethodPost, `{"spec": "alice"}`); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "invalid SubjectAccessReview") {
+		t.Errorf("POST invalid = %d %s, want 400", rec.Code, rec.Body.String())
+	}
+	if rec := do(http.MethodGet, ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET = %d, want 405", rec.Code)
+	}
+}
+
+func TestExplainHandlerNotCounted(t *testing.T) {
+	cfg := &config.Config{}
+	celEval, err := cel.NewEvaluator([]config.CELRule{
+		{Name: "explain-broken", Expression: "request.extra['team'][0] == 'infra'", Effect: "deny", Match: config.RuleMatch{Namespaces: []string{"broken"}}},
+		{Name: "explain-deny-prod", Expression: "resourceAttributes.namespace == 'prod'", Effect: "deny"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create CEL evaluator: %v", err)
+	}
+	handler := explainHandler(auth.NewAuthorizer(cfg, celEval))
+
+	matches := testutil.ToFloat64(metrics.RuleMatches.WithLabelValues("explain-deny-prod", "Deny"))
+	ruleErrors := testutil.ToFloat64(metrics.RuleErrors.WithLabelValues("explain-broken"))
+	for _, namespace := range []string{"prod", "broken"} {
+		rec := httptest.NewRecorder()
+		body := `{"spec": {"user": "alice", "resourceAttributes": {"verb": "delete", "namespace": "` + namespace + `"}}}`
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/explain", strings.NewReader(body)))
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"decision":"Deny"`) {
+			t.Fatalf("POST in %s = %d %s, want a denial", namespace, rec.Code, rec.Body.String())
+		}
+	}
+
+	if got := testutil.ToFloat64(metrics.RuleMatches.WithLabelValues("explain-deny-prod", "Deny")); got != matches {
+		t.Errorf("rule match metric changed from %v to %v, want explained requests not to be counted", matches, got)
+	}
+	if got := testutil.ToFloat64(metrics.RuleErrors.WithLabelValues("explain-broken")); got != ruleErrors {
+		t.Errorf("rule error metric changed from %v to %v, want explained requests not to be counted", ruleErrors, got)
+	}
+
+	// The same requests authorized for real are counted
+	celEval.Evaluate(&authorizationv1.SubjectAccessReview{Spec: authorizationv1.SubjectAccessReviewSpec{
+		ResourceAttributes: &authorizationv1.ResourceAttributes{Verb: "delete", Namespace: "prod"},
+	}})
+	if got := testutil.ToFloat64(metrics.RuleMatches.WithLabelValues("explain-deny-prod", "Deny")); got != matches+1 {
+		t.Errorf("rule match metric = %v after Evaluate, want %v", got, matches+1)
+	}
+}
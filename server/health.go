@@ -0,0 +1,159 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// healthCheck is a single named check reported by a health endpoint
+type healthCheck struct {
+	name  string
+	check func() error
+	// detail, if set, describes a passing check in verbose output
+	detail func() string
+}
+
+// ReloadStatus reports whether the last configuration reload was rejected.
+// It is implemented by reload.Reloader.
+type ReloadStatus interface {
+	// ConfigErr returns why the configuration file failed to load
+	ConfigErr() error
+	// RulesErr returns why the CEL rules failed to compile
+	RulesErr() error
+}
+
+// SetReloadStatus makes readiness fail while the configuration file on disk
+// has been rejected, so a broken rollout is noticed even though the previous
+// policy keeps being served. It must be called before Start.
+func (s *WebhookServer) SetReloadStatus(status ReloadStatus) {
+	s.reloadStatus = status
+}
+
+// healthHandler serves a health endpoint in the style of the kube-apiserver.
+// It responds "ok" when every check passes and 500 otherwise. With ?verbose
+// each check is listed, ?exclude=<name> skips a check, and /<endpoint>/<name>
+// runs a single check. Failure details are logged rather than returned.
+func healthHandler(endpoint string, checks []healthCheck) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		selected := checks
+		if name := strings.TrimPrefix(r.URL.Path, "/"+endpoint+"/"); name != r.URL.Path && name != "" {
+			selected = nil
+			for _, c := range checks {
+				if c.name == name {
+					selected = []healthCheck{c}
+				}
+			}
+			if selected == nil {
+				http.NotFound(w, r)
+				return
+			}
+		}
+
+		excluded := r.URL.Query()["exclude"]
+		var out strings.Builder
+		failed := false
+		for _, c := range selected {
+			if contains(excluded, c.name) {
+				fmt.Fprintf(&out, "[+]%s excluded: ok\n", c.name)
+				continue
+			}
+			if err := c.check(); err != nil {
+				log.Printf("%s check %s failed: %v", endpoint, c.name, err)
+				fmt.Fprintf(&out, "[-]%s failed: reason withheld\n", c.name)
+				failed = true
+				continue
+			}
+			if c.detail != nil {
+				fmt.Fprintf(&out, "[+]%s ok: %s\n", c.name, c.detail())
+				continue
+			}
+			fmt.Fprintf(&out, "[+]%s ok\n", c.name)
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if failed {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "%s%s check failed\n", out.String(), endpoint)
+			return
+		}
+		if _, verbose := r.URL.Query()["verbose"]; verbose {
+			fmt.Fprintf(w, "%s%s check passed\n", out.String(), endpoint)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	})
+}
+
+// registerHealthHandlers adds /livez, /readyz and /healthz to mux. Liveness
+// only reports that the process is serving; readiness and health also require
+// that the last reload of the configuration file loaded it and compiled its
+// rules, and a valid serving certificate, and fail once the server starts
+// shutting down.
+func (s *WebhookServer) registerHealthHandlers(mux *http.ServeMux) {
+	ping := healthCheck{name: "ping", check: func() error { return nil }}
+	live := []healthCheck{ping}
+	ready := []healthCheck{
+		ping,
+		{name: "config", check: s.checkConfig, detail: s.configDetail},
+		{name: "rules", check: s.checkRules, detail: s.rulesDetail},
+		{name: "certificates", check: s.checkCertificates},
+		{name: "shutdown", check: s.checkShutdown},
+	}
+
+	for endpoint, checks := range map[string][]healthCheck{"livez": live, "readyz": ready, "healthz": ready} {
+		handler := healthHandler(endpoint, checks)
+		mux.Handle("/"+endpoint, handler)
+		mux.Handle("/"+endpoint+"/", handler)
+	}
+}
+
+// checkConfig fails when the last reload could not load the configuration file
+func (s *WebhookServer) checkConfig() error {
+	if s.reloadStatus == nil {
+		return nil
+	}
+	if err := s.reloadStatus.ConfigErr(); err != nil {
+		return fmt.Errorf("configuration reload rejected, serving generation %d: %v", s.authorizer.Generation(), err)
+	}
+	return nil
+}
+
+// configDetail describes the configuration in effect
+func (s *WebhookServer) configDetail() string {
+	return fmt.Sprintf("generation %d", s.authorizer.Generation())
+}
+
+// checkRules fails when the last reload could not compile the CEL rules
+func (s *WebhookServer) checkRules() error {
+	if s.reloadStatus == nil {
+		return nil
+	}
+	if err := s.reloadStatus.RulesErr(); err != nil {
+		return fmt.Errorf("CEL rules rejected on reload, serving generation %d: %v", s.authorizer.Generation(), err)
+	}
+	return nil
+}
+
+// rulesDetail describes the CEL rules in effect
+func (s *WebhookServer) rulesDetail() string {
+	return fmt.Sprintf("%d CEL rules", s.authorizer.RuleCount())
+}
+
+// checkCertificates reports whether the serving certificate is currently valid
+func (s *WebhookServer) checkCertificates() error {
+	if s.certs == nil {
+		return fmt.Errorf("serving certificate not loaded")
+	}
+	return s.certs.check()
+}
+
+// checkShutdown fails once the server has started shutting down
+func (s *WebhookServer) checkShutdown() error {
+	if s.shuttingDown.Load() {
+		return fmt.Errorf("server is shutting down")
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/imiller31/k8s-auth-webhook/auth"
+	"github.com/imiller31/k8s-auth-webhook/cel"
+	"github.com/imiller31/k8s-auth-webhook/config"
+)
+
+func TestHealthHandler(t *testing.T) {
+	handler := healthHandler("readyz", []healthCheck{
+		{name: "good", check: func() error { return nil }},
+		{name: "bad", check: func() error { return errors.New("broken") }},
+	})
+
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "failing check",
+			path:       "/readyz",
+			wantStatus: http.StatusInternalServerError,
+			wantBody:   "[+]good ok\n[-]bad failed: reason withheld\nreadyz check failed\n",
+		},
+		{
+			name:       "excluded failing check",
+			path:       "/readyz?exclude=bad",
+			wantStatus: http.StatusOK,
+			wantBody:   "ok",
+		},
+		{
+			name:       "verbose",
+			path:       "/readyz?verbose&exclude=bad",
+			wantStatus: http.StatusOK,
+			wantBody:   "[+]good ok\n[+]bad excluded: ok\nreadyz check passed\n",
+		},
+		{
+			name:       "single check",
+			path:       "/readyz/good",
+			wantStatus: http.StatusOK,
+			wantBody:   "ok",
+		},
+		{
+			name:       "unknown check",
+			path:       "/readyz/missing",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, rr.Code)
+			}
+			if tt.wantBody != "" && rr.Body.String() != tt.wantBody {
+				t.Errorf("expected body %q, got %q", tt.wantBody, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	cfg := &config.Config{}
+	celEval, err := cel.NewEvaluator(nil)
+	if err != nil {
+		t.Fatalf("Failed to create CEL evaluator: %v", err)
+	}
+	server := NewWebhookServer(cfg, auth.NewAuthorizer(cfg, celEval), nil)
+	mux := http.NewServeMux()
+	server.registerHealthHandlers(mux)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		return rr
+	}
+
+	// Before Start loads the serving certificate the server is live but not ready
+	if rr := get("/livez"); rr.Code != http.StatusOK {
+		t.Errorf("expected /livez to pass, got %d: %s", rr.Code, rr.Body.String())
+	}
+	for _, path := range []string{"/readyz", "/healthz"} {
+		rr := get(path + "?verbose")
+		if rr.Code != http.StatusInternalServerError || !strings.Contains(rr.Body.String(), "[-]certificates failed") {
+			t.Errorf("expected %s to fail the certificates check, got %d: %s", path, rr.Code, rr.Body.String())
+		}
+	}
+
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issue(t, "webhook", []string{"localhost"}, x509.ExtKeyUsageServerAuth)
+	certPath, keyPath := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeFile(t, certPath, certPEM, time.Now())
+	writeFile(t, keyPath, keyPEM, time.Now())
+	if server.certs, err = newCertReloader(certPath, keyPath); err != nil {
+		t.Fatalf("newCertReloader() unexpected error: %v", err)
+	}
+
+	rr := get("/readyz?verbose")
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected /readyz to pass, got %d: %s", rr.Code, rr.Body.String())
+	}
+	for _, check := range []string{"ping", "config ok: generation 1", "rules ok: 0 CEL rules", "certificates"} {
+		if !strings.Contains(rr.Body.String(), "[+]"+check) {
+			t.Errorf("expected verbose /readyz to list %s, got %s", check, rr.Body.String())
+		}
+	}
+
+	// A rejected reload fails readiness even though the previous policy is served
+	status := &fakeReloadStatus{}
+	server.SetReloadStatus(status)
+	for _, tt := range []struct {
+		configErr, rulesErr error
+		wantFailed          string
+	}{
+		{configErr: errors.New("invalid YAML"), wantFailed: "[-]config failed"},
+		{rulesErr: errors.New("undeclared reference"), wantFailed: "[-]rules failed"},
+	} {
+		status.configErr, status.rulesErr = tt.configErr, tt.rulesErr
+		if rr := get("/readyz?verbose"); rr.Code != http.StatusInternalServerError || !strings.Contains(rr.Body.String(), tt.wantFailed) {
+			t.Errorf("expected /readyz to fail with %s, got %d: %s", tt.wantFailed, rr.Code, rr.Body.String())
+		}
+	}
+	status.configErr, status.rulesErr = nil, nil
+	if rr := get("/readyz"); rr.Code != http.StatusOK {
+		t.Errorf("expected /readyz to pass after a successful reload, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+// fakeReloadStatus reports fixed reload errors
+type fakeReloadStatus struct {
+	configErr, rulesErr error
+}
+
+func (f *fakeReloadStatus) ConfigErr() error { return f.configErr }
+func (f *fakeReloadStatus) RulesErr() error  { return f.rulesErr }
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/imiller31/k8s-auth-webhook/auth"
+	"github.com/imiller31/k8s-auth-webhook/cel"
+	"github.com/imiller31/k8s-auth-webhook/config"
+	"github.com/imiller31/k8s-auth-webhook/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInstrument(t *testing.T) {
+	handler := instrument(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/authorize", nil))
+
+	expected := `k8s_auth_webhook_request_duration_seconds_count{code="400"} 1`
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), expected) {
+		t.Errorf("metrics output missing %q", expected)
+	}
+}
+
+func TestDecodeErrorMetric(t *testing.T) {
+	cfg := &config.Config{
+		Port:            "8080",
+		ProtectedPrefix: "test-",
+		PrivilegedUser:  "admin",
+	}
+	celEval, err := cel.NewEvaluator(nil)
+	if err != nil {
+		t.Fatalf("Failed to create CEL evaluator: %v", err)
+	}
+	server := NewWebhookServer(cfg, auth.NewAuthorizer(cfg, celEval), nil)
+
+	before := testutil.ToFloat64(metrics.DecodeErrors)
+	req := httptest.NewRequest("POST", "/authorize", strings.NewReader("{not json"))
+	server.handleAuthorize(httptest.NewRecorder(), req)
+
+	if got := testutil.ToFloat64(metrics.DecodeErrors) - before; got != 1 {
+		t.Errorf("decode_errors_total increased by %v, want 1", got)
+	}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	authorizationv1beta1 "k8s.io/api/authorization/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// API versions of SubjectAccessReview the webhook serves. The apiserver
+// sends the version set by subjectAccessReviewVersion in its webhook
+// configuration and expects the response in the same version.
+const (
+	reviewKind           = "SubjectAccessReview"
+	reviewVersionV1      = "authorization.k8s.io/v1"
+	reviewVersionV1beta1 = "authorization.k8s.io/v1beta1"
+)
+
+// decodeReview decodes a SubjectAccessReview of either served version into
+// the v1 model the authorizer evaluates, and returns the API version to
+// respond in. A review declaring neither apiVersion nor kind is taken to
+// be v1. Other kinds and versions are rejected.
+func decodeReview(body []byte) (*authorizationv1.SubjectAccessReview, string, error) {
+	var meta metav1.TypeMeta
+	if err := json.Unmarshal(body, &meta); err != nil {
+		return nil, "", err
+	}
+	if meta.Kind != "" && meta.Kind != reviewKind {
+		return nil, "", fmt.Errorf("unsupported kind %q: must be %s", meta.Kind, reviewKind)
+	}
+
+	switch meta.APIVersion {
+	case reviewVersionV1, "":
+		var sar authorizationv1.SubjectAccessReview
+		if err := json.Unmarshal(body, &sar); err != nil {
+			return nil, "", err
+		}
+		return &sar, reviewVersionV1, nil
+	case reviewVersionV1beta1:
+		var sar authorizationv1beta1.SubjectAccessReview
+		if err := json.Unmarshal(body, &sar); err != nil {
+			return nil, "", err
+		}
+		return convertV1beta1Review(&sar), reviewVersionV1beta1, nil
+	default:
+		return nil, "", fmt.Errorf("unsupported apiVersion %q: must be %s or %s", meta.APIVersion, reviewVersionV1, reviewVersionV1beta1)
+	}
+}
+
+// convertV1beta1Review converts a v1beta1 SubjectAccessReview to v1. The
+// versions differ only in that v1beta1 names the user's groups "group".
+func convertV1beta1Review(in *authorizationv1beta1.SubjectAccessReview) *authorizationv1.SubjectAccessReview {
+	out := &authorizationv1.SubjectAccessReview{
+		ObjectMeta: in.ObjectMeta,
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   in.Spec.User,
+			Groups: in.Spec.Groups,
+			UID:    in.Spec.UID,
+		},
+	}
+
+	if in.Spec.Extra != nil {
+		out.Spec.Extra = make(map[string]authorizationv1.ExtraValue, len(in.Spec.Extra))
+		for key, value := range in.Spec.Extra {
+			out.Spec.Extra[key] = authorizationv1.ExtraValue(value)
+		}
+	}
+	if attrs := in.Spec.ResourceAttributes; attrs != nil {
+		out.Spec.ResourceAttributes = &authorizationv1.ResourceAttributes{
+			Namespace:     attrs.Namespace,
+			Verb:          attrs.Verb,
+			Group:         attrs.Group,
+			Version:       attrs.Version,
+			Resource:      attrs.Resource,
+			Subresource:   attrs.Subresource,
+			Name:          attrs.Name,
+			FieldSelector: attrs.FieldSelector,
+			LabelSelector: attrs.LabelSelector,
+		}
+	}
+	if attrs := in.Spec.NonResourceAttributes; attrs != nil {
+		out.Spec.NonResourceAttributes = &authorizationv1.NonResourceAttributes{
+			Path: attrs.Path,
+			Verb: attrs.Verb,
+		}
+	}
+	return out
+}
+
+// encodeReview encodes the response to a SubjectAccessReview in the API
+// version it was received in
+func encodeReview(apiVersion string, status authorizationv1.SubjectAccessReviewStatus) ([]byte, error) {
+	typeMeta := metav1.TypeMeta{APIVersion: apiVersion, Kind: reviewKind}
+	if apiVersion == reviewVersionV1beta1 {
+		return json.Marshal(authorizationv1beta1.SubjectAccessReview{
+			TypeMeta: typeMeta,
+			Status: authorizationv1beta1.SubjectAccessReviewStatus{
+				Allowed:         status.Allowed,
+				Denied:          status.Denied,
+				Reason:          status.Reason,
+				EvaluationError: status.EvaluationError,
+			},
+		})
+	}
+	return json.Marshal(authorizationv1.SubjectAccessReview{TypeMeta: typeMeta, Status: status})
+}
+
+// writeStatus writes an error as a Kubernetes Status object, the form the
+// apiserver itself reports errors in
+func writeStatus(w http.ResponseWriter, code int, reason metav1.StatusReason, message string) {
+	body, err := json.Marshal(metav1.Status{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Status"},
+		Status:   metav1.StatusFailure,
+		Message:  message,
+		Reason:   reason,
+		Code:     int32(code),
+	})
+	if err != nil {
+		log.Printf("Error marshaling status: %v", err)
+		http.Error(w, message, code)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(body)
+}
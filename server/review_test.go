@@ -0,0 +1,128 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/imiller31/k8s-auth-webhook/auth"
+	"github.com/imiller31/k8s-auth-webhook/cel"
+	"github.com/imiller31/k8s-auth-webhook/config"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestHandleAuthorizeVersions(t *testing.T) {
+	cfg := &config.Config{
+		ProtectedPrefix:  "test-",
+		PrivilegedUser:   "admin",
+		PrivilegedGroups: []string{"ops"},
+	}
+	celEval, err := cel.NewEvaluator([]config.CELRule{
+		{Name: "deny-read-only", Expression: "has(request.extra) && 'scopes' in request.extra && 'read-only' in request.extra['scopes']", Effect: "deny"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create CEL evaluator: %v", err)
+	}
+	server := NewWebhookServer(cfg, auth.NewAuthorizer(cfg, celEval), nil)
+
+	tests := []struct {
+		name           string
+		body           string
+		wantStatus     int
+		wantAPIVersion string
+		wantAllowed    bool
+		wantDenied     bool
+		wantMessage    string
+	}{
+		{
+			name:           "v1 groups",
+			body:           `{"apiVersion": "authorization.k8s.io/v1", "kind": "SubjectAccessReview", "spec": {"user": "alice", "groups": ["ops"], "resourceAttributes": {"verb": "delete", "name": "test-web"}}}`,
+			wantStatus:     http.StatusOK,
+			wantAPIVersion: "authorization.k8s.io/v1",
+			wantAllowed:    true,
+		},
+		{
+			name:           "v1beta1 groups",
+			body:           `{"apiVersion": "authorization.k8s.io/v1beta1", "kind": "SubjectAccessReview", "spec": {"user": "alice", "group": ["ops"], "resourceAttributes": {"verb": "delete", "name": "test-web"}}}`,
+			wantStatus:     http.StatusOK,
+			wantAPIVersion: "authorization.k8s.io/v1beta1",
+			wantAllowed:    true,
+		},
+		{
+			name:           "v1beta1 without privileged group",
+			body:           `{"apiVersion": "authorization.k8s.io/v1beta1", "kind": "SubjectAccessReview", "spec": {"user": "alice", "group": ["dev"], "resourceAttributes": {"verb": "delete", "name": "test-web"}}}`,
+			wantStatus:     http.StatusOK,
+			wantAPIVersion: "authorization.k8s.io/v1beta1",
+			wantDenied:     true,
+		},
+		{
+			name:           "v1beta1 extra",
+			body:           `{"apiVersion": "authorization.k8s.io/v1beta1", "kind": "SubjectAccessReview", "spec": {"user": "alice", "extra": {"scopes": ["read-only"]}, "nonResourceAttributes": {"path": "/healthz", "verb": "get"}}}`,
+			wantStatus:     http.StatusOK,
+			wantAPIVersion: "authorization.k8s.io/v1beta1",
+			wantDenied:     true,
+		},
+		{
+			name:           "undeclared version is v1",
+			body:           `{"spec": {"user": "alice", "groups": ["ops"], "resourceAttributes": {"verb": "delete", "name": "test-web"}}}`,
+			wantStatus:     http.StatusOK,
+			wantAPIVersion: "authorization.k8s.io/v1",
+			wantAllowed:    true,
+		},
+		{
+			name:        "unknown kind",
+			body:        `{"apiVersion": "authorization.k8s.io/v1", "kind": "SelfSubjectAccessReview", "spec": {}}`,
+			wantStatus:  http.StatusBadRequest,
+			wantMessage: `unsupported kind "SelfSubjectAccessReview"`,
+		},
+		{
+			name:        "unknown version",
+			body:        `{"apiVersion": "authorization.k8s.io/v2", "kind": "SubjectAccessReview", "spec": {}}`,
+			wantStatus:  http.StatusBadRequest,
+			wantMessage: `unsupported apiVersion "authorization.k8s.io/v2"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			server.handleAuthorize(rec, httptest.NewRequest(http.MethodPost, "/authorize", strings.NewReader(tt.body)))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("handleAuthorize() status = %d %s, want %d", rec.Code, rec.Body.String(), tt.wantStatus)
+			}
+
+			if tt.wantStatus != http.StatusOK {
+				var status metav1.Status
+				if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil || status.Kind != "Status" || status.Code != int32(tt.wantStatus) {
+					t.Fatalf("handleAuthorize() body = %s, want a Status with code %d: %v", rec.Body.String(), tt.wantStatus, err)
+				}
+				if !strings.Contains(status.Message, tt.wantMessage) {
+					t.Errorf("handleAuthorize() message = %q, want it to contain %q", status.Message, tt.wantMessage)
+				}
+				return
+			}
+
+			// The status fields are the same in both versions
+			var response struct {
+				metav1.TypeMeta `json:",inline"`
+				Status          struct {
+					Allowed bool   `json:"allowed"`
+					Denied  bool   `json:"denied"`
+					Reason  string `json:"reason"`
+				} `json:"status"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatalf("Failed to decode response %s: %v", rec.Body.String(), err)
+			}
+			if response.APIVersion != tt.wantAPIVersion || response.Kind != "SubjectAccessReview" {
+				t.Errorf("handleAuthorize() responded with %s %s, want %s SubjectAccessReview", response.APIVersion, response.Kind, tt.wantAPIVersion)
+			}
+			if response.Status.Allowed != tt.wantAllowed || response.Status.Denied != tt.wantDenied {
+				t.Errorf("handleAuthorize() allowed = %v, denied = %v (%s), want %v and %v",
+					response.Status.Allowed, response.Status.Denied, response.Status.Reason, tt.wantAllowed, tt.wantDenied)
+			}
+		})
+	}
+}
@@ -1,105 +1,286 @@
 package server
 
 import (
-	"crypto/tls"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
-	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/imiller31/k8s-auth-webhook/audit"
 	"github.com/imiller31/k8s-auth-webhook/auth"
 	"github.com/imiller31/k8s-auth-webhook/config"
+	"github.com/imiller31/k8s-auth-webhook/metrics"
 	authorizationv1 "k8s.io/api/authorization/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 // WebhookServer handles HTTP requests for the authorization webhook
 type WebhookServer struct {
-	server     *http.Server
+	// mu guards the servers and listener, which Start creates and Stop shuts down
+	mu       sync.Mutex
+	server   *http.Server
+	listener net.Listener
+	// metricsServer serves /metrics over plain HTTP on a separate port
+	metricsServer *http.Server
+	// shuttingDown is set by Stop and fails the readiness check
+	shuttingDown atomic.Bool
+
 	config     *config.Config
 	authorizer *auth.Authorizer
+	// certs serves the TLS keypair; set by Start
+	certs *certReloader
+	// auditor receives a record for every decision; nil disables auditing
+	auditor *audit.Logger
+	// reloadStatus fails readiness while a reload is rejected; nil when
+	// the configuration is not reloaded
+	reloadStatus ReloadStatus
 }
 
-// NewWebhookServer creates a new webhook server with the given configuration and authorizer
-func NewWebhookServer(config *config.Config, authorizer *auth.Authorizer) *WebhookServer {
+// NewWebhookServer creates a new webhook server with the given configuration,
+// authorizer and audit logger. The audit logger may be nil.
+func NewWebhookServer(config *config.Config, authorizer *auth.Authorizer, auditor *audit.Logger) *WebhookServer {
 	return &WebhookServer{
 		config:     config,
 		authorizer: authorizer,
+		auditor:    auditor,
 	}
 }
 
 // handleAuthorize processes authorization requests
 func (s *WebhookServer) handleAuthorize(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Received request: Method=%s, URL=%s, Headers=%v", r.Method, r.URL.String(), r.Header)
+	log.Printf("Received request: Method=%s, URL=%s, Headers=%v", r.Method, r.URL.String(), redactHeaders(r.Header))
 
 	if r.Method != http.MethodPost {
 		log.Printf("Invalid method: %s", r.Method)
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeStatus(w, http.StatusMethodNotAllowed, metav1.StatusReasonMethodNotAllowed, "Method not allowed")
 		return
 	}
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		log.Printf("Error reading request body: %v", err)
-		http.Error(w, "Error reading request", http.StatusBadRequest)
+		writeStatus(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, "Error reading request")
 		return
 	}
-	log.Printf("Raw request body: %s", string(body))
 
-	var sar authorizationv1.SubjectAccessReview
-	if err := json.NewDecoder(strings.NewReader(string(body))).Decode(&sar); err != nil {
+	// Reviews are answered in the version they were sent in
+	sar, apiVersion, err := decodeReview(body)
+	if err != nil {
 		log.Printf("Error decoding request: %v", err)
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		metrics.DecodeErrors.Inc()
+		writeStatus(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, fmt.Sprintf("Invalid SubjectAccessReview: %v", err))
 		return
 	}
 
-	log.Printf("Received authorization request: %+v", sar)
-
 	// Process the authorization request
-	allowed, reason := s.authorizer.ProcessRequest(&sar)
-
-	// Create response
-	response := authorizationv1.SubjectAccessReview{
-		TypeMeta: metav1.TypeMeta{
-			APIVersion: "authorization.k8s.io/v1",
-			Kind:       "SubjectAccessReview",
-		},
-		Status: authorizationv1.SubjectAccessReviewStatus{
-			Allowed: allowed,
-			Denied:  !allowed,
-			Reason:  reason,
-		},
-	}
-
-	responseBody, err := json.Marshal(response)
+	result := s.authorizer.Authorize(sar)
+	s.audit(sar, result)
+
+	responseBody, err := encodeReview(apiVersion, result.Decision.Status(result.Reason))
 	if err != nil {
 		log.Printf("Error marshaling response: %v", err)
 		http.Error(w, "Error encoding response", http.StatusInternalServerError)
 		return
 	}
-	log.Printf("Sending response: %s", string(responseBody))
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(responseBody)
 }
 
-// Start starts the webhook server with TLS
+// audit records the decision for a request
+func (s *WebhookServer) audit(sar *authorizationv1.SubjectAccessReview, result auth.Result) {
+	var wouldHaveDenied []audit.AuditedDenial
+	for _, denial := range result.Audited {
+		wouldHaveDenied = append(wouldHaveDenied, audit.AuditedDenial{Rule: denial.Rule, Reason: denial.Reason})
+	}
+
+	var breakGlass *audit.BreakGlassUse
+	if grant := result.BreakGlass; grant != nil {
+		breakGlass = &audit.BreakGlassUse{
+			GrantID:     grant.ID,
+			Reason:      grant.Reason,
+			CreatedBy:   grant.CreatedBy,
+			RequestedBy: grant.RequestedBy,
+			Source:      grant.Source,
+			ExpiresAt:   grant.ExpiresAt,
+		}
+	}
+
+	s.auditor.Log(audit.Record{
+		Timestamp:             time.Now().UTC(),
+		User:                  sar.Spec.User,
+		UID:                   sar.Spec.UID,
+		Groups:                sar.Spec.Groups,
+		ResourceAttributes:    sar.Spec.ResourceAttributes,
+		NonResourceAttributes: sar.Spec.NonResourceAttributes,
+		Decision:              result.Decision.String(),
+		Reason:                result.Reason,
+		Rule:                  result.Rule,
+		WouldHaveDenied:       wouldHaveDenied,
+		BreakGlass:            breakGlass,
+		Cached:                result.Cached,
+		EvaluationMicros:      result.Duration.Microseconds(),
+		ConfigGeneration:      result.Generation,
+	})
+}
+
+// Start starts the webhook server with TLS and blocks until it fails or is
+// stopped. It returns nil once Stop has been called.
 func (s *WebhookServer) Start() error {
-	// Create mux and register handlers
+	// Require a bearer token on authorization requests when configured
+	var authorizeHandler http.Handler = http.HandlerFunc(s.handleAuthorize)
+	if s.config.TokenFile != "" {
+		tokens, err := newTokenAuthenticator(s.config.TokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to configure token authentication: %v", err)
+		}
+		authorizeHandler = tokens.middleware(authorizeHandler)
+		log.Printf("Requiring bearer tokens from %s", s.config.TokenFile)
+	} else if s.config.ClientCAFile == "" {
+		log.Printf("WARNING: neither tokenFile nor clientCAFile is configured; authorization requests are not authenticated")
+	}
+
+	// Serving certificates are reloaded from disk when rotated
+	tlsConfig, certs, err := newTLSConfig(s.config)
+	if err != nil {
+		return fmt.Errorf("failed to configure TLS: %v", err)
+	}
+	s.certs = certs
+
+	// Create mux and register handlers; health endpoints are unauthenticated
 	mux := http.NewServeMux()
-	mux.HandleFunc("/authorize", s.handleAuthorize)
+	mux.Handle("/authorize", instrument(authorizeHandler))
+	s.registerHealthHandlers(mux)
 
-	// Create and start server with TLS
+	// The explain endpoint has its own tokens, separate from the apiserver's
+	if s.config.ExplainTokenFile != "" {
+		operators, err := newTokenAuthenticator(s.config.ExplainTokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to configure explain authentication: %v", err)
+		}
+		mux.Handle("/explain", operators.middleware(explainHandler(s.authorizer)))
+		log.Printf("Serving /explain, requiring bearer tokens from %s", s.config.ExplainTokenFile)
+	}
+
+	// The break-glass admin API has its own tokens, separate from the apiserver's
+	if grants := s.authorizer.BreakGlass(); grants != nil && s.config.BreakGlass.AdminTokenFile != "" {
+		admins, err := newTokenAuthenticator(s.config.BreakGlass.AdminTokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to configure break-glass admin authentication: %v", err)
+		}
+		mux.Handle("/breakglass/", admins.middleware(breakGlassHandler(grants)))
+		log.Printf("Serving the break-glass admin API, requiring bearer tokens from %s", s.config.BreakGlass.AdminTokenFile)
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%s", s.config.Port))
+	if err != nil {
+		return fmt.Errorf("failed to listen on port %s: %v", s.config.Port, err)
+	}
+
+	// Create the servers unless Stop was called while starting up
+	s.mu.Lock()
+	if s.shuttingDown.Load() {
+		s.mu.Unlock()
+		listener.Close()
+		return nil
+	}
 	s.server = &http.Server{
-		Addr:    fmt.Sprintf(":%s", s.config.Port),
+		Handler:   mux,
+		TLSConfig: tlsConfig,
+	}
+	s.listener = listener
+	if s.config.MetricsPort != "" {
+		s.startMetricsServer()
+	}
+	s.mu.Unlock()
+
+	if s.config.ClientCAFile != "" {
+		log.Printf("Requiring client certificates signed by %s", s.config.ClientCAFile)
+	}
+	log.Printf("Starting authorization webhook server on %s with TLS", listener.Addr())
+	if err := s.server.ServeTLS(listener, "", ""); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Stop gracefully shuts the server down. Readiness starts failing at once and
+// requests keep being served for the drain period, so the apiserver and load
+// balancers stop routing here first. The servers then stop accepting
+// connections and wait up to the shutdown timeout for in-flight requests,
+// after which the audit log is flushed.
+func (s *WebhookServer) Stop(ctx context.Context) error {
+	if !s.shuttingDown.CompareAndSwap(false, true) {
+		return nil
+	}
+
+	if s.config.DrainPeriod > 0 {
+		log.Printf("Shutting down: draining for %s", s.config.DrainPeriod)
+		select {
+		case <-time.After(s.config.DrainPeriod):
+		case <-ctx.Done():
+		}
+	}
+
+	if s.config.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.config.ShutdownTimeout)
+		defer cancel()
+	}
+
+	// The metrics server goes last so probes and scrapes see the shutdown
+	s.mu.Lock()
+	servers := []struct {
+		name   string
+		server *http.Server
+	}{
+		{"webhook", s.server},
+		{"metrics", s.metricsServer},
+	}
+	s.mu.Unlock()
+
+	var errs []error
+	for _, srv := range servers {
+		if srv.server == nil {
+			continue
+		}
+		if err := srv.server.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to shut down %s server: %v", srv.name, err))
+			srv.server.Close()
+		}
+	}
+
+	if err := s.auditor.Close(); err != nil {
+		errs = append(errs, err)
+	}
+
+	log.Printf("Authorization webhook server stopped")
+	return errors.Join(errs...)
+}
+
+// startMetricsServer serves Prometheus metrics and the health endpoints
+// without TLS on the metrics port, so probes work even when client
+// certificates are required on the webhook port
+func (s *WebhookServer) startMetricsServer() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	s.registerHealthHandlers(mux)
+
+	s.metricsServer = &http.Server{
+		Addr:    fmt.Sprintf(":%s", s.config.MetricsPort),
 		Handler: mux,
-		TLSConfig: &tls.Config{
-			MinVersion: tls.VersionTLS12,
-		},
 	}
 
-	log.Printf("Starting authorization webhook server on port %s with TLS", s.config.Port)
-	return s.server.ListenAndServeTLS(s.config.TLSCertFile, s.config.TLSKeyFile)
+	go func() {
+		log.Printf("Starting metrics server on port %s", s.config.MetricsPort)
+		if err := s.metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("Metrics server failed: %v", err)
+		}
+	}()
 }
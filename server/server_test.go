@@ -2,24 +2,34 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/imiller31/k8s-auth-webhook/audit"
 	"github.com/imiller31/k8s-auth-webhook/auth"
 	"github.com/imiller31/k8s-auth-webhook/cel"
 	"github.com/imiller31/k8s-auth-webhook/config"
+	"github.com/imiller31/k8s-auth-webhook/decision"
 	authorizationv1 "k8s.io/api/authorization/v1"
 )
 
 type mockAuthorizer struct {
-	allow  bool
-	reason string
+	decision decision.Decision
+	reason   string
 }
 
-func (m *mockAuthorizer) ProcessRequest(sar *authorizationv1.SubjectAccessReview) (bool, string) {
-	return m.allow, m.reason
+func (m *mockAuthorizer) ProcessRequest(sar *authorizationv1.SubjectAccessReview) (decision.Decision, string) {
+	return m.decision, m.reason
 }
 
 func TestNewWebhookServer(t *testing.T) {
@@ -31,13 +41,13 @@ func TestNewWebhookServer(t *testing.T) {
 		PrivilegedUser:  "admin",
 	}
 
-	celEval, err := cel.NewEvaluator([]string{})
+	celEval, err := cel.NewEvaluator(nil)
 	if err != nil {
 		t.Fatalf("Failed to create CEL evaluator: %v", err)
 	}
 
 	authorizer := auth.NewAuthorizer(cfg, celEval)
-	server := NewWebhookServer(cfg, authorizer)
+	server := NewWebhookServer(cfg, authorizer, nil)
 
 	if server == nil {
 		t.Error("Expected server to be created")
@@ -53,29 +63,31 @@ func TestHandleAuthorize(t *testing.T) {
 		PrivilegedUser:  "admin",
 	}
 
-	celEval, err := cel.NewEvaluator([]string{})
+	celEval, err := cel.NewEvaluator(nil)
 	if err != nil {
 		t.Fatalf("Failed to create CEL evaluator: %v", err)
 	}
 
 	authorizer := auth.NewAuthorizer(cfg, celEval)
-	server := NewWebhookServer(cfg, authorizer)
+	server := NewWebhookServer(cfg, authorizer, nil)
 
 	tests := []struct {
-		name           string
-		request        *authorizationv1.SubjectAccessReview
-		expectedStatus int
-		expectedReason string
+		name            string
+		request         *authorizationv1.SubjectAccessReview
+		expectedStatus  int
+		expectedReason  string
+		expectedAllowed bool
+		expectedDenied  bool
 	}{
 		{
-			name: "allow request",
+			name: "no opinion request",
 			request: &authorizationv1.SubjectAccessReview{
 				Spec: authorizationv1.SubjectAccessReviewSpec{
 					User: "test-user",
 				},
 			},
 			expectedStatus: http.StatusOK,
-			expectedReason: "Request allowed by authorization webhook",
+			expectedReason: "No opinion: request not matched by authorization webhook",
 		},
 		{
 			name: "deny request",
@@ -89,7 +101,23 @@ func TestHandleAuthorize(t *testing.T) {
 				},
 			},
 			expectedStatus: http.StatusOK,
-			expectedReason: "User 'test-user' is not authorized to delete resources with prefix 'test-'. Only 'admin' users or members of system:masters/system:nodes groups can perform this operation.",
+			expectedReason: "User 'test-user' is not authorized to delete \"test-resource\": it is protected by policy 'protected-prefix'",
+			expectedDenied: true,
+		},
+		{
+			name: "allow request",
+			request: &authorizationv1.SubjectAccessReview{
+				Spec: authorizationv1.SubjectAccessReviewSpec{
+					User: "admin",
+					ResourceAttributes: &authorizationv1.ResourceAttributes{
+						Verb: "delete",
+						Name: "test-resource",
+					},
+				},
+			},
+			expectedStatus:  http.StatusOK,
+			expectedReason:  "User 'admin' is authorized to delete resources protected by policy 'protected-prefix' as an allowed user",
+			expectedAllowed: true,
 		},
 		{
 			name:           "invalid request body",
@@ -129,11 +157,60 @@ func TestHandleAuthorize(t *testing.T) {
 				if response.Status.Reason != tt.expectedReason {
 					t.Errorf("handleAuthorize() reason = %v, want %v", response.Status.Reason, tt.expectedReason)
 				}
+				if response.Status.Allowed != tt.expectedAllowed {
+					t.Errorf("handleAuthorize() allowed = %v, want %v", response.Status.Allowed, tt.expectedAllowed)
+				}
+				if response.Status.Denied != tt.expectedDenied {
+					t.Errorf("handleAuthorize() denied = %v, want %v", response.Status.Denied, tt.expectedDenied)
+				}
 			}
 		})
 	}
 }
 
+func TestHandleAuthorizeAudit(t *testing.T) {
+	cfg := &config.Config{
+		ProtectedPrefix: "test-",
+		PrivilegedUser:  "admin",
+	}
+
+	celEval, err := cel.NewEvaluator(nil)
+	if err != nil {
+		t.Fatalf("Failed to create CEL evaluator: %v", err)
+	}
+
+	var buf bytes.Buffer
+	auditor := audit.NewLoggerWithSinks(config.AuditConfig{}, audit.NewWriterSink(&buf))
+	server := NewWebhookServer(cfg, auth.NewAuthorizer(cfg, celEval), auditor)
+
+	body, _ := json.Marshal(&authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   "test-user",
+			Groups: []string{"dev"},
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Verb: "delete",
+				Name: "test-resource",
+			},
+		},
+	})
+	server.handleAuthorize(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/authorize", bytes.NewReader(body)))
+	auditor.Close()
+
+	var record audit.Record
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("expected a single JSON audit record, got %q: %v", buf.String(), err)
+	}
+	if record.User != "test-user" || record.Decision != "Deny" || record.Rule != "builtin:protection:protected-prefix" {
+		t.Errorf("unexpected audit record: %+v", record)
+	}
+	if record.ResourceAttributes == nil || record.ResourceAttributes.Name != "test-resource" {
+		t.Errorf("expected resource attributes in audit record, got %+v", record.ResourceAttributes)
+	}
+	if record.ConfigGeneration != 1 {
+		t.Errorf("expected ConfigGeneration=1, got %d", record.ConfigGeneration)
+	}
+}
+
 func TestStart(t *testing.T) {
 	cfg := &config.Config{
 		Port:            "8080",
@@ -143,20 +220,108 @@ func TestStart(t *testing.T) {
 		PrivilegedUser:  "admin",
 	}
 
-	celEval, err := cel.NewEvaluator([]string{})
+	celEval, err := cel.NewEvaluator(nil)
 	if err != nil {
 		t.Fatalf("Failed to create CEL evaluator: %v", err)
 	}
 
 	authorizer := auth.NewAuthorizer(cfg, celEval)
-	server := NewWebhookServer(cfg, authorizer)
+	server := NewWebhookServer(cfg, authorizer, nil)
 
-	// Start server in a goroutine
+	// The TLS files do not exist, so Start fails before listening
+	if err := server.Start(); err == nil {
+		t.Error("Start() expected error for missing TLS files, got none")
+	}
+}
+
+func TestStartStop(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issue(t, "webhook", []string{"localhost"}, x509.ExtKeyUsageServerAuth)
+	certPath, keyPath := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeFile(t, certPath, certPEM, time.Now())
+	writeFile(t, keyPath, keyPEM, time.Now())
+
+	cfg := &config.Config{
+		Port:            "0",
+		TLSCertFile:     certPath,
+		TLSKeyFile:      keyPath,
+		ProtectedPrefix: "test-",
+		PrivilegedUser:  "admin",
+		DefaultDecision: "NoOpinion",
+		DrainPeriod:     200 * time.Millisecond,
+		ShutdownTimeout: time.Second,
+	}
+
+	celEval, err := cel.NewEvaluator(nil)
+	if err != nil {
+		t.Fatalf("Failed to create CEL evaluator: %v", err)
+	}
+
+	var buf bytes.Buffer
+	auditor := audit.NewLoggerWithSinks(config.AuditConfig{FlushInterval: time.Hour}, audit.NewWriterSink(&buf))
+	server := NewWebhookServer(cfg, auth.NewAuthorizer(cfg, celEval), auditor)
+
+	started := make(chan error, 1)
 	go func() {
-		if err := server.Start(); err != nil {
-			t.Errorf("Failed to start server: %v", err)
+		started <- server.Start()
+	}()
+
+	// Wait for the listener
+	var addr string
+	for deadline := time.Now().Add(5 * time.Second); addr == ""; {
+		if time.Now().After(deadline) {
+			t.Fatal("server did not start listening")
+		}
+		server.mu.Lock()
+		if server.listener != nil {
+			addr = fmt.Sprintf("127.0.0.1:%d", server.listener.Addr().(*net.TCPAddr).Port)
 		}
+		server.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca.pem)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	url := "https://" + addr
+
+	body, _ := json.Marshal(&authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{User: "test-user"},
+	})
+	resp, err := client.Post(url+"/authorize", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("authorize request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- server.Stop(context.Background())
 	}()
 
-	// TODO: Add test for server shutdown
+	// During the drain period requests are still served but readiness fails
+	time.Sleep(50 * time.Millisecond)
+	resp, err = client.Get(url + "/readyz")
+	if err != nil {
+		t.Fatalf("readyz request during drain failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected /readyz to fail while draining, got %d", resp.StatusCode)
+	}
+
+	if err := <-stopped; err != nil {
+		t.Errorf("Stop() unexpected error: %v", err)
+	}
+	if err := <-started; err != nil {
+		t.Errorf("Start() expected nil after Stop, got %v", err)
+	}
+
+	if _, err := client.Get(url + "/livez"); err == nil {
+		t.Error("expected connections to be refused after Stop")
+	}
+	if !strings.Contains(buf.String(), `"user":"test-user"`) {
+		t.Errorf("expected audit log to be flushed on Stop, got %q", buf.String())
+	}
 }
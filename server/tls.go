@@ -0,0 +1,256 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/imiller31/k8s-auth-webhook/config"
+)
+
+// certReloader serves the TLS keypair from disk and reloads it whenever the
+// certificate or key file is modified, so rotated certificates are picked up
+// without a restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	certTime time.Time
+	keyTime  time.Time
+}
+
+// newCertReloader loads the initial keypair, failing if it is invalid
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.maybeReload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// maybeReload reloads the keypair if either file changed since the last load
+func (r *certReloader) maybeReload() error {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return fmt.Errorf("failed to stat TLS certificate: %v", err)
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to stat TLS key: %v", err)
+	}
+
+	r.mu.RLock()
+	unchanged := r.cert != nil && certInfo.ModTime().Equal(r.certTime) && keyInfo.ModTime().Equal(r.keyTime)
+	r.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS keypair: %v", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cert != nil {
+		log.Printf("Reloaded TLS certificate from %s", r.certFile)
+	}
+	r.cert = &cert
+	r.certTime = certInfo.ModTime()
+	r.keyTime = keyInfo.ModTime()
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate. If a changed keypair
+// cannot be loaded, for example because only one of the two files has been
+// rewritten so far, the previous keypair keeps being served.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if err := r.maybeReload(); err != nil {
+		log.Printf("Failed to reload TLS certificate, serving previous one: %v", err)
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// check reports whether the current certificate is within its validity
+// period, reloading it first if the files changed
+func (r *certReloader) check() error {
+	if err := r.maybeReload(); err != nil {
+		log.Printf("Failed to reload TLS certificate, checking previous one: %v", err)
+	}
+
+	r.mu.RLock()
+	cert := r.cert
+	r.mu.RUnlock()
+
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("failed to parse TLS certificate: %v", err)
+		}
+	}
+
+	now := time.Now()
+	if now.Before(leaf.NotBefore) {
+		return fmt.Errorf("TLS certificate is not valid until %s", leaf.NotBefore)
+	}
+	if now.After(leaf.NotAfter) {
+		return fmt.Errorf("TLS certificate expired at %s", leaf.NotAfter)
+	}
+	return nil
+}
+
+// caReloader serves the client CA bundle from disk and reloads it whenever
+// the file is modified
+type caReloader struct {
+	caFile string
+
+	mu      sync.RWMutex
+	pool    *x509.CertPool
+	modTime time.Time
+}
+
+// newCAReloader loads the initial CA bundle, failing if it holds no certificates
+func newCAReloader(caFile string) (*caReloader, error) {
+	r := &caReloader{caFile: caFile}
+	if err := r.maybeReload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// maybeReload reloads the CA bundle if the file changed since the last load
+func (r *caReloader) maybeReload() error {
+	info, err := os.Stat(r.caFile)
+	if err != nil {
+		return fmt.Errorf("failed to stat client CA file: %v", err)
+	}
+
+	r.mu.RLock()
+	unchanged := r.pool != nil && info.ModTime().Equal(r.modTime)
+	r.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	data, err := os.ReadFile(r.caFile)
+	if err != nil {
+		return fmt.Errorf("failed to read client CA file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("no certificates found in client CA file %s", r.caFile)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pool != nil {
+		log.Printf("Reloaded client CA bundle from %s", r.caFile)
+	}
+	r.pool = pool
+	r.modTime = info.ModTime()
+	return nil
+}
+
+// Pool returns the current CA pool, reloading it first if the file changed
+func (r *caReloader) Pool() *x509.CertPool {
+	if err := r.maybeReload(); err != nil {
+		log.Printf("Failed to reload client CA bundle, using previous one: %v", err)
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.pool
+}
+
+// newTLSConfig builds the server TLS configuration and returns it with the
+// reloader for the serving keypair, which is reloaded on rotation. When a
+// client CA file is configured, callers must present a certificate signed
+// by it whose common name or SANs appear in the configured allow lists.
+func newTLSConfig(cfg *config.Config) (*tls.Config, *certReloader, error) {
+	certs, err := newCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.GetCertificate,
+	}
+
+	if cfg.ClientCAFile == "" {
+		return tlsConfig, certs, nil
+	}
+
+	cas, err := newCAReloader(cfg.ClientCAFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	tlsConfig.VerifyConnection = verifyClientName(cfg.AllowedClientCNs, cfg.AllowedClientSANs)
+
+	// Hand out a fresh config per connection so a rotated CA bundle is used
+	tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		perConn := tlsConfig.Clone()
+		perConn.GetConfigForClient = nil
+		perConn.ClientCAs = cas.Pool()
+		return perConn, nil
+	}
+
+	return tlsConfig, certs, nil
+}
+
+// verifyClientName returns a VerifyConnection callback that accepts a
+// verified client certificate whose common name is in allowedCNs or one of
+// whose DNS, email or URI SANs is in allowedSANs. When both lists are empty
+// any certificate signed by the client CA is accepted.
+func verifyClientName(allowedCNs, allowedSANs []string) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(allowedCNs) == 0 && len(allowedSANs) == 0 {
+			return nil
+		}
+		if len(cs.PeerCertificates) == 0 {
+			return fmt.Errorf("client certificate required")
+		}
+
+		cert := cs.PeerCertificates[0]
+		if contains(allowedCNs, cert.Subject.CommonName) {
+			return nil
+		}
+
+		sans := append([]string{}, cert.DNSNames...)
+		sans = append(sans, cert.EmailAddresses...)
+		for _, uri := range cert.URIs {
+			sans = append(sans, uri.String())
+		}
+		for _, san := range sans {
+			if contains(allowedSANs, san) {
+				return nil
+			}
+		}
+
+		log.Printf("Rejected client certificate: CN=%s, SANs=%v", cert.Subject.CommonName, sans)
+		return fmt.Errorf("client certificate CN %q is not allowed", cert.Subject.CommonName)
+	}
+}
+
+// contains reports whether value is in values
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/imiller31/k8s-auth-webhook/config"
+)
+
+// testCA is a throwaway certificate authority for TLS tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate CA key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create CA certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// issue signs a leaf certificate and returns its PEM-encoded certificate and key
+func (ca *testCA) issue(t *testing.T, commonName string, dnsNames []string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeFile writes data to path and moves its modification time forward so
+// reloaders relying on mtime notice the change
+func writeFile(t *testing.T, path string, data []byte, modTime time.Time) {
+	t.Helper()
+
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("Failed to set modification time of %s: %v", path, err)
+	}
+}
+
+// serveTLS serves a trivial handler with the given TLS configuration and returns its address
+func serveTLS(t *testing.T, tlsConfig *tls.Config) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	go srv.Serve(tls.NewListener(ln, tlsConfig))
+	t.Cleanup(func() { srv.Close() })
+	return ln.Addr().String()
+}
+
+// handshake connects to addr and returns the server certificate's common name
+func handshake(addr string, clientConfig *tls.Config) (string, error) {
+	conn, err := tls.Dial("tcp", addr, clientConfig)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	// Client certificate rejections surface on the first read under TLS 1.3
+	if err := conn.Handshake(); err != nil {
+		return "", err
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write([]byte("GET / HTTP/1.0\r\n\r\n")); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 1)
+	if _, err := conn.Read(buf); err != nil {
+		return "", err
+	}
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName, nil
+}
+
+func TestCertificateRotation(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+
+	certPEM, keyPEM := ca.issue(t, "server-a", []string{"localhost"}, x509.ExtKeyUsageServerAuth)
+	start := time.Now().Add(-time.Minute)
+	writeFile(t, certPath, certPEM, start)
+	writeFile(t, keyPath, keyPEM, start)
+
+	tlsConfig, _, err := newTLSConfig(&config.Config{TLSCertFile: certPath, TLSKeyFile: keyPath})
+	if err != nil {
+		t.Fatalf("newTLSConfig() unexpected error: %v", err)
+	}
+	addr := serveTLS(t, tlsConfig)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	clientConfig := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+
+	if cn, err := handshake(addr, clientConfig); err != nil || cn != "server-a" {
+		t.Fatalf("handshake() = %q, %v; want server-a", cn, err)
+	}
+
+	certPEM, keyPEM = ca.issue(t, "server-b", []string{"localhost"}, x509.ExtKeyUsageServerAuth)
+	writeFile(t, certPath, certPEM, start.Add(30*time.Second))
+	writeFile(t, keyPath, keyPEM, start.Add(30*time.Second))
+
+	if cn, err := handshake(addr, clientConfig); err != nil || cn != "server-b" {
+		t.Fatalf("handshake() after rotation = %q, %v; want server-b", cn, err)
+	}
+
+	// A half-written rotation keeps serving the previous keypair
+	writeFile(t, keyPath, []byte("garbage"), start.Add(45*time.Second))
+	if cn, err := handshake(addr, clientConfig); err != nil || cn != "server-b" {
+		t.Fatalf("handshake() with invalid key = %q, %v; want server-b", cn, err)
+	}
+}
+
+func TestNewTLSConfigInvalidFiles(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	writeFile(t, certPath, []byte("not a cert"), time.Now())
+	writeFile(t, keyPath, []byte("not a key"), time.Now())
+
+	if _, _, err := newTLSConfig(&config.Config{TLSCertFile: certPath, TLSKeyFile: keyPath}); err == nil {
+		t.Error("newTLSConfig() expected error for invalid keypair, got none")
+	}
+}
+
+func TestClientCertificateAuthentication(t *testing.T) {
+	dir := t.TempDir()
+	serverCA := newTestCA(t)
+	clientCA := newTestCA(t)
+	otherCA := newTestCA(t)
+
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	caPath := filepath.Join(dir, "client-ca.pem")
+	certPEM, keyPEM := serverCA.issue(t, "server", []string{"localhost"}, x509.ExtKeyUsageServerAuth)
+	writeFile(t, certPath, certPEM, time.Now())
+	writeFile(t, keyPath, keyPEM, time.Now())
+	writeFile(t, caPath, clientCA.pem, time.Now())
+
+	tlsConfig, _, err := newTLSConfig(&config.Config{
+		TLSCertFile:       certPath,
+		TLSKeyFile:        keyPath,
+		ClientCAFile:      caPath,
+		AllowedClientCNs:  []string{"kube-apiserver"},
+		AllowedClientSANs: []string{"apiserver.cluster.local"},
+	})
+	if err != nil {
+		t.Fatalf("newTLSConfig() unexpected error: %v", err)
+	}
+	addr := serveTLS(t, tlsConfig)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCA.cert)
+	clientConfig := func(ca *testCA, cn string, dnsNames []string) *tls.Config {
+		cfg := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+		if ca != nil {
+			certPEM, keyPEM := ca.issue(t, cn, dnsNames, x509.ExtKeyUsageClientAuth)
+			cert, err := tls.X509KeyPair(certPEM, keyPEM)
+			if err != nil {
+				t.Fatalf("Failed to load client keypair: %v", err)
+			}
+			cfg.Certificates = []tls.Certificate{cert}
+		}
+		return cfg
+	}
+
+	tests := []struct {
+		name    string
+		client  *tls.Config
+		wantErr bool
+	}{
+		{name: "no client certificate", client: clientConfig(nil, "", nil), wantErr: true},
+		{name: "allowed common name", client: clientConfig(clientCA, "kube-apiserver", nil), wantErr: false},
+		{name: "allowed SAN", client: clientConfig(clientCA, "other", []string{"apiserver.cluster.local"}), wantErr: false},
+		{name: "disallowed name", client: clientConfig(clientCA, "intruder", []string{"intruder.local"}), wantErr: true},
+		{name: "untrusted CA", client: clientConfig(otherCA, "kube-apiserver", nil), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := handshake(addr, tt.client)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("handshake() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -73,6 +73,7 @@ docker run -d \
   --name k8s-oline \
   --network kind \
   -p 8443:8443 \
+  -p 9090:9090 \
   -v "$(pwd)/webhook-cert.pem:/app/webhook-cert.pem:ro" \
   -v "$(pwd)/webhook-key.pem:/app/webhook-key.pem:ro" \
   -v "$(pwd)/config.yaml:/app/config.yaml:ro" \